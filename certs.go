@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader keeps the TLS certificate in memory and loads it again when
+// the files change on disk or the process gets SIGHUP, so a renewed
+// certificate is picked up without restarting the server
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time //the newest modification time of the two files when they were loaded
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate and the key from disk. If they can't be loaded
+// the old certificate stays in use.
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate is used by tls.Config to pick the certificate for every handshake
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// watch checks the files every interval and listens for SIGHUP, until the context is cancelled
+func (c *certReloader) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := c.reload(); err != nil {
+				slog.Error("Error reloading TLS certificate", "err", err)
+				continue
+			}
+			slog.Info("TLS certificate reloaded", "reason", "SIGHUP")
+		case <-ticker.C:
+			modTime, err := c.latestModTime()
+			if err != nil {
+				slog.Error("Error checking TLS certificate", "err", err)
+				continue
+			}
+			c.mu.RLock()
+			changed := modTime.After(c.modTime)
+			c.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := c.reload(); err != nil {
+				slog.Error("Error reloading TLS certificate", "err", err)
+				continue
+			}
+			slog.Info("TLS certificate reloaded", "reason", "file changed")
+		}
+	}
+}
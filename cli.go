@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"forum/config"
+	"forum/handlers"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+const usage = `Usage: forum [command] [arguments]
+
+Commands:
+  serve                                      start the web server (the default)
+  user create -email E -username U [-password P] [-admin]
+  user promote <email or username>           make the user an admin
+  user demote <email or username>            remove the admin rights
+  user ban <email or username>               ban the user and log them out
+  user unban <email or username>             lift the ban
+  user reset-password [-password P] <email or username>
+  category add [-description D] [-parent ID] <name>
+  category rename <id> <new name>
+  category delete [-force] <id>
+  category archive <id>                      make the category read-only
+  category unarchive <id>                    open the category again
+  category merge <id> <target id>            move the posts and redirect the old URL
+  category parent <id> <parent id>           move under another category (0 for top level)
+  session purge [-all]                       delete expired (or all) sessions
+  stats                                      print the totals of the forum
+  reindex                                    rebuild the database indexes
+  backup                                     take a snapshot into FORUM_BACKUP_DIR
+  restore <snapshot>                         replace the database with a snapshot
+                                             (stop the server first)
+
+When no password is given a random one is generated and printed.
+The commands use the same FORUM_* environment variables as the server.
+`
+
+// errUsage is returned when the command line is wrong, main prints the usage for it
+var errUsage = errors.New("invalid command line")
+
+// runCommand runs the subcommand given on the command line
+func runCommand(cfg *config.Config, logger *slog.Logger, args []string) error {
+	if len(args) == 0 || args[0] == "serve" {
+		return run(cfg, logger)
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return nil
+	case "restore":
+		//the database is replaced, so it must not be opened like for the other commands
+		return restoreCommand(cfg, args[1:])
+	case "user", "category", "session", "stats", "reindex", "backup":
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+	}
+
+	db, err := handlers.InitDB(cfg.DBPath, cfg.SchemaPath, cfg.MigrationsDir)
+	if err != nil {
+		return fmt.Errorf("failed to initialize the database: %w", err)
+	}
+	defer handlers.CloseDB(db)
+
+	switch args[0] {
+	case "user":
+		return userCommand(db, args[1:])
+	case "category":
+		return categoryCommand(db, args[1:])
+	case "session":
+		return sessionCommand(db, args[1:])
+	case "stats":
+		return statsCommand(db)
+	case "backup":
+		return backupCommand(cfg, db)
+	default:
+		if err := handlers.Reindex(db); err != nil {
+			return err
+		}
+		fmt.Println("Indexes rebuilt")
+		return nil
+	}
+}
+
+func userCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: user needs a subcommand", errUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("user create", flag.ContinueOnError)
+		email := fs.String("email", "", "email of the user")
+		username := fs.String("username", "", "username of the user")
+		password := fs.String("password", "", "password, generated when empty")
+		admin := fs.Bool("admin", false, "make the user an admin")
+		if err := fs.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		if *email == "" || *username == "" || fs.NArg() != 0 {
+			return fmt.Errorf("%w: user create needs -email and -username", errUsage)
+		}
+
+		generated := *password == ""
+		if generated {
+			*password = randomPassword()
+		}
+		id, err := handlers.CreateUser(db, *email, *username, *password, *admin)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created user %s (id %d)\n", *username, id)
+		if generated {
+			fmt.Printf("Password: %s\n", *password)
+		}
+		return nil
+
+	case "reset-password":
+		fs := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+		password := fs.String("password", "", "new password, generated when empty")
+		if err := fs.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		user, err := userArg(db, fs.Args())
+		if err != nil {
+			return err
+		}
+
+		generated := *password == ""
+		if generated {
+			*password = randomPassword()
+		}
+		if err := handlers.ResetPassword(db, user.ID, *password); err != nil {
+			return err
+		}
+		fmt.Printf("Password of %s changed, the user was logged out\n", user.Username)
+		if generated {
+			fmt.Printf("Password: %s\n", *password)
+		}
+		return nil
+
+	case "promote", "demote":
+		user, err := userArg(db, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := handlers.SetAdmin(db, user.ID, args[0] == "promote"); err != nil {
+			return err
+		}
+		fmt.Printf("%s %sd\n", user.Username, args[0])
+		return nil
+
+	case "ban", "unban":
+		user, err := userArg(db, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := handlers.SetBanned(db, user.ID, args[0] == "ban"); err != nil {
+			return err
+		}
+		fmt.Printf("%s %sned\n", user.Username, args[0])
+		return nil
+	}
+	return fmt.Errorf("%w: unknown user command %q", errUsage, args[0])
+}
+
+// userArg finds the user given as the only argument
+func userArg(db *sql.DB, args []string) (*handlers.User, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%w: expected one email or username", errUsage)
+	}
+	user, err := handlers.FindUser(db, args[0])
+	if errors.Is(err, handlers.ErrNotFound) {
+		return nil, fmt.Errorf("user %q not found", args[0])
+	}
+	return user, err
+}
+
+func categoryCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: category needs a subcommand", errUsage)
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("category add", flag.ContinueOnError)
+		description := fs.String("description", "", "description of the category")
+		parent := fs.Int64("parent", 0, "id of the parent category")
+		if err := fs.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		if fs.NArg() == 0 {
+			return fmt.Errorf("%w: category add needs a name", errUsage)
+		}
+		name := strings.Join(fs.Args(), " ")
+		id, err := handlers.CreateCategory(db, name, *description, *parent)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created category %q (id %d)\n", name, id)
+		return nil
+
+	case "rename":
+		if len(args) < 3 {
+			return fmt.Errorf("%w: category rename needs an id and a name", errUsage)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid category id %q", errUsage, args[1])
+		}
+		name := strings.Join(args[2:], " ")
+		if err := handlers.RenameCategory(db, id, name); err != nil {
+			return categoryError(err, id)
+		}
+		fmt.Printf("Category %d renamed to %q\n", id, name)
+		return nil
+
+	case "delete":
+		fs := flag.NewFlagSet("category delete", flag.ContinueOnError)
+		force := fs.Bool("force", false, "remove the category from its posts too")
+		if err := fs.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("%w: category delete needs an id", errUsage)
+		}
+		id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid category id %q", errUsage, fs.Arg(0))
+		}
+		if err := handlers.DeleteCategory(db, id, *force); err != nil {
+			if errors.Is(err, handlers.ErrCategoryNotEmpty) {
+				return fmt.Errorf("%w, use -force to delete it anyway", err)
+			}
+			return categoryError(err, id)
+		}
+		fmt.Printf("Category %d deleted\n", id)
+		return nil
+
+	case "archive", "unarchive":
+		if len(args) != 2 {
+			return fmt.Errorf("%w: category %s needs an id", errUsage, args[0])
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid category id %q", errUsage, args[1])
+		}
+		if err := handlers.SetCategoryArchived(db, id, args[0] == "archive"); err != nil {
+			return categoryError(err, id)
+		}
+		fmt.Printf("Category %d %sd\n", id, args[0])
+		return nil
+
+	case "merge":
+		if len(args) != 3 {
+			return fmt.Errorf("%w: category merge needs two ids", errUsage)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid category id %q", errUsage, args[1])
+		}
+		targetID, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid category id %q", errUsage, args[2])
+		}
+		if err := handlers.MergeCategories(db, id, targetID); err != nil {
+			if errors.Is(err, handlers.ErrNotFound) {
+				return fmt.Errorf("category %d or %d not found", id, targetID)
+			}
+			return err
+		}
+		fmt.Printf("Category %d merged into %d\n", id, targetID)
+		return nil
+
+	case "parent":
+		if len(args) != 3 {
+			return fmt.Errorf("%w: category parent needs two ids", errUsage)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid category id %q", errUsage, args[1])
+		}
+		parentID, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid category id %q", errUsage, args[2])
+		}
+		if err := handlers.SetCategoryParent(db, id, parentID); err != nil {
+			return categoryError(err, id)
+		}
+		if parentID == 0 {
+			fmt.Printf("Category %d moved to the top level\n", id)
+		} else {
+			fmt.Printf("Category %d moved under %d\n", id, parentID)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown category command %q", errUsage, args[0])
+}
+
+func categoryError(err error, id int64) error {
+	if errors.Is(err, handlers.ErrNotFound) {
+		return fmt.Errorf("category %d not found", id)
+	}
+	return err
+}
+
+func sessionCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 || args[0] != "purge" {
+		return fmt.Errorf("%w: expected session purge", errUsage)
+	}
+	fs := flag.NewFlagSet("session purge", flag.ContinueOnError)
+	all := fs.Bool("all", false, "delete all sessions, logging everyone out")
+	if err := fs.Parse(args[1:]); err != nil {
+		return errUsage
+	}
+
+	n, err := handlers.PurgeSessions(context.Background(), db, *all)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d sessions\n", n)
+	return nil
+}
+
+func statsCommand(db *sql.DB) error {
+	stats, err := handlers.GetStats(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Users:           %d (%d admins, %d banned)\n", stats.Users, stats.Admins, stats.BannedUsers)
+	fmt.Printf("Categories:      %d\n", stats.Categories)
+	fmt.Printf("Posts:           %d\n", stats.Posts)
+	fmt.Printf("Comments:        %d\n", stats.Comments)
+	fmt.Printf("Reactions:       %d\n", stats.Reactions)
+	fmt.Printf("Active sessions: %d\n", stats.ActiveSessions)
+	return nil
+}
+
+func backupCommand(cfg *config.Config, db *sql.DB) error {
+	path, err := handlers.Backup(context.Background(), db, cfg.BackupDir, cfg.BackupGzip)
+	if err != nil {
+		return err
+	}
+	if err := handlers.PruneBackups(cfg.BackupDir, cfg.BackupKeep); err != nil {
+		return err
+	}
+	fmt.Printf("Backup written to %s\n", path)
+	return nil
+}
+
+func restoreCommand(cfg *config.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: restore needs the path of a snapshot", errUsage)
+	}
+	previous, err := handlers.Restore(args[0], cfg.DBPath, cfg.MigrationsDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database restored from %s\n", args[0])
+	if previous != "" {
+		fmt.Printf("The old database was saved as %s\n", previous)
+	}
+	return nil
+}
+
+// randomPassword generates a password for the user create and reset commands
+func randomPassword() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
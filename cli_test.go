@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"forum/config"
+	"forum/handlers"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	cfg := &config.Config{
+		DBPath:        filepath.Join(t.TempDir(), "forum.db"),
+		SchemaPath:    "database/schema.sql",
+		MigrationsDir: "database/migrations",
+	}
+	//the commands run in order on the same database
+	steps := []struct {
+		args    string
+		wantErr error //nil for success
+	}{
+		{"user create -email admin@example.com -username admin -password secret1", nil},
+		{"user create -email admin@example.com -username other", handlers.ErrEmailTaken},
+		{"user create -username nomail", errUsage},
+		{"user promote admin", nil},
+		{"user ban admin@example.com", nil},
+		{"user unban admin", nil},
+		{"user demote nobody", nil}, //checked below, not a usage error
+		{"user reset-password -password short admin", handlers.ErrPasswordTooShort},
+		{"user fly admin", errUsage},
+		{"user", errUsage},
+		{"category add -description Everything Harbour news", nil},
+		{"category add", errUsage},
+		{"category rename x Ferries", errUsage},
+		{"session purge -all", nil},
+		{"session clear", errUsage},
+		{"stats", nil},
+		{"frobnicate", errUsage},
+	}
+	for _, step := range steps {
+		err := runCommand(cfg, nil, strings.Fields(step.args))
+		switch {
+		case step.args == "user demote nobody":
+			if err == nil || errors.Is(err, errUsage) {
+				t.Errorf("forum %s: %v, want a user not found error", step.args, err)
+			}
+		case step.wantErr == nil && err != nil:
+			t.Errorf("forum %s: %v", step.args, err)
+		case step.wantErr != nil && !errors.Is(err, step.wantErr):
+			t.Errorf("forum %s: %v, want %v", step.args, err, step.wantErr)
+		}
+	}
+
+	db, err := handlers.InitDB(cfg.DBPath, cfg.SchemaPath, cfg.MigrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handlers.CloseDB(db)
+	user, err := handlers.FindUser(db, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var admin, banned bool
+	var categories int
+	db.QueryRow("SELECT is_admin, banned_at IS NOT NULL FROM users WHERE id = ?", user.ID).Scan(&admin, &banned)
+	db.QueryRow("SELECT COUNT(*) FROM categories WHERE name = 'Harbour news' AND description = 'Everything'").Scan(&categories)
+	if !admin || banned {
+		t.Errorf("admin %v and banned %v, want the user promoted and unbanned", admin, banned)
+	}
+	if categories != 1 {
+		t.Errorf("%d categories created, want 1", categories)
+	}
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings the forum needs to start. Every value can be
+// overridden with an environment variable, so the same binary works both
+// locally and inside the Docker container.
+type Config struct {
+	Addr          string //address the HTTP server listens on
+	DBPath        string //path to the SQLite database file
+	SchemaPath    string //path to the schema that is applied on start
+	MigrationsDir string //directory of the numbered migration files
+	TemplatesGlob string //glob used to parse the HTML templates
+
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration //how long in-flight requests get to finish
+
+	SessionCleanupInterval time.Duration //how often expired sessions are removed
+
+	TLSCertFile        string        //certificate file, HTTPS is enabled when both files are set
+	TLSKeyFile         string        //private key file of the certificate
+	CertReloadInterval time.Duration //how often the certificate files are checked for changes
+	HTTPRedirectAddr   string        //plain HTTP listener that redirects to HTTPS, empty to disable
+	HSTSMaxAge         time.Duration //max-age of the Strict-Transport-Security header
+
+	CSPReportOnly bool //the browsers only report CSP violations instead of blocking
+
+	LogFormat string //"text" or "json"
+	LogLevel  string //"debug", "info", "warn" or "error"
+
+	MetricsToken string //bearer token required on /metrics, empty allows everyone
+
+	BackupDir      string        //where the database snapshots are written
+	BackupInterval time.Duration //how often a snapshot is taken, 0 turns the scheduled backups off
+	BackupKeep     int           //how many snapshots are kept
+	BackupGzip     bool          //compress the snapshots
+
+	UploadDir     string //where the uploaded photos are saved
+	MaxUploadSize int    //largest accepted photo in bytes
+
+	ListingTTL     time.Duration //how long a marketplace listing stays open
+	ExpiryInterval time.Duration //how often the stale listings are closed
+
+	BaseURL       string //address of the forum for the links in the emails
+	MailTransport string //"smtp", "file" or empty to send no email
+	MailDir       string //where the file transport writes the messages
+	MailFrom      string //sender of the emails
+	SMTPAddr      string //host:port of the SMTP server
+	SMTPUsername  string //the SMTP server is used without auth when empty
+	SMTPPassword  string
+	MailInterval  time.Duration //how often the mail queue and the digests are checked
+}
+
+// TLSEnabled reports whether the server should serve HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// Load reads the configuration from the environment, falling back to the defaults
+func Load() (*Config, error) {
+	cfg := &Config{
+		Addr:          getEnv("FORUM_ADDR", ":8080"),
+		DBPath:        getEnv("FORUM_DB_PATH", "./database/forum.db"),
+		SchemaPath:    getEnv("FORUM_SCHEMA_PATH", "database/schema.sql"),
+		MigrationsDir: getEnv("FORUM_MIGRATIONS_DIR", "database/migrations"),
+		TemplatesGlob: getEnv("FORUM_TEMPLATES", "templates/*.html"),
+
+		TLSCertFile:      getEnv("FORUM_TLS_CERT", ""),
+		TLSKeyFile:       getEnv("FORUM_TLS_KEY", ""),
+		HTTPRedirectAddr: getEnv("FORUM_HTTP_REDIRECT_ADDR", ""),
+
+		LogFormat: getEnv("FORUM_LOG_FORMAT", "text"),
+		LogLevel:  getEnv("FORUM_LOG_LEVEL", "info"),
+
+		MetricsToken: getEnv("FORUM_METRICS_TOKEN", ""),
+
+		BackupDir: getEnv("FORUM_BACKUP_DIR", "backups"),
+		UploadDir: getEnv("FORUM_UPLOAD_DIR", "uploads"),
+
+		BaseURL:       strings.TrimSuffix(getEnv("FORUM_BASE_URL", "http://localhost:8080"), "/"),
+		MailTransport: getEnv("FORUM_MAIL_TRANSPORT", ""),
+		MailDir:       getEnv("FORUM_MAIL_DIR", "mail"),
+		MailFrom:      getEnv("FORUM_MAIL_FROM", "Åland forum <forum@localhost>"),
+		SMTPAddr:      getEnv("FORUM_SMTP_ADDR", ""),
+		SMTPUsername:  getEnv("FORUM_SMTP_USERNAME", ""),
+		SMTPPassword:  getEnv("FORUM_SMTP_PASSWORD", ""),
+	}
+
+	//all the durations are parsed the same way, so we list them here
+	durations := []struct {
+		key    string
+		def    time.Duration
+		target *time.Duration
+	}{
+		{"FORUM_READ_TIMEOUT", 15 * time.Second, &cfg.ReadTimeout},
+		{"FORUM_READ_HEADER_TIMEOUT", 5 * time.Second, &cfg.ReadHeaderTimeout},
+		{"FORUM_WRITE_TIMEOUT", 30 * time.Second, &cfg.WriteTimeout},
+		{"FORUM_IDLE_TIMEOUT", 120 * time.Second, &cfg.IdleTimeout},
+		{"FORUM_SHUTDOWN_TIMEOUT", 20 * time.Second, &cfg.ShutdownTimeout},
+		{"FORUM_SESSION_CLEANUP_INTERVAL", time.Hour, &cfg.SessionCleanupInterval},
+		{"FORUM_CERT_RELOAD_INTERVAL", time.Minute, &cfg.CertReloadInterval},
+		{"FORUM_HSTS_MAX_AGE", 365 * 24 * time.Hour, &cfg.HSTSMaxAge},
+		{"FORUM_BACKUP_INTERVAL", 24 * time.Hour, &cfg.BackupInterval},
+		{"FORUM_LISTING_TTL", 60 * 24 * time.Hour, &cfg.ListingTTL},
+		{"FORUM_EXPIRY_INTERVAL", time.Hour, &cfg.ExpiryInterval},
+		{"FORUM_MAIL_INTERVAL", 30 * time.Second, &cfg.MailInterval},
+	}
+	for _, d := range durations {
+		value, err := getDuration(d.key, d.def)
+		if err != nil {
+			return nil, err
+		}
+		*d.target = value
+	}
+
+	//the background jobs tick at these intervals, and a ticker can't tick at 0
+	if cfg.SessionCleanupInterval <= 0 {
+		return nil, fmt.Errorf("FORUM_SESSION_CLEANUP_INTERVAL must be greater than 0")
+	}
+
+	var err error
+	if cfg.CSPReportOnly, err = getBool("FORUM_CSP_REPORT_ONLY", false); err != nil {
+		return nil, err
+	}
+	if cfg.BackupGzip, err = getBool("FORUM_BACKUP_GZIP", true); err != nil {
+		return nil, err
+	}
+	if cfg.BackupKeep, err = getInt("FORUM_BACKUP_KEEP", 7); err != nil {
+		return nil, err
+	}
+	if cfg.MaxUploadSize, err = getInt("FORUM_MAX_UPLOAD_SIZE", 5<<20); err != nil {
+		return nil, err
+	}
+
+	//only one of the two TLS files is most likely a typo, so we don't silently fall back to HTTP
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("FORUM_TLS_CERT and FORUM_TLS_KEY must be set together")
+	}
+	if cfg.HTTPRedirectAddr != "" && !cfg.TLSEnabled() {
+		return nil, fmt.Errorf("FORUM_HTTP_REDIRECT_ADDR requires FORUM_TLS_CERT and FORUM_TLS_KEY")
+	}
+	if cfg.TLSEnabled() && cfg.CertReloadInterval <= 0 {
+		return nil, fmt.Errorf("FORUM_CERT_RELOAD_INTERVAL must be greater than 0")
+	}
+	switch cfg.MailTransport {
+	case "", "file":
+	case "smtp":
+		if cfg.SMTPAddr == "" {
+			return nil, fmt.Errorf("FORUM_MAIL_TRANSPORT=smtp requires FORUM_SMTP_ADDR")
+		}
+	default:
+		return nil, fmt.Errorf("invalid value for FORUM_MAIL_TRANSPORT: %q, use smtp or file", cfg.MailTransport)
+	}
+	if cfg.MailTransport != "" && cfg.MailInterval == 0 {
+		return nil, fmt.Errorf("FORUM_MAIL_INTERVAL can't be 0 when the email is on")
+	}
+
+	return cfg, nil
+}
+
+// getEnv returns the value of the environment variable or the default if it is not set
+func getEnv(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// getDuration parses a duration like "15s" or "2m" from the environment
+func getDuration(key string, def time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid value for %s: duration cannot be negative", key)
+	}
+	return d, nil
+}
+
+// getBool parses a boolean like "true" or "1" from the environment
+func getBool(key string, def bool) (bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// getInt parses a whole number from the environment
+func getInt(key string, def int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid value for %s: cannot be negative", key)
+	}
+	return n, nil
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":8080" || cfg.ReadTimeout != 15*time.Second || cfg.SessionCleanupInterval != time.Hour {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string //empty when the config is valid
+		check   func(*Config) bool
+	}{
+		{
+			name:  "durations",
+			env:   map[string]string{"FORUM_READ_TIMEOUT": "2s", "FORUM_SHUTDOWN_TIMEOUT": "1m30s"},
+			check: func(c *Config) bool { return c.ReadTimeout == 2*time.Second && c.ShutdownTimeout == 90*time.Second },
+		},
+		{
+			name:    "invalid duration",
+			env:     map[string]string{"FORUM_WRITE_TIMEOUT": "soon"},
+			wantErr: "FORUM_WRITE_TIMEOUT",
+		},
+		{
+			name:    "negative duration",
+			env:     map[string]string{"FORUM_IDLE_TIMEOUT": "-1s"},
+			wantErr: "cannot be negative",
+		},
+		{
+			name:    "session cleanup every 0",
+			env:     map[string]string{"FORUM_SESSION_CLEANUP_INTERVAL": "0s"},
+			wantErr: "FORUM_SESSION_CLEANUP_INTERVAL must be greater than 0",
+		},
+		{
+			name:  "TLS",
+			env:   map[string]string{"FORUM_TLS_CERT": "cert.pem", "FORUM_TLS_KEY": "key.pem", "FORUM_HTTP_REDIRECT_ADDR": ":80"},
+			check: func(c *Config) bool { return c.TLSEnabled() && c.HTTPRedirectAddr == ":80" },
+		},
+		{
+			name:    "certificate without the key",
+			env:     map[string]string{"FORUM_TLS_CERT": "cert.pem"},
+			wantErr: "must be set together",
+		},
+		{
+			name:    "redirect without TLS",
+			env:     map[string]string{"FORUM_HTTP_REDIRECT_ADDR": ":80"},
+			wantErr: "requires FORUM_TLS_CERT",
+		},
+		{
+			name:    "certificate checked every 0",
+			env:     map[string]string{"FORUM_TLS_CERT": "cert.pem", "FORUM_TLS_KEY": "key.pem", "FORUM_CERT_RELOAD_INTERVAL": "0s"},
+			wantErr: "FORUM_CERT_RELOAD_INTERVAL must be greater than 0",
+		},
+		{
+			name:  "reload interval only matters with TLS",
+			env:   map[string]string{"FORUM_CERT_RELOAD_INTERVAL": "0s"},
+			check: func(c *Config) bool { return !c.TLSEnabled() },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := Load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want one about %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
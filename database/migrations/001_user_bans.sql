@@ -0,0 +1,2 @@
+-- Banned users can't log in and their sessions are removed
+ALTER TABLE users ADD COLUMN banned_at TIMESTAMP;
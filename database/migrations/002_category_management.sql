@@ -0,0 +1,28 @@
+-- The base categories used to be inserted by schema.sql on every start, which
+-- brought back the categories an admin renamed, merged or deleted. Now they
+-- are only added once.
+INSERT OR IGNORE INTO categories (name, description) VALUES 
+    ('General', 'General discussion about Åland'),
+    ('Studying in Åland', 'Posts about studying in Åland'),
+    ('Culture and leisure in Åland', 'Posts about culture and leisure activities'),
+    ('Moving to Åland', 'Get insights and practical tips on relocating to Åland'),
+    ('Living in Åland', 'Explore all aspects of life in Åland'),
+    ('Housing in Åland', 'Guidance on finding housing in Åland'),
+    ('Jobs and entrepreneurship in Åland', 'Information about job opportunities'),
+    ('Family life in Åland', 'Support and resources for families'),
+    ('For sale and wanted in Åland', 'Browse listings for items');
+
+-- Order of the categories on the home page
+ALTER TABLE categories ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+UPDATE categories SET position = id;
+
+-- Archived categories are read-only
+ALTER TABLE categories ADD COLUMN archived_at TIMESTAMP;
+
+-- Old category URLs that lead to the category they were merged into
+CREATE TABLE IF NOT EXISTS category_redirects (
+    old_id INTEGER PRIMARY KEY,
+    new_id INTEGER NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (new_id) REFERENCES categories(id) ON DELETE CASCADE
+);
@@ -0,0 +1,11 @@
+-- Categories can have subcategories, top level categories have no parent
+ALTER TABLE categories ADD COLUMN parent_id INTEGER REFERENCES categories(id);
+CREATE INDEX IF NOT EXISTS idx_categories_parent ON categories(parent_id);
+
+INSERT OR IGNORE INTO categories (name, description, parent_id, position)
+SELECT 'Rentals', 'Apartments and houses for rent', id, (SELECT MAX(position) + 1 FROM categories)
+FROM categories WHERE name = 'Housing in Åland';
+
+INSERT OR IGNORE INTO categories (name, description, parent_id, position)
+SELECT 'Buying', 'Buying a home or a summer cottage', id, (SELECT MAX(position) + 1 FROM categories)
+FROM categories WHERE name = 'Housing in Åland';
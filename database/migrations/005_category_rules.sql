@@ -0,0 +1,29 @@
+-- Rules for posting in a category, categories without a row have no rules.
+-- who_can_post is 'everyone' or 'admins', 0 turns the limits off.
+CREATE TABLE IF NOT EXISTS category_rules (
+    category_id INTEGER PRIMARY KEY,
+    who_can_post TEXT NOT NULL DEFAULT 'everyone',
+    min_account_age_days INTEGER NOT NULL DEFAULT 0,
+    title_prefix TEXT NOT NULL DEFAULT '',
+    content_template TEXT NOT NULL DEFAULT '',
+    max_posts_per_day INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (category_id) REFERENCES categories(id) ON DELETE CASCADE
+);
+
+INSERT OR IGNORE INTO category_rules (category_id, content_template, max_posts_per_day)
+SELECT id, 'Selling or looking for:
+Price:
+Condition:
+Location:
+Contact:', 3
+FROM categories WHERE name = 'For sale and wanted in Åland';
+
+INSERT OR IGNORE INTO category_rules (category_id, min_account_age_days, content_template, max_posts_per_day)
+SELECT id, 1, 'Employer:
+Role:
+Employment type:
+Salary:
+Languages:
+Apply by:', 3
+FROM categories WHERE name = 'Jobs and entrepreneurship in Åland';
@@ -0,0 +1,32 @@
+-- The kind of posts a category takes: 'post' for free text, 'listing' for
+-- the marketplace. A post gets the type of its category when it is created.
+ALTER TABLE categories ADD COLUMN post_type TEXT NOT NULL DEFAULT 'post';
+ALTER TABLE posts ADD COLUMN type TEXT NOT NULL DEFAULT 'post';
+
+UPDATE categories SET post_type = 'listing' WHERE name = 'For sale and wanted in Åland';
+
+-- Marketplace listings, the price is in cents
+CREATE TABLE IF NOT EXISTS listings (
+    post_id INTEGER PRIMARY KEY,
+    kind TEXT NOT NULL,
+    price_cents INTEGER,
+    currency TEXT NOT NULL DEFAULT 'EUR',
+    condition TEXT NOT NULL DEFAULT '',
+    location TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'open',
+    expires_at TIMESTAMP NOT NULL,
+    closed_at TIMESTAMP,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_listings_status ON listings(status, expires_at);
+
+-- Photos uploaded with a post, the files are in the upload directory
+CREATE TABLE IF NOT EXISTS post_photos (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER NOT NULL,
+    filename TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_post_photos_post ON post_photos(post_id);
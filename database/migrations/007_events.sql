@@ -0,0 +1,22 @@
+-- Events of "Culture and leisure", the times are in UTC
+UPDATE categories SET post_type = 'event' WHERE name = 'Culture and leisure in Åland';
+
+CREATE TABLE IF NOT EXISTS events (
+    post_id INTEGER PRIMARY KEY,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    venue TEXT NOT NULL DEFAULT '',
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_events_time ON events(starts_at, ends_at);
+
+-- Who is going to or interested in an event, one answer per user
+CREATE TABLE IF NOT EXISTS event_rsvps (
+    post_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (post_id, user_id),
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
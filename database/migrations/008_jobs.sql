@@ -0,0 +1,23 @@
+-- Job postings of "Jobs and entrepreneurship", the salaries are in whole euros
+-- and the deadline is in UTC
+UPDATE categories SET post_type = 'job' WHERE name = 'Jobs and entrepreneurship in Åland';
+
+CREATE TABLE IF NOT EXISTS jobs (
+    post_id INTEGER PRIMARY KEY,
+    employer TEXT NOT NULL,
+    role TEXT NOT NULL,
+    employment_type TEXT NOT NULL,
+    salary_min INTEGER,
+    salary_max INTEGER,
+    salary_period TEXT NOT NULL DEFAULT '',
+    languages TEXT NOT NULL DEFAULT '',
+    deadline TIMESTAMP NOT NULL,
+    status TEXT NOT NULL DEFAULT 'open',
+    closed_at TIMESTAMP,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status, deadline);
+
+-- the fields of the old content template are in the form now
+UPDATE category_rules SET content_template = ''
+WHERE category_id = (SELECT id FROM categories WHERE name = 'Jobs and entrepreneurship in Åland');
@@ -0,0 +1,42 @@
+-- Housing listings of "Housing in Åland" and its subcategories, the price is
+-- in whole euros and the rent is per month
+UPDATE categories SET post_type = 'housing'
+WHERE name = 'Housing in Åland'
+   OR parent_id = (SELECT id FROM categories WHERE name = 'Housing in Åland');
+
+CREATE TABLE IF NOT EXISTS housing (
+    post_id INTEGER PRIMARY KEY,
+    kind TEXT NOT NULL,
+    municipality TEXT NOT NULL,
+    rooms INTEGER NOT NULL,
+    size_m2 INTEGER NOT NULL,
+    price INTEGER NOT NULL,
+    available_from TEXT NOT NULL, -- 2006-01-02
+    furnished BOOLEAN NOT NULL DEFAULT 0,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_housing_search ON housing(municipality, kind, price);
+
+-- Housing searches the users get alerts of, the query is the search as URL
+-- parameters
+CREATE TABLE IF NOT EXISTS housing_searches (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    category_id INTEGER NOT NULL,
+    query TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, category_id, query),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (category_id) REFERENCES categories(id) ON DELETE CASCADE
+);
+
+-- The new listings that matched a saved search
+CREATE TABLE IF NOT EXISTS housing_alerts (
+    search_id INTEGER NOT NULL,
+    post_id INTEGER NOT NULL,
+    seen BOOLEAN NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (search_id, post_id),
+    FOREIGN KEY (search_id) REFERENCES housing_searches(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
@@ -0,0 +1,7 @@
+-- Q&A mode: the posts of a Q&A category are questions, and the author can
+-- accept one of the comments as the answer
+ALTER TABLE categories ADD COLUMN qa_mode BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN accepted_comment_id INTEGER REFERENCES comments(id);
+CREATE INDEX IF NOT EXISTS idx_posts_accepted_comment ON posts(accepted_comment_id);
+
+UPDATE categories SET qa_mode = 1 WHERE name IN ('Moving to Åland', 'Studying in Åland');
@@ -0,0 +1,22 @@
+-- Notifications: the comments, reactions, mentions and moderation actions
+-- that concern a user. A notification is unread until read_at is set.
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    actor_id INTEGER REFERENCES users(id),
+    type TEXT NOT NULL,
+    post_id INTEGER REFERENCES posts(id),
+    comment_id INTEGER REFERENCES comments(id),
+    message TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    read_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_id, read_at);
+
+-- The types of notifications a user has turned off, every type is on by default
+CREATE TABLE IF NOT EXISTS notification_settings (
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    type TEXT NOT NULL,
+    in_app BOOLEAN NOT NULL DEFAULT 1,
+    PRIMARY KEY (user_id, type)
+);
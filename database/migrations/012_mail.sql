@@ -0,0 +1,37 @@
+-- Email: the queue of outgoing mail, the email settings of the notifications,
+-- the digests of the followed categories and the unsubscribe tokens
+CREATE TABLE IF NOT EXISTS mail_queue (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    to_addr TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    unsubscribe_url TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    sent_at TIMESTAMP,
+    failed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_mail_queue_due ON mail_queue(sent_at, failed_at, next_attempt_at);
+
+ALTER TABLE notification_settings ADD COLUMN email BOOLEAN NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS category_follows (
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    category_id INTEGER NOT NULL REFERENCES categories(id),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, category_id)
+);
+
+-- The digest is off until the user picks daily or weekly
+CREATE TABLE IF NOT EXISTS digest_subscriptions (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id),
+    frequency TEXT NOT NULL,
+    last_sent_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS unsubscribe_tokens (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id),
+    token TEXT NOT NULL UNIQUE
+);
@@ -0,0 +1,21 @@
+-- Chat: a live chat room for every category. The moderators can delete the
+-- messages and mute the users of a room for a while.
+CREATE TABLE IF NOT EXISTS chat_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    category_id INTEGER NOT NULL REFERENCES categories(id),
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    username TEXT NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    deleted_at TIMESTAMP,
+    deleted_by INTEGER REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_chat_messages_category ON chat_messages(category_id, id);
+
+CREATE TABLE IF NOT EXISTS chat_mutes (
+    category_id INTEGER NOT NULL REFERENCES categories(id),
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    muted_until TIMESTAMP NOT NULL,
+    muted_by INTEGER NOT NULL REFERENCES users(id),
+    PRIMARY KEY (category_id, user_id)
+);
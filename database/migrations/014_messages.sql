@@ -0,0 +1,59 @@
+-- Private messages: conversations of two or a few users. A member has read
+-- the messages up to last_read_id, and a member who left no longer sees the
+-- conversation.
+CREATE TABLE IF NOT EXISTS conversations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    subject TEXT NOT NULL DEFAULT '',
+    created_by INTEGER NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP NOT NULL,
+    last_message_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS conversation_members (
+    conversation_id INTEGER NOT NULL REFERENCES conversations(id),
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    last_read_id INTEGER NOT NULL DEFAULT 0,
+    left_at TIMESTAMP,
+    PRIMARY KEY (conversation_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS idx_conversation_members_user ON conversation_members(user_id);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    conversation_id INTEGER NOT NULL REFERENCES conversations(id),
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    content TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    removed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages(conversation_id, id);
+
+-- The images of a message, the files are in the upload directory but only
+-- the members of the conversation can load them
+CREATE TABLE IF NOT EXISTS message_attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL REFERENCES messages(id),
+    filename TEXT NOT NULL UNIQUE
+);
+CREATE INDEX IF NOT EXISTS idx_message_attachments_message ON message_attachments(message_id);
+
+-- The users a user doesn't want messages from
+CREATE TABLE IF NOT EXISTS user_blocks (
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    blocked_id INTEGER NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, blocked_id)
+);
+
+-- The messages reported to the moderators, the only messages they can read
+CREATE TABLE IF NOT EXISTS message_reports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL REFERENCES messages(id),
+    reporter_id INTEGER NOT NULL REFERENCES users(id),
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP,
+    resolved_by INTEGER REFERENCES users(id),
+    UNIQUE (message_id, reporter_id)
+);
+CREATE INDEX IF NOT EXISTS idx_message_reports_open ON message_reports(resolved_at);
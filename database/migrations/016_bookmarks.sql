@@ -0,0 +1,22 @@
+-- Bookmarks of posts and comments with a private note, in folders of the
+-- user's own. comment_id is 0 for a bookmark of the post itself, and a
+-- bookmark without a folder has folder_id NULL.
+CREATE TABLE IF NOT EXISTS bookmark_folders (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    name TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS bookmarks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    post_id INTEGER NOT NULL REFERENCES posts(id),
+    comment_id INTEGER NOT NULL DEFAULT 0,
+    folder_id INTEGER REFERENCES bookmark_folders(id),
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, post_id, comment_id)
+);
+CREATE INDEX IF NOT EXISTS idx_bookmarks_folder ON bookmarks(user_id, folder_id);
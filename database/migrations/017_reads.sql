@@ -0,0 +1,19 @@
+-- What the users have read. A post the user has opened has a row with the
+-- last comment they saw, and marking a category as read keeps one watermark
+-- per category instead of a row for every post: the posts and comments up to
+-- the watermark are read. Both tables are keyed by the user without a rowid,
+-- so a row costs only its three numbers.
+CREATE TABLE IF NOT EXISTS post_reads (
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    last_comment_id INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, post_id)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS category_reads (
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    category_id INTEGER NOT NULL REFERENCES categories(id),
+    last_post_id INTEGER NOT NULL,
+    last_comment_id INTEGER NOT NULL,
+    PRIMARY KEY (user_id, category_id)
+) WITHOUT ROWID;
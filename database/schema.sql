@@ -71,14 +71,4 @@ CREATE TABLE IF NOT EXISTS sessions (
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
--- -- Add base categories
-INSERT OR IGNORE INTO categories (name, description) VALUES 
-    ('General', 'General discussion about Åland'),
-    ('Studying in Åland', 'Posts about studying in Åland'),
-    ('Culture and leisure in Åland', 'Posts about culture and leisure activities'),
-    ('Moving to Åland', 'Get insights and practical tips on relocating to Åland'),
-    ('Living in Åland', 'Explore all aspects of life in Åland'),
-    ('Housing in Åland', 'Guidance on finding housing in Åland'),
-    ('Jobs and entrepreneurship in Åland', 'Information about job opportunities'),
-    ('Family life in Åland', 'Support and resources for families'),
-    ('For sale and wanted in Åland', 'Browse listings for items'); 
\ No newline at end of file
+-- The base categories are added by database/migrations/002_category_management.sql
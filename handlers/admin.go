@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CategoryAction is one change to the categories, sent as a form from the
+// admin page or as JSON to the API
+type CategoryAction struct {
+	Action      string         `json:"action"`
+	ID          int64          `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	TargetID    int64          `json:"target_id"`
+	ParentID    int64          `json:"parent_id"` //0 for the top level
+	Rules       *CategoryRules `json:"rules"`
+	PostType    string         `json:"post_type"`
+	QAMode      bool           `json:"qa_mode"`
+}
+
+var errUnknownAction = errors.New("unknown action")
+
+// ActionResponse is the JSON answer of the admin APIs
+type ActionResponse struct {
+	Success bool   `json:"success"`
+	ID      int64  `json:"id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// requireAdmin returns the logged in admin. Everyone else gets a 404, so the
+// admin pages don't show up for them at all.
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) *User {
+	user := h.GetSessionUser(w, r)
+	if user == nil || !user.IsAdmin {
+		h.ErrorHandler(w, r, "Page not found", http.StatusNotFound)
+		return nil
+	}
+	return user
+}
+
+// AdminCategories shows the category management page
+func (h *Handler) AdminCategories(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(w, r)
+	if user == nil {
+		return
+	}
+	if r.Method != http.MethodGet {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.renderAdminCategories(w, r, user, "", http.StatusOK)
+}
+
+// AdminCategoryRules shows the posting rules of one category, /admin/categories/{id}
+func (h *Handler) AdminCategoryRules(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(w, r)
+	if user == nil {
+		return
+	}
+	categoryID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/admin/categories/"), 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	categories, err := h.getCategories()
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting categories", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	category := findCategory(categories, categoryID)
+	if category == nil {
+		h.ErrorHandler(w, r, "Category not found", http.StatusNotFound)
+		return
+	}
+	category.Rules, err = GetCategoryRules(h.db, categoryID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting posting rules", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	data := TemplateData{
+		Title:     category.Name,
+		User:      user,
+		Category:  category,
+		PostTypes: PostTypes,
+	}
+	if err := h.render(w, r, "admin_category.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) renderAdminCategories(w http.ResponseWriter, r *http.Request, user *User, message string, code int) {
+	categories, err := h.getCategories()
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting categories", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	data := TemplateData{
+		Title:      "Categories",
+		User:       user,
+		Categories: flattenCategories(categories),
+		Error:      message,
+	}
+	w.WriteHeader(code)
+	if err := h.render(w, r, "admin_categories.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+	}
+}
+
+// CategoryAPI changes the categories. The admin page posts forms here and gets
+// redirected back, JSON requests get a JSON answer.
+func (h *Handler) CategoryAPI(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(w, r)
+	if user == nil {
+		return
+	}
+
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+
+	if r.Method == http.MethodGet {
+		categories, err := h.getCategories()
+		if err != nil {
+			LogFrom(r.Context()).Error("Error getting categories", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(categories)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var action CategoryAction
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+			h.ErrorHandler(w, r, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		action.Action = r.FormValue("action")
+		action.ID, _ = strconv.ParseInt(r.FormValue("id"), 10, 64)
+		action.Name = r.FormValue("name")
+		action.Description = r.FormValue("description")
+		action.TargetID, _ = strconv.ParseInt(r.FormValue("target_id"), 10, 64)
+		action.ParentID, _ = strconv.ParseInt(r.FormValue("parent_id"), 10, 64)
+		action.PostType = r.FormValue("post_type")
+		action.QAMode = r.FormValue("qa_mode") == "1"
+		if action.Action == "rules" {
+			action.Rules = &CategoryRules{
+				WhoCanPost:      r.FormValue("who_can_post"),
+				TitlePrefix:     r.FormValue("title_prefix"),
+				ContentTemplate: r.FormValue("content_template"),
+			}
+			action.Rules.MinAccountAgeDays, _ = strconv.Atoi(r.FormValue("min_account_age_days"))
+			action.Rules.MaxPostsPerDay, _ = strconv.Atoi(r.FormValue("max_posts_per_day"))
+		}
+	}
+
+	id, err := h.applyCategoryAction(action)
+	code := http.StatusOK
+	switch {
+	case err == nil:
+		LogFrom(r.Context()).Info("Category changed", "action", action.Action, "category_id", id, "admin_id", user.ID)
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrCategoryExists), errors.Is(err, ErrCategoryName),
+		errors.Is(err, ErrMergeIntoItself), errors.Is(err, ErrCategoryCycle),
+		errors.Is(err, ErrInvalidCategory), errors.Is(err, ErrInvalidRules), errors.Is(err, ErrInvalidPostType),
+		errors.Is(err, errUnknownAction):
+		code = http.StatusBadRequest
+	default:
+		LogFrom(r.Context()).Error("Error changing category", "action", action.Action, "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	if isJSON {
+		resp := ActionResponse{Success: err == nil, ID: id}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if err != nil {
+		h.renderAdminCategories(w, r, user, err.Error(), code)
+		return
+	}
+	if action.Action == "rules" || action.Action == "post_type" || action.Action == "qa" {
+		http.Redirect(w, r, "/admin/categories/"+strconv.FormatInt(id, 10), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
+
+// applyCategoryAction runs the action and returns the ID of the changed category
+func (h *Handler) applyCategoryAction(a CategoryAction) (int64, error) {
+	switch a.Action {
+	case "create":
+		return CreateCategory(h.db, a.Name, strings.TrimSpace(a.Description), a.ParentID)
+	case "update":
+		return a.ID, UpdateCategory(h.db, a.ID, a.Name, a.Description)
+	case "parent":
+		return a.ID, SetCategoryParent(h.db, a.ID, a.ParentID)
+	case "up", "down":
+		return a.ID, MoveCategory(h.db, a.ID, a.Action == "up")
+	case "archive", "unarchive":
+		return a.ID, SetCategoryArchived(h.db, a.ID, a.Action == "archive")
+	case "rules":
+		if a.Rules == nil {
+			return a.ID, ErrInvalidRules
+		}
+		a.Rules.CategoryID = a.ID
+		return a.ID, SetCategoryRules(h.db, a.Rules)
+	case "post_type":
+		return a.ID, SetCategoryPostType(h.db, a.ID, a.PostType)
+	case "qa":
+		return a.ID, SetCategoryQAMode(h.db, a.ID, a.QAMode)
+	case "merge":
+		return a.TargetID, MergeCategories(h.db, a.ID, a.TargetID)
+	}
+	return 0, errUnknownAction
+}
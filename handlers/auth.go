@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"database/sql"
-	"log"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
@@ -28,18 +28,18 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		data := TemplateData{
 			Title: "Login",
 		}
-		h.templates.ExecuteTemplate(w, "login.html", data)
+		h.render(w, r, "login.html", &data)
 		return
 	}
 
 	if r.Method != http.MethodPost {
-		h.ErrorHandler(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	//this will analyze the form data and parses it
 	if err := r.ParseForm(); err != nil {
-		h.ErrorHandler(w, "Failed to parse form", http.StatusBadRequest)
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 	//this will get the email and password from the form
@@ -48,41 +48,55 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 
 	// Validate email
 	if !isValidEmail(email) {
-		h.ErrorHandler(w, "Invalid email format", http.StatusBadRequest)
+		h.ErrorHandler(w, r, "Invalid email format", http.StatusBadRequest)
 		return
 	}
 
 	//this will get the user from the database
 	var user User
 	var hashedPassword string
+	var banned bool
+	done := observeQuery("login_user")
 	err := h.db.QueryRow(`
-		SELECT id, email, username, password_hash, is_admin 
+		SELECT id, email, username, password_hash, is_admin, banned_at IS NOT NULL
 		FROM users 
 		WHERE email = ?
-	`, email).Scan(&user.ID, &user.Email, &user.Username, &hashedPassword, &user.IsAdmin)
+	`, email).Scan(&user.ID, &user.Email, &user.Username, &hashedPassword, &user.IsAdmin, &banned)
+	done()
 
 	//if the user is not found, then we will display an error message
 	if err != nil {
 		if err == sql.ErrNoRows {
+			failedLogins.Inc()
 			data := TemplateData{
 				Title: "Login",
 				Error: "Invalid email or password",
 			}
-			h.templates.ExecuteTemplate(w, "login.html", data)
+			h.render(w, r, "login.html", &data)
 			return
 		}
-		log.Printf("Error getting user from database: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Error getting user from database", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 	//this will compare the password from the form with the password from the database
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 	if err != nil {
+		failedLogins.Inc()
 		data := TemplateData{
 			Title: "Login",
 			Error: "Invalid email or password",
 		}
-		h.templates.ExecuteTemplate(w, "login.html", data)
+		h.render(w, r, "login.html", &data)
+		return
+	}
+	//banned users are told so only after the password is right, so the ban can't be used to guess emails
+	if banned {
+		data := TemplateData{
+			Title: "Login",
+			Error: "This account has been banned",
+		}
+		h.render(w, r, "login.html", &data)
 		return
 	}
 	//creating a new session with unique token
@@ -105,8 +119,8 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	//starting a transaction from the database. If there is an error, then we will display an error message
 	tx, err := h.db.Begin()
 	if err != nil {
-        log.Printf("Error starting transaction: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+        LogFrom(r.Context()).Error("Error starting transaction", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 	defer tx.Rollback()
@@ -114,8 +128,8 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	//deleting the old sessions from the database
 	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID)
 	if err != nil {
-		log.Printf("Session error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Session error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
@@ -126,15 +140,15 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	`, sessionToken, user.ID, expiresAt)
 
 	if err != nil {
-		log.Printf("Session creation error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Session creation error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
 	//committing the transaction to the database
 	if err := tx.Commit(); err != nil {
-		log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
@@ -146,6 +160,7 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		Path:     "/",
 		SameSite: http.SameSiteLaxMode,
+		Secure:   h.secureCookies,
 	})
 	//redirecting the user to the home page after successful login
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -157,13 +172,13 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		data := TemplateData{
 			Title: "Register",
 		}
-		h.templates.ExecuteTemplate(w, "register.html", data)
+		h.render(w, r, "register.html", &data)
 		return
 	}
 
 	// If request is not POST, display an error message
 	if r.Method != http.MethodPost {
-		h.ErrorHandler(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -173,105 +188,53 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	password := r.FormValue("password")
 	confirmPassword := r.FormValue("confirm_password")
 
-	if !strings.Contains(email, "@") || !strings.Contains(email, ".") {
-		data := TemplateData{
-			Title: "Register",
-			Error: "Wrong e-mail format",
-		}
-		if err := h.templates.ExecuteTemplate(w, "register.html", data); err != nil {
-			log.Printf("Error rendering page: %v", err)
-		    h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
-		}
-		return
-	}
-
-	// Password validation
-	if len(password) < 6 {
-		data := TemplateData{
-			Title: "Register",
-			Error: "Password must be at least 6 characters long",
-		}
-		if err := h.templates.ExecuteTemplate(w, "register.html", data); err != nil {
-			log.Printf("Error rendering page: %v", err)
-		    h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
-		}
-		return
-	}
-
 	if password != confirmPassword {
-		data := TemplateData{
-			Title: "Register",
-			Error: "The passwords don't match",
-		}
-		if err := h.templates.ExecuteTemplate(w, "register.html", data); err != nil {
-            log.Printf("Error rendering page: %v", err)
-		    h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
-		}
+		h.renderRegisterError(w, r, "The passwords don't match")
 		return
 	}
 
-	// Check if user exists with this email
-	var exists bool
-	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", email).Scan(&exists)
-	if err != nil {
-        log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	// Validate the data and create the new user
+	_, err := CreateUser(h.db, email, username, password, false)
+	switch {
+	case errors.Is(err, ErrInvalidEmail):
+		h.renderRegisterError(w, r, "Wrong e-mail format")
 		return
-	}
-
-	if exists {
-		data := TemplateData{
-			Title: "Register",
-			Error: "This email address is already registered",
-		}
-		if err := h.templates.ExecuteTemplate(w, "register.html", data); err != nil {
-			log.Printf("Error rendering page: %v", err)
-		    h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
-		}
+	case errors.Is(err, ErrUsernameRequired):
+		h.renderRegisterError(w, r, "Username cannot be empty")
 		return
-	}
-
-	// Check if username is taken
-	err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists)
-	if err != nil {
-		log.Printf("Error rendering page: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	case errors.Is(err, ErrPasswordTooShort):
+		h.renderRegisterError(w, r, "Password must be at least 6 characters long")
 		return
-	}
-
-	if exists {
-		data := TemplateData{
-			Title: "Register",
-			Error: "This username is already taken",
-		}
-		h.templates.ExecuteTemplate(w, "register.html", data)
+	case errors.Is(err, ErrEmailTaken):
+		h.renderRegisterError(w, r, "This email address is already registered")
 		return
-	}
-
-	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("Internal server error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	case errors.Is(err, ErrUsernameTaken):
+		h.renderRegisterError(w, r, "This username is already taken")
 		return
-	}
-
-	// Create new user
-	_, err = h.db.Exec(`
-		INSERT INTO users (email, username, password_hash)
-		VALUES (?, ?, ?)
-	`, email, username, string(hashedPassword))
-
-	if err != nil {
-		log.Printf("Error creating user: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	case err != nil:
+		LogFrom(r.Context()).Error("Error creating user", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
+	registrations.Inc()
+
 	// Redirect to login page
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// renderRegisterError shows the register page again with the error message
+func (h *Handler) renderRegisterError(w http.ResponseWriter, r *http.Request, message string) {
+	data := TemplateData{
+		Title: "Register",
+		Error: message,
+	}
+	if err := h.render(w, r, "register.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
 // Helper function to validate email format
 func isValidEmail(email string) bool {
 	return strings.Contains(email, "@") && strings.Contains(email, ".")
@@ -288,8 +251,8 @@ func (h *Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	//deleting the session associated with the token from the database
 	_, err = h.db.Exec("DELETE FROM sessions WHERE token = ?", cookie.Value)
 	if err != nil {
-		log.Printf("Error deleting session: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Error deleting session", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
@@ -301,6 +264,7 @@ func (h *Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		MaxAge:   -1, //-1 because we want to delete the cookie immediately, cookie is considered expired
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
+		Secure:   h.secureCookies,
 	})
 	//after logging out, the user will be redirected to the home page
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -316,12 +280,14 @@ func (h *Handler) GetSessionUser(w http.ResponseWriter, r *http.Request) *User {
 
 	var user User //creating a new object of the User struct
 	//SQL query to get the user from the session
+	done := observeQuery("session_user")
 	err = h.db.QueryRow(` 
 		SELECT u.id, u.email, u.username, u.is_admin 
 		FROM users u
 		JOIN sessions s ON u.id = s.user_id
-		WHERE s.token = ? AND s.expires_at > CURRENT_TIMESTAMP
+		WHERE s.token = ? AND s.expires_at > CURRENT_TIMESTAMP AND u.banned_at IS NULL
 	`, cookie.Value).Scan(&user.ID, &user.Email, &user.Username, &user.IsAdmin)
+	done()
 
 	//if the scan was successful, then we will fill the user object with the data
 
@@ -333,13 +299,13 @@ func (h *Handler) GetSessionUser(w http.ResponseWriter, r *http.Request) *User {
 			MaxAge:   -1,
 			HttpOnly: true,
 			SameSite: http.SameSiteLaxMode,
+			Secure:   h.secureCookies,
 		})
-		//if we don't find the user, then we will return nil
-		if err != sql.ErrNoRows {
-
-			return nil
-		}
+		//an unknown, expired or banned session is no session at all, so a
+		//stale cookie can't act as a user with the ID 0
+		return nil
 	}
 	//if the user is found, then we will log the user's information
+	setRequestUser(r, user.ID)
 	return &user
 }
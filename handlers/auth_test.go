@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetSessionUser(t *testing.T) {
+	h := newTestHandler(t)
+	member := addUser(t, h, "member")
+	banned := addUser(t, h, "banned")
+	exec(t, h.db, "INSERT INTO sessions (token, user_id, expires_at) VALUES ('valid', ?, datetime('now', '+1 hour'))", member)
+	exec(t, h.db, "INSERT INTO sessions (token, user_id, expires_at) VALUES ('expired', ?, datetime('now', '-1 hour'))", member)
+	exec(t, h.db, "INSERT INTO sessions (token, user_id, expires_at) VALUES ('banned', ?, datetime('now', '+1 hour'))", banned)
+	exec(t, h.db, "UPDATE users SET banned_at = CURRENT_TIMESTAMP WHERE id = ?", banned)
+
+	tests := []struct {
+		name        string
+		token       string //no cookie when empty
+		want        int64  //the ID of the user, 0 for no user
+		clearCookie bool
+	}{
+		{"no cookie", "", 0, false},
+		{"valid", "valid", member, false},
+		{"expired", "expired", 0, true},
+		{"banned", "banned", 0, true},
+		{"made up", "made-up", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.token != "" {
+				r.AddCookie(&http.Cookie{Name: SessionTokenCookie, Value: tt.token})
+			}
+			w := httptest.NewRecorder()
+			user := h.GetSessionUser(w, r)
+			switch {
+			case tt.want == 0 && user != nil:
+				t.Errorf("got the user %+v, want no user", user)
+			case tt.want != 0 && (user == nil || user.ID != tt.want):
+				t.Errorf("got the user %+v, want %d", user, tt.want)
+			}
+			cleared := false
+			for _, c := range w.Result().Cookies() {
+				cleared = cleared || (c.Name == SessionTokenCookie && c.MaxAge < 0)
+			}
+			if cleared != tt.clearCookie {
+				t.Errorf("cookie cleared %v, want %v", cleared, tt.clearCookie)
+			}
+		})
+	}
+}
+
+func TestStaleSessionCannotWrite(t *testing.T) {
+	h := newTestHandler(t)
+	author := addUser(t, h, "author")
+	postID := addPost(t, h, author, PostTypePost, time.Now())
+
+	id := strconv.FormatInt(postID, 10)
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		contentType string
+		body        string
+	}{
+		{"comment", h.AddComment, "application/x-www-form-urlencoded", url.Values{"post_id": {id}, "content": {"hello"}}.Encode()},
+		{"reaction", h.PostReaction, "application/json", `{"post_id": ` + id + `, "type": "like"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			r.AddCookie(&http.Cookie{Name: SessionTokenCookie, Value: "made-up"})
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+	var rows int
+	h.db.QueryRow("SELECT (SELECT COUNT(*) FROM comments) + (SELECT COUNT(*) FROM reactions)").Scan(&rows)
+	if rows != 0 {
+		t.Errorf("%d comments and reactions written without a session", rows)
+	}
+}
@@ -0,0 +1,333 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupPrefix = "forum-"
+
+// the time in the names of the snapshots, to the nanosecond so a manual
+// backup never gets the name of a scheduled one
+const backupTimeFormat = "20060102-150405.000000000"
+
+// the scheduled and the manual backups of the server take turns
+var backupMu sync.Mutex
+
+// the tables a snapshot must have to be restored
+var requiredTables = []string{"users", "categories", "posts", "post_categories", "comments", "reactions", "sessions"}
+
+// Backup writes a consistent copy of the running database into dir with
+// VACUUM INTO, checks its integrity and compresses it when compress is true.
+// It returns the path of the new snapshot.
+func Backup(ctx context.Context, db *sql.DB, dir string, compress bool) (string, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + ".db"
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+	os.Remove(tmp) //VACUUM INTO fails if the file is already there
+
+	//the path is a string literal in SQL, so the quotes have to be doubled
+	if _, err := db.ExecContext(ctx, "VACUUM INTO '"+strings.ReplaceAll(tmp, "'", "''")+"'"); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("vacuum into %s: %w", tmp, err)
+	}
+
+	if _, err := checkSnapshot(tmp); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("checking the new snapshot: %w", err)
+	}
+
+	if !compress {
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+		return path, nil
+	}
+
+	path += ".gz"
+	err := gzipFile(tmp, path)
+	os.Remove(tmp)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// checkSnapshot opens a database file read only, runs the integrity check and
+// returns its schema version
+func checkSnapshot(path string) (int, error) {
+	snapshot, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Close()
+
+	var result string
+	if err := snapshot.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return 0, fmt.Errorf("integrity check: %w", err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	for _, table := range requiredTables {
+		var exists bool
+		err := snapshot.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", table).Scan(&exists)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, fmt.Errorf("not a forum database: table %s is missing", table)
+		}
+	}
+
+	return SchemaVersion(snapshot)
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// PruneBackups removes the oldest snapshots so only keep of them are left
+func PruneBackups(dir string, keep int) error {
+	backups, err := ListBackups(dir)
+	if err != nil || keep <= 0 || len(backups) <= keep {
+		return err
+	}
+	for _, path := range backups[:len(backups)-keep] {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBackups returns the snapshots in dir from the oldest to the newest
+func ListBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) {
+			continue
+		}
+		if strings.HasSuffix(name, ".db") || strings.HasSuffix(name, ".db.gz") {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	//the names contain the time, so sorting them by name sorts them by age
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// RunBackups takes a snapshot every interval and removes the old ones, until the context is cancelled
+func (h *Handler) RunBackups(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			path, err := Backup(ctx, h.db, h.backupDir, h.backupGzip)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("Backup failed", "err", err)
+				}
+				continue
+			}
+			slog.Info("Backup created", "path", path)
+			if err := PruneBackups(h.backupDir, h.backupKeep); err != nil {
+				slog.Error("Error removing old backups", "err", err)
+			}
+		}
+	}
+}
+
+// DownloadBackup lets an admin take a snapshot right now and download it
+func (h *Handler) DownloadBackup(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(w, r)
+	if user == nil {
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, err := Backup(r.Context(), h.db, h.backupDir, h.backupGzip)
+	if err != nil {
+		LogFrom(r.Context()).Error("Backup failed", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	LogFrom(r.Context()).Info("Backup created", "path", path, "user_id", user.ID)
+	if err := PruneBackups(h.backupDir, h.backupKeep); err != nil {
+		LogFrom(r.Context()).Error("Error removing old backups", "err", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error opening backup", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	contentType := "application/vnd.sqlite3"
+	if strings.HasSuffix(path, ".gz") {
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := io.Copy(w, file); err != nil {
+		LogFrom(r.Context()).Error("Error sending backup", "err", err)
+	}
+}
+
+// Restore replaces the database with a snapshot. The snapshot is checked and
+// migrated to the current schema in a temporary file first, so a bad snapshot
+// never touches the database. The old database is kept next to it. The server
+// must not be running while restoring.
+func Restore(snapshotPath, dbPath, migrationsDir string) (string, error) {
+	latest, err := LatestMigration(migrationsDir)
+	if err != nil {
+		return "", err
+	}
+
+	//the snapshot is copied (and unpacked) next to the database, so the final rename is atomic
+	tmp := dbPath + ".restore"
+	os.Remove(tmp)
+	if err := copySnapshot(snapshotPath, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	version, err := checkSnapshot(tmp)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", snapshotPath, err)
+	}
+	if version > latest {
+		return "", fmt.Errorf("snapshot has schema version %d, but this build only knows up to %d", version, latest)
+	}
+
+	if version < latest {
+		snapshot, err := sql.Open("sqlite3", "file:"+tmp)
+		if err != nil {
+			return "", err
+		}
+		err = Migrate(snapshot, migrationsDir)
+		snapshot.Close()
+		if err != nil {
+			return "", fmt.Errorf("migrating the snapshot: %w", err)
+		}
+	}
+
+	//moving the WAL into the old database, so the copy we keep is complete
+	if _, err := os.Stat(dbPath); err == nil {
+		current, err := sql.Open("sqlite3", "file:"+dbPath)
+		if err != nil {
+			return "", err
+		}
+		if err := CloseDB(current); err != nil {
+			return "", err
+		}
+	}
+
+	previous := dbPath + ".before-restore-" + time.Now().UTC().Format("20060102-150405")
+	if err := os.Rename(dbPath, previous); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		previous = "" //there was no database to keep
+	}
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+
+	if err := os.Rename(tmp, dbPath); err != nil {
+		//putting the old database back, so the forum can still start
+		if previous != "" {
+			os.Rename(previous, dbPath)
+		}
+		return "", err
+	}
+	return previous, nil
+}
+
+// copySnapshot copies the snapshot to dst, unpacking it when it is gzipped
+func copySnapshot(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	if strings.HasSuffix(src, ".gz") {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", src, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// oldDatabase writes a database with only the table old to the path, it
+// stands for the database a restore replaces
+func oldDatabase(t *testing.T, path string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE old (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hasTable tells if the database file has the table
+func hasTable(t *testing.T, path, table string) bool {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", table).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+// snapshotOf writes a snapshot of the database into the directory
+func snapshotOf(t *testing.T, db *sql.DB, dir string) string {
+	t.Helper()
+	path, err := Backup(context.Background(), db, dir, false)
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	return path
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (email, username, password_hash) VALUES ('a@example.com', 'alice', '')"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	first, err := Backup(context.Background(), db, dir, true)
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	second, err := Backup(context.Background(), db, dir, true)
+	if err != nil {
+		t.Fatalf("second Backup: %v", err)
+	}
+	if first == second {
+		t.Fatalf("two backups got the same name %s", first)
+	}
+	backups, err := ListBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0] != first || backups[1] != second {
+		t.Fatalf("ListBackups = %v, want [%s %s]", backups, first, second)
+	}
+
+	//the restore replaces the database and keeps the old one
+	dbPath := filepath.Join(t.TempDir(), "forum.db")
+	oldDatabase(t, dbPath)
+	previous, err := Restore(second, dbPath, testMigrations)
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if !hasTable(t, previous, "old") {
+		t.Errorf("the old database wasn't kept at %s", previous)
+	}
+	restored, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	var username string
+	if err := restored.QueryRow("SELECT username FROM users").Scan(&username); err != nil || username != "alice" {
+		t.Errorf("restored user is %q, %v, want alice", username, err)
+	}
+}
+
+func TestRestoreChecks(t *testing.T) {
+	latest, err := LatestMigration(testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, dir string) string //returns the snapshot
+		wantErr string
+	}{
+		{
+			name: "newer schema",
+			setup: func(t *testing.T, dir string) string {
+				db := newTestDB(t)
+				if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", latest+1)); err != nil {
+					t.Fatal(err)
+				}
+				return snapshotOf(t, db, dir)
+			},
+			wantErr: fmt.Sprintf("this build only knows up to %d", latest),
+		},
+		{
+			name: "older schema is migrated",
+			setup: func(t *testing.T, dir string) string {
+				db, err := InitDB(filepath.Join(dir, "old.db"), testSchema, filepath.Join(dir, "no-migrations"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+				return snapshotOf(t, db, dir)
+			},
+		},
+		{
+			name: "not a forum database",
+			setup: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "forum-other.db")
+				oldDatabase(t, path)
+				return path
+			},
+			wantErr: "not a forum database",
+		},
+		{
+			name: "not a database",
+			setup: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "forum-broken.db")
+				if err := os.WriteFile(path, []byte("hello"), 0o640); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			wantErr: "forum-broken.db",
+		},
+		{
+			name: "not gzip",
+			setup: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "forum-broken.db.gz")
+				if err := os.WriteFile(path, []byte("hello"), 0o640); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			wantErr: "reading",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := tt.setup(t, t.TempDir())
+			dbPath := filepath.Join(t.TempDir(), "forum.db")
+			oldDatabase(t, dbPath)
+
+			_, err := Restore(snapshot, dbPath, testMigrations)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Restore: %v", err)
+				}
+				db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+				if version, _ := SchemaVersion(db); version != latest {
+					t.Errorf("restored version is %d, want %d", version, latest)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one with %q", err, tt.wantErr)
+			}
+			//a refused snapshot leaves the database alone
+			if !hasTable(t, dbPath, "old") {
+				t.Error("the database was changed by a refused restore")
+			}
+			if _, err := os.Stat(dbPath + ".restore"); !os.IsNotExist(err) {
+				t.Error("the temporary file of the restore was left behind")
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxBookmarkNote = 1000 //characters
+	maxFolderName   = 50   //characters
+	maxFolders      = 50   //folders of a user
+)
+
+// Bookmark is a saved post or comment with the user's private note
+type Bookmark struct {
+	ID        int64     `json:"-"`
+	PostID    int64     `json:"post_id"`
+	CommentID int64     `json:"comment_id,omitempty"` //0 for the post itself
+	FolderID  int64     `json:"-"`                    //0 when the bookmark is in no folder
+	Folder    string    `json:"folder,omitempty"`
+	Title     string    `json:"title"`
+	Username  string    `json:"author"`
+	Excerpt   string    `json:"excerpt"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+}
+
+// Link is the address of the post or the comment
+func (b *Bookmark) Link() string {
+	link := "/post/" + strconv.FormatInt(b.PostID, 10)
+	if b.CommentID != 0 {
+		link += "#comment-" + strconv.FormatInt(b.CommentID, 10)
+	}
+	return link
+}
+
+// BookmarkFolder is a folder of the user's bookmarks
+type BookmarkFolder struct {
+	ID       int64
+	Name     string
+	Count    int  //bookmarks in the folder
+	Selected bool //the bookmarks page shows the folder
+}
+
+// getBookmarkFolders returns the folders of the user by name
+func (h *Handler) getBookmarkFolders(userID int64) ([]BookmarkFolder, error) {
+	rows, err := h.db.Query(`
+		SELECT f.id, f.name, (SELECT COUNT(*) FROM bookmarks b WHERE b.folder_id = f.id)
+		FROM bookmark_folders f
+		WHERE f.user_id = ?
+		ORDER BY f.name COLLATE NOCASE
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []BookmarkFolder
+	for rows.Next() {
+		var f BookmarkFolder
+		if err := rows.Scan(&f.ID, &f.Name, &f.Count); err != nil {
+			return nil, err
+		}
+		folders = append(folders, f)
+	}
+	return folders, rows.Err()
+}
+
+// getBookmarks returns the bookmarks of the user, the latest first. folder
+// is "" for all of them, "none" for the ones without a folder, or the ID of
+// a folder.
+func (h *Handler) getBookmarks(userID int64, folder string) ([]Bookmark, error) {
+	query := `
+		SELECT b.id, b.post_id, b.comment_id, COALESCE(b.folder_id, 0), COALESCE(f.name, ''),
+		p.title, COALESCE(c.username, p.username), COALESCE(c.content, p.content), b.note, b.created_at
+		FROM bookmarks b
+		JOIN posts p ON p.id = b.post_id
+		LEFT JOIN comments c ON c.id = b.comment_id
+		LEFT JOIN bookmark_folders f ON f.id = b.folder_id
+		WHERE b.user_id = ?`
+	args := []interface{}{userID}
+	switch folder {
+	case "":
+	case "none":
+		query += " AND b.folder_id IS NULL"
+	default:
+		query += " AND b.folder_id = ?"
+		args = append(args, folder)
+	}
+	query += " ORDER BY b.created_at DESC, b.id DESC"
+
+	done := observeQuery("get_bookmarks")
+	rows, err := h.db.Query(query, args...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookmarks []Bookmark
+	for rows.Next() {
+		var b Bookmark
+		err := rows.Scan(&b.ID, &b.PostID, &b.CommentID, &b.FolderID, &b.Folder,
+			&b.Title, &b.Username, &b.Excerpt, &b.Note, &b.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		b.Excerpt = excerpt(b.Excerpt, feedExcerpt)
+		b.CreatedAt = b.CreatedAt.In(h.location)
+		b.URL = h.baseURL + b.Link()
+		bookmarks = append(bookmarks, b)
+	}
+	return bookmarks, rows.Err()
+}
+
+// bookmarkedOnPost returns what the user has bookmarked of the post: the
+// post itself, and the comments by ID
+func (h *Handler) bookmarkedOnPost(userID, postID int64) (bool, map[int64]bool, error) {
+	rows, err := h.db.Query("SELECT comment_id FROM bookmarks WHERE user_id = ? AND post_id = ?", userID, postID)
+	if err != nil {
+		return false, nil, err
+	}
+	defer rows.Close()
+
+	post := false
+	comments := make(map[int64]bool)
+	for rows.Next() {
+		var commentID int64
+		if err := rows.Scan(&commentID); err != nil {
+			return false, nil, err
+		}
+		if commentID == 0 {
+			post = true
+		} else {
+			comments[commentID] = true
+		}
+	}
+	return post, comments, rows.Err()
+}
+
+// folderOf checks that the folder, a form value, is the user's. It returns
+// nil for no folder.
+func (h *Handler) folderOf(userID int64, value string) (interface{}, error) {
+	if value == "" || value == "0" {
+		return nil, nil
+	}
+	var folderID int64
+	err := h.db.QueryRow("SELECT id FROM bookmark_folders WHERE id = ? AND user_id = ?", value, userID).Scan(&folderID)
+	if err == sql.ErrNoRows {
+		return nil, &FormError{Message: "Folder not found", Code: http.StatusNotFound}
+	}
+	return folderID, err
+}
+
+// checkFolderName checks the name of a new or renamed folder
+func checkFolderName(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > maxFolderName {
+		return &FormError{Message: fmt.Sprintf("A folder name is 1 to %d characters", maxFolderName), Code: http.StatusBadRequest}
+	}
+	return nil
+}
+
+// Bookmarks shows the bookmarks of the user, /bookmarks?folder={id} shows
+// one folder and folder=none the bookmarks in no folder
+func (h *Handler) Bookmarks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	folder := r.URL.Query().Get("folder")
+	if folder != "" && folder != "none" {
+		if _, err := strconv.ParseInt(folder, 10, 64); err != nil {
+			h.ErrorHandler(w, r, "Invalid folder", http.StatusBadRequest)
+			return
+		}
+	}
+
+	folders, err := h.getBookmarkFolders(user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting bookmark folders", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	for i := range folders {
+		folders[i].Selected = strconv.FormatInt(folders[i].ID, 10) == folder
+	}
+	bookmarks, err := h.getBookmarks(user.ID, folder)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting bookmarks", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	data := TemplateData{
+		Title:     "Bookmarks",
+		User:      user,
+		Bookmarks: bookmarks,
+		Folders:   folders,
+		Folder:    folder,
+	}
+	if err := h.render(w, r, "bookmarks.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// BookmarksExport downloads all of the user's bookmarks as JSON
+func (h *Handler) BookmarksExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	folders, err := h.getBookmarkFolders(user.ID)
+	var bookmarks []Bookmark
+	if err == nil {
+		bookmarks, err = h.getBookmarks(user.ID, "")
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error exporting bookmarks", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	names := make([]string, len(folders))
+	for i, f := range folders {
+		names[i] = f.Name
+	}
+	export := struct {
+		ExportedAt time.Time  `json:"exported_at"`
+		Folders    []string   `json:"folders"`
+		Bookmarks  []Bookmark `json:"bookmarks"`
+	}{time.Now().In(h.location), names, bookmarks}
+	if export.Bookmarks == nil {
+		export.Bookmarks = []Bookmark{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="bookmarks.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		LogFrom(r.Context()).Error("Error writing bookmarks", "err", err)
+	}
+}
+
+// BookmarkAPI changes the bookmarks and the folders from the forms of the post
+// and the bookmarks pages. The actions are add (post_id, comment_id, folder_id,
+// note), update (id, folder_id, note), remove (id, or post_id and
+// comment_id), create_folder (name), rename_folder (id, name) and
+// delete_folder (id), which leaves its bookmarks in no folder. The form goes
+// back to the post of post_id or to the bookmarks.
+func (h *Handler) BookmarkAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	redirect := "/bookmarks"
+	if folder := r.FormValue("return_folder"); folder != "" {
+		redirect += "?folder=" + url.QueryEscape(folder)
+	}
+	note := strings.TrimSpace(r.FormValue("note"))
+	if utf8.RuneCountInString(note) > maxBookmarkNote {
+		h.ErrorHandler(w, r, fmt.Sprintf("A note can be at most %d characters", maxBookmarkNote), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch action := r.FormValue("action"); action {
+	case "add", "remove":
+		if action == "remove" && r.FormValue("id") != "" {
+			_, err = h.db.Exec("DELETE FROM bookmarks WHERE id = ? AND user_id = ?", r.FormValue("id"), user.ID)
+			break
+		}
+		postID, _ := strconv.ParseInt(r.FormValue("post_id"), 10, 64)
+		commentID, _ := strconv.ParseInt(r.FormValue("comment_id"), 10, 64)
+		redirect = "/post/" + strconv.FormatInt(postID, 10)
+		if commentID != 0 {
+			redirect += "#comment-" + strconv.FormatInt(commentID, 10)
+		}
+		if action == "remove" {
+			_, err = h.db.Exec("DELETE FROM bookmarks WHERE user_id = ? AND post_id = ? AND comment_id = ?", user.ID, postID, commentID)
+			break
+		}
+		var exists bool
+		if commentID == 0 {
+			err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = ?)", postID).Scan(&exists)
+		} else {
+			err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM comments WHERE id = ? AND post_id = ?)", commentID, postID).Scan(&exists)
+		}
+		if err == nil && !exists {
+			err = &FormError{Message: "Post or comment not found", Code: http.StatusNotFound}
+		}
+		var folderID interface{}
+		if err == nil {
+			folderID, err = h.folderOf(user.ID, r.FormValue("folder_id"))
+		}
+		if err == nil {
+			_, err = h.db.Exec(`
+				INSERT INTO bookmarks (user_id, post_id, comment_id, folder_id, note) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (user_id, post_id, comment_id) DO UPDATE SET folder_id = excluded.folder_id, note = excluded.note
+			`, user.ID, postID, commentID, folderID, note)
+		}
+
+	case "update":
+		var folderID interface{}
+		folderID, err = h.folderOf(user.ID, r.FormValue("folder_id"))
+		if err == nil {
+			_, err = h.db.Exec("UPDATE bookmarks SET folder_id = ?, note = ? WHERE id = ? AND user_id = ?",
+				folderID, note, r.FormValue("id"), user.ID)
+		}
+
+	case "create_folder":
+		name := strings.TrimSpace(r.FormValue("name"))
+		var count int
+		err = checkFolderName(name)
+		if err == nil {
+			err = h.db.QueryRow("SELECT COUNT(*) FROM bookmark_folders WHERE user_id = ?", user.ID).Scan(&count)
+		}
+		if err == nil && count >= maxFolders {
+			err = &FormError{Message: fmt.Sprintf("You can have at most %d folders", maxFolders), Code: http.StatusBadRequest}
+		}
+		if err == nil {
+			_, err = h.db.Exec("INSERT OR IGNORE INTO bookmark_folders (user_id, name) VALUES (?, ?)", user.ID, name)
+		}
+
+	case "rename_folder":
+		name := strings.TrimSpace(r.FormValue("name"))
+		err = checkFolderName(name)
+		if err == nil {
+			_, err = h.db.Exec("UPDATE OR IGNORE bookmark_folders SET name = ? WHERE id = ? AND user_id = ?", name, r.FormValue("id"), user.ID)
+		}
+
+	case "delete_folder":
+		var folderID interface{}
+		folderID, err = h.folderOf(user.ID, r.FormValue("id"))
+		if err == nil && folderID != nil {
+			_, err = h.db.Exec("UPDATE bookmarks SET folder_id = NULL WHERE folder_id = ? AND user_id = ?", folderID, user.ID)
+			if err == nil {
+				_, err = h.db.Exec("DELETE FROM bookmark_folders WHERE id = ?", folderID)
+			}
+		}
+		redirect = "/bookmarks"
+
+	default:
+		h.ErrorHandler(w, r, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		var formErr *FormError
+		if errors.As(err, &formErr) {
+			h.ErrorHandler(w, r, formErr.Message, formErr.Code)
+			return
+		}
+		LogFrom(r.Context()).Error("Error changing bookmarks", "action", r.FormValue("action"), "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBookmarkOwnership(t *testing.T) {
+	h := newTestHandler(t)
+	anna := addUser(t, h, "anna")
+	bob := addUser(t, h, "bob")
+	postID := addPost(t, h, anna, PostTypePost, time.Now())
+	otherPost := addPost(t, h, anna, PostTypePost, time.Now())
+	commentID := addComment(t, h, anna, postID, time.Now())
+	folderID := exec(t, h.db, "INSERT INTO bookmark_folders (user_id, name) VALUES (?, 'Boats')", anna)
+	bookmarkID := exec(t, h.db, "INSERT INTO bookmarks (user_id, post_id, folder_id, note) VALUES (?, ?, ?, 'mine')", anna, postID, folderID)
+	cookies := map[int64]*http.Cookie{anna: addSession(t, h, anna), bob: addSession(t, h, bob)}
+
+	id := func(n int64) string { return strconv.FormatInt(n, 10) }
+	tests := []struct {
+		name   string
+		userID int64
+		form   url.Values
+		want   int
+	}{
+		//the changes to someone else's bookmarks and folders do nothing
+		{"update another's bookmark", bob, url.Values{"action": {"update"}, "id": {id(bookmarkID)}, "note": {"bob's"}}, http.StatusSeeOther},
+		{"remove another's bookmark", bob, url.Values{"action": {"remove"}, "id": {id(bookmarkID)}}, http.StatusSeeOther},
+		{"rename another's folder", bob, url.Values{"action": {"rename_folder"}, "id": {id(folderID)}, "name": {"Mine"}}, http.StatusSeeOther},
+		//and the ones that would use them are refused
+		{"add to another's folder", bob, url.Values{"action": {"add"}, "post_id": {id(postID)}, "folder_id": {id(folderID)}}, http.StatusNotFound},
+		{"move to another's folder", bob, url.Values{"action": {"update"}, "id": {id(bookmarkID)}, "folder_id": {id(folderID)}}, http.StatusNotFound},
+		{"delete another's folder", bob, url.Values{"action": {"delete_folder"}, "id": {id(folderID)}}, http.StatusNotFound},
+		{"a comment of another post", bob, url.Values{"action": {"add"}, "post_id": {id(otherPost)}, "comment_id": {id(commentID)}}, http.StatusNotFound},
+		{"a missing post", bob, url.Values{"action": {"add"}, "post_id": {"999"}}, http.StatusNotFound},
+		{"the same post for oneself", bob, url.Values{"action": {"add"}, "post_id": {id(postID)}, "note": {"bob's"}}, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		if code := formRequest(h.BookmarkAPI, cookies[tt.userID], "POST", "/bookmarks/api", tt.form); code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+
+	//anna's bookmark and folder are as they were
+	bookmarks, err := h.getBookmarks(anna, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmarks) != 1 || bookmarks[0].Note != "mine" || bookmarks[0].FolderID != folderID || bookmarks[0].Folder != "Boats" {
+		t.Errorf("anna's bookmarks are %+v", bookmarks)
+	}
+	if folders, err := h.getBookmarkFolders(bob); err != nil || len(folders) != 0 {
+		t.Errorf("bob's folders are %+v, %v", folders, err)
+	}
+	if bookmarks, err := h.getBookmarks(bob, ""); err != nil || len(bookmarks) != 1 || bookmarks[0].Note != "bob's" {
+		t.Errorf("bob's bookmarks are %+v, %v", bookmarks, err)
+	}
+
+	//deleting the folder keeps its bookmarks without a folder
+	form := url.Values{"action": {"delete_folder"}, "id": {id(folderID)}}
+	if code := formRequest(h.BookmarkAPI, cookies[anna], "POST", "/bookmarks/api", form); code != http.StatusSeeOther {
+		t.Fatalf("deleting the folder: status %d", code)
+	}
+	if bookmarks, err := h.getBookmarks(anna, "none"); err != nil || len(bookmarks) != 1 {
+		t.Errorf("anna's bookmarks without a folder are %+v, %v", bookmarks, err)
+	}
+}
+
+func TestBookmarksExport(t *testing.T) {
+	h := newTestHandler(t)
+	anna := addUser(t, h, "anna")
+	bob := addUser(t, h, "bob")
+	postID := addPost(t, h, anna, PostTypePost, time.Now())
+	exec(t, h.db, "INSERT INTO bookmark_folders (user_id, name) VALUES (?, 'Anna''s')", anna)
+	exec(t, h.db, "INSERT INTO bookmarks (user_id, post_id, note) VALUES (?, ?, 'anna''s')", anna, postID)
+	exec(t, h.db, "INSERT INTO bookmarks (user_id, post_id, note) VALUES (?, ?, 'bob''s')", bob, postID)
+
+	r := httptest.NewRequest("GET", "/bookmarks/export", nil)
+	r.AddCookie(addSession(t, h, bob))
+	w := httptest.NewRecorder()
+	h.BookmarksExport(w, r)
+	var export struct {
+		Folders   []string   `json:"folders"`
+		Bookmarks []Bookmark `json:"bookmarks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&export); err != nil {
+		t.Fatalf("status %d: %v", w.Code, err)
+	}
+	if len(export.Folders) != 0 || len(export.Bookmarks) != 1 || export.Bookmarks[0].Note != "bob's" {
+		t.Errorf("bob's export has %+v", export)
+	}
+}
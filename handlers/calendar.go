@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// how many events the upcoming events sidebar shows
+const upcomingEventsLimit = 5
+
+// CalendarDay is one day of the calendar view
+type CalendarDay struct {
+	Date    time.Time
+	Outside bool //the day belongs to the previous or the next month
+	Today   bool
+	Events  []Post
+}
+
+// Calendar is the month or the week shown on the events page
+type Calendar struct {
+	View  string //"month" or "week"
+	Title string
+	Date  string //the day the view is around, as 2006-01-02
+	Prev  string
+	Next  string
+	Weeks [][]CalendarDay
+}
+
+// startOfWeek returns the Monday of the week of the day
+func startOfWeek(day time.Time) time.Time {
+	offset := (int(day.Weekday()) + 6) % 7
+	return time.Date(day.Year(), day.Month(), day.Day()-offset, 0, 0, 0, 0, day.Location())
+}
+
+// buildCalendar lays out the days of the month or the week of the date and
+// returns the time range it covers
+func buildCalendar(view string, date time.Time) (*Calendar, time.Time, time.Time) {
+	loc := date.Location()
+	cal := &Calendar{View: view, Date: date.Format("2006-01-02")}
+
+	var first time.Time
+	var days int
+	if view == "week" {
+		first = startOfWeek(date)
+		days = 7
+		year, week := first.ISOWeek()
+		cal.Title = "Week " + strconv.Itoa(week) + ", " + strconv.Itoa(year)
+		cal.Prev = first.AddDate(0, 0, -7).Format("2006-01-02")
+		cal.Next = first.AddDate(0, 0, 7).Format("2006-01-02")
+	} else {
+		month := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, loc)
+		first = startOfWeek(month)
+		last := month.AddDate(0, 1, -1)
+		//the grid runs to the Sunday after the last day of the month, the days
+		//are counted in UTC so a daylight saving change doesn't cut a day short
+		days = int(time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, time.UTC).
+			Sub(time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)).Hours()/24) + 1
+		days = (days + 6) / 7 * 7
+		cal.Title = month.Format("January 2006")
+		cal.Prev = month.AddDate(0, -1, 0).Format("2006-01-02")
+		cal.Next = month.AddDate(0, 1, 0).Format("2006-01-02")
+	}
+
+	now := time.Now().In(loc)
+	var week []CalendarDay
+	for i := 0; i < days; i++ {
+		//time.Date keeps the days at midnight over the daylight saving changes
+		day := time.Date(first.Year(), first.Month(), first.Day()+i, 0, 0, 0, 0, loc)
+		week = append(week, CalendarDay{
+			Date:    day,
+			Outside: view != "week" && day.Month() != date.Month(),
+			Today:   day.Year() == now.Year() && day.YearDay() == now.YearDay(),
+		})
+		if len(week) == 7 {
+			cal.Weeks = append(cal.Weeks, week)
+			week = nil
+		}
+	}
+	end := time.Date(first.Year(), first.Month(), first.Day()+days, 0, 0, 0, 0, loc)
+	return cal, first, end
+}
+
+// addEvents puts the events on every day they are on
+func (cal *Calendar) addEvents(events []Post) {
+	for w := range cal.Weeks {
+		for d := range cal.Weeks[w] {
+			day := &cal.Weeks[w][d]
+			dayEnd := day.Date.AddDate(0, 0, 1)
+			for _, p := range events {
+				if p.Event == nil {
+					continue
+				}
+				if p.Event.StartsAt.Before(dayEnd) && !p.Event.EndsAt.Before(day.Date) {
+					day.Events = append(day.Events, p)
+				}
+			}
+		}
+	}
+}
+
+// EventsCalendar shows the events of a month, or of a week with
+// /events?view=week. ?date=2006-01-02 picks the month or the week.
+func (h *Handler) EventsCalendar(w http.ResponseWriter, r *http.Request) {
+	user := h.GetSessionUser(w, r)
+
+	view := r.URL.Query().Get("view")
+	if view != "week" {
+		view = "month"
+	}
+	date := time.Now().In(h.location)
+	if value := r.URL.Query().Get("date"); value != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", value, h.location)
+		if err != nil {
+			h.ErrorHandler(w, r, "Invalid date", http.StatusBadRequest)
+			return
+		}
+		date = parsed
+	}
+
+	cal, from, to := buildCalendar(view, date)
+	events, err := h.getEventPosts(from, to, 1000)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting events", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	cal.addEvents(events)
+
+	upcoming, err := h.upcomingEvents(upcomingEventsLimit)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting events", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	data := TemplateData{
+		Title:          "Events",
+		User:           user,
+		Calendar:       cal,
+		UpcomingEvents: upcoming,
+	}
+	if err := h.render(w, r, "events.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
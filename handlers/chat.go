@@ -0,0 +1,535 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	chatMaxLength    = 1000             //the longest chat message in characters
+	chatMaxFrame     = 16 << 10         //the largest WebSocket message a client can send
+	chatHistory      = 50               //how many messages the history sends at a time
+	chatSendBuffer   = 64               //how many messages a client can fall behind before it is dropped
+	chatPongWait     = 60 * time.Second //a client that doesn't answer the pings in time is gone
+	chatPingInterval = 50 * time.Second
+	chatBurst        = 5               //messages a user can send at once
+	chatRefill       = 2 * time.Second //then one more message every refill
+	chatTypingEvery  = 2 * time.Second //the typing indicator is passed on at most this often
+	chatMaxMute      = 7 * 24 * 60     //the longest mute in minutes
+)
+
+// ChatMessage is a message of a category's chat room
+type ChatMessage struct {
+	ID        int64  `json:"id"`
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"created_at"`
+}
+
+// chatEvent is what goes over the socket both ways. The clients send
+// "message" with content, "typing", "history" with before, and the
+// moderators "delete" with id and "mute" with user_id and minutes.
+type chatEvent struct {
+	Type     string        `json:"type"`
+	Content  string        `json:"content,omitempty"`
+	Before   int64         `json:"before,omitempty"`
+	ID       int64         `json:"id,omitempty"`
+	UserID   int64         `json:"user_id,omitempty"`
+	Minutes  int           `json:"minutes,omitempty"`
+	Username string        `json:"username,omitempty"`
+	Message  *ChatMessage  `json:"message,omitempty"`
+	Messages []ChatMessage `json:"messages,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Until    string        `json:"until,omitempty"`
+}
+
+// chatClient is one open chat connection. The handler goroutine reads it and
+// a writer goroutine sends what is queued in send.
+type chatClient struct {
+	conn       *wsConn
+	user       *User
+	categoryID int64
+	send       chan []byte //closed when the client leaves the hub
+	closeCode  int         //the close code the writer sends when send is closed
+
+	tokens     float64 //the rate limit of the messages
+	refilledAt time.Time
+	typingAt   time.Time
+}
+
+// allow takes a token of the rate limit, the tokens refill over time up to chatBurst
+func (c *chatClient) allow(now time.Time) bool {
+	c.tokens += float64(now.Sub(c.refilledAt)) / float64(chatRefill)
+	if c.tokens > chatBurst {
+		c.tokens = chatBurst
+	}
+	c.refilledAt = now
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// ChatHub keeps the clients of every chat room and passes the messages to
+// them. Every client has its own writer goroutine, the hub never waits for a
+// slow client: it is dropped when its buffer fills up.
+type ChatHub struct {
+	mu     sync.Mutex
+	rooms  map[int64]map[*chatClient]bool
+	closed bool
+}
+
+func NewChatHub() *ChatHub {
+	return &ChatHub{rooms: make(map[int64]map[*chatClient]bool)}
+}
+
+// join adds the client to its room, false when the hub has been closed
+func (hub *ChatHub) join(c *chatClient) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return false
+	}
+	room := hub.rooms[c.categoryID]
+	if room == nil {
+		room = make(map[*chatClient]bool)
+		hub.rooms[c.categoryID] = room
+	}
+	room[c] = true
+	chatClients.Add(1)
+	return true
+}
+
+// leave removes the client, its writer sends a close frame with the code
+func (hub *ChatHub) leave(c *chatClient, code int) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.remove(c, code)
+}
+
+// remove takes the client out of its room, the caller holds the lock
+func (hub *ChatHub) remove(c *chatClient, code int) {
+	room := hub.rooms[c.categoryID]
+	if !room[c] {
+		return
+	}
+	delete(room, c)
+	if len(room) == 0 {
+		delete(hub.rooms, c.categoryID)
+	}
+	c.closeCode = code
+	close(c.send)
+	chatClients.Add(-1)
+}
+
+// broadcast sends the event to the clients of the room. skip, when set,
+// doesn't get it, and only tells if a client is of that user.
+func (hub *ChatHub) broadcast(categoryID int64, event *chatEvent, skip func(*chatClient) bool) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding chat event", "err", err)
+		return
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for c := range hub.rooms[categoryID] {
+		if skip != nil && skip(c) {
+			continue
+		}
+		select {
+		case c.send <- data:
+		default:
+			hub.remove(c, wsPolicyViolation)
+		}
+	}
+}
+
+// Close disconnects every client, the writers send them a going away close
+// frame. The clients reconnect when the server is back.
+func (hub *ChatHub) Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.closed = true
+	for _, room := range hub.rooms {
+		for c := range room {
+			hub.remove(c, wsGoingAway)
+		}
+	}
+}
+
+// CloseChat ends the chat connections on shutdown
+func (h *Handler) CloseChat() {
+	h.chat.Close()
+}
+
+// sendTo queues an event for the client alone
+func (hub *ChatHub) sendTo(c *chatClient, event *chatEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding chat event", "err", err)
+		return
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if !hub.rooms[c.categoryID][c] {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		hub.remove(c, wsPolicyViolation)
+	}
+}
+
+// writeLoop sends the queued messages and the pings until the client leaves
+func (c *chatClient) writeLoop() {
+	ping := time.NewTicker(chatPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case data, ok := <-c.send:
+			if !ok {
+				c.conn.Close(c.closeCode, "")
+				return
+			}
+			if err := c.conn.WriteText(data); err != nil {
+				c.conn.Close(wsGoingAway, "")
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.Ping(); err != nil {
+				c.conn.Close(wsGoingAway, "")
+				return
+			}
+		}
+	}
+}
+
+// getChatHistory returns the messages of the room before the ID, or the
+// latest ones when before is 0, oldest first
+func (h *Handler) getChatHistory(categoryID, before int64) ([]ChatMessage, error) {
+	if before == 0 {
+		before = 1<<63 - 1
+	}
+	done := observeQuery("chat_history")
+	rows, err := h.db.Query(`
+		SELECT id, user_id, username, content, created_at
+		FROM chat_messages
+		WHERE category_id = ? AND id < ? AND deleted_at IS NULL
+		ORDER BY id DESC
+		LIMIT ?
+	`, categoryID, before, chatHistory)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []ChatMessage
+	for rows.Next() {
+		var m ChatMessage
+		var createdAt time.Time
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Username, &m.Content, &createdAt); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = createdAt.In(h.location).Format("02 Jan 2006 15:04")
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// mutedUntil returns when the mute of the user in the room ends, zero when
+// the user isn't muted
+func (h *Handler) mutedUntil(categoryID, userID int64) (time.Time, error) {
+	var until time.Time
+	err := h.db.QueryRow(`
+		SELECT muted_until FROM chat_mutes WHERE category_id = ? AND user_id = ? AND muted_until > ?
+	`, categoryID, userID, time.Now().UTC()).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until, err
+}
+
+// errChat is an error the client is told about, the connection stays open
+type errChat string
+
+func (e errChat) Error() string { return string(e) }
+
+// chatCategory returns the name of the category and if it is archived
+func (h *Handler) chatCategory(categoryID int64) (string, bool, error) {
+	var name string
+	var archived bool
+	err := h.db.QueryRow("SELECT name, archived_at IS NOT NULL FROM categories WHERE id = ?", categoryID).
+		Scan(&name, &archived)
+	return name, archived, err
+}
+
+// Chat shows the chat room of a category, /chat/{id}, and connects its
+// WebSocket, /chat/{id}/ws. Only the logged in users can chat.
+func (h *Handler) Chat(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/chat/")
+	id, socket := strings.CutSuffix(path, "/ws")
+	categoryID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+	name, archived, err := h.chatCategory(categoryID)
+	if err == sql.ErrNoRows {
+		h.ErrorHandler(w, r, "Category not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		if socket {
+			h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if socket {
+		h.chatSocket(w, r, user, categoryID, archived)
+		return
+	}
+
+	data := TemplateData{
+		Title:    name + " chat",
+		User:     user,
+		Category: &Category{ID: categoryID, Name: name, Archived: archived},
+	}
+	if err := h.render(w, r, "chat.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// chatSocket upgrades the connection and reads the client until it leaves
+func (h *Handler) chatSocket(w http.ResponseWriter, r *http.Request, user *User, categoryID int64, archived bool) {
+	conn, err := upgradeWebSocket(w, r, chatMaxFrame)
+	if err != nil {
+		LogFrom(r.Context()).Warn("WebSocket upgrade failed", "err", err)
+		return
+	}
+	c := &chatClient{
+		conn:       conn,
+		user:       user,
+		categoryID: categoryID,
+		send:       make(chan []byte, chatSendBuffer),
+		tokens:     chatBurst,
+		refilledAt: time.Now(),
+	}
+	if !h.chat.join(c) {
+		conn.Close(wsGoingAway, "server shutting down")
+		return
+	}
+	go c.writeLoop()
+	LogFrom(r.Context()).Info("Chat joined", "category_id", categoryID, "user_id", user.ID)
+
+	history, err := h.getChatHistory(categoryID, 0)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting chat history", "err", err)
+		h.chat.leave(c, wsGoingAway)
+		return
+	}
+	h.chat.sendTo(c, &chatEvent{Type: "history", Messages: history})
+
+	code := wsNormalClosure
+	for {
+		conn.SetReadDeadline(time.Now().Add(chatPongWait))
+		data, err := conn.ReadMessage(func() {
+			conn.SetReadDeadline(time.Now().Add(chatPongWait))
+		})
+		if err != nil {
+			var closeErr *wsCloseError
+			if errors.As(err, &closeErr) {
+				code = closeErr.Code
+			}
+			break
+		}
+
+		var event chatEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			h.chat.sendTo(c, &chatEvent{Type: "error", Error: "Invalid message"})
+			continue
+		}
+		if err := h.handleChatEvent(r, c, &event, archived); err != nil {
+			var chatErr errChat
+			if errors.As(err, &chatErr) {
+				h.chat.sendTo(c, &chatEvent{Type: "error", Error: chatErr.Error()})
+				continue
+			}
+			LogFrom(r.Context()).Error("Chat error", "type", event.Type, "err", err)
+			h.chat.sendTo(c, &chatEvent{Type: "error", Error: "Something went wrong. Please try again later."})
+		}
+	}
+	h.chat.leave(c, code)
+}
+
+// handleChatEvent acts on one event of the client
+func (h *Handler) handleChatEvent(r *http.Request, c *chatClient, event *chatEvent, archived bool) error {
+	switch event.Type {
+	case "message":
+		return h.chatMessage(c, event.Content, archived)
+
+	case "typing":
+		now := time.Now()
+		if now.Sub(c.typingAt) < chatTypingEvery {
+			return nil
+		}
+		c.typingAt = now
+		h.chat.broadcast(c.categoryID, &chatEvent{Type: "typing", Username: c.user.Username}, func(other *chatClient) bool {
+			return other == c
+		})
+		return nil
+
+	case "history":
+		history, err := h.getChatHistory(c.categoryID, event.Before)
+		if err != nil {
+			return err
+		}
+		h.chat.sendTo(c, &chatEvent{Type: "history", Before: event.Before, Messages: history})
+		return nil
+
+	case "delete":
+		if !c.user.IsAdmin {
+			return errChat("Only the moderators can delete messages")
+		}
+		result, err := h.db.Exec(`
+			UPDATE chat_messages SET deleted_at = CURRENT_TIMESTAMP, deleted_by = ?
+			WHERE id = ? AND category_id = ? AND deleted_at IS NULL
+		`, c.user.ID, event.ID, c.categoryID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return errChat("Message not found")
+		}
+		LogFrom(r.Context()).Info("Chat message deleted", "message_id", event.ID, "user_id", c.user.ID)
+		h.chat.broadcast(c.categoryID, &chatEvent{Type: "deleted", ID: event.ID}, nil)
+		return nil
+
+	case "mute":
+		if !c.user.IsAdmin {
+			return errChat("Only the moderators can mute users")
+		}
+		return h.chatMute(r, c, event.UserID, event.Minutes)
+	}
+	return errChat("Unknown message type")
+}
+
+// chatMessage saves the message and sends it to the room
+func (h *Handler) chatMessage(c *chatClient, content string, archived bool) error {
+	content = strings.TrimSpace(content)
+	switch {
+	case archived:
+		return errChat("This category is archived, its chat is read-only")
+	case content == "":
+		return nil
+	case utf8.RuneCountInString(content) > chatMaxLength:
+		return errChat(fmt.Sprintf("A message can be at most %d characters", chatMaxLength))
+	case !c.allow(time.Now()):
+		return errChat("You are sending messages too fast, wait a moment")
+	}
+	until, err := h.mutedUntil(c.categoryID, c.user.ID)
+	if err != nil {
+		return err
+	}
+	if !until.IsZero() {
+		return errChat("You are muted in this chat until " + until.In(h.location).Format("02 Jan 2006 15:04"))
+	}
+
+	now := time.Now().UTC()
+	done := observeQuery("create_chat_message")
+	result, err := h.db.Exec(`
+		INSERT INTO chat_messages (category_id, user_id, username, content, created_at) VALUES (?, ?, ?, ?, ?)
+	`, c.categoryID, c.user.ID, c.user.Username, content, now)
+	done()
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	chatMessages.Inc()
+	h.chat.broadcast(c.categoryID, &chatEvent{Type: "message", Message: &ChatMessage{
+		ID:        id,
+		UserID:    c.user.ID,
+		Username:  c.user.Username,
+		Content:   content,
+		CreatedAt: now.In(h.location).Format("02 Jan 2006 15:04"),
+	}}, nil)
+	return nil
+}
+
+// chatMute mutes the user in the room for the minutes, 0 lifts the mute
+func (h *Handler) chatMute(r *http.Request, c *chatClient, userID int64, minutes int) error {
+	if minutes < 0 || minutes > chatMaxMute {
+		return errChat("A mute can be at most a week")
+	}
+	var username string
+	err := h.db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	if err == sql.ErrNoRows {
+		return errChat("User not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	until := time.Now().UTC().Add(time.Duration(minutes) * time.Minute)
+	if minutes == 0 {
+		_, err = h.db.Exec("DELETE FROM chat_mutes WHERE category_id = ? AND user_id = ?", c.categoryID, userID)
+	} else {
+		_, err = h.db.Exec(`
+			INSERT INTO chat_mutes (category_id, user_id, muted_until, muted_by) VALUES (?, ?, ?, ?)
+			ON CONFLICT (category_id, user_id) DO UPDATE SET muted_until = excluded.muted_until, muted_by = excluded.muted_by
+		`, c.categoryID, userID, until, c.user.ID)
+	}
+	if err != nil {
+		return err
+	}
+	LogFrom(r.Context()).Info("Chat mute", "category_id", c.categoryID, "muted_user_id", userID,
+		"minutes", minutes, "user_id", c.user.ID)
+
+	event := &chatEvent{Type: "muted", UserID: userID, Username: username}
+	if minutes > 0 {
+		event.Until = until.In(h.location).Format("02 Jan 2006 15:04")
+		name, _, err := h.chatCategory(c.categoryID)
+		if err != nil {
+			return err
+		}
+		h.notify(r.Context(), Notification{
+			UserID:  userID,
+			ActorID: c.user.ID,
+			Type:    NotifyModeration,
+			Message: fmt.Sprintf("A moderator muted you in the %s chat until %s", name, event.Until),
+		})
+	}
+	h.chat.broadcast(c.categoryID, event, nil)
+	return nil
+}
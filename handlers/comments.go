@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -11,20 +10,20 @@ import (
 func (h *Handler) AddComment(w http.ResponseWriter, r *http.Request) {
 	// Check method
 	if r.Method != http.MethodPost {
-		h.ErrorHandler(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Check authentication
 	user := h.GetSessionUser(w, r)
-	if user == nil {
-		h.ErrorHandler(w, "Unauthorized", http.StatusUnauthorized)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Parse form
 	if err := r.ParseForm(); err != nil {
-		h.ErrorHandler(w, "Failed to parse form", http.StatusBadRequest)
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
@@ -34,27 +33,41 @@ func (h *Handler) AddComment(w http.ResponseWriter, r *http.Request) {
 
 	// Check if comment is not empty
 	if content == "" {
-		h.ErrorHandler(w, "Comment cannot be empty", http.StatusBadRequest)
+		h.ErrorHandler(w, r, "Comment cannot be empty", http.StatusBadRequest)
 		return
 	}
 
 	// Check if postID is a valid number
 	pid, err := strconv.ParseInt(postID, 10, 64)
 	if err != nil {
-		h.ErrorHandler(w, "Invalid post ID", http.StatusBadRequest)
+		h.ErrorHandler(w, r, "Invalid post ID", http.StatusBadRequest)
 		return
 	}
 
 	// Check if post exists in the db
 	var exists bool
+	done := observeQuery("post_exists")
 	err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = ?)", pid).Scan(&exists)
+	done()
 	if err != nil {
-		log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 	if !exists {
-		h.ErrorHandler(w, "Post not found", http.StatusNotFound)
+		h.ErrorHandler(w, r, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	// Check if the post is in an archived category
+	readOnly, err := h.isPostReadOnly(pid)
+	if err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if readOnly {
+		h.ErrorHandler(w, r, "This post is archived", http.StatusForbidden)
 		return
 	}
 
@@ -64,36 +77,40 @@ func (h *Handler) AddComment(w http.ResponseWriter, r *http.Request) {
 	// Start transaction
 	tx, err := h.db.Begin()
 	if err != nil {
-		log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 	defer tx.Rollback()
 
 	//inserting the comment into the database
+	done = observeQuery("create_comment")
 	result, err := tx.Exec(`
 		INSERT INTO comments (post_id, user_id, content, username, created_at)
 		VALUES (?, ?, ?, ?, ?)
 	`, pid, user.ID, content, user.Username, now)
+	done()
 
 	if err != nil {
-		log.Printf("Error creating comment: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Error creating comment", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
 	//committing the transaction
 	if err := tx.Commit(); err != nil {
-		log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
+	commentsCreated.Inc()
+
 	//getting the ID of the comment
 	commentID, err := result.LastInsertId()
 	if err != nil {
-		log.Printf("Error creating comment: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Error creating comment", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
@@ -101,23 +118,29 @@ func (h *Handler) AddComment(w http.ResponseWriter, r *http.Request) {
 	var count int
 	err = h.db.QueryRow("SELECT COUNT(*) FROM comments WHERE id = ?", commentID).Scan(&count)
 	if err != nil {
-		log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
 	if count == 0 {
-		log.Printf("Failed to create comment: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Failed to create comment", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
+	if err := h.notifyComment(r.Context(), user, pid, commentID, content); err != nil {
+		LogFrom(r.Context()).Error("Error sending notifications", "comment_id", commentID, "err", err)
+	}
+	h.publishComment(pid, commentID, user.Username, content, now)
+
 	//redirecting the user back to the post page
 	http.Redirect(w, r, "/post/"+postID, http.StatusSeeOther)
 }
 
 // Add a new method to get comments
 func (h *Handler) getComments(postID int64) ([]*Comment, error) {
+	done := observeQuery("get_comments")
 	rows, err := h.db.Query(`
 		SELECT c.id, c.user_id, c.content, c.created_at, c.username,
 		COUNT(CASE WHEN r.type = 'like' THEN 1 END) as likes,
@@ -128,6 +151,7 @@ func (h *Handler) getComments(postID int64) ([]*Comment, error) {
 		GROUP BY c.id, c.user_id, c.content, c.created_at, c.username
 		ORDER BY c.created_at DESC
 	`, postID)
+	done()
 
 	if err != nil {
 		return nil, err
@@ -5,23 +5,41 @@ import (
 	"os"
 )
 
-func InitDB()(*sql.DB, error) {
-	// Open the database
-	db, err := sql.Open("sqlite3", "./database/forum.db")
+func InitDB(dbPath, schemaPath, migrationsDir string) (*sql.DB, error) {
+	// Open the database in WAL mode, so readers don't block the writer
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
 	if err != nil {
 		return nil, err
-}
+	}
 
 	//read the schema from the file
-	schema, err := os.ReadFile("database/schema.sql")
+	schema, err := os.ReadFile(schemaPath)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	//filling the database with the schema
 	_, err = db.Exec(string(schema))
 	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	//bringing the database up to date with the newest migrations
+	if err := Migrate(db, migrationsDir); err != nil {
+		db.Close()
 		return nil, err
 	}
 	return db, nil
 }
+
+// CloseDB writes everything from the WAL file back into the main database file
+// and closes the connection, so the database is left in a clean state
+func CloseDB(db *sql.DB) error {
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
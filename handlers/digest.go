@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many top posts of each followed category the digest lists
+const digestPostsLimit = 5
+
+// the digest is sent daily or weekly, or not at all
+var DigestFrequencies = []string{"daily", "weekly"}
+
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// isFollowing tells if the user follows the category
+func (h *Handler) isFollowing(userID, categoryID int64) (bool, error) {
+	var following bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM category_follows WHERE user_id = ? AND category_id = ?)
+	`, userID, categoryID).Scan(&following)
+	return following, err
+}
+
+// getFollowedCategories returns the categories the user follows by name
+func (h *Handler) getFollowedCategories(userID int64) ([]Category, error) {
+	rows, err := h.db.Query(`
+		SELECT c.id, c.name FROM category_follows f JOIN categories c ON c.id = f.category_id
+		WHERE f.user_id = ?
+		ORDER BY c.name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// FollowCategory follows the category, or with action=unfollow stops
+// following it. The digest lists the top posts of the followed categories.
+func (h *Handler) FollowCategory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	categoryID, err := strconv.ParseInt(r.FormValue("category_id"), 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", categoryID).Scan(&exists)
+	if err == nil && !exists {
+		h.ErrorHandler(w, r, "Category not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		if r.FormValue("action") == "unfollow" {
+			_, err = h.db.Exec("DELETE FROM category_follows WHERE user_id = ? AND category_id = ?", user.ID, categoryID)
+		} else {
+			_, err = h.db.Exec("INSERT OR IGNORE INTO category_follows (user_id, category_id) VALUES (?, ?)", user.ID, categoryID)
+		}
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error following category", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/category/"+strconv.FormatInt(categoryID, 10), http.StatusSeeOther)
+}
+
+// getDigestFrequency returns "daily", "weekly" or "" when the user gets no digest
+func (h *Handler) getDigestFrequency(userID int64) (string, error) {
+	var frequency string
+	err := h.db.QueryRow("SELECT frequency FROM digest_subscriptions WHERE user_id = ?", userID).Scan(&frequency)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return frequency, err
+}
+
+// saveDigestFrequency turns the digest on or off. The first digest of a new
+// subscription covers the posts from the subscription on.
+func (h *Handler) saveDigestFrequency(userID int64, frequency string) error {
+	if !contains(DigestFrequencies, frequency) {
+		_, err := h.db.Exec("DELETE FROM digest_subscriptions WHERE user_id = ?", userID)
+		return err
+	}
+	_, err := h.db.Exec(`
+		INSERT INTO digest_subscriptions (user_id, frequency, last_sent_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET frequency = excluded.frequency
+	`, userID, frequency, time.Now().UTC())
+	return err
+}
+
+// digestPosts returns the most liked and commented posts of the category and
+// its subcategories since the time
+func (h *Handler) digestPosts(ctx context.Context, categoryID int64, since time.Time) ([]Post, error) {
+	done := observeQuery("digest_posts")
+	//the posts are stored in the forum's time zone, so the times compare as text
+	rows, err := h.db.QueryContext(ctx, `
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT p.id, p.title,
+		(SELECT COUNT(*) FROM reactions r WHERE r.post_id = p.id AND r.type = 'like') AS likes,
+		(SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments
+		FROM posts p
+		WHERE p.created_at >= ?
+		AND p.id IN (SELECT post_id FROM post_categories WHERE category_id IN (SELECT id FROM subtree))
+		ORDER BY likes + comments DESC, p.created_at DESC
+		LIMIT ?
+	`, categoryID, since.In(h.location), digestPostsLimit)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title, &p.Likes, &p.CommentCount); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// digestBody writes the top posts of the followed categories as the text of
+// the digest, it is empty when there are no new posts
+func (h *Handler) digestBody(ctx context.Context, userID int64, since time.Time) (string, error) {
+	categories, err := h.getFollowedCategories(userID)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, c := range categories {
+		posts, err := h.digestPosts(ctx, c.ID, since)
+		if err != nil {
+			return "", err
+		}
+		if len(posts) == 0 {
+			continue
+		}
+		b.WriteString(c.Name + "\n")
+		for _, p := range posts {
+			fmt.Fprintf(&b, "- %s (%d likes, %d comments)\n  %s/post/%d\n", p.Title, p.Likes, p.CommentCount, h.baseURL, p.ID)
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// queueDigests queues the digests that are due. A digest without new posts
+// isn't sent, but the next one starts from now all the same.
+func (h *Handler) queueDigests(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT d.user_id, u.email, d.frequency, d.last_sent_at
+		FROM digest_subscriptions d JOIN users u ON u.id = d.user_id
+		WHERE (d.frequency = 'daily' AND d.last_sent_at <= ?) OR (d.frequency = 'weekly' AND d.last_sent_at <= ?)
+	`, now.Add(-digestPeriods["daily"]), now.Add(-digestPeriods["weekly"]))
+	if err != nil {
+		return 0, err
+	}
+	type due struct {
+		userID    int64
+		address   string
+		frequency string
+		since     time.Time
+	}
+	var digests []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.userID, &d.address, &d.frequency, &d.since); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		digests = append(digests, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for _, d := range digests {
+		body, err := h.digestBody(ctx, d.userID, d.since)
+		if err != nil {
+			return queued, err
+		}
+		if to, ok := emailAddress(d.address); ok && body != "" {
+			unsubscribe, err := h.unsubscribeURL(ctx, d.userID, "digest")
+			if err != nil {
+				return queued, err
+			}
+			err = h.queueMail(ctx, &Mail{
+				To:      to,
+				Subject: "Your " + d.frequency + " digest of the Åland forum",
+				Body: "The top posts in the categories you follow:\n\n" + body +
+					"--\n" +
+					"Change the categories you follow on their pages, and the digest at " + h.baseURL + "/notifications\n" +
+					"Stop the digest: " + unsubscribe + "\n",
+				UnsubscribeURL: unsubscribe,
+			})
+			if err != nil {
+				return queued, err
+			}
+			queued++
+		}
+		_, err = h.db.ExecContext(ctx, "UPDATE digest_subscriptions SET last_sent_at = ? WHERE user_id = ?", now, d.userID)
+		if err != nil {
+			return queued, err
+		}
+	}
+	return queued, nil
+}
+
+// what the unsubscribe links stop, besides the digest and all of the emails
+var unsubscribeLists = map[string]string{
+	NotifyComment: "emails of comments on your posts",
+	NotifyReply:   "emails of comments on posts you have commented on",
+	NotifyMention: "emails of mentions of you",
+	"digest":      "the digest",
+	"all":         "any emails",
+}
+
+// Unsubscribe stops the emails of the list of the link without logging in,
+// the token of the link tells the user. The mail clients POST to the same
+// address for the one-click unsubscribe of RFC 8058.
+func (h *Handler) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	list := query.Get("list")
+	what, ok := unsubscribeLists[list]
+	if !ok {
+		h.ErrorHandler(w, r, "Invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+	var userID int64
+	err := h.db.QueryRow("SELECT user_id FROM unsubscribe_tokens WHERE token = ?", query.Get("token")).Scan(&userID)
+	if err == sql.ErrNoRows {
+		h.ErrorHandler(w, r, "Invalid unsubscribe link", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = h.unsubscribe(userID, list)
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error unsubscribing", "list", list, "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	LogFrom(r.Context()).Info("Unsubscribed", "user_id", userID, "list", list)
+
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	data := TemplateData{
+		Title:        "Unsubscribed",
+		User:         h.GetSessionUser(w, r),
+		Unsubscribed: what,
+	}
+	if err := h.render(w, r, "unsubscribe.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// unsubscribe turns off the emails of a notification type, the digest or all
+func (h *Handler) unsubscribe(userID int64, list string) error {
+	if list == "digest" || list == "all" {
+		if err := h.saveDigestFrequency(userID, ""); err != nil {
+			return err
+		}
+	}
+	for _, t := range NotificationTypes {
+		if list != "all" && list != t.Name {
+			continue
+		}
+		_, err := h.db.Exec(`
+			INSERT INTO notification_settings (user_id, type, email) VALUES (?, ?, 0)
+			ON CONFLICT (user_id, type) DO UPDATE SET email = 0
+		`, userID, t.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the answers to an event
+const (
+	RSVPGoing      = "going"
+	RSVPInterested = "interested"
+)
+
+// the format of the datetime-local inputs
+const eventInputFormat = "2006-01-02T15:04"
+
+// the longest an event can last
+const maxEventLength = 31 * 24 * time.Hour
+
+// Event is a post of the events calendar. The times are saved in UTC and
+// shown in the time zone of the forum.
+type Event struct {
+	StartsAt   time.Time
+	EndsAt     time.Time
+	Venue      string
+	Going      int
+	Interested int
+	UserRSVP   string //the answer of the user looking at the page
+}
+
+// StartInput is the start time for the form
+func (e *Event) StartInput() string {
+	if e.StartsAt.IsZero() {
+		return ""
+	}
+	return e.StartsAt.Format(eventInputFormat)
+}
+
+// EndInput is the end time for the form
+func (e *Event) EndInput() string {
+	if e.EndsAt.IsZero() {
+		return ""
+	}
+	return e.EndsAt.Format(eventInputFormat)
+}
+
+// SameDay tells if the event ends on the day it starts
+func (e *Event) SameDay() bool {
+	return e.StartsAt.Format("2006-01-02") == e.EndsAt.Format("2006-01-02")
+}
+
+// Past tells if the event is already over
+func (e *Event) Past() bool {
+	return e.EndsAt.Before(time.Now())
+}
+
+// parseEventForm reads the event fields of the new post form. The event is
+// returned also with an error, to show the form again as it was.
+func (h *Handler) parseEventForm(r *http.Request) (*Event, error) {
+	event := &Event{Venue: strings.TrimSpace(r.FormValue("venue"))}
+	invalid := func(message string) error {
+		return &FormError{Message: message, Code: http.StatusBadRequest}
+	}
+
+	//the browser sends the time without a zone, it is the forum's local time
+	start, err := time.ParseInLocation(eventInputFormat, r.FormValue("event_start"), h.location)
+	if err != nil {
+		return event, invalid("Give the date and time the event starts")
+	}
+	event.StartsAt = start
+	event.EndsAt = start
+	if value := r.FormValue("event_end"); value != "" {
+		end, err := time.ParseInLocation(eventInputFormat, value, h.location)
+		if err != nil {
+			return event, invalid("Invalid end time")
+		}
+		event.EndsAt = end
+	}
+
+	if event.EndsAt.Before(event.StartsAt) {
+		return event, invalid("The event can't end before it starts")
+	}
+	if event.EndsAt.Sub(event.StartsAt) > maxEventLength {
+		return event, invalid("An event can last at most 31 days")
+	}
+	if event.EndsAt.Before(time.Now()) {
+		return event, invalid("The event is already over")
+	}
+	if event.Venue == "" {
+		return event, invalid("Give the venue of the event")
+	}
+	if len(event.Venue) > 100 {
+		return event, invalid("The venue can be at most 100 characters")
+	}
+	return event, nil
+}
+
+func (h *Handler) saveEvent(tx dbtx, postID int64, event *Event) error {
+	done := observeQuery("create_event")
+	_, err := tx.Exec(`
+		INSERT INTO events (post_id, starts_at, ends_at, venue) VALUES (?, ?, ?, ?)
+	`, postID, event.StartsAt.UTC(), event.EndsAt.UTC(), event.Venue)
+	done()
+	return err
+}
+
+// getting the events of the posts by post ID, with the RSVP counts
+func (h *Handler) getEvents(postIDs []int64) (map[int64]*Event, error) {
+	events := make(map[int64]*Event)
+	if len(postIDs) == 0 {
+		return events, nil
+	}
+	done := observeQuery("get_events")
+	rows, err := h.db.Query(`
+		SELECT e.post_id, e.starts_at, e.ends_at, e.venue,
+		(SELECT COUNT(*) FROM event_rsvps r WHERE r.post_id = e.post_id AND r.status = 'going'),
+		(SELECT COUNT(*) FROM event_rsvps r WHERE r.post_id = e.post_id AND r.status = 'interested')
+		FROM events e
+		WHERE e.post_id IN (?`+strings.Repeat(", ?", len(postIDs)-1)+`)
+	`, int64Args(postIDs)...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		var e Event
+		if err := rows.Scan(&postID, &e.StartsAt, &e.EndsAt, &e.Venue, &e.Going, &e.Interested); err != nil {
+			return nil, err
+		}
+		e.StartsAt = e.StartsAt.In(h.location)
+		e.EndsAt = e.EndsAt.In(h.location)
+		events[postID] = &e
+	}
+	return events, rows.Err()
+}
+
+// getUserRSVP returns the answer of the user to the event, empty if there is none
+func (h *Handler) getUserRSVP(postID, userID int64) (string, error) {
+	var status string
+	err := h.db.QueryRow("SELECT status FROM event_rsvps WHERE post_id = ? AND user_id = ?", postID, userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+// getEventPosts returns the events that are on between from and to, the
+// earliest first
+func (h *Handler) getEventPosts(from, to time.Time, limit int) ([]Post, error) {
+	done := observeQuery("get_event_posts")
+	rows, err := h.db.Query(`
+		SELECT p.id, p.title, p.content, p.username, p.created_at, p.user_id, p.type
+		FROM events e
+		JOIN posts p ON p.id = e.post_id
+		WHERE e.starts_at < ? AND e.ends_at >= ?
+		ORDER BY e.starts_at, p.id
+		LIMIT ?
+	`, to.UTC(), from.UTC(), limit)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Username, &p.CreatedAt, &p.UserID, &p.Type); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := h.loadPostDetails(posts); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// upcomingEvents returns the next events for the sidebar, the ones going on
+// right now included
+func (h *Handler) upcomingEvents(limit int) ([]Post, error) {
+	now := time.Now()
+	return h.getEventPosts(now, now.AddDate(10, 0, 0), limit)
+}
+
+// EventRSVP saves the answer of the user to an event. An empty status
+// removes the answer.
+func (h *Handler) EventRSVP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	postID, err := strconv.ParseInt(r.FormValue("post_id"), 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Invalid post ID", http.StatusBadRequest)
+		return
+	}
+	status := r.FormValue("status")
+	if status != RSVPGoing && status != RSVPInterested && status != "" {
+		h.ErrorHandler(w, r, "Invalid answer", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM events WHERE post_id = ?)", postID).Scan(&exists); err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		h.ErrorHandler(w, r, "Event not found", http.StatusNotFound)
+		return
+	}
+	readOnly, err := h.isPostReadOnly(postID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if readOnly {
+		h.ErrorHandler(w, r, "This post is archived", http.StatusForbidden)
+		return
+	}
+
+	if status == "" {
+		_, err = h.db.Exec("DELETE FROM event_rsvps WHERE post_id = ? AND user_id = ?", postID, user.ID)
+	} else {
+		_, err = h.db.Exec(`
+			INSERT INTO event_rsvps (post_id, user_id, status) VALUES (?, ?, ?)
+			ON CONFLICT(post_id, user_id) DO UPDATE SET status = excluded.status, created_at = CURRENT_TIMESTAMP
+		`, postID, user.ID, status)
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error saving RSVP", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// RunExpiry closes the stale listings and the jobs past their deadline every
+// interval until the context is cancelled. It runs once right away, so the
+// posts that expired while the server was down are closed on start.
+func (h *Handler) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := ExpireListings(ctx, h.db); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Error closing expired listings", "err", err)
+			}
+		} else if n > 0 {
+			slog.Info("Closed expired listings", "count", n)
+		}
+		if n, err := CloseJobs(ctx, h.db); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Error closing jobs past their deadline", "err", err)
+			}
+		} else if n > 0 {
+			slog.Info("Closed jobs past their deadline", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	feedLimit   = 30  //items on a page of the feed
+	feedExcerpt = 200 //characters of the content shown in the feed
+)
+
+// FeedItem is a new post or comment on the home feed
+type FeedItem struct {
+	PostID    int64
+	CommentID int64 //0 for a post
+	Title     string
+	Username  string
+	Content   string
+	CreatedAt time.Time
+	Reason    string //why it is on the following feed, like "in General"
+}
+
+// Link is the address of the post or the comment
+func (f *FeedItem) Link() string {
+	link := "/post/" + strconv.FormatInt(f.PostID, 10)
+	if f.CommentID != 0 {
+		link += "#comment-" + strconv.FormatInt(f.CommentID, 10)
+	}
+	return link
+}
+
+// excerpt shortens the text to the length in characters
+func excerpt(text string, length int) string {
+	if utf8.RuneCountInString(text) <= length {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:length])) + "…"
+}
+
+// the queries of the following feed, one for every kind of follow. Each
+// takes the user, the time the page starts from and the limit, and returns
+// the latest items from the indexes, so the feed costs the same however many
+// posts the forum has.
+var followingFeedQueries = []string{
+	//the posts of the followed categories and their subcategories
+	`WITH RECURSIVE followed(id) AS (
+		SELECT category_id FROM category_follows WHERE user_id = ?1
+		UNION
+		SELECT c.id FROM categories c JOIN followed f ON c.parent_id = f.id
+	)
+	SELECT p.id, 0, p.title, p.username, p.content, p.created_at,
+	'in ' || (SELECT c.name FROM post_categories pc JOIN categories c ON c.id = pc.category_id
+		WHERE pc.post_id = p.id AND pc.category_id IN followed ORDER BY c.name LIMIT 1)
+	FROM posts p
+	WHERE p.id IN (SELECT post_id FROM post_categories WHERE category_id IN followed)
+	AND p.user_id != ?1 AND p.created_at < ?2
+	ORDER BY p.created_at DESC
+	LIMIT ?3`,
+
+	//the posts of the followed users
+	`SELECT p.id, 0, p.title, p.username, p.content, p.created_at, 'by ' || p.username
+	FROM posts p
+	WHERE p.user_id IN (SELECT followed_id FROM user_follows WHERE follower_id = ?1) AND p.created_at < ?2
+	ORDER BY p.created_at DESC
+	LIMIT ?3`,
+
+	//the comments of the followed users
+	`SELECT c.post_id, c.id, p.title, c.username, c.content, c.created_at, 'by ' || c.username
+	FROM comments c JOIN posts p ON p.id = c.post_id
+	WHERE c.user_id IN (SELECT followed_id FROM user_follows WHERE follower_id = ?1) AND c.created_at < ?2
+	ORDER BY c.created_at DESC
+	LIMIT ?3`,
+
+	//the comments on the followed posts
+	`SELECT c.post_id, c.id, p.title, c.username, c.content, c.created_at, 'on a post you follow'
+	FROM comments c JOIN posts p ON p.id = c.post_id
+	WHERE c.post_id IN (SELECT post_id FROM post_follows WHERE user_id = ?1)
+	AND c.user_id != ?1 AND c.created_at < ?2
+	ORDER BY c.created_at DESC
+	LIMIT ?3`,
+}
+
+// the queries of the feed of the whole forum, they take the same arguments
+// but don't need the user
+var allFeedQueries = []string{
+	`SELECT p.id, 0, p.title, p.username, p.content, p.created_at, ''
+	FROM posts p
+	WHERE p.created_at < ?2
+	ORDER BY p.created_at DESC
+	LIMIT ?3`,
+
+	`SELECT c.post_id, c.id, p.title, c.username, c.content, c.created_at, ''
+	FROM comments c JOIN posts p ON p.id = c.post_id
+	WHERE c.created_at < ?2
+	ORDER BY c.created_at DESC
+	LIMIT ?3`,
+}
+
+// getFeed returns a page of the feed older than before, and whether there
+// are older items. The queries fan out on read: every one of them returns
+// its latest items and they are merged here, an item found by more than one
+// keeps the reason of the first.
+func (h *Handler) getFeed(ctx context.Context, userID int64, mode string, before time.Time) ([]FeedItem, bool, error) {
+	queries := allFeedQueries
+	if mode == "following" {
+		queries = followingFeedQueries
+	}
+	//the posts and the comments are stored in the forum's time zone, so the
+	//times compare as text
+	before = before.In(h.location)
+
+	done := observeQuery("feed_" + mode)
+	defer done()
+	seen := make(map[[2]int64]bool)
+	var items []FeedItem
+	for _, query := range queries {
+		rows, err := h.db.QueryContext(ctx, query, userID, before, feedLimit+1)
+		if err != nil {
+			return nil, false, err
+		}
+		for rows.Next() {
+			var item FeedItem
+			var reason sql.NullString
+			err := rows.Scan(&item.PostID, &item.CommentID, &item.Title, &item.Username, &item.Content, &item.CreatedAt, &reason)
+			if err != nil {
+				rows.Close()
+				return nil, false, err
+			}
+			key := [2]int64{item.PostID, item.CommentID}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			item.Reason = reason.String
+			item.Content = excerpt(item.Content, feedExcerpt)
+			item.CreatedAt = item.CreatedAt.In(h.location)
+			items = append(items, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].CreatedAt.After(items[j].CreatedAt)
+	})
+	more := len(items) > feedLimit
+	if more {
+		items = items[:feedLimit]
+	}
+	return items, more, nil
+}
+
+// isFollowingUser tells if the user follows the other user
+func (h *Handler) isFollowingUser(userID, followedID int64) (bool, error) {
+	var following bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM user_follows WHERE follower_id = ? AND followed_id = ?)
+	`, userID, followedID).Scan(&following)
+	return following, err
+}
+
+// isFollowingPost tells if the user follows the comments of the post
+func (h *Handler) isFollowingPost(userID, postID int64) (bool, error) {
+	var following bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM post_follows WHERE user_id = ? AND post_id = ?)
+	`, userID, postID).Scan(&following)
+	return following, err
+}
+
+// getFollowedUsers returns the users the user follows by name
+func (h *Handler) getFollowedUsers(userID int64) ([]User, error) {
+	rows, err := h.db.Query(`
+		SELECT u.id, u.username FROM user_follows f JOIN users u ON u.id = f.followed_id
+		WHERE f.follower_id = ?
+		ORDER BY u.username
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// getFollowedPosts returns the posts the user follows, the latest followed first
+func (h *Handler) getFollowedPosts(userID int64) ([]Post, error) {
+	rows, err := h.db.Query(`
+		SELECT p.id, p.title FROM post_follows f JOIN posts p ON p.id = f.post_id
+		WHERE f.user_id = ?
+		ORDER BY f.created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// Follow follows a user or a post for the home feed, type=user or type=post
+// with the id, and action=unfollow stops following. The form goes back to
+// the post of post_id when it is given, or to the following feed.
+func (h *Handler) Follow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	unfollow := r.FormValue("action") == "unfollow"
+
+	var exists bool
+	switch r.FormValue("type") {
+	case "user":
+		if id == user.ID {
+			h.ErrorHandler(w, r, "You can't follow yourself", http.StatusBadRequest)
+			return
+		}
+		err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", id).Scan(&exists)
+		if err == nil && exists {
+			if unfollow {
+				_, err = h.db.Exec("DELETE FROM user_follows WHERE follower_id = ? AND followed_id = ?", user.ID, id)
+			} else {
+				_, err = h.db.Exec("INSERT OR IGNORE INTO user_follows (follower_id, followed_id) VALUES (?, ?)", user.ID, id)
+			}
+		}
+	case "post":
+		err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = ?)", id).Scan(&exists)
+		if err == nil && exists {
+			if unfollow {
+				_, err = h.db.Exec("DELETE FROM post_follows WHERE user_id = ? AND post_id = ?", user.ID, id)
+			} else {
+				_, err = h.db.Exec("INSERT OR IGNORE INTO post_follows (user_id, post_id) VALUES (?, ?)", user.ID, id)
+			}
+		}
+	default:
+		h.ErrorHandler(w, r, "Unknown type", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error following", "type", r.FormValue("type"), "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		h.ErrorHandler(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if postID, err := strconv.ParseInt(r.FormValue("post_id"), 10, 64); err == nil {
+		http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/?feed=following", http.StatusSeeOther)
+}
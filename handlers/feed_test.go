@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetFeed(t *testing.T) {
+	h := newTestHandler(t)
+	reader := addUser(t, h, "reader")
+	alice := addUser(t, h, "alice")
+	bob := addUser(t, h, "bob")
+	carol := addUser(t, h, "carol")
+	sports := addCategory(t, h, "Sports", 0)
+	football := addCategory(t, h, "Football", sports)
+	cooking := addCategory(t, h, "Cooking", 0)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	at := func(minute int) time.Time { return start.Add(time.Duration(minute) * time.Minute) }
+	followed := addPost(t, h, carol, PostTypePost, at(0), cooking)
+	inSubcategory := addPost(t, h, bob, PostTypePost, at(1), football)
+	byAlice := addPost(t, h, alice, PostTypePost, at(2), cooking)
+	byAliceInSports := addPost(t, h, alice, PostTypePost, at(3), sports)
+	unrelated := addPost(t, h, bob, PostTypePost, at(4), cooking)
+	addPost(t, h, reader, PostTypePost, at(5), sports)
+	onFollowed := addComment(t, h, bob, followed, at(6))
+	aliceComment := addComment(t, h, alice, unrelated, at(7))
+	addComment(t, h, reader, followed, at(8))
+	addComment(t, h, bob, unrelated, at(9))
+
+	exec(t, h.db, "INSERT INTO category_follows (user_id, category_id) VALUES (?, ?)", reader, sports)
+	exec(t, h.db, "INSERT INTO user_follows (follower_id, followed_id) VALUES (?, ?)", reader, alice)
+	exec(t, h.db, "INSERT INTO post_follows (user_id, post_id) VALUES (?, ?)", reader, followed)
+
+	type item struct {
+		postID, commentID int64
+		reason            string
+	}
+	tests := []struct {
+		name   string
+		mode   string
+		before time.Time
+		want   []item
+	}{
+		{
+			//the own posts and comments are left out, and a post found by
+			//more than one follow keeps the reason of the first
+			name:   "following",
+			mode:   "following",
+			before: time.Now(),
+			want: []item{
+				{unrelated, aliceComment, "by alice"},
+				{followed, onFollowed, "on a post you follow"},
+				{byAliceInSports, 0, "in Sports"},
+				{byAlice, 0, "by alice"},
+				{inSubcategory, 0, "in Football"},
+			},
+		},
+		{
+			name:   "following before a time",
+			mode:   "following",
+			before: at(3),
+			want: []item{
+				{byAlice, 0, "by alice"},
+				{inSubcategory, 0, "in Football"},
+			},
+		},
+		{
+			name:   "all before a time",
+			mode:   "all",
+			before: at(2),
+			want: []item{
+				{inSubcategory, 0, ""},
+				{followed, 0, ""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, more, err := h.getFeed(context.Background(), reader, tt.mode, tt.before)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if more {
+				t.Error("more items, want none")
+			}
+			var got []item
+			for _, i := range items {
+				got = append(got, item{i.PostID, i.CommentID, i.Reason})
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("item %d is %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	items, _, err := h.getFeed(context.Background(), reader, "all", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 10 {
+		t.Errorf("all has %d items, want the 6 posts and the 4 comments", len(items))
+	}
+}
+
+func TestGetFeedPages(t *testing.T) {
+	h := newTestHandler(t)
+	reader := addUser(t, h, "reader")
+	writer := addUser(t, h, "writer")
+	exec(t, h.db, "INSERT INTO user_follows (follower_id, followed_id) VALUES (?, ?)", reader, writer)
+
+	start := time.Now().Add(-2 * time.Hour).Truncate(time.Minute)
+	posts := feedLimit + 5
+	for i := 0; i < posts; i++ {
+		addPost(t, h, writer, PostTypePost, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	before := time.Now()
+	seen := 0
+	for page := 1; ; page++ {
+		items, more, err := h.getFeed(context.Background(), reader, "following", before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) > feedLimit {
+			t.Fatalf("page %d has %d items, over the limit of %d", page, len(items), feedLimit)
+		}
+		for _, item := range items {
+			if !item.CreatedAt.Before(before) {
+				t.Errorf("page %d has an item of %v, not before %v", page, item.CreatedAt, before)
+			}
+		}
+		seen += len(items)
+		if !more {
+			break
+		}
+		before = items[len(items)-1].CreatedAt
+	}
+	if seen != posts {
+		t.Errorf("the pages have %d items, want %d", seen, posts)
+	}
+}
@@ -3,30 +3,61 @@ package handlers
 import (
 	"database/sql"
 	"fmt"
+	"forum/config"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 )
 
 type Handler struct {
-	db        *sql.DB
-	templates *template.Template
-	location  *time.Location
+	db            *sql.DB
+	templates     *template.Template
+	location      *time.Location
+	secureCookies bool //cookies are only sent over HTTPS when TLS is on
+	dbPath        string
+	migrationsDir string
+	startedAt     time.Time
+	backupDir     string
+	backupKeep    int
+	backupGzip    bool
+	uploadDir     string
+	maxUpload     int
+	listingTTL    time.Duration
+	mailer        MailTransport //nil when the forum sends no email
+	mailFrom      string
+	baseURL       string //the address of the forum in the emails
+	live          *Hub
+	chat          *ChatHub
 }
 
 // this will create a new handler which contains the database and the templates
-func NewHandler(db *sql.DB, templates *template.Template) *Handler {
+func NewHandler(db *sql.DB, templates *template.Template, cfg *config.Config) *Handler {
 	location, err := time.LoadLocation("Europe/Helsinki") // UTC+2
 	if err != nil {
-		log.Printf("Error loading location: %v", err)
+		slog.Warn("Error loading location", "err", err)
 		location = time.UTC
 	}
 
 	return &Handler{
-		db:        db,
-		templates: templates,
-		location:  location,
+		db:            db,
+		templates:     templates,
+		location:      location,
+		secureCookies: cfg.TLSEnabled(),
+		dbPath:        cfg.DBPath,
+		migrationsDir: cfg.MigrationsDir,
+		startedAt:     time.Now(),
+		backupDir:     cfg.BackupDir,
+		backupKeep:    cfg.BackupKeep,
+		backupGzip:    cfg.BackupGzip,
+		uploadDir:     cfg.UploadDir,
+		maxUpload:     cfg.MaxUploadSize,
+		listingTTL:    cfg.ListingTTL,
+		mailer:        newMailTransport(cfg),
+		mailFrom:      cfg.MailFrom,
+		baseURL:       cfg.BaseURL,
+		live:          NewHub(),
+		chat:          NewChatHub(),
 	}
 }
 
@@ -36,20 +67,46 @@ func (h *Handler) Rules(w http.ResponseWriter, r *http.Request) {
 		Title: "Forum Rules",
 		User:  h.GetSessionUser(w, r),
 	}
-	h.templates.ExecuteTemplate(w, "rules.html", data)
+	h.render(w, r, "rules.html", data)
 }
 
 // handling the error messages
-func (h *Handler) ErrorHandler(w http.ResponseWriter, errorMessage string, statusCode int) {
-    w.WriteHeader(statusCode)
-
-    data := ErrorData{
-        ErrorMessage: errorMessage,
-        ErrorCode:    fmt.Sprintf("%d", statusCode),
-    }
-
-    err := h.templates.ExecuteTemplate(w, "error.html", data)
-    if err != nil {
-        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-    }
+func (h *Handler) ErrorHandler(w http.ResponseWriter, r *http.Request, errorMessage string, statusCode int) {
+	w.WriteHeader(statusCode)
+
+	data := ErrorData{
+		ErrorMessage: errorMessage,
+		ErrorCode:    fmt.Sprintf("%d", statusCode),
+		Nonce:        Nonce(r.Context()),
+	}
+
+	start := time.Now()
+	err := h.templates.ExecuteTemplate(w, "error.html", data)
+	templateDuration.WithLabelValues("error.html").Observe(time.Since(start).Seconds())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// render executes the template with the data and adds the CSP nonce of the request
+func (h *Handler) render(w http.ResponseWriter, r *http.Request, name string, data *TemplateData) error {
+	data.Nonce = Nonce(r.Context())
+	if data.User != nil && data.User.ID != 0 {
+		unread, err := h.unreadNotifications(data.User.ID)
+		if err != nil {
+			LogFrom(r.Context()).Error("Error counting notifications", "err", err)
+		}
+		data.UnreadCount = unread
+		messages, err := h.unreadMessages(data.User.ID)
+		if err != nil {
+			LogFrom(r.Context()).Error("Error counting messages", "err", err)
+		}
+		data.UnreadMessages = messages
+	}
+
+	start := time.Now()
+	defer func() {
+		templateDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}()
+	return h.templates.ExecuteTemplate(w, name, data)
 }
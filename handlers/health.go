@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Version is the version of the build, set with -ldflags "-X forum/handlers.Version=v1.2.3".
+// Without it the VCS revision recorded by the Go toolchain is used.
+var Version = ""
+
+// the templates the forum can't work without, checked by /readyz
+var requiredTemplates = []string{
+	"index.html", "category.html", "post.html", "new_post.html",
+	"login.html", "register.html", "rules.html", "error.html", "tag.html",
+	"events.html", "saved_searches.html",
+}
+
+// SystemStatus is shown on the /debug/status page
+type SystemStatus struct {
+	Version       string
+	GoVersion     string
+	StartedAt     time.Time
+	Uptime        string
+	SchemaVersion int
+	LatestVersion int
+	DBFileSize    string
+	WALFileSize   string
+	TableCounts   []TableCount
+	Goroutines    int
+	CPUs          int
+	HeapAlloc     string
+	HeapObjects   uint64
+	SysMemory     string
+	NumGC         uint32
+	LastGC        string
+}
+
+type TableCount struct {
+	Name string
+	Rows int64
+}
+
+// Healthz tells that the process is alive, it doesn't touch the database
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz tells if the forum can serve requests: the database answers, all the
+// migrations are applied and the templates are parsed
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	checks := map[string]string{
+		"database":   "ok",
+		"migrations": "ok",
+		"templates":  "ok",
+	}
+	ready := true
+
+	if err := h.db.PingContext(ctx); err != nil {
+		checks["database"] = err.Error()
+		ready = false
+	}
+
+	current, latest, err := h.schemaVersions()
+	if err != nil {
+		checks["migrations"] = err.Error()
+		ready = false
+	} else if current != latest {
+		checks["migrations"] = fmt.Sprintf("schema version %d, expected %d", current, latest)
+		ready = false
+	}
+
+	var missing []string
+	for _, name := range requiredTemplates {
+		if h.templates == nil || h.templates.Lookup(name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		checks["templates"] = "missing " + strings.Join(missing, ", ")
+		ready = false
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+		LogFrom(r.Context()).Warn("Not ready", "checks", checks)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":  ready,
+		"checks": checks,
+	})
+}
+
+// DebugStatus shows the build, database and runtime information to the admins
+func (h *Handler) DebugStatus(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(w, r)
+	if user == nil {
+		return
+	}
+
+	status, err := h.systemStatus(r.Context())
+	if err != nil {
+		LogFrom(r.Context()).Error("Error collecting status", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	data := TemplateData{
+		Title:  "Status",
+		User:   user,
+		Status: status,
+	}
+	if err := h.render(w, r, "debug_status.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// schemaVersions returns the version of the database and the newest migration
+func (h *Handler) schemaVersions() (current, latest int, err error) {
+	current, err = SchemaVersion(h.db)
+	if err != nil {
+		return 0, 0, err
+	}
+	latest, err = LatestMigration(h.migrationsDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	return current, latest, nil
+}
+
+func (h *Handler) systemStatus(ctx context.Context) (*SystemStatus, error) {
+	status := &SystemStatus{
+		Version:    buildVersion(),
+		GoVersion:  runtime.Version(),
+		StartedAt:  h.startedAt.In(h.location),
+		Uptime:     time.Since(h.startedAt).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		CPUs:       runtime.NumCPU(),
+	}
+
+	var err error
+	status.SchemaVersion, status.LatestVersion, err = h.schemaVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	status.DBFileSize = fileSize(h.dbPath)
+	status.WALFileSize = fileSize(h.dbPath + "-wal")
+
+	status.TableCounts, err = h.tableCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	status.HeapAlloc = formatBytes(int64(mem.HeapAlloc))
+	status.HeapObjects = mem.HeapObjects
+	status.SysMemory = formatBytes(int64(mem.Sys))
+	status.NumGC = mem.NumGC
+	if mem.LastGC > 0 {
+		status.LastGC = time.Since(time.Unix(0, int64(mem.LastGC))).Round(time.Second).String() + " ago"
+	}
+
+	return status, nil
+}
+
+// tableCounts counts the rows of every table in the database
+func (h *Handler) tableCounts(ctx context.Context) ([]TableCount, error) {
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	counts := make([]TableCount, 0, len(names))
+	for _, name := range names {
+		//table names can't be parameters, so the name is quoted as an identifier
+		quoted := `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+		var n int64
+		if err := h.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+quoted).Scan(&n); err != nil {
+			return nil, err
+		}
+		counts = append(counts, TableCount{Name: name, Rows: n})
+	}
+	return counts, nil
+}
+
+// buildVersion returns the Version or the VCS revision the binary was built from
+func buildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			if setting.Value == "true" {
+				modified = " (modified)"
+			}
+		}
+	}
+	if revision == "" {
+		return info.Main.Version
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	return revision + modified
+}
+
+func fileSize(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "-"
+	}
+	return formatBytes(info.Size())
+}
+
+// formatBytes writes a size like 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"forum/config"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the schema, the migrations and the templates of the repository, the tests
+// run in the package directory
+const (
+	testSchema     = "../database/schema.sql"
+	testMigrations = "../database/migrations"
+	testTemplates  = "../templates/*.html"
+)
+
+// newTestDB returns a new database in a temporary directory with the whole
+// schema of the forum
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "forum.db"), testSchema, testMigrations)
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestHandler returns a handler on a new test database
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	templates := template.Must(template.ParseGlob(testTemplates))
+	return NewHandler(newTestDB(t), templates, &config.Config{ListingTTL: 60 * 24 * time.Hour})
+}
+
+// exec runs a statement of the test setup and returns the ID it inserted
+func exec(t *testing.T, db *sql.DB, query string, args ...interface{}) int64 {
+	t.Helper()
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// addUser adds a user with the name
+func addUser(t *testing.T, h *Handler, name string) int64 {
+	t.Helper()
+	return exec(t, h.db, "INSERT INTO users (email, username, password_hash) VALUES (?, ?, '')", name+"@example.com", name)
+}
+
+// addSession logs the user in and returns the cookie of the session
+func addSession(t *testing.T, h *Handler, userID int64) *http.Cookie {
+	t.Helper()
+	token := fmt.Sprintf("session-%d", userID)
+	exec(t, h.db, "INSERT INTO sessions (token, user_id, expires_at) VALUES (?, ?, datetime('now', '+1 hour'))", token, userID)
+	return &http.Cookie{Name: SessionTokenCookie, Value: token}
+}
+
+// formRequest sends the request to the handler as the user, with the form as
+// the body, and returns the status
+func formRequest(handler http.HandlerFunc, cookie *http.Cookie, method, target string, form url.Values) int {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+// addPost adds a post of the type by the user, created at the time, in the categories
+func addPost(t *testing.T, h *Handler, userID int64, postType string, createdAt time.Time, categoryIDs ...int64) int64 {
+	t.Helper()
+	postID := exec(t, h.db, `
+		INSERT INTO posts (user_id, title, content, username, created_at, type)
+		SELECT ?, 'title', 'content', username, ?, ? FROM users WHERE id = ?
+	`, userID, createdAt.In(h.location), postType, userID)
+	for _, categoryID := range categoryIDs {
+		exec(t, h.db, "INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)", postID, categoryID)
+	}
+	return postID
+}
+
+// addCategory adds a category under the parent, 0 for a top level one
+func addCategory(t *testing.T, h *Handler, name string, parentID int64) int64 {
+	t.Helper()
+	return exec(t, h.db, "INSERT INTO categories (name, description, parent_id) VALUES (?, '', NULLIF(?, 0))", name, parentID)
+}
+
+// addComment adds a comment by the user on the post, created at the time
+func addComment(t *testing.T, h *Handler, userID, postID int64, createdAt time.Time) int64 {
+	t.Helper()
+	return exec(t, h.db, `
+		INSERT INTO comments (post_id, user_id, content, username, created_at)
+		SELECT ?, ?, 'comment', username, ? FROM users WHERE id = ?
+	`, postID, userID, createdAt.In(h.location), userID)
+}
+
+// filteredPosts returns the IDs of the posts that the condition and the
+// order of a category filter give
+func filteredPosts(t *testing.T, h *Handler, where, order string, args []interface{}) []int64 {
+	t.Helper()
+	rows, err := h.db.Query("SELECT p.id FROM posts p WHERE 1 = 1"+where+" ORDER BY "+order, args...)
+	if err != nil {
+		t.Fatalf("filter %q: %v", where, err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// sameIDs tells if the two lists have the same IDs in the same order
+func sameIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
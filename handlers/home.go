@@ -1,53 +1,106 @@
 package handlers
 
 import (
-	"log"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // HomeHandler is a handler for the home page
 func (h *Handler) HomeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
-		h.ErrorHandler(w, "Page not found", http.StatusNotFound)
+		h.ErrorHandler(w, r, "Page not found", http.StatusNotFound)
 		return
 	}
 
 	//calling out the getCategories function to get all the categories
 	categories, err := h.getCategories()
 	if err != nil {
-		log.Printf("Server error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Server error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
 	//getting the user from the session
 	user := h.GetSessionUser(w, r)
 
+	//the feed of the new posts and comments, the logged in users see the
+	//ones they follow unless they choose all of them
+	mode := "all"
+	if user != nil && user.ID != 0 && r.URL.Query().Get("feed") != "all" {
+		mode = "following"
+	}
+	before := time.Now()
+	if value := r.URL.Query().Get("before"); value != "" {
+		if before, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			h.ErrorHandler(w, r, "Invalid time", http.StatusBadRequest)
+			return
+		}
+	}
+	var userID int64
+	if user != nil {
+		userID = user.ID
+	}
+	feed, more, err := h.getFeed(r.Context(), userID, mode, before)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting feed", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
 	//collecting all the data into a struct
 
 	data := TemplateData{
 		User:       user,
 		Categories: categories,
+		Feed:       feed,
+		FeedMode:   mode,
+	}
+	if more {
+		data.FeedBefore = feed[len(feed)-1].CreatedAt.Format(time.RFC3339Nano)
+	}
+	if mode == "following" {
+		if data.Followed, err = h.getFollowedCategories(userID); err == nil {
+			if data.FollowedUsers, err = h.getFollowedUsers(userID); err == nil {
+				data.FollowedPosts, err = h.getFollowedPosts(userID)
+			}
+		}
+		if err != nil {
+			LogFrom(r.Context()).Error("Error getting follows", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
 	}
 
-	if err := h.templates.ExecuteTemplate(w, "index.html", data); err != nil {
-		log.Printf("Error rendering page: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	if err := h.render(w, r, "index.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 	}
 }
 
-// getting the categories from the database
+// getting the categories from the database as a tree, the subcategories are
+// in the Children of their parent
 func (h *Handler) getCategories() ([]Category, error) {
-	//this will query the database to get the categories
+	//this will query the database to get the categories, the post count
+	//includes the posts of all the subcategories, each post counted once
+	done := observeQuery("get_categories")
 	rows, err := h.db.Query(`
-		SELECT c.id, c.name, c.description, 
-		COUNT(pc.post_id) as post_count 
+		WITH RECURSIVE subtree(root_id, id) AS (
+			SELECT id, id FROM categories
+			UNION
+			SELECT s.root_id, c.id FROM categories c
+			JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT c.id, c.name, c.description,
+		(SELECT COUNT(DISTINCT pc.post_id) FROM subtree s
+			JOIN post_categories pc ON pc.category_id = s.id
+			WHERE s.root_id = c.id) as post_count,
+		c.position, c.archived_at IS NOT NULL, COALESCE(c.parent_id, 0), c.post_type, c.qa_mode
 		FROM categories c
-		LEFT JOIN post_categories pc ON c.id = pc.category_id
-		GROUP BY c.id, c.name, c.description
-		ORDER BY c.id
+		ORDER BY c.position, c.id
 	`)
+	done()
 	if err != nil {
 		return nil, err
 	}
@@ -57,12 +110,98 @@ func (h *Handler) getCategories() ([]Category, error) {
 	var categories []Category
 	for rows.Next() {
 		var cat Category
-		if err := rows.Scan(&cat.ID, &cat.Name, &cat.Description, &cat.PostCount); err != nil {
+		if err := rows.Scan(&cat.ID, &cat.Name, &cat.Description, &cat.PostCount, &cat.Position, &cat.Archived, &cat.ParentID, &cat.PostType, &cat.QAMode); err != nil {
 			return nil, err
 		}
 		categories = append(categories, cat)
 	}
-	return categories, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return buildCategoryTree(categories, 0, 0), nil
+}
+
+// buildCategoryTree collects the children of the parent from the flat list,
+// keeping the order of the list
+func buildCategoryTree(categories []Category, parentID int64, depth int) []Category {
+	var tree []Category
+	for _, cat := range categories {
+		if cat.ParentID != parentID {
+			continue
+		}
+		cat.Depth = depth
+		cat.Children = buildCategoryTree(categories, cat.ID, depth+1)
+		tree = append(tree, cat)
+	}
+	return tree
+}
+
+// flattenCategories lists the tree parents first, for the selects and tables
+func flattenCategories(tree []Category) []Category {
+	var flat []Category
+	for _, cat := range tree {
+		flat = append(flat, cat)
+		flat = append(flat, flattenCategories(cat.Children)...)
+	}
+	return flat
+}
+
+// activeCategories leaves out the archived categories, which can't get new posts
+func activeCategories(categories []Category) []Category {
+	var active []Category
+	for _, cat := range categories {
+		if !cat.Archived {
+			active = append(active, cat)
+		}
+	}
+	return active
+}
+
+// findCategory looks for the category from the tree
+func findCategory(tree []Category, categoryID int64) *Category {
+	for i := range tree {
+		if tree[i].ID == categoryID {
+			return &tree[i]
+		}
+		if found := findCategory(tree[i].Children, categoryID); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// categoryPath returns the category and its parents, the top level category first
+func (h *Handler) categoryPath(categoryID int64) ([]Category, error) {
+	done := observeQuery("category_path")
+	rows, err := h.db.Query(`
+		WITH RECURSIVE path(id, depth) AS (
+			SELECT ?, 0
+			UNION ALL
+			SELECT c.parent_id, p.depth + 1 FROM categories c
+			JOIN path p ON c.id = p.id
+			WHERE c.parent_id IS NOT NULL AND p.depth < 32
+		)
+		SELECT c.id, c.name, COALESCE(c.parent_id, 0)
+		FROM path p
+		JOIN categories c ON c.id = p.id
+		ORDER BY p.depth DESC
+	`, categoryID)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var path []Category
+	for rows.Next() {
+		var cat Category
+		if err := rows.Scan(&cat.ID, &cat.Name, &cat.ParentID); err != nil {
+			return nil, err
+		}
+		cat.Depth = len(path)
+		path = append(path, cat)
+	}
+	return path, rows.Err()
 }
 
 func (h *Handler) CategoryHandler(w http.ResponseWriter, r *http.Request) {
@@ -71,42 +210,116 @@ func (h *Handler) CategoryHandler(w http.ResponseWriter, r *http.Request) {
 
 	//if the category ID is empty, return a 404 error
 	if categoryIDStr == "" {
-		h.ErrorHandler(w, "Category not found", http.StatusNotFound)
+		h.ErrorHandler(w, r, "Category not found", http.StatusNotFound)
 		return
 	}
 
 	//convert the category ID to an int64 because it is a string
 	categoryID, err := strconv.ParseInt(categoryIDStr, 10, 64)
 	if err != nil {
-		h.ErrorHandler(w, "Invalid category ID", http.StatusBadRequest)
+		h.ErrorHandler(w, r, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	//finding the category from the tree, so it comes with its subcategories
+	categories, err := h.getCategories()
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting categories", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	found := findCategory(categories, categoryID)
+	if found == nil {
+		//the category might have been merged into another one
+		if newID, err := CategoryRedirect(h.db, categoryID); err == nil {
+			http.Redirect(w, r, "/category/"+strconv.FormatInt(newID, 10), http.StatusMovedPermanently)
+			return
+		}
+		h.ErrorHandler(w, r, "Category not found", http.StatusNotFound)
 		return
 	}
+	category := *found
 
-	//query the database to get the category with the given ID
-	var category Category
-	err = h.db.QueryRow("SELECT id, name, description FROM categories WHERE id = ?", categoryID).
-		Scan(&category.ID, &category.Name, &category.Description)
+	//the parent categories for the breadcrumb navigation
+	path, err := h.categoryPath(categoryID)
 	if err != nil {
-		h.ErrorHandler(w, "Category not found", http.StatusNotFound)
+		LogFrom(r.Context()).Error("Error getting category path", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
+	breadcrumbs := path[:len(path)-1]
 
 	//gets the user who has a session right now
 	user := h.GetSessionUser(w, r)
 
-	//query to get the posts with the given category ID
+	//query to get the posts of the category and its subcategories
 	query := `
-		SELECT p.id, p.title, p.content, p.username, p.created_at, p.user_id,
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT p.id, p.title, p.content, p.username, p.created_at, p.user_id, p.type,
+		COALESCE(p.accepted_comment_id, 0),
 		COUNT(DISTINCT cm.id) as comment_count,
 		EXISTS(SELECT 1 FROM reactions r WHERE r.post_id = p.id AND r.user_id = ? AND r.type = 'like') as user_liked
 		FROM posts p
 		INNER JOIN post_categories pc ON p.id = pc.post_id
 		LEFT JOIN comments cm ON p.id = cm.post_id
-		WHERE pc.category_id = ?
+		WHERE pc.category_id IN (SELECT id FROM subtree)%s
 		GROUP BY p.id
-		ORDER BY p.created_at DESC
+		ORDER BY %s
 	`
 
+	//the posts can be filtered by tags, /category/3?tag=ferry&tag=summer
+	tags, err := h.resolveTags(filterTags(r.URL.Query()))
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting tags", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	filter, filterArgs := tagFilter(tags)
+
+	//the marketplace can be filtered and sorted by the listing fields
+	order := "p.created_at DESC"
+	var listingFilter *ListingFilter
+	if category.PostType == PostTypeListing {
+		listingFilter = readListingFilter(r.URL.Query())
+		where, listingOrder, args := listingFilter.sql()
+		filter += where
+		filterArgs = append(filterArgs, args...)
+		order = listingOrder
+	}
+	var jobFilter *JobFilter
+	if category.PostType == PostTypeJob {
+		jobFilter = readJobFilter(r.URL.Query())
+		where, jobOrder, args := jobFilter.sql()
+		filter += where
+		filterArgs = append(filterArgs, args...)
+		order = jobOrder
+	}
+	var housingFilter *HousingFilter
+	if category.PostType == PostTypeHousing {
+		housingFilter = readHousingFilter(r.URL.Query())
+		where, housingOrder, args := housingFilter.sql()
+		filter += where
+		filterArgs = append(filterArgs, args...)
+		order = housingOrder
+	}
+	//the questions of a Q&A category can be filtered by having an accepted answer
+	var unanswered string
+	if category.QAMode {
+		switch r.URL.Query().Get("unanswered") {
+		case "yes":
+			unanswered = "yes"
+			filter += " AND p.accepted_comment_id IS NULL"
+		case "no":
+			unanswered = "no"
+			filter += " AND p.accepted_comment_id IS NOT NULL"
+		}
+	}
+	query = fmt.Sprintf(query, filter, order)
+
 	//creates an user ID (0, if the user is not logged in)
 	var userID int64
 	if user != nil {
@@ -114,10 +327,12 @@ func (h *Handler) CategoryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//starts the query to get the posts with the given category ID
-	rows, err := h.db.Query(query, userID, categoryID)
+	done := observeQuery("category_posts")
+	rows, err := h.db.Query(query, append([]interface{}{categoryID, userID}, filterArgs...)...)
+	done()
 	if err != nil {
-		log.Printf("Error getting posts: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Error getting posts", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
@@ -127,8 +342,8 @@ func (h *Handler) CategoryHandler(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var p Post
 		err := rows.Scan(
-			&p.ID, &p.Title, &p.Content, &p.Username, &p.CreatedAt, &p.UserID,
-			&p.CommentCount, &p.UserLiked,
+			&p.ID, &p.Title, &p.Content, &p.Username, &p.CreatedAt, &p.UserID, &p.Type,
+			&p.AcceptedCommentID, &p.CommentCount, &p.UserLiked,
 		)
 		if err != nil {
 			continue
@@ -136,6 +351,77 @@ func (h *Handler) CategoryHandler(w http.ResponseWriter, r *http.Request) {
 		posts = append(posts, p)
 	}
 
+	if err := h.addPostTags(posts); err != nil {
+		LogFrom(r.Context()).Error("Error getting tags", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if err := h.loadPostDetails(posts); err != nil {
+		LogFrom(r.Context()).Error("Error getting post details", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	//what the user hasn't read yet, ?unread=1 leaves out the read posts
+	var unreadOnly bool
+	if user != nil && user.ID != 0 {
+		if err := h.addReadStates(user.ID, posts); err != nil {
+			LogFrom(r.Context()).Error("Error getting read states", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("unread") == "1" {
+			unreadOnly = true
+			var unread []Post
+			for _, p := range posts {
+				if p.New || p.UnreadComments > 0 {
+					unread = append(unread, p)
+				}
+			}
+			posts = unread
+		}
+	}
+
+	//the most used tags of the category
+	cloud, err := h.tagCloud(categoryID, 30)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting tags", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	//the event categories show the coming events beside the posts
+	var upcoming []Post
+	if category.PostType == PostTypeEvent {
+		upcoming, err = h.upcomingEvents(upcomingEventsLimit)
+		if err != nil {
+			LogFrom(r.Context()).Error("Error getting events", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	//the housing pages tell about the new matches of the saved searches
+	var alerts int
+	if housingFilter != nil && user != nil && user.ID != 0 {
+		alerts, err = h.unseenHousingAlerts(user.ID)
+		if err != nil {
+			LogFrom(r.Context()).Error("Error counting housing alerts", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var following bool
+	if user != nil && user.ID != 0 {
+		following, err = h.isFollowing(user.ID, category.ID)
+		if err != nil {
+			LogFrom(r.Context()).Error("Error checking follow", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	if user == nil {
 		user = &User{
 			ID:       0,
@@ -147,12 +433,28 @@ func (h *Handler) CategoryHandler(w http.ResponseWriter, r *http.Request) {
 
 	//collecting all the data into a struct
 	data := TemplateData{
-		Title:    category.Name,
-		User:     user,
-		Category: &category,
-		Posts:    posts,
+		Title:           category.Name,
+		User:            user,
+		Category:        &category,
+		Posts:           posts,
+		Breadcrumbs:     breadcrumbs,
+		TagCloud:        cloud,
+		FilterTags:      tags,
+		ListingFilter:   listingFilter,
+		Conditions:      ListingConditions,
+		UpcomingEvents:  upcoming,
+		JobFilter:       jobFilter,
+		EmploymentTypes: EmploymentTypes,
+		JobLanguages:    JobLanguages,
+		HousingFilter:   housingFilter,
+		HousingKinds:    HousingKinds,
+		Municipalities:  Municipalities,
+		HousingAlerts:   alerts,
+		Unanswered:      unanswered,
+		Following:       following,
+		UnreadOnly:      unreadOnly,
 	}
 
 	//render the category.html template with the data
-	h.templates.ExecuteTemplate(w, "category.html", data)
+	h.render(w, r, "category.html", &data)
 }
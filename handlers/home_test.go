@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCategoryPostCounts(t *testing.T) {
+	h := newTestHandler(t)
+	userID := addUser(t, h, "member")
+	top := addCategory(t, h, "Region", 0)
+	middle := addCategory(t, h, "Homes", top)
+	bottom := addCategory(t, h, "Flats", middle)
+	sibling := addCategory(t, h, "Houses", middle)
+	other := addCategory(t, h, "Other", 0)
+
+	addPost(t, h, userID, PostTypePost, time.Now(), top)
+	addPost(t, h, userID, PostTypePost, time.Now(), bottom)
+	addPost(t, h, userID, PostTypePost, time.Now(), sibling)
+	//a post in a category and its subcategory is counted once
+	addPost(t, h, userID, PostTypePost, time.Now(), middle, bottom)
+	addPost(t, h, userID, PostTypePost, time.Now(), other)
+
+	tree, err := h.getCategories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		categoryID int64
+		count      int
+		depth      int
+	}{
+		{top, 4, 0},
+		{middle, 3, 1},
+		{bottom, 2, 2},
+		{sibling, 1, 2},
+		{other, 1, 0},
+	}
+	for _, tt := range tests {
+		cat := findCategory(tree, tt.categoryID)
+		if cat == nil {
+			t.Errorf("category %d not in the tree", tt.categoryID)
+			continue
+		}
+		if cat.PostCount != tt.count || cat.Depth != tt.depth {
+			t.Errorf("%s has %d posts at depth %d, want %d at %d", cat.Name, cat.PostCount, cat.Depth, tt.count, tt.depth)
+		}
+	}
+	if children := findCategory(tree, middle).Children; len(children) != 2 {
+		t.Errorf("Homes has %d subcategories, want 2", len(children))
+	}
+}
+
+func TestCategoryPath(t *testing.T) {
+	h := newTestHandler(t)
+	top := addCategory(t, h, "Region", 0)
+	middle := addCategory(t, h, "Homes", top)
+	bottom := addCategory(t, h, "Flats", middle)
+
+	path, err := h.categoryPath(bottom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for i, cat := range path {
+		ids = append(ids, cat.ID)
+		if cat.Depth != i {
+			t.Errorf("%s at depth %d, want %d", cat.Name, cat.Depth, i)
+		}
+	}
+	if !sameIDs(ids, []int64{top, middle, bottom}) {
+		t.Errorf("path %v, want %v", ids, []int64{top, middle, bottom})
+	}
+}
+
+func TestSetCategoryParent(t *testing.T) {
+	h := newTestHandler(t)
+	top := addCategory(t, h, "Region", 0)
+	middle := addCategory(t, h, "Homes", top)
+	bottom := addCategory(t, h, "Flats", middle)
+
+	tests := []struct {
+		categoryID, parentID int64
+		want                 error
+	}{
+		{top, top, ErrCategoryCycle},
+		{top, bottom, ErrCategoryCycle},
+		{bottom, 999, ErrInvalidCategory},
+		{bottom, top, nil},
+		{middle, 0, nil},
+	}
+	for _, tt := range tests {
+		if err := SetCategoryParent(h.db, tt.categoryID, tt.parentID); !errors.Is(err, tt.want) {
+			t.Errorf("SetCategoryParent(%d, %d) = %v, want %v", tt.categoryID, tt.parentID, err, tt.want)
+		}
+	}
+	var parentID int64
+	h.db.QueryRow("SELECT COALESCE(parent_id, 0) FROM categories WHERE id = ?", bottom).Scan(&parentID)
+	if parentID != top {
+		t.Errorf("Flats is under %d, want %d", parentID, top)
+	}
+}
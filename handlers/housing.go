@@ -0,0 +1,556 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the kinds of housing listings
+const (
+	HousingRent   = "rent"
+	HousingSublet = "sublet"
+	HousingSale   = "sale"
+)
+
+var (
+	HousingKinds = []string{HousingRent, HousingSublet, HousingSale}
+
+	// Municipalities are the 16 municipalities of Åland
+	Municipalities = []string{
+		"Brändö", "Eckerö", "Finström", "Föglö", "Geta", "Hammarland", "Jomala", "Kumlinge",
+		"Kökar", "Lemland", "Lumparland", "Mariehamn", "Saltvik", "Sottunga", "Sund", "Vårdö",
+	}
+)
+
+// Housing is a post of the housing listings. The price is in whole euros,
+// a month's rent for the rentals and sublets.
+type Housing struct {
+	Kind          string
+	Municipality  string
+	Rooms         int
+	Size          int //square metres
+	Price         int64
+	AvailableFrom time.Time
+	Furnished     bool
+}
+
+// PriceText formats the rent or the price for the pages
+func (h *Housing) PriceText() string {
+	price := strconv.FormatInt(h.Price, 10) + " €"
+	if h.Kind != HousingSale {
+		price += " / month"
+	}
+	return price
+}
+
+// AvailableInput is the availability date for the form
+func (h *Housing) AvailableInput() string {
+	if h.AvailableFrom.IsZero() {
+		return ""
+	}
+	return h.AvailableFrom.Format("2006-01-02")
+}
+
+// parseHousingForm reads the housing fields of the new post form. The housing
+// is returned also with an error, to show the form again as it was.
+func (h *Handler) parseHousingForm(r *http.Request) (*Housing, error) {
+	housing := &Housing{
+		Kind:         r.FormValue("housing_kind"),
+		Municipality: r.FormValue("municipality"),
+		Furnished:    r.FormValue("furnished") != "",
+	}
+	invalid := func(message string) error {
+		return &FormError{Message: message, Code: http.StatusBadRequest}
+	}
+
+	rooms, roomsErr := strconv.Atoi(strings.TrimSpace(r.FormValue("rooms")))
+	size, sizeErr := strconv.Atoi(strings.TrimSpace(r.FormValue("size_m2")))
+	price, priceErr := strconv.ParseInt(strings.TrimSpace(r.FormValue("housing_price")), 10, 64)
+	available, availableErr := time.ParseInLocation("2006-01-02", r.FormValue("available_from"), h.location)
+	housing.Rooms, housing.Size, housing.Price = rooms, size, price
+	if availableErr == nil {
+		housing.AvailableFrom = available
+	}
+
+	switch {
+	case !contains(HousingKinds, housing.Kind):
+		return housing, invalid("Choose if the home is for rent, a sublet or for sale")
+	case !contains(Municipalities, housing.Municipality):
+		return housing, invalid("Choose the municipality")
+	case roomsErr != nil || rooms < 1 || rooms > 20:
+		return housing, invalid("The number of rooms must be between 1 and 20")
+	case sizeErr != nil || size < 5 || size > 1000:
+		return housing, invalid("The size must be between 5 and 1000 square metres")
+	case priceErr != nil || price < 0 || price > 100_000_000:
+		return housing, invalid("The rent or the price must be a whole number of euros")
+	case availableErr != nil:
+		return housing, invalid("Give the date the home is available from")
+	}
+	return housing, nil
+}
+
+func (h *Handler) saveHousing(tx dbtx, postID int64, housing *Housing) error {
+	done := observeQuery("create_housing")
+	_, err := tx.Exec(`
+		INSERT INTO housing (post_id, kind, municipality, rooms, size_m2, price, available_from, furnished)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, postID, housing.Kind, housing.Municipality, housing.Rooms, housing.Size, housing.Price,
+		housing.AvailableFrom.Format("2006-01-02"), housing.Furnished)
+	done()
+	return err
+}
+
+// getting the housing listings of the posts by post ID
+func (h *Handler) getHousing(postIDs []int64) (map[int64]*Housing, error) {
+	homes := make(map[int64]*Housing)
+	if len(postIDs) == 0 {
+		return homes, nil
+	}
+	done := observeQuery("get_housing")
+	rows, err := h.db.Query(`
+		SELECT post_id, kind, municipality, rooms, size_m2, price, available_from, furnished
+		FROM housing
+		WHERE post_id IN (?`+strings.Repeat(", ?", len(postIDs)-1)+`)
+	`, int64Args(postIDs)...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		var home Housing
+		var available string
+		if err := rows.Scan(&postID, &home.Kind, &home.Municipality, &home.Rooms, &home.Size,
+			&home.Price, &available, &home.Furnished); err != nil {
+			return nil, err
+		}
+		home.AvailableFrom, _ = time.ParseInLocation("2006-01-02", available, h.location)
+		homes[postID] = &home
+	}
+	return homes, rows.Err()
+}
+
+// HousingFilter is the search of the housing category page, it can be saved
+// to get alerts of the new listings that match it
+type HousingFilter struct {
+	Kind         string
+	Municipality string
+	MinRooms     string
+	MinSize      string
+	MaxPrice     string
+	AvailableBy  string
+	Furnished    string //"yes", "no" or empty for both
+	Sort         string
+}
+
+// readHousingFilter reads the housing search of the category page
+func readHousingFilter(query url.Values) *HousingFilter {
+	f := &HousingFilter{
+		Kind:         query.Get("kind"),
+		Municipality: query.Get("municipality"),
+		MinRooms:     strings.TrimSpace(query.Get("min_rooms")),
+		MinSize:      strings.TrimSpace(query.Get("min_size")),
+		MaxPrice:     strings.TrimSpace(query.Get("max_price")),
+		AvailableBy:  query.Get("available_by"),
+		Furnished:    query.Get("furnished"),
+		Sort:         query.Get("sort"),
+	}
+	if !contains(HousingKinds, f.Kind) {
+		f.Kind = ""
+	}
+	if !contains(Municipalities, f.Municipality) {
+		f.Municipality = ""
+	}
+	if _, err := strconv.Atoi(f.MinRooms); err != nil {
+		f.MinRooms = ""
+	}
+	if _, err := strconv.Atoi(f.MinSize); err != nil {
+		f.MinSize = ""
+	}
+	if _, err := strconv.ParseInt(f.MaxPrice, 10, 64); err != nil {
+		f.MaxPrice = ""
+	}
+	if _, err := time.Parse("2006-01-02", f.AvailableBy); err != nil {
+		f.AvailableBy = ""
+	}
+	if f.Furnished != "yes" && f.Furnished != "no" {
+		f.Furnished = ""
+	}
+	if f.Sort != "price_asc" && f.Sort != "price_desc" {
+		f.Sort = ""
+	}
+	return f
+}
+
+// Query is the search as URL parameters, without the order
+func (f *HousingFilter) Query() string {
+	values := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	set("kind", f.Kind)
+	set("municipality", f.Municipality)
+	set("min_rooms", f.MinRooms)
+	set("min_size", f.MinSize)
+	set("max_price", f.MaxPrice)
+	set("available_by", f.AvailableBy)
+	set("furnished", f.Furnished)
+	return values.Encode()
+}
+
+// Summary describes the search in a few words, for the saved searches
+func (f *HousingFilter) Summary() string {
+	var parts []string
+	if f.Kind != "" {
+		parts = append(parts, f.Kind)
+	}
+	if f.Municipality != "" {
+		parts = append(parts, f.Municipality)
+	}
+	if f.MinRooms != "" {
+		parts = append(parts, f.MinRooms+"+ rooms")
+	}
+	if f.MinSize != "" {
+		parts = append(parts, f.MinSize+"+ m²")
+	}
+	if f.MaxPrice != "" {
+		parts = append(parts, "max "+f.MaxPrice+" €")
+	}
+	if f.AvailableBy != "" {
+		parts = append(parts, "available by "+f.AvailableBy)
+	}
+	switch f.Furnished {
+	case "yes":
+		parts = append(parts, "furnished")
+	case "no":
+		parts = append(parts, "unfurnished")
+	}
+	if len(parts) == 0 {
+		return "All homes"
+	}
+	return strings.Join(parts, " · ")
+}
+
+// sql returns the condition and the order of the posts query for the filter
+func (f *HousingFilter) sql() (string, string, []interface{}) {
+	var where strings.Builder
+	var args []interface{}
+	where.WriteString(" AND p.id IN (SELECT post_id FROM housing ho WHERE 1 = 1")
+	add := func(condition string, arg interface{}) {
+		where.WriteString(condition)
+		args = append(args, arg)
+	}
+	if f.Kind != "" {
+		add(" AND ho.kind = ?", f.Kind)
+	}
+	if f.Municipality != "" {
+		add(" AND ho.municipality = ?", f.Municipality)
+	}
+	if rooms, err := strconv.Atoi(f.MinRooms); err == nil {
+		add(" AND ho.rooms >= ?", rooms)
+	}
+	if size, err := strconv.Atoi(f.MinSize); err == nil {
+		add(" AND ho.size_m2 >= ?", size)
+	}
+	if price, err := strconv.ParseInt(f.MaxPrice, 10, 64); err == nil {
+		add(" AND ho.price <= ?", price)
+	}
+	//the dates are saved as 2006-01-02, so they compare as text
+	if f.AvailableBy != "" {
+		add(" AND ho.available_from <= ?", f.AvailableBy)
+	}
+	switch f.Furnished {
+	case "yes":
+		where.WriteString(" AND ho.furnished = 1")
+	case "no":
+		where.WriteString(" AND ho.furnished = 0")
+	}
+	where.WriteString(")")
+
+	order := "p.created_at DESC"
+	switch f.Sort {
+	case "price_asc":
+		order = "(SELECT price FROM housing WHERE post_id = p.id), p.created_at DESC"
+	case "price_desc":
+		order = "(SELECT price FROM housing WHERE post_id = p.id) DESC, p.created_at DESC"
+	}
+	return where.String(), order, args
+}
+
+// SavedSearch is a housing search a user gets alerts of
+type SavedSearch struct {
+	ID         int64
+	CategoryID int64
+	Category   string
+	Filter     *HousingFilter
+	CreatedAt  time.Time
+	Matches    []Post //the new listings that match the search
+}
+
+// URL is the category page with the search
+func (s *SavedSearch) URL() template.URL {
+	return template.URL("/category/" + strconv.FormatInt(s.CategoryID, 10) + "?" + s.Filter.Query())
+}
+
+// alertSavedSearches finds the saved searches the new listing matches and
+// saves an alert for their users. The searches are checked with the same
+// query as the category page, so an alert leads to a listing the search shows.
+func (h *Handler) alertSavedSearches(ctx context.Context, postID, authorID int64) (int, error) {
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT id, category_id, query FROM housing_searches WHERE user_id != ?
+	`, authorID)
+	if err != nil {
+		return 0, err
+	}
+	type search struct {
+		id, categoryID int64
+		query          string
+	}
+	var searches []search
+	for rows.Next() {
+		var s search
+		if err := rows.Scan(&s.id, &s.categoryID, &s.query); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		searches = append(searches, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	alerts := 0
+	for _, s := range searches {
+		values, _ := url.ParseQuery(s.query)
+		where, _, args := readHousingFilter(values).sql()
+		var matches bool
+		err := h.db.QueryRowContext(ctx, `
+			WITH RECURSIVE subtree(id) AS (
+				SELECT ?
+				UNION
+				SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+			)
+			SELECT EXISTS(
+				SELECT 1 FROM posts p
+				JOIN post_categories pc ON pc.post_id = p.id
+				WHERE p.id = ? AND pc.category_id IN (SELECT id FROM subtree)`+where+`
+			)
+		`, append([]interface{}{s.categoryID, postID}, args...)...).Scan(&matches)
+		if err != nil {
+			return alerts, err
+		}
+		if !matches {
+			continue
+		}
+		_, err = h.db.ExecContext(ctx, "INSERT OR IGNORE INTO housing_alerts (search_id, post_id) VALUES (?, ?)", s.id, postID)
+		if err != nil {
+			return alerts, err
+		}
+		alerts++
+	}
+	return alerts, nil
+}
+
+// unseenHousingAlerts counts the alerts of the user that haven't been looked at
+func (h *Handler) unseenHousingAlerts(userID int64) (int, error) {
+	var count int
+	err := h.db.QueryRow(`
+		SELECT COUNT(*) FROM housing_alerts a
+		JOIN housing_searches s ON s.id = a.search_id
+		WHERE s.user_id = ? AND a.seen = 0
+	`, userID).Scan(&count)
+	return count, err
+}
+
+// getSavedSearches returns the saved searches of the user with their unseen
+// matches
+func (h *Handler) getSavedSearches(userID int64) ([]SavedSearch, error) {
+	done := observeQuery("get_housing_searches")
+	rows, err := h.db.Query(`
+		SELECT s.id, s.category_id, c.name, s.query, s.created_at
+		FROM housing_searches s
+		JOIN categories c ON c.id = s.category_id
+		WHERE s.user_id = ?
+		ORDER BY s.created_at DESC
+	`, userID)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	var searches []SavedSearch
+	for rows.Next() {
+		var s SavedSearch
+		var query string
+		if err := rows.Scan(&s.ID, &s.CategoryID, &s.Category, &query, &s.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		values, _ := url.ParseQuery(query)
+		s.Filter = readHousingFilter(values)
+		searches = append(searches, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range searches {
+		rows, err := h.db.Query(`
+			SELECT p.id, p.title, p.content, p.username, p.created_at, p.user_id, p.type
+			FROM housing_alerts a
+			JOIN posts p ON p.id = a.post_id
+			WHERE a.search_id = ? AND a.seen = 0
+			ORDER BY p.created_at DESC
+		`, searches[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var p Post
+			if err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Username, &p.CreatedAt, &p.UserID, &p.Type); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			searches[i].Matches = append(searches[i].Matches, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if err := h.loadPostDetails(searches[i].Matches); err != nil {
+			return nil, err
+		}
+	}
+	return searches, nil
+}
+
+// SavedSearches shows the saved housing searches of the user with the new
+// listings that match them. Looking at the page marks the alerts seen.
+func (h *Handler) SavedSearches(w http.ResponseWriter, r *http.Request) {
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	searches, err := h.getSavedSearches(user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting saved searches", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	_, err = h.db.Exec(`
+		UPDATE housing_alerts SET seen = 1
+		WHERE seen = 0 AND search_id IN (SELECT id FROM housing_searches WHERE user_id = ?)
+	`, user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error marking alerts seen", "err", err)
+	}
+
+	data := TemplateData{
+		Title:         "Saved searches",
+		User:          user,
+		SavedSearches: searches,
+	}
+	if err := h.render(w, r, "saved_searches.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// SavedSearchAPI saves the search of a housing category page
+// (action=save with the search fields and category_id) or removes a saved
+// search (action=delete with id)
+func (h *Handler) SavedSearchAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "save":
+		categoryID, err := strconv.ParseInt(r.FormValue("category_id"), 10, 64)
+		if err != nil {
+			h.ErrorHandler(w, r, "Invalid category ID", http.StatusBadRequest)
+			return
+		}
+		var postType string
+		err = h.db.QueryRow("SELECT post_type FROM categories WHERE id = ?", categoryID).Scan(&postType)
+		if err == sql.ErrNoRows || (err == nil && postType != PostTypeHousing) {
+			h.ErrorHandler(w, r, "Only housing searches can be saved", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			LogFrom(r.Context()).Error("Database error", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		filter := readHousingFilter(r.Form)
+		_, err = h.db.Exec(`
+			INSERT OR IGNORE INTO housing_searches (user_id, category_id, query) VALUES (?, ?, ?)
+		`, user.ID, categoryID, filter.Query())
+		if err != nil {
+			LogFrom(r.Context()).Error("Error saving search", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+
+	case "delete":
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			h.ErrorHandler(w, r, "Invalid search ID", http.StatusBadRequest)
+			return
+		}
+		tx, err := h.db.Begin()
+		if err != nil {
+			LogFrom(r.Context()).Error("Database error", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		result, err := tx.Exec("DELETE FROM housing_searches WHERE id = ? AND user_id = ?", id, user.ID)
+		if err == nil {
+			var n int64
+			if n, err = result.RowsAffected(); err == nil && n == 0 {
+				h.ErrorHandler(w, r, "Search not found", http.StatusNotFound)
+				return
+			}
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM housing_alerts WHERE search_id = ?", id)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			LogFrom(r.Context()).Error("Error deleting search", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		h.ErrorHandler(w, r, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/housing/searches", http.StatusSeeOther)
+}
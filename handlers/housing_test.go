@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReadHousingFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  HousingFilter
+	}{
+		{"", HousingFilter{}},
+		{
+			"kind=" + HousingRent + "&municipality=Jomala&min_rooms=2&min_size=40&max_price=900&available_by=2026-09-01&furnished=no&sort=price_desc",
+			HousingFilter{Kind: HousingRent, Municipality: "Jomala", MinRooms: "2", MinSize: "40", MaxPrice: "900", AvailableBy: "2026-09-01", Furnished: "no", Sort: "price_desc"},
+		},
+		{
+			"kind=castle&municipality=Stockholm&min_rooms=two&min_size=big&max_price=cheap&available_by=soon&furnished=maybe&sort=random",
+			HousingFilter{},
+		},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readHousingFilter(query); *got != tt.want {
+			t.Errorf("readHousingFilter(%q) = %+v, want %+v", tt.query, *got, tt.want)
+		}
+	}
+}
+
+func TestHousingFilterSQL(t *testing.T) {
+	h := newTestHandler(t)
+	landlord := addUser(t, h, "landlord")
+	start := time.Now().Add(-time.Hour)
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	//the homes from the oldest to the newest
+	homes := []Housing{
+		{Kind: HousingRent, Municipality: "Mariehamn", Rooms: 2, Size: 45, Price: 750, AvailableFrom: day("2026-08-01"), Furnished: true},
+		{Kind: HousingRent, Municipality: "Jomala", Rooms: 4, Size: 90, Price: 1100, AvailableFrom: day("2026-10-01")},
+		{Kind: HousingSale, Municipality: "Mariehamn", Rooms: 3, Size: 70, Price: 180000, AvailableFrom: day("2026-09-01")},
+		{Kind: HousingSublet, Municipality: "Mariehamn", Rooms: 1, Size: 25, Price: 450, AvailableFrom: day("2026-07-01"), Furnished: true},
+	}
+	var ids []int64
+	for i := range homes {
+		postID := addPost(t, h, landlord, PostTypeHousing, start.Add(time.Duration(i)*time.Minute))
+		if err := h.saveHousing(h.db, postID, &homes[i]); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, postID)
+	}
+
+	tests := []struct {
+		name   string
+		filter HousingFilter
+		want   []int64
+	}{
+		{"everything, newest first", HousingFilter{}, []int64{ids[3], ids[2], ids[1], ids[0]}},
+		{"kind", HousingFilter{Kind: HousingRent}, []int64{ids[1], ids[0]}},
+		{"municipality", HousingFilter{Municipality: "Jomala"}, []int64{ids[1]}},
+		{"rooms and size", HousingFilter{MinRooms: "2", MinSize: "50"}, []int64{ids[2], ids[1]}},
+		{"price", HousingFilter{MaxPrice: "750"}, []int64{ids[3], ids[0]}},
+		{"available by the day", HousingFilter{AvailableBy: "2026-08-01"}, []int64{ids[3], ids[0]}},
+		{"furnished", HousingFilter{Furnished: "yes"}, []int64{ids[3], ids[0]}},
+		{"unfurnished", HousingFilter{Furnished: "no"}, []int64{ids[2], ids[1]}},
+		{"cheapest first", HousingFilter{Kind: HousingRent, Sort: "price_asc"}, []int64{ids[0], ids[1]}},
+		{"dearest first", HousingFilter{Sort: "price_desc"}, []int64{ids[2], ids[1], ids[0], ids[3]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, order, args := tt.filter.sql()
+			if got := filteredPosts(t, h, where, order, args); !sameIDs(got, tt.want) {
+				t.Errorf("got posts %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
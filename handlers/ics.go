@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the format of the UTC times in iCalendar
+const icsTimeFormat = "20060102T150405Z"
+
+// icsEscape escapes a TEXT value of iCalendar (RFC 5545 3.3.11)
+func icsEscape(value string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", "",
+	).Replace(value)
+}
+
+// icsLine writes a content line folded to 75 octets, without cutting a
+// UTF-8 character in half (RFC 5545 3.1)
+func icsLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		//the space of the folded line counts too
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// baseURL is the address of the forum as the client sees it
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// writeICS writes the events as an iCalendar file
+func writeICS(w http.ResponseWriter, r *http.Request, name string, posts []Post) {
+	var b strings.Builder
+	icsLine(&b, "BEGIN:VCALENDAR")
+	icsLine(&b, "VERSION:2.0")
+	icsLine(&b, "PRODID:-//Aland Forum//Events//EN")
+	icsLine(&b, "CALSCALE:GREGORIAN")
+	icsLine(&b, "METHOD:PUBLISH")
+	icsLine(&b, "X-WR-CALNAME:"+icsEscape(name))
+
+	host := strings.Split(r.Host, ":")[0]
+	for _, p := range posts {
+		if p.Event == nil {
+			continue
+		}
+		url := baseURL(r) + "/post/" + strconv.FormatInt(p.ID, 10)
+		icsLine(&b, "BEGIN:VEVENT")
+		icsLine(&b, fmt.Sprintf("UID:event-%d@%s", p.ID, host))
+		icsLine(&b, "DTSTAMP:"+p.CreatedAt.UTC().Format(icsTimeFormat))
+		icsLine(&b, "DTSTART:"+p.Event.StartsAt.UTC().Format(icsTimeFormat))
+		icsLine(&b, "DTEND:"+p.Event.EndsAt.UTC().Format(icsTimeFormat))
+		icsLine(&b, "SUMMARY:"+icsEscape(p.Title))
+		icsLine(&b, "LOCATION:"+icsEscape(p.Event.Venue))
+		icsLine(&b, "DESCRIPTION:"+icsEscape(p.Content))
+		icsLine(&b, "URL:"+url)
+		icsLine(&b, "END:VEVENT")
+	}
+	icsLine(&b, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// EventICS serves one event as an .ics file, /event/{id}.ics
+func (h *Handler) EventICS(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/event/"), ".ics")
+	if !ok {
+		h.ErrorHandler(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		h.ErrorHandler(w, r, "Event not found", http.StatusNotFound)
+		return
+	}
+	post, err := h.getPostByID(id)
+	if err != nil || post.Event == nil {
+		h.ErrorHandler(w, r, "Event not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="event-%d.ics"`, post.ID))
+	writeICS(w, r, post.Title, []Post{*post})
+}
+
+// EventFeed serves the events of the last three months and the coming two
+// years as a calendar the calendar apps can subscribe to, /events.ics
+func (h *Handler) EventFeed(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	posts, err := h.getEventPosts(now.AddDate(0, -3, 0), now.AddDate(2, 0, 0), 1000)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting events", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=900")
+	writeICS(w, r, "Åland forum events", posts)
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestICSEscape(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"Midsummer", "Midsummer"},
+		{"Mariehamn, Åland; harbour", `Mariehamn\, Åland\; harbour`},
+		{`C:\path`, `C:\\path`},
+		{"one\r\ntwo\nthree\rfour", `one\ntwo\nthreefour`},
+	}
+	for _, tt := range tests {
+		if got := icsEscape(tt.value); got != tt.want {
+			t.Errorf("icsEscape(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestICSLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"short", "SUMMARY:Midsummer"},
+		{"exactly 75", "DESCRIPTION:" + strings.Repeat("a", 63)},
+		{"long", "DESCRIPTION:" + strings.Repeat("a", 200)},
+		{"multibyte at the fold", "DESCRIPTION:" + strings.Repeat("å", 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			icsLine(&b, tt.line)
+			out := b.String()
+			if !strings.HasSuffix(out, "\r\n") {
+				t.Fatalf("%q doesn't end with CRLF", out)
+			}
+			for _, physical := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+				if len(physical) > 75 {
+					t.Errorf("line of %d octets: %q", len(physical), physical)
+				}
+				if !utf8.ValidString(physical) {
+					t.Errorf("a character was cut in half: %q", physical)
+				}
+			}
+			//unfolding removes the CRLF and the space after it
+			if unfolded := strings.ReplaceAll(strings.TrimSuffix(out, "\r\n"), "\r\n ", ""); unfolded != tt.line {
+				t.Errorf("unfolded %q, want %q", unfolded, tt.line)
+			}
+		})
+	}
+}
+
+func TestWriteICS(t *testing.T) {
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("no time zone data")
+	}
+	starts := time.Date(2026, 6, 19, 18, 0, 0, 0, helsinki)
+	posts := []Post{
+		{
+			ID:        7,
+			Title:     "Midsummer, by the sea",
+			Content:   "Bring food\nand a jacket",
+			CreatedAt: time.Date(2026, 5, 1, 12, 0, 0, 0, helsinki),
+			Event:     &Event{StartsAt: starts, EndsAt: starts.Add(4 * time.Hour), Venue: "Mariehamn"},
+		},
+		{ID: 8, Title: "Not an event"},
+	}
+
+	r := httptest.NewRequest("GET", "/events.ics", nil)
+	r.Host = "forum.example:8080"
+	w := httptest.NewRecorder()
+	writeICS(w, r, "Åland forum events", posts)
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/calendar; charset=utf-8" {
+		t.Errorf("Content-Type is %q", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"X-WR-CALNAME:Åland forum events\r\n",
+		"UID:event-7@forum.example\r\n",
+		"DTSTAMP:20260501T090000Z\r\n",
+		"DTSTART:20260619T150000Z\r\n",
+		"DTEND:20260619T190000Z\r\n",
+		"SUMMARY:Midsummer\\, by the sea\r\n",
+		"LOCATION:Mariehamn\r\n",
+		"DESCRIPTION:Bring food\\nand a jacket\r\n",
+		"URL:http://forum.example:8080/post/7\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the calendar has no %q:\n%s", want, body)
+		}
+	}
+	if n := strings.Count(body, "BEGIN:VEVENT"); n != 1 {
+		t.Errorf("%d events, want 1, a post without an event is left out", n)
+	}
+}
@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the statuses of a job posting, it closes at the application deadline
+const (
+	JobOpen   = "open"
+	JobClosed = "closed"
+)
+
+var (
+	EmploymentTypes = []string{"full-time", "part-time", "summer job", "temporary", "internship", "freelance"}
+	JobLanguages    = []string{"Swedish", "Finnish", "English"}
+	SalaryPeriods   = []string{"hour", "month", "year"}
+)
+
+// the schema.org names of the employment types
+var schemaEmploymentTypes = map[string]string{
+	"full-time":  "FULL_TIME",
+	"part-time":  "PART_TIME",
+	"summer job": "TEMPORARY",
+	"temporary":  "TEMPORARY",
+	"internship": "INTERN",
+	"freelance":  "CONTRACTOR",
+}
+
+// Job is a post of the job board. The salary is in whole euros.
+type Job struct {
+	Employer       string
+	Role           string
+	EmploymentType string
+	SalaryMin      int64
+	SalaryMax      int64
+	HasSalary      bool
+	SalaryPeriod   string
+	Languages      []string
+	Deadline       time.Time //the applications close at this time, midnight after the last day
+	Status         string
+}
+
+// Salary formats the salary range for the pages, like "2500–3000 € / month"
+func (j *Job) Salary() string {
+	if !j.HasSalary {
+		return ""
+	}
+	salary := strconv.FormatInt(j.SalaryMin, 10)
+	if j.SalaryMax != j.SalaryMin {
+		salary += "–" + strconv.FormatInt(j.SalaryMax, 10)
+	}
+	return salary + " € / " + j.SalaryPeriod
+}
+
+// LastDay is the last day to apply, the deadline is the midnight after it
+func (j *Job) LastDay() time.Time {
+	return j.Deadline.Add(-time.Minute)
+}
+
+// DeadlineInput is the last day to apply for the form
+func (j *Job) DeadlineInput() string {
+	if j.Deadline.IsZero() {
+		return ""
+	}
+	return j.LastDay().Format("2006-01-02")
+}
+
+// Requires tells if the language is required, for the form
+func (j *Job) Requires(language string) bool {
+	return contains(j.Languages, language)
+}
+
+// JobPosting is the schema.org JobPosting of the post as JSON-LD, so search
+// engines can show the job. The JSON encoder escapes <, > and &, so the
+// content can't break out of the script tag.
+func (p *Post) JobPosting() template.JS {
+	if p.Job == nil {
+		return ""
+	}
+	job := p.Job
+	posting := map[string]interface{}{
+		"@context":       "https://schema.org/",
+		"@type":          "JobPosting",
+		"title":          job.Role,
+		"description":    p.Content,
+		"datePosted":     p.CreatedAt.Format("2006-01-02"),
+		"validThrough":   job.Deadline.Format(time.RFC3339),
+		"employmentType": schemaEmploymentTypes[job.EmploymentType],
+		"hiringOrganization": map[string]interface{}{
+			"@type": "Organization",
+			"name":  job.Employer,
+		},
+		"jobLocation": map[string]interface{}{
+			"@type": "Place",
+			"address": map[string]interface{}{
+				"@type":          "PostalAddress",
+				"addressRegion":  "Åland",
+				"addressCountry": "AX",
+			},
+		},
+	}
+	if job.HasSalary {
+		posting["baseSalary"] = map[string]interface{}{
+			"@type":    "MonetaryAmount",
+			"currency": "EUR",
+			"value": map[string]interface{}{
+				"@type":    "QuantitativeValue",
+				"minValue": job.SalaryMin,
+				"maxValue": job.SalaryMax,
+				"unitText": strings.ToUpper(job.SalaryPeriod),
+			},
+		}
+	}
+	if len(job.Languages) > 0 {
+		posting["qualifications"] = "Languages: " + strings.Join(job.Languages, ", ")
+	}
+	data, err := json.Marshal(posting)
+	if err != nil {
+		return ""
+	}
+	return template.JS(data)
+}
+
+// parseSalary reads a salary in whole euros, an empty value is 0
+func parseSalary(value string) (int64, bool, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false, nil
+	}
+	salary, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || salary < 0 || salary > 10_000_000 {
+		return 0, false, strconv.ErrSyntax
+	}
+	return salary, true, nil
+}
+
+// parseJobForm reads the job fields of the new post form. The job is
+// returned also with an error, to show the form again as it was.
+func (h *Handler) parseJobForm(r *http.Request) (*Job, error) {
+	job := &Job{
+		Employer:       strings.TrimSpace(r.FormValue("employer")),
+		Role:           strings.TrimSpace(r.FormValue("role")),
+		EmploymentType: r.FormValue("employment_type"),
+		SalaryPeriod:   r.FormValue("salary_period"),
+		Status:         JobOpen,
+	}
+	for _, language := range r.Form["languages"] {
+		if contains(JobLanguages, language) && !contains(job.Languages, language) {
+			job.Languages = append(job.Languages, language)
+		}
+	}
+	invalid := func(message string) error {
+		return &FormError{Message: message, Code: http.StatusBadRequest}
+	}
+
+	//the deadline is the end of the last day to apply in the forum's time zone
+	lastDay, err := time.ParseInLocation("2006-01-02", r.FormValue("deadline"), h.location)
+	if err == nil {
+		job.Deadline = time.Date(lastDay.Year(), lastDay.Month(), lastDay.Day()+1, 0, 0, 0, 0, h.location)
+	}
+
+	min, hasMin, minErr := parseSalary(r.FormValue("salary_min"))
+	max, hasMax, maxErr := parseSalary(r.FormValue("salary_max"))
+	if hasMin && !hasMax {
+		max = min
+	}
+	if hasMax && !hasMin {
+		min = max
+	}
+	job.SalaryMin, job.SalaryMax, job.HasSalary = min, max, hasMin || hasMax
+
+	switch {
+	case job.Employer == "":
+		return job, invalid("Give the employer")
+	case job.Role == "":
+		return job, invalid("Give the role")
+	case len(job.Employer) > 100 || len(job.Role) > 100:
+		return job, invalid("The employer and the role can be at most 100 characters")
+	case !contains(EmploymentTypes, job.EmploymentType):
+		return job, invalid("Choose the employment type")
+	case minErr != nil || maxErr != nil:
+		return job, invalid("The salary must be a whole number of euros")
+	case job.SalaryMax < job.SalaryMin:
+		return job, invalid("The highest salary can't be lower than the lowest")
+	case job.HasSalary && !contains(SalaryPeriods, job.SalaryPeriod):
+		return job, invalid("Choose if the salary is per hour, month or year")
+	case err != nil:
+		return job, invalid("Give the last day to apply")
+	case !job.Deadline.After(time.Now()):
+		return job, invalid("The last day to apply has passed")
+	case job.Deadline.After(time.Now().AddDate(1, 0, 0)):
+		return job, invalid("The last day to apply can be at most a year away")
+	}
+	if !job.HasSalary {
+		job.SalaryPeriod = ""
+	}
+	return job, nil
+}
+
+func (h *Handler) saveJob(tx dbtx, postID int64, job *Job) error {
+	var min, max interface{}
+	if job.HasSalary {
+		min, max = job.SalaryMin, job.SalaryMax
+	}
+	done := observeQuery("create_job")
+	_, err := tx.Exec(`
+		INSERT INTO jobs (post_id, employer, role, employment_type, salary_min, salary_max,
+			salary_period, languages, deadline, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, postID, job.Employer, job.Role, job.EmploymentType, min, max,
+		job.SalaryPeriod, strings.Join(job.Languages, ","), job.Deadline.UTC(), JobOpen)
+	done()
+	return err
+}
+
+// getting the jobs of the posts by post ID
+func (h *Handler) getJobs(postIDs []int64) (map[int64]*Job, error) {
+	jobs := make(map[int64]*Job)
+	if len(postIDs) == 0 {
+		return jobs, nil
+	}
+	done := observeQuery("get_jobs")
+	rows, err := h.db.Query(`
+		SELECT post_id, employer, role, employment_type, salary_min, salary_max,
+		salary_period, languages, deadline, status
+		FROM jobs
+		WHERE post_id IN (?`+strings.Repeat(", ?", len(postIDs)-1)+`)
+	`, int64Args(postIDs)...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		var j Job
+		var min, max sql.NullInt64
+		var languages string
+		if err := rows.Scan(&postID, &j.Employer, &j.Role, &j.EmploymentType, &min, &max,
+			&j.SalaryPeriod, &languages, &j.Deadline, &j.Status); err != nil {
+			return nil, err
+		}
+		j.SalaryMin, j.SalaryMax, j.HasSalary = min.Int64, max.Int64, min.Valid
+		if languages != "" {
+			j.Languages = strings.Split(languages, ",")
+		}
+		j.Deadline = j.Deadline.In(h.location)
+		jobs[postID] = &j
+	}
+	return jobs, rows.Err()
+}
+
+// JobFilter is the filter and the order of the jobs on the category page
+type JobFilter struct {
+	EmploymentType string
+	Language       string
+	MinSalary      string
+	Status         string
+	Sort           string
+}
+
+// readJobFilter reads the job filters of the category page
+func readJobFilter(query url.Values) *JobFilter {
+	f := &JobFilter{
+		EmploymentType: query.Get("employment_type"),
+		Language:       query.Get("language"),
+		MinSalary:      strings.TrimSpace(query.Get("min_salary")),
+		Status:         query.Get("status"),
+		Sort:           query.Get("sort"),
+	}
+	if !contains(EmploymentTypes, f.EmploymentType) {
+		f.EmploymentType = ""
+	}
+	if !contains(JobLanguages, f.Language) {
+		f.Language = ""
+	}
+	//the open jobs are shown by default
+	if f.Status != JobClosed && f.Status != "all" {
+		f.Status = JobOpen
+	}
+	return f
+}
+
+// sql returns the condition and the order of the posts query for the filter
+func (f *JobFilter) sql() (string, string, []interface{}) {
+	var where strings.Builder
+	var args []interface{}
+	where.WriteString(" AND p.id IN (SELECT post_id FROM jobs j WHERE 1 = 1")
+	if f.EmploymentType != "" {
+		where.WriteString(" AND j.employment_type = ?")
+		args = append(args, f.EmploymentType)
+	}
+	if f.Language != "" {
+		where.WriteString(" AND (',' || j.languages || ',') LIKE ?")
+		args = append(args, "%,"+f.Language+",%")
+	}
+	//a salary filter compares the top of the range and leaves out the jobs without a salary
+	if salary, ok, err := parseSalary(f.MinSalary); err == nil && ok {
+		where.WriteString(" AND j.salary_max >= ?")
+		args = append(args, salary)
+	}
+	if f.Status != "all" {
+		where.WriteString(" AND j.status = ?")
+		args = append(args, f.Status)
+	}
+	where.WriteString(")")
+
+	order := "p.created_at DESC"
+	if f.Sort == "deadline" {
+		order = "(SELECT deadline FROM jobs WHERE post_id = p.id), p.created_at DESC"
+	}
+	return where.String(), order, args
+}
+
+// CloseJobs closes the open jobs whose application deadline has passed
+func CloseJobs(ctx context.Context, db *sql.DB) (int64, error) {
+	result, err := db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, closed_at = CURRENT_TIMESTAMP
+		WHERE status = ? AND deadline <= ?
+	`, JobClosed, JobOpen, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReadJobFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  JobFilter
+	}{
+		{"", JobFilter{Status: JobOpen}},
+		{"employment_type=part-time&language=Finnish&status=closed", JobFilter{EmploymentType: "part-time", Language: "Finnish", Status: JobClosed}},
+		{"employment_type=gig&language=Klingon&status=deleted", JobFilter{Status: JobOpen}},
+		{"status=all&min_salary=+2000+&sort=deadline", JobFilter{Status: "all", MinSalary: "2000", Sort: "deadline"}},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readJobFilter(query); *got != tt.want {
+			t.Errorf("readJobFilter(%q) = %+v, want %+v", tt.query, *got, tt.want)
+		}
+	}
+}
+
+func TestJobFilterSQL(t *testing.T) {
+	h := newTestHandler(t)
+	employer := addUser(t, h, "employer")
+	start := time.Now().Add(-time.Hour)
+	deadline := time.Now().AddDate(0, 1, 0)
+
+	//the jobs from the oldest to the newest
+	jobs := []Job{
+		{EmploymentType: "full-time", Languages: []string{"Swedish", "English"}, HasSalary: true, SalaryMin: 2500, SalaryMax: 3000, Deadline: deadline.AddDate(0, 0, 3)},
+		{EmploymentType: "summer job", Languages: []string{"Swedish"}, Deadline: deadline.AddDate(0, 0, 1)},
+		{EmploymentType: "full-time", Languages: []string{"Finnish"}, HasSalary: true, SalaryMin: 1800, SalaryMax: 2200, Deadline: deadline.AddDate(0, 0, 2)},
+		{EmploymentType: "part-time", Languages: []string{"English"}, HasSalary: true, SalaryMin: 4000, SalaryMax: 4000, Deadline: deadline},
+	}
+	var ids []int64
+	for i := range jobs {
+		postID := addPost(t, h, employer, PostTypeJob, start.Add(time.Duration(i)*time.Minute))
+		if err := h.saveJob(h.db, postID, &jobs[i]); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, postID)
+	}
+	exec(t, h.db, "UPDATE jobs SET status = ? WHERE post_id = ?", JobClosed, ids[3])
+
+	tests := []struct {
+		name   string
+		filter JobFilter
+		want   []int64
+	}{
+		{"open, newest first", JobFilter{Status: JobOpen}, []int64{ids[2], ids[1], ids[0]}},
+		{"closed", JobFilter{Status: JobClosed}, []int64{ids[3]}},
+		{"employment type", JobFilter{Status: JobOpen, EmploymentType: "full-time"}, []int64{ids[2], ids[0]}},
+		{"language among many", JobFilter{Status: "all", Language: "English"}, []int64{ids[3], ids[0]}},
+		{"minimum salary against the top of the range", JobFilter{Status: "all", MinSalary: "2200"}, []int64{ids[3], ids[2], ids[0]}},
+		{"invalid salary is ignored", JobFilter{Status: JobOpen, MinSalary: "lots"}, []int64{ids[2], ids[1], ids[0]}},
+		{"closest deadline first", JobFilter{Status: "all", Sort: "deadline"}, []int64{ids[3], ids[1], ids[2], ids[0]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, order, args := tt.filter.sql()
+			if got := filteredPosts(t, h, where, order, args); !sameIDs(got, tt.want) {
+				t.Errorf("got posts %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listing kinds and statuses
+const (
+	ListingForSale = "sale"
+	ListingWanted  = "wanted"
+
+	ListingOpen   = "open"
+	ListingSold   = "sold"
+	ListingClosed = "closed"
+)
+
+var (
+	Currencies        = []string{"EUR", "SEK", "USD"}
+	ListingConditions = []string{"new", "like new", "good", "fair", "for parts"}
+)
+
+// Listing is a post of the marketplace
+type Listing struct {
+	Kind       string
+	PriceCents int64
+	HasPrice   bool //the price can be left out, e.g. when giving away or asking
+	Currency   string
+	Condition  string
+	Location   string
+	Status     string
+	ExpiresAt  time.Time
+}
+
+// Price formats the price for the pages, like "12.50 EUR"
+func (l *Listing) Price() string {
+	if !l.HasPrice {
+		return ""
+	}
+	return l.Amount() + " " + l.Currency
+}
+
+// Amount is the price without the currency, for the form
+func (l *Listing) Amount() string {
+	if !l.HasPrice {
+		return ""
+	}
+	return fmt.Sprintf("%d.%02d", l.PriceCents/100, l.PriceCents%100)
+}
+
+// ListingFilter is the filter and the order of the listings on the category page
+type ListingFilter struct {
+	Kind      string
+	Status    string
+	Condition string
+	MinPrice  string
+	MaxPrice  string
+	Sort      string
+}
+
+// parsePrice reads a price like "12", "12.5" or "12,50" into cents
+func parsePrice(value string) (int64, error) {
+	value = strings.ReplaceAll(strings.TrimSpace(value), ",", ".")
+	whole, fraction, _ := strings.Cut(value, ".")
+	if len(fraction) > 2 {
+		return 0, fmt.Errorf("invalid price %q", value)
+	}
+	for len(fraction) < 2 {
+		fraction += "0"
+	}
+	euros, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || euros < 0 || euros > 100_000_000 {
+		return 0, fmt.Errorf("invalid price %q", value)
+	}
+	cents, err := strconv.ParseInt(fraction, 10, 64)
+	if err != nil || cents < 0 {
+		return 0, fmt.Errorf("invalid price %q", value)
+	}
+	return euros*100 + cents, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseListingForm reads the listing fields of the new post form. The listing
+// is returned also with an error, to show the form again as it was.
+func parseListingForm(r *http.Request) (*Listing, error) {
+	listing := &Listing{
+		Kind:      r.FormValue("listing_kind"),
+		Currency:  r.FormValue("currency"),
+		Condition: r.FormValue("condition"),
+		Location:  strings.TrimSpace(r.FormValue("location")),
+		Status:    ListingOpen,
+	}
+	invalid := func(message string) error {
+		return &FormError{Message: message, Code: http.StatusBadRequest}
+	}
+
+	if listing.Kind != ListingForSale && listing.Kind != ListingWanted {
+		return listing, invalid("Choose if the listing is for sale or wanted")
+	}
+	if listing.Currency == "" {
+		listing.Currency = "EUR"
+	}
+	if !contains(Currencies, listing.Currency) {
+		return listing, invalid("Invalid currency")
+	}
+	if listing.Condition != "" && !contains(ListingConditions, listing.Condition) {
+		return listing, invalid("Invalid condition")
+	}
+	if len(listing.Location) > 100 {
+		return listing, invalid("The location can be at most 100 characters")
+	}
+	if price := r.FormValue("price"); strings.TrimSpace(price) != "" {
+		cents, err := parsePrice(price)
+		if err != nil {
+			return listing, invalid("The price must be a number like 12 or 12.50")
+		}
+		listing.PriceCents = cents
+		listing.HasPrice = true
+	}
+	return listing, nil
+}
+
+func (h *Handler) saveListing(tx dbtx, postID int64, listing *Listing) error {
+	var price interface{}
+	if listing.HasPrice {
+		price = listing.PriceCents
+	}
+	done := observeQuery("create_listing")
+	_, err := tx.Exec(`
+		INSERT INTO listings (post_id, kind, price_cents, currency, condition, location, status, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, postID, listing.Kind, price, listing.Currency, listing.Condition, listing.Location,
+		ListingOpen, time.Now().UTC().Add(h.listingTTL))
+	done()
+	return err
+}
+
+// getting the listings of the posts by post ID
+func (h *Handler) getListings(postIDs []int64) (map[int64]*Listing, error) {
+	listings := make(map[int64]*Listing)
+	if len(postIDs) == 0 {
+		return listings, nil
+	}
+	done := observeQuery("get_listings")
+	rows, err := h.db.Query(`
+		SELECT post_id, kind, price_cents, currency, condition, location, status, expires_at
+		FROM listings
+		WHERE post_id IN (?`+strings.Repeat(", ?", len(postIDs)-1)+`)
+	`, int64Args(postIDs)...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		var l Listing
+		var price sql.NullInt64
+		if err := rows.Scan(&postID, &l.Kind, &price, &l.Currency, &l.Condition, &l.Location, &l.Status, &l.ExpiresAt); err != nil {
+			return nil, err
+		}
+		l.PriceCents, l.HasPrice = price.Int64, price.Valid
+		l.ExpiresAt = l.ExpiresAt.In(h.location)
+		listings[postID] = &l
+	}
+	return listings, rows.Err()
+}
+
+// readListingFilter reads the listing filters of the category page
+func readListingFilter(query url.Values) *ListingFilter {
+	f := &ListingFilter{
+		Kind:      query.Get("kind"),
+		Status:    query.Get("status"),
+		Condition: query.Get("condition"),
+		MinPrice:  strings.TrimSpace(query.Get("min_price")),
+		MaxPrice:  strings.TrimSpace(query.Get("max_price")),
+		Sort:      query.Get("sort"),
+	}
+	if f.Kind != ListingForSale && f.Kind != ListingWanted {
+		f.Kind = ""
+	}
+	//the open listings are shown by default
+	if f.Status != ListingSold && f.Status != ListingClosed && f.Status != "all" {
+		f.Status = ListingOpen
+	}
+	if !contains(ListingConditions, f.Condition) {
+		f.Condition = ""
+	}
+	return f
+}
+
+// sql returns the condition and the order of the posts query for the filter
+func (f *ListingFilter) sql() (string, string, []interface{}) {
+	var where strings.Builder
+	var args []interface{}
+	where.WriteString(" AND p.id IN (SELECT post_id FROM listings l WHERE 1 = 1")
+	if f.Kind != "" {
+		where.WriteString(" AND l.kind = ?")
+		args = append(args, f.Kind)
+	}
+	if f.Status != "all" {
+		where.WriteString(" AND l.status = ?")
+		args = append(args, f.Status)
+	}
+	if f.Condition != "" {
+		where.WriteString(" AND l.condition = ?")
+		args = append(args, f.Condition)
+	}
+	if cents, err := parsePrice(f.MinPrice); err == nil && f.MinPrice != "" {
+		where.WriteString(" AND l.price_cents >= ?")
+		args = append(args, cents)
+	}
+	if cents, err := parsePrice(f.MaxPrice); err == nil && f.MaxPrice != "" {
+		where.WriteString(" AND l.price_cents <= ?")
+		args = append(args, cents)
+	}
+	where.WriteString(")")
+
+	//the listings without a price go last
+	order := "p.created_at DESC"
+	switch f.Sort {
+	case "price_asc":
+		order = "(SELECT price_cents IS NULL FROM listings WHERE post_id = p.id), (SELECT price_cents FROM listings WHERE post_id = p.id), p.created_at DESC"
+	case "price_desc":
+		order = "(SELECT price_cents IS NULL FROM listings WHERE post_id = p.id), (SELECT price_cents FROM listings WHERE post_id = p.id) DESC, p.created_at DESC"
+	}
+	return where.String(), order, args
+}
+
+// ListingStatus lets the seller, or an admin, mark the listing sold or closed,
+// or open it again for another period
+func (h *Handler) ListingStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	postID, err := strconv.ParseInt(r.FormValue("post_id"), 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Invalid post ID", http.StatusBadRequest)
+		return
+	}
+	status := r.FormValue("status")
+	if status != ListingOpen && status != ListingSold && status != ListingClosed {
+		h.ErrorHandler(w, r, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	var ownerID int64
+	var title string
+	err = h.db.QueryRow(`
+		SELECT p.user_id, p.title FROM posts p JOIN listings l ON l.post_id = p.id WHERE p.id = ?
+	`, postID).Scan(&ownerID, &title)
+	if err == sql.ErrNoRows {
+		h.ErrorHandler(w, r, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if ownerID != user.ID && !user.IsAdmin {
+		h.ErrorHandler(w, r, "Only the seller can change the listing", http.StatusForbidden)
+		return
+	}
+
+	if status == ListingOpen {
+		_, err = h.db.Exec("UPDATE listings SET status = ?, closed_at = NULL, expires_at = ? WHERE post_id = ?",
+			status, time.Now().UTC().Add(h.listingTTL), postID)
+	} else {
+		_, err = h.db.Exec("UPDATE listings SET status = ?, closed_at = CURRENT_TIMESTAMP WHERE post_id = ?", status, postID)
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error changing listing status", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	//the seller is told when an admin changes their listing
+	h.notify(r.Context(), Notification{
+		UserID:  ownerID,
+		ActorID: user.ID,
+		Type:    NotifyModeration,
+		PostID:  postID,
+		Message: fmt.Sprintf("A moderator marked your listing “%s” %s", title, status),
+	})
+	http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+}
+
+// ExpireListings closes the open listings that have passed their expiry time
+func ExpireListings(ctx context.Context, db *sql.DB) (int64, error) {
+	result, err := db.ExecContext(ctx, `
+		UPDATE listings SET status = ?, closed_at = CURRENT_TIMESTAMP
+		WHERE status = ? AND expires_at < ?
+	`, ListingClosed, ListingOpen, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"12", 1200, false},
+		{"12.5", 1250, false},
+		{"12,50", 1250, false},
+		{" 0.99 ", 99, false},
+		{"100000000", 10_000_000_000, false},
+		{"100000001", 0, true},
+		{"12.505", 0, true},
+		{"-1", 0, true},
+		{"abc", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePrice(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePrice(%q) = %d, %v, want %d, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestReadListingFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  ListingFilter
+	}{
+		{"", ListingFilter{Status: ListingOpen}},
+		{"kind=wanted&status=sold&condition=good", ListingFilter{Kind: "wanted", Status: "sold", Condition: "good"}},
+		{"kind=gift&status=deleted&condition=broken", ListingFilter{Status: ListingOpen}},
+		{"status=all&min_price=+5+&sort=price_asc", ListingFilter{Status: "all", MinPrice: "5", Sort: "price_asc"}},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readListingFilter(query); *got != tt.want {
+			t.Errorf("readListingFilter(%q) = %+v, want %+v", tt.query, *got, tt.want)
+		}
+	}
+}
+
+func TestListingFilterSQL(t *testing.T) {
+	h := newTestHandler(t)
+	seller := addUser(t, h, "seller")
+	start := time.Now().Add(-time.Hour)
+
+	//the listings from the oldest to the newest
+	listings := []Listing{
+		{Kind: ListingForSale, Condition: "good", PriceCents: 1000, HasPrice: true},
+		{Kind: ListingForSale, Condition: "new", PriceCents: 5000, HasPrice: true},
+		{Kind: ListingWanted},
+		{Kind: ListingForSale, Condition: "good", PriceCents: 2500, HasPrice: true},
+	}
+	var ids []int64
+	for i := range listings {
+		postID := addPost(t, h, seller, PostTypeListing, start.Add(time.Duration(i)*time.Minute))
+		if err := h.saveListing(h.db, postID, &listings[i]); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, postID)
+	}
+	exec(t, h.db, "UPDATE listings SET status = ? WHERE post_id = ?", ListingSold, ids[3])
+
+	tests := []struct {
+		name   string
+		filter ListingFilter
+		want   []int64
+	}{
+		{"open, newest first", ListingFilter{Status: ListingOpen}, []int64{ids[2], ids[1], ids[0]}},
+		{"all", ListingFilter{Status: "all"}, []int64{ids[3], ids[2], ids[1], ids[0]}},
+		{"sold", ListingFilter{Status: ListingSold}, []int64{ids[3]}},
+		{"kind", ListingFilter{Status: ListingOpen, Kind: ListingWanted}, []int64{ids[2]}},
+		{"condition", ListingFilter{Status: "all", Condition: "good"}, []int64{ids[3], ids[0]}},
+		{"price range", ListingFilter{Status: "all", MinPrice: "20", MaxPrice: "50,00"}, []int64{ids[3], ids[1]}},
+		{"invalid price is ignored", ListingFilter{Status: ListingOpen, MinPrice: "cheap"}, []int64{ids[2], ids[1], ids[0]}},
+		{"cheapest first, no price last", ListingFilter{Status: "all", Sort: "price_asc"}, []int64{ids[0], ids[3], ids[1], ids[2]}},
+		{"dearest first, no price last", ListingFilter{Status: "all", Sort: "price_desc"}, []int64{ids[1], ids[3], ids[0], ids[2]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, order, args := tt.filter.sql()
+			if got := filteredPosts(t, h, where, order, args); !sameIDs(got, tt.want) {
+				t.Errorf("got posts %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
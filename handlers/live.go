@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	liveHistory      = 1024             //how many events the hub keeps for the reconnecting clients
+	liveClientBuffer = 64               //how many events a client can fall behind before it is dropped
+	liveMaxChannels  = 10               //how many channels one connection can listen to
+	liveHeartbeat    = 25 * time.Second //a comment line keeps the proxies from closing an idle stream
+	liveRetry        = 3000             //milliseconds the browser waits before reconnecting
+)
+
+// LiveEvent is an update sent to the pages over Server-Sent Events
+type LiveEvent struct {
+	ID      uint64
+	Channel string //"post:{id}" or "category:{id}"
+	Type    string //the SSE event name
+	Data    []byte //JSON
+}
+
+// liveClient is one open event stream
+type liveClient struct {
+	channels map[string]bool
+	events   chan LiveEvent //closed when the client is dropped or the hub closes
+}
+
+// Hub passes the live events to the clients listening to their channel. It
+// keeps the latest events, so a client that reconnects with Last-Event-ID
+// gets what it missed. A client that doesn't keep up is dropped, it
+// reconnects and catches up from the history.
+type Hub struct {
+	mu      sync.Mutex
+	nextID  uint64
+	evicted uint64 //the newest event that is no longer in the history
+	history []LiveEvent
+	clients map[*liveClient]bool
+	closed  bool
+}
+
+// NewHub creates a hub. The IDs start from the clock, so the IDs of a restarted
+// server are newer than the ones the clients saw before the restart, and the
+// clients know to reload.
+func NewHub() *Hub {
+	start := uint64(time.Now().UnixMicro())
+	return &Hub{
+		nextID:  start,
+		evicted: start - 1,
+		clients: make(map[*liveClient]bool),
+	}
+}
+
+// Publish sends the event to the clients of the channel
+func (hub *Hub) Publish(channel, eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("Error encoding live event", "type", eventType, "err", err)
+		return
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return
+	}
+	event := LiveEvent{ID: hub.nextID, Channel: channel, Type: eventType, Data: payload}
+	hub.nextID++
+	if len(hub.history) == liveHistory {
+		hub.evicted = hub.history[0].ID
+		hub.history = append(hub.history[:0], hub.history[1:]...)
+	}
+	hub.history = append(hub.history, event)
+
+	for c := range hub.clients {
+		if !c.channels[channel] {
+			continue
+		}
+		select {
+		case c.events <- event:
+		default:
+			hub.drop(c)
+		}
+	}
+}
+
+// subscribe adds a client of the channels. It returns the events after
+// lastID that the client missed, and false when some of them are no longer
+// in the history.
+func (hub *Hub) subscribe(channels []string, lastID uint64) (*liveClient, []LiveEvent, bool) {
+	c := &liveClient{channels: make(map[string]bool), events: make(chan LiveEvent, liveClientBuffer)}
+	for _, channel := range channels {
+		c.channels[channel] = true
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		close(c.events)
+		return c, nil, true
+	}
+	hub.clients[c] = true
+	liveClients.Set(float64(len(hub.clients)))
+
+	if lastID == 0 {
+		return c, nil, true
+	}
+	var missed []LiveEvent
+	for _, event := range hub.history {
+		if event.ID > lastID && c.channels[event.Channel] {
+			missed = append(missed, event)
+		}
+	}
+	return c, missed, lastID >= hub.evicted
+}
+
+// unsubscribe removes the client when its stream ends
+func (hub *Hub) unsubscribe(c *liveClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.clients[c] {
+		hub.drop(c)
+	}
+}
+
+// drop removes the client and closes its events, the caller holds the lock
+func (hub *Hub) drop(c *liveClient) {
+	delete(hub.clients, c)
+	close(c.events)
+	liveClients.Set(float64(len(hub.clients)))
+}
+
+// Close ends every stream, so the server can shut down. The browsers
+// reconnect to the next server.
+func (hub *Hub) Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.closed = true
+	for c := range hub.clients {
+		hub.drop(c)
+	}
+}
+
+// CloseLive ends the live streams on shutdown
+func (h *Handler) CloseLive() {
+	h.live.Close()
+}
+
+// publishPost tells the pages of the post's categories and their parents of
+// a new post
+func (h *Handler) publishPost(postID int64, title, username string) error {
+	rows, err := h.db.Query(`
+		WITH RECURSIVE ancestors(id) AS (
+			SELECT category_id FROM post_categories WHERE post_id = ?
+			UNION
+			SELECT c.parent_id FROM categories c JOIN ancestors a ON c.id = a.id WHERE c.parent_id IS NOT NULL
+		)
+		SELECT id FROM ancestors
+	`, postID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var categoryID int64
+		if err := rows.Scan(&categoryID); err != nil {
+			return err
+		}
+		h.live.Publish("category:"+strconv.FormatInt(categoryID, 10), "post", map[string]interface{}{
+			"post_id":  postID,
+			"title":    title,
+			"username": username,
+		})
+	}
+	return rows.Err()
+}
+
+// publishComment sends a new comment to the post page
+func (h *Handler) publishComment(postID, commentID int64, username, content string, createdAt time.Time) {
+	h.live.Publish("post:"+strconv.FormatInt(postID, 10), "comment", map[string]interface{}{
+		"post_id":    postID,
+		"comment_id": commentID,
+		"username":   username,
+		"content":    content,
+		"created_at": createdAt.Format("02 Jan 2006 15:04"),
+	})
+}
+
+// publishReactions sends the new like and dislike counts of the post, or of
+// the comment when commentID is set, to the post page
+func (h *Handler) publishReactions(postID, commentID int64, likes, dislikes int) {
+	if commentID != 0 {
+		if err := h.db.QueryRow("SELECT post_id FROM comments WHERE id = ?", commentID).Scan(&postID); err != nil {
+			slog.Error("Error publishing reactions", "comment_id", commentID, "err", err)
+			return
+		}
+	}
+	h.live.Publish("post:"+strconv.FormatInt(postID, 10), "reaction", map[string]interface{}{
+		"post_id":    postID,
+		"comment_id": commentID,
+		"likes":      likes,
+		"dislikes":   dislikes,
+	})
+}
+
+// writeLiveEvent writes one event in the text/event-stream format. The data
+// is JSON on one line.
+func writeLiveEvent(w http.ResponseWriter, event LiveEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+// Live streams the updates of the posts and the categories as Server-Sent
+// Events, /live?post=1 or /live?category=2, the parameters can repeat. A
+// reconnecting browser sends the Last-Event-ID header and gets the events
+// it missed, or a reset event when they are no longer kept.
+func (h *Handler) Live(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var channels []string
+	for _, kind := range []string{"post", "category"} {
+		for _, value := range r.URL.Query()[kind] {
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				h.ErrorHandler(w, r, "Invalid "+kind+" ID", http.StatusBadRequest)
+				return
+			}
+			channels = append(channels, kind+":"+strconv.FormatInt(id, 10))
+		}
+	}
+	if len(channels) == 0 || len(channels) > liveMaxChannels {
+		h.ErrorHandler(w, r, "Give 1 to 10 posts or categories", http.StatusBadRequest)
+		return
+	}
+	var lastID uint64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		lastID, _ = strconv.ParseUint(value, 10, 64)
+	}
+
+	//the stream stays open longer than the write timeout of the server
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		LogFrom(r.Context()).Error("Error starting event stream", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	client, missed, complete := h.live.subscribe(channels, lastID)
+	defer h.live.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") //nginx would hold the events back
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", liveRetry)
+	if !complete {
+		//the page has missed updates, it has to load again
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range missed {
+		if err := writeLiveEvent(w, event); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-client.events:
+			if !ok {
+				return
+			}
+			if err := writeLiveEvent(w, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishN publishes n events of the channel and returns their IDs
+func publishN(hub *Hub, channel string, n int) []uint64 {
+	var ids []uint64
+	for i := 0; i < n; i++ {
+		hub.Publish(channel, "comment", map[string]int{"n": i})
+		hub.mu.Lock()
+		ids = append(ids, hub.nextID-1)
+		hub.mu.Unlock()
+	}
+	return ids
+}
+
+func TestHubReplay(t *testing.T) {
+	hub := NewHub()
+	first := publishN(hub, "post:1", 3)
+	publishN(hub, "post:2", 2)
+	last := publishN(hub, "post:1", 1)
+
+	tests := []struct {
+		name     string
+		channels []string
+		lastID   uint64
+		want     []uint64
+	}{
+		{"new client", []string{"post:1"}, 0, nil},
+		{"missed events of its channel", []string{"post:1"}, first[0], []uint64{first[1], first[2], last[0]}},
+		{"up to date", []string{"post:1"}, last[0], nil},
+		{"several channels", []string{"post:1", "post:2"}, first[2], []uint64{first[2] + 1, first[2] + 2, last[0]}},
+	}
+	for _, tt := range tests {
+		c, missed, complete := hub.subscribe(tt.channels, tt.lastID)
+		var got []uint64
+		for _, event := range missed {
+			got = append(got, event.ID)
+		}
+		if len(got) != len(tt.want) || !complete {
+			t.Errorf("%s: replayed %v, complete %v, want %v", tt.name, got, complete, tt.want)
+		}
+		for i := range got {
+			if i < len(tt.want) && got[i] != tt.want[i] {
+				t.Errorf("%s: replayed %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+		hub.unsubscribe(c)
+	}
+}
+
+func TestHubEvictedHistory(t *testing.T) {
+	hub := NewHub()
+	ids := publishN(hub, "post:1", liveHistory+2)
+
+	//the first two events are gone, a client that saw only the first one has
+	//missed one it can't get
+	if _, missed, complete := hub.subscribe([]string{"post:1"}, ids[0]); complete || len(missed) != liveHistory {
+		t.Errorf("%d events replayed, complete %v, want %d and a reset", len(missed), complete, liveHistory)
+	}
+	if _, missed, complete := hub.subscribe([]string{"post:1"}, ids[1]); !complete || len(missed) != liveHistory {
+		t.Errorf("%d events replayed, complete %v, want %d without a reset", len(missed), complete, liveHistory)
+	}
+	//the IDs of a restarted server are newer than the ones the client has
+	if _, _, complete := NewHub().subscribe([]string{"post:1"}, 1); complete {
+		t.Error("a client of an earlier server didn't get a reset")
+	}
+}
+
+func TestHubDropsSlowClient(t *testing.T) {
+	hub := NewHub()
+	slow, _, _ := hub.subscribe([]string{"post:1"}, 0)
+	other, _, _ := hub.subscribe([]string{"post:2"}, 0)
+	publishN(hub, "post:1", liveClientBuffer+1)
+
+	received := 0
+	for range slow.events {
+		received++
+	}
+	if received != liveClientBuffer {
+		t.Errorf("the slow client got %d events before it was dropped, want %d", received, liveClientBuffer)
+	}
+	if !hub.clients[other] || len(hub.clients) != 1 {
+		t.Error("the client of the other channel was dropped")
+	}
+	hub.Close()
+	if _, ok := <-other.events; ok {
+		t.Error("the events are still open after Close")
+	}
+}
+
+func TestLive(t *testing.T) {
+	h := newTestHandler(t)
+	first := publishN(h.live, "post:7", 2)
+	server := httptest.NewServer(http.HandlerFunc(h.Live))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/live?post=7", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(first[0], 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+
+	//the event the client missed comes first, then the new one
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	nextID := func() string {
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return ""
+				}
+				if id, found := strings.CutPrefix(line, "id: "); found {
+					return id
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event in 5 seconds")
+			}
+		}
+	}
+	if id := nextID(); id != strconv.FormatUint(first[1], 10) {
+		t.Errorf("the replayed event has the ID %s, want %d", id, first[1])
+	}
+	next := publishN(h.live, "post:7", 1)
+	if id := nextID(); id != strconv.FormatUint(next[0], 10) {
+		t.Errorf("the new event has the ID %s, want %d", id, next[0])
+	}
+	//closing the hub ends the stream
+	h.CloseLive()
+	if id := nextID(); id != "" {
+		t.Errorf("got the event %s after the hub was closed", id)
+	}
+}
+
+func TestLiveBadRequest(t *testing.T) {
+	h := newTestHandler(t)
+	tests := []string{"/live", "/live?post=x", "/live?" + strings.Repeat("post=1&", liveMaxChannels+1)}
+	for _, target := range tests {
+		w := httptest.NewRecorder()
+		h.Live(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	loggerKey      contextKey = "logger"
+	requestInfoKey contextKey = "request-info"
+
+	RequestIDHeader = "X-Request-ID"
+)
+
+// requestInfo is filled in while the request is handled and read by the access log
+type requestInfo struct {
+	ID     string
+	UserID int64 //0 if the user is not logged in
+}
+
+// NewLogger creates the logger of the application. The format is "text" or "json"
+// and the level one of "debug", "info", "warn" or "error".
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// LogFrom returns the logger of the request, which adds the request ID to every
+// line. Outside of a request it returns the default logger.
+func LogFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// RequestID gives every request an ID and a logger that includes it. An ID sent
+// by a proxy in the X-Request-ID header is used when it looks sane.
+func RequestID(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestInfoKey, &requestInfo{ID: id})
+		ctx = context.WithValue(ctx, loggerKey, logger.With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e { //only visible ASCII, so the ID can't break the log lines
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		//crypto/rand doesn't fail on the systems we run on, but the time is unique enough
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// setRequestUser remembers the logged in user for the access log
+func setRequestUser(r *http.Request, userID int64) {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		info.UserID = userID
+	}
+}
+
+// statusRecorder remembers the status code and the size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the original writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// AccessLog writes one line for every request with the status, latency and user.
+// It has to run inside RequestID to get the request ID and the user.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		var userID int64
+		if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+			userID = info.UserID
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		//the load balancer probes would fill the log, so they are only logged when debugging
+		if level == slog.LevelInfo && (r.URL.Path == "/healthz" || r.URL.Path == "/readyz") {
+			level = slog.LevelDebug
+		}
+
+		LogFrom(r.Context()).LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int64("user_id", userID),
+			slog.String("remote", r.RemoteAddr),
+		)
+	})
+}
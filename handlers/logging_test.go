@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// logLines parses the JSON log lines
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool //the ID of the header is used
+	}{
+		{"from the proxy", "abc-123", true},
+		{"none", "", false},
+		{"with a space", "abc 123", false},
+		{"with a new line", "abc\n123", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := NewLogger(&buf, "json", "debug")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := RequestID(logger, AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				setRequestUser(r, 7)
+				LogFrom(r.Context()).Info("inside")
+				w.WriteHeader(http.StatusTeapot)
+			})))
+			r := httptest.NewRequest("GET", "/post/1", nil)
+			if tt.header != "" {
+				r.Header.Set(RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			id := w.Header().Get(RequestIDHeader)
+			if tt.keep && id != tt.header {
+				t.Errorf("request ID %q, want %q from the header", id, tt.header)
+			}
+			if !tt.keep && (len(id) != 32 || id == tt.header) {
+				t.Errorf("request ID %q, want a new one", id)
+			}
+
+			//the handler's line and the access log line both have the ID
+			lines := logLines(t, &buf)
+			if len(lines) != 2 {
+				t.Fatalf("%d log lines, want 2", len(lines))
+			}
+			for _, line := range lines {
+				if line["request_id"] != id {
+					t.Errorf("line %v has the request ID %v, want %q", line["msg"], line["request_id"], id)
+				}
+			}
+			access := lines[1]
+			if access["msg"] != "request" || access["status"] != float64(http.StatusTeapot) ||
+				access["user_id"] != float64(7) || access["level"] != "WARN" || access["path"] != "/post/1" {
+				t.Errorf("access log line %v", access)
+			}
+		})
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		format, level string
+		wantErr       bool
+	}{
+		{"text", "info", false},
+		{"JSON", "debug", false},
+		{"xml", "info", true},
+		{"text", "loud", true},
+	}
+	for _, tt := range tests {
+		if _, err := NewLogger(&bytes.Buffer{}, tt.format, tt.level); (err != nil) != tt.wantErr {
+			t.Errorf("NewLogger(%q, %q) error = %v, want error %v", tt.format, tt.level, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"forum/config"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// a message is given up after this many failed attempts
+const maxMailAttempts = 8
+
+// how many queued messages are sent at a time
+const mailBatch = 50
+
+// Mail is a plain text email of the queue
+type Mail struct {
+	ID             int64
+	To             string
+	Subject        string
+	Body           string
+	UnsubscribeURL string //the List-Unsubscribe address, empty for none
+	Attempts       int
+}
+
+// MailTransport delivers the emails
+type MailTransport interface {
+	Send(ctx context.Context, from string, m *Mail) error
+}
+
+// FileTransport writes every email as an .eml file into a directory instead
+// of sending it, for development and testing
+type FileTransport struct {
+	Dir string
+}
+
+func (t *FileTransport) Send(ctx context.Context, from string, m *Mail) error {
+	if err := os.MkdirAll(t.Dir, 0o750); err != nil {
+		return err
+	}
+	message, err := m.message(from)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%d.eml", time.Now().UTC().Format("20060102-150405"), m.ID)
+	tmp := filepath.Join(t.Dir, name+".tmp")
+	if err := os.WriteFile(tmp, message, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.Dir, name))
+}
+
+// SMTPTransport sends the emails through an SMTP server. PLAIN auth is used
+// when the username is set, net/smtp only allows it over TLS or to localhost.
+type SMTPTransport struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+// how long the conversation with the SMTP server can take, so a server that
+// stops answering doesn't hold up the queue or the shutdown
+const smtpTimeout = 30 * time.Second
+
+func (t *SMTPTransport) Send(ctx context.Context, from string, m *Mail) error {
+	message, err := m.message(from)
+	if err != nil {
+		return err
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return err
+	}
+	host := strings.Split(t.Addr, ":")[0]
+
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	//closing the connection interrupts the conversation when the context is
+	//cancelled, like on shutdown
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := t.send(c, host, sender.Address, m.To, message); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// send has the conversation of smtp.SendMail over the client
+func (t *SMTPTransport) send(c *smtp.Client, host, from, to string, message []byte) error {
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if t.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("the SMTP server doesn't support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", t.Username, t.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// newMailTransport returns the transport of the config, or nil when the
+// email is off
+func newMailTransport(cfg *config.Config) MailTransport {
+	switch cfg.MailTransport {
+	case "smtp":
+		return &SMTPTransport{Addr: cfg.SMTPAddr, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}
+	case "file":
+		return &FileTransport{Dir: cfg.MailDir}
+	}
+	return nil
+}
+
+// message formats the email as RFC 5322, the body quoted-printable
+func (m *Mail) message(from string) ([]byte, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	_, domain, _ := strings.Cut(sender.Address, "@")
+
+	var b bytes.Buffer
+	header := func(name, value string) {
+		b.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", sender.String())
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<mail-%d-%d@%s>", m.ID, time.Now().UnixNano(), domain))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	if m.UnsubscribeURL != "" {
+		//one-click unsubscribe of RFC 8058, the mail clients POST to the address
+		header("List-Unsubscribe", "<"+m.UnsubscribeURL+">")
+		header("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	b.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&b)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// queueMail adds the email to the queue, the mail worker sends it
+func (h *Handler) queueMail(ctx context.Context, m *Mail) error {
+	done := observeQuery("queue_mail")
+	_, err := h.db.ExecContext(ctx, `
+		INSERT INTO mail_queue (to_addr, subject, body, unsubscribe_url, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, m.To, m.Subject, m.Body, m.UnsubscribeURL, time.Now().UTC())
+	done()
+	return err
+}
+
+// mailBackoff is the wait after the failed attempt: a minute, doubled after
+// every failure, at most six hours
+func mailBackoff(attempts int) time.Duration {
+	wait := time.Minute << (attempts - 1)
+	if attempts > 10 || wait > 6*time.Hour {
+		wait = 6 * time.Hour
+	}
+	return wait
+}
+
+// sendQueuedMail sends the emails that are due. A failed email is tried
+// again later, until maxMailAttempts.
+func (h *Handler) sendQueuedMail(ctx context.Context) (int, error) {
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT id, to_addr, subject, body, unsubscribe_url, attempts
+		FROM mail_queue
+		WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= ?
+		ORDER BY id
+		LIMIT ?
+	`, time.Now().UTC(), mailBatch)
+	if err != nil {
+		return 0, err
+	}
+	var queue []Mail
+	for rows.Next() {
+		var m Mail
+		if err := rows.Scan(&m.ID, &m.To, &m.Subject, &m.Body, &m.UnsubscribeURL, &m.Attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		queue = append(queue, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for i := range queue {
+		m := &queue[i]
+		if ctx.Err() != nil {
+			break
+		}
+		sendErr := h.mailer.Send(ctx, h.mailFrom, m)
+		if sendErr == nil {
+			sent++
+			_, err = h.db.ExecContext(ctx, "UPDATE mail_queue SET sent_at = CURRENT_TIMESTAMP, attempts = attempts + 1 WHERE id = ?", m.ID)
+		} else if m.Attempts+1 >= maxMailAttempts {
+			slog.Error("Giving up sending email", "mail_id", m.ID, "attempts", m.Attempts+1, "err", sendErr)
+			_, err = h.db.ExecContext(ctx, `
+				UPDATE mail_queue SET failed_at = CURRENT_TIMESTAMP, attempts = attempts + 1, last_error = ? WHERE id = ?
+			`, sendErr.Error(), m.ID)
+		} else {
+			slog.Warn("Error sending email, trying again later", "mail_id", m.ID, "attempts", m.Attempts+1, "err", sendErr)
+			_, err = h.db.ExecContext(ctx, `
+				UPDATE mail_queue SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?
+			`, sendErr.Error(), time.Now().UTC().Add(mailBackoff(m.Attempts+1)), m.ID)
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// RunMail sends the queued emails and queues the due digests every interval
+// until the context is cancelled
+func (h *Handler) RunMail(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := h.queueDigests(ctx); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Error queueing digests", "err", err)
+			}
+		} else if n > 0 {
+			slog.Info("Queued digests", "count", n)
+		}
+		if n, err := h.sendQueuedMail(ctx); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Error sending email", "err", err)
+			}
+		} else if n > 0 {
+			slog.Info("Sent emails", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// unsubscribeToken returns the token of the unsubscribe links of the user,
+// it is created with the first email
+func (h *Handler) unsubscribeToken(ctx context.Context, userID int64) (string, error) {
+	token, err := newNonce()
+	if err != nil {
+		return "", err
+	}
+	_, err = h.db.ExecContext(ctx, "INSERT OR IGNORE INTO unsubscribe_tokens (user_id, token) VALUES (?, ?)", userID, token)
+	if err != nil {
+		return "", err
+	}
+	err = h.db.QueryRowContext(ctx, "SELECT token FROM unsubscribe_tokens WHERE user_id = ?", userID).Scan(&token)
+	return token, err
+}
+
+// unsubscribeURL is the one-click link that stops the emails of the list, a
+// notification type, "digest" or "all"
+func (h *Handler) unsubscribeURL(ctx context.Context, userID int64, list string) (string, error) {
+	token, err := h.unsubscribeToken(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	return h.baseURL + "/unsubscribe?token=" + token + "&list=" + list, nil
+}
+
+// mailNotification queues the email of a notification
+func (h *Handler) mailNotification(ctx context.Context, to string, n *Notification) error {
+	unsubscribe, err := h.unsubscribeURL(ctx, n.UserID, n.Type)
+	if err != nil {
+		return err
+	}
+	body := n.Message + ".\n\n" +
+		h.baseURL + n.Target() + "\n\n" +
+		"--\n" +
+		"You get this email because of your notification settings at " + h.baseURL + "/notifications\n" +
+		"Stop these emails: " + unsubscribe + "\n"
+	return h.queueMail(ctx, &Mail{
+		To:             to,
+		Subject:        n.Message,
+		Body:           body,
+		UnsubscribeURL: unsubscribe,
+	})
+}
+
+// emailAddress checks the address of a user before it is mailed
+func emailAddress(value string) (string, bool) {
+	address, err := mail.ParseAddress(value)
+	if err != nil {
+		return "", false
+	}
+	return address.Address, true
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP answers one SMTP conversation on a local port and sends the
+// message it received to the channel. With hang it greets and then stops
+// answering.
+func fakeSMTP(t *testing.T, hang bool) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		if hang {
+			//reads until the client gives up
+			r.ReadString(0)
+			return
+		}
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					reply("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				inData = true
+				reply("354 Go ahead")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestSMTPTransportSend(t *testing.T) {
+	addr, received := fakeSMTP(t, false)
+	transport := &SMTPTransport{Addr: addr}
+	m := &Mail{ID: 1, To: "user@example.com", Subject: "Hello", Body: "A reply to your post"}
+
+	if err := transport.Send(context.Background(), "Forum <forum@example.com>", m); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case message := <-received:
+		if !strings.Contains(message, "To: user@example.com") || !strings.Contains(message, "A reply to your post") {
+			t.Errorf("unexpected message:\n%s", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the server got no message")
+	}
+}
+
+func TestSMTPTransportSendCancelled(t *testing.T) {
+	addr, _ := fakeSMTP(t, true)
+	transport := &SMTPTransport{Addr: addr}
+	m := &Mail{ID: 1, To: "user@example.com", Subject: "Hello", Body: "Body"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := transport.Send(ctx, "forum@example.com", m)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Send to a hung server: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Send returned after %v, the cancel didn't stop it", elapsed)
+	}
+}
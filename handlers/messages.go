@@ -0,0 +1,934 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxConversationMembers = 8    //the most users in a conversation, the starter included
+	maxMessageLength       = 5000 //characters
+	maxAttachments         = 3    //images of a message
+	conversationsLimit     = 100  //the latest conversations shown in the inbox
+	messagesLimit          = 200  //the latest messages shown of a conversation
+)
+
+// Conversation is a private conversation of two or a few users
+type Conversation struct {
+	ID            int64
+	Subject       string
+	Members       []User //the other members
+	LastMessageAt time.Time
+	Unread        int
+	Messages      []Message
+}
+
+// Names is the usernames of the other members, comma separated
+func (c *Conversation) Names() string {
+	names := make([]string, len(c.Members))
+	for i, m := range c.Members {
+		names[i] = m.Username
+	}
+	return strings.Join(names, ", ")
+}
+
+// Message is a private message of a conversation
+type Message struct {
+	ID             int64
+	ConversationID int64
+	UserID         int64
+	Username       string
+	Content        string
+	CreatedAt      time.Time
+	Attachments    []string //the file names in the upload directory
+	Removed        bool     //removed by a moderator
+	Own            bool     //sent by the viewer
+}
+
+// MessageDraft is the new conversation form, kept when it has an error
+type MessageDraft struct {
+	To      string
+	Subject string
+	Content string
+}
+
+// MessageReport is a reported message on the moderators' page
+type MessageReport struct {
+	ID        int64
+	Message   Message
+	Reporter  string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// unreadMessages counts the messages of the user's conversations that came
+// after the last read one, the messages of the blocked users don't count
+func (h *Handler) unreadMessages(userID int64) (int, error) {
+	var count int
+	err := h.db.QueryRow(`
+		SELECT COUNT(*) FROM conversation_members cm
+		JOIN messages m ON m.conversation_id = cm.conversation_id AND m.id > cm.last_read_id
+		WHERE cm.user_id = ? AND cm.left_at IS NULL AND m.user_id != ? AND m.removed_at IS NULL
+		AND m.user_id NOT IN (SELECT blocked_id FROM user_blocks WHERE user_id = ?)
+	`, userID, userID, userID).Scan(&count)
+	return count, err
+}
+
+// getConversations returns the conversations of the user, the latest first
+func (h *Handler) getConversations(userID int64) ([]Conversation, error) {
+	done := observeQuery("get_conversations")
+	rows, err := h.db.Query(`
+		SELECT c.id, c.subject, c.last_message_at,
+		(SELECT COUNT(*) FROM messages m
+			WHERE m.conversation_id = c.id AND m.id > cm.last_read_id AND m.user_id != cm.user_id AND m.removed_at IS NULL
+			AND m.user_id NOT IN (SELECT blocked_id FROM user_blocks WHERE user_id = cm.user_id)) AS unread
+		FROM conversation_members cm JOIN conversations c ON c.id = cm.conversation_id
+		WHERE cm.user_id = ? AND cm.left_at IS NULL
+		ORDER BY c.last_message_at DESC
+		LIMIT ?
+	`, userID, conversationsLimit)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []Conversation
+	for rows.Next() {
+		var c Conversation
+		if err := rows.Scan(&c.ID, &c.Subject, &c.LastMessageAt, &c.Unread); err != nil {
+			return nil, err
+		}
+		c.LastMessageAt = c.LastMessageAt.In(h.location)
+		conversations = append(conversations, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range conversations {
+		members, err := h.conversationMembers(conversations[i].ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		conversations[i].Members = members
+	}
+	return conversations, nil
+}
+
+// conversationMembers returns the members of the conversation besides the
+// user, the ones who left too
+func (h *Handler) conversationMembers(conversationID, userID int64) ([]User, error) {
+	rows, err := h.db.Query(`
+		SELECT u.id, u.username FROM conversation_members cm JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id = ? AND cm.user_id != ?
+		ORDER BY u.username
+	`, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username); err != nil {
+			return nil, err
+		}
+		members = append(members, u)
+	}
+	return members, rows.Err()
+}
+
+// isMember tells if the user is in the conversation and hasn't left it
+func (h *Handler) isMember(conversationID, userID int64) (bool, error) {
+	var member bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM conversation_members WHERE conversation_id = ? AND user_id = ? AND left_at IS NULL)
+	`, conversationID, userID).Scan(&member)
+	return member, err
+}
+
+// getConversation returns the conversation with its latest messages as the
+// member sees them, without the messages of the users the member blocked
+func (h *Handler) getConversation(conversationID, userID int64) (*Conversation, error) {
+	c := &Conversation{ID: conversationID}
+	err := h.db.QueryRow("SELECT subject, last_message_at FROM conversations WHERE id = ?", conversationID).
+		Scan(&c.Subject, &c.LastMessageAt)
+	if err != nil {
+		return nil, err
+	}
+	if c.Members, err = h.conversationMembers(conversationID, userID); err != nil {
+		return nil, err
+	}
+
+	done := observeQuery("get_messages")
+	rows, err := h.db.Query(`
+		SELECT * FROM (
+			SELECT m.id, m.user_id, u.username, m.content, m.created_at, m.removed_at IS NOT NULL
+			FROM messages m JOIN users u ON u.id = m.user_id
+			WHERE m.conversation_id = ? AND m.user_id NOT IN (SELECT blocked_id FROM user_blocks WHERE user_id = ?)
+			ORDER BY m.id DESC
+			LIMIT ?
+		) ORDER BY id
+	`, conversationID, userID, messagesLimit)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := Message{ConversationID: conversationID}
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Username, &m.Content, &m.CreatedAt, &m.Removed); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = m.CreatedAt.In(h.location)
+		m.Own = m.UserID == userID
+		c.Messages = append(c.Messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return c, h.addAttachments(c.Messages)
+}
+
+// addAttachments fills in the attachments of the messages
+func (h *Handler) addAttachments(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, len(messages))
+	index := make(map[int64]int, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+		index[m.ID] = i
+	}
+	rows, err := h.db.Query(`
+		SELECT message_id, filename FROM message_attachments
+		WHERE message_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+		ORDER BY id
+	`, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID int64
+		var name string
+		if err := rows.Scan(&messageID, &name); err != nil {
+			return err
+		}
+		m := &messages[index[messageID]]
+		if !m.Removed {
+			m.Attachments = append(m.Attachments, name)
+		}
+	}
+	return rows.Err()
+}
+
+// isBlocked tells if either user has blocked the other
+func (h *Handler) isBlocked(userID, otherID int64) (bool, error) {
+	var blocked bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM user_blocks
+			WHERE (user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?))
+	`, userID, otherID, otherID, userID).Scan(&blocked)
+	return blocked, err
+}
+
+// getBlockedUsers returns the users the user has blocked
+func (h *Handler) getBlockedUsers(userID int64) ([]User, error) {
+	rows, err := h.db.Query(`
+		SELECT u.id, u.username FROM user_blocks b JOIN users u ON u.id = b.blocked_id
+		WHERE b.user_id = ?
+		ORDER BY u.username
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// checkMessage checks the text of a message, it can be empty when the
+// message has attachments
+func checkMessage(content string, attachments []string) error {
+	if content == "" && len(attachments) == 0 {
+		return &FormError{Message: "The message cannot be empty", Code: http.StatusBadRequest}
+	}
+	if utf8.RuneCountInString(content) > maxMessageLength {
+		return &FormError{
+			Message: fmt.Sprintf("A message can be at most %d characters", maxMessageLength),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+// readAttachments saves the images of the message form to the upload directory
+func (h *Handler) readAttachments(r *http.Request) ([]string, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+	files := r.MultipartForm.File["attachments"]
+	if len(files) > maxAttachments {
+		return nil, &FormError{Message: fmt.Sprintf("A message can have at most %d images", maxAttachments), Code: http.StatusBadRequest}
+	}
+
+	var names []string
+	for _, fh := range files {
+		if fh.Size == 0 && fh.Filename == "" {
+			continue
+		}
+		name, err := h.saveUpload(fh)
+		if err != nil {
+			h.removeUploads(names)
+			if errors.Is(err, ErrUploadTooLarge) {
+				return nil, &FormError{
+					Message: fmt.Sprintf("The image %s is too large, the limit is %d MB", fh.Filename, h.maxUpload>>20),
+					Code:    http.StatusRequestEntityTooLarge,
+				}
+			}
+			if errors.Is(err, ErrUploadType) {
+				return nil, &FormError{Message: "Only JPEG, PNG, GIF and WebP images can be attached", Code: http.StatusBadRequest}
+			}
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// parseMessageForm parses the message form, it is multipart when it has images
+func (h *Handler) parseMessageForm(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(h.maxUpload)*maxAttachments+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		return err
+	}
+	return nil
+}
+
+// insertMessage saves the message and its attachments in the transaction.
+// The sender has read the conversation up to the message.
+func (h *Handler) insertMessage(tx *sql.Tx, conversationID, userID int64, content string, attachments []string, now time.Time) (int64, error) {
+	result, err := tx.Exec(`
+		INSERT INTO messages (conversation_id, user_id, content, created_at) VALUES (?, ?, ?, ?)
+	`, conversationID, userID, content, now)
+	if err != nil {
+		return 0, err
+	}
+	messageID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range attachments {
+		if _, err := tx.Exec("INSERT INTO message_attachments (message_id, filename) VALUES (?, ?)", messageID, name); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec("UPDATE conversations SET last_message_at = ? WHERE id = ?", now, conversationID); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		UPDATE conversation_members SET last_read_id = ? WHERE conversation_id = ? AND user_id = ?
+	`, messageID, conversationID, userID)
+	return messageID, err
+}
+
+// startConversation checks the recipients, comma separated usernames, and
+// starts a conversation with them
+func (h *Handler) startConversation(user *User, to, subject, content string, attachments []string) (int64, error) {
+	var recipients []User
+	seen := map[int64]bool{user.ID: true}
+	for _, name := range strings.Split(to, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		var u User
+		err := h.db.QueryRow("SELECT id, username FROM users WHERE username = ? COLLATE NOCASE", name).Scan(&u.ID, &u.Username)
+		if err == sql.ErrNoRows {
+			return 0, &FormError{Message: "There is no user " + name, Code: http.StatusBadRequest}
+		}
+		if err != nil {
+			return 0, err
+		}
+		if seen[u.ID] {
+			continue
+		}
+		seen[u.ID] = true
+		blocked, err := h.isBlocked(user.ID, u.ID)
+		if err != nil {
+			return 0, err
+		}
+		if blocked {
+			return 0, &FormError{Message: "You can't send messages to " + u.Username, Code: http.StatusForbidden}
+		}
+		recipients = append(recipients, u)
+	}
+	switch {
+	case len(recipients) == 0:
+		return 0, &FormError{Message: "Choose who to send the message to", Code: http.StatusBadRequest}
+	case len(recipients)+1 > maxConversationMembers:
+		return 0, &FormError{
+			Message: fmt.Sprintf("A conversation can have at most %d members", maxConversationMembers),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if err := checkMessage(content, attachments); err != nil {
+		return 0, err
+	}
+	if utf8.RuneCountInString(subject) > 100 {
+		return 0, &FormError{Message: "The subject can be at most 100 characters", Code: http.StatusBadRequest}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(`
+		INSERT INTO conversations (subject, created_by, created_at, last_message_at) VALUES (?, ?, ?, ?)
+	`, subject, user.ID, now, now)
+	if err != nil {
+		return 0, err
+	}
+	conversationID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range append(recipients, *user) {
+		_, err := tx.Exec("INSERT INTO conversation_members (conversation_id, user_id) VALUES (?, ?)", conversationID, u.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if _, err := h.insertMessage(tx, conversationID, user.ID, content, attachments, now); err != nil {
+		return 0, err
+	}
+	return conversationID, tx.Commit()
+}
+
+// sendMessage adds a reply to the conversation. In a conversation of two a
+// block in either direction stops the messages, in a group the blocker just
+// doesn't see them.
+func (h *Handler) sendMessage(user *User, conversationID int64, content string, attachments []string) (int64, error) {
+	if err := checkMessage(content, attachments); err != nil {
+		return 0, err
+	}
+	var members, active int
+	var otherID int64
+	err := h.db.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE left_at IS NULL), MAX(CASE WHEN user_id != ? THEN user_id END)
+		FROM conversation_members WHERE conversation_id = ?
+	`, user.ID, conversationID).Scan(&members, &active, &otherID)
+	if err != nil {
+		return 0, err
+	}
+	if members == 2 {
+		blocked, err := h.isBlocked(user.ID, otherID)
+		if err != nil {
+			return 0, err
+		}
+		if blocked {
+			return 0, &FormError{Message: "You can't send messages in this conversation", Code: http.StatusForbidden}
+		}
+		if active < 2 {
+			return 0, &FormError{Message: "The other member has left the conversation", Code: http.StatusBadRequest}
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	messageID, err := h.insertMessage(tx, conversationID, user.ID, content, attachments, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return messageID, tx.Commit()
+}
+
+// Messages is the inbox, /messages, and a conversation, /messages/{id}.
+// Posting to the inbox starts a conversation and posting to a conversation
+// replies to it. The attachments are served from /messages/attachments/{name}
+// to the members only.
+func (h *Handler) Messages(w http.ResponseWriter, r *http.Request) {
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/messages"), "/")
+	if name, ok := strings.CutPrefix(path, "attachments/"); ok {
+		h.messageAttachment(w, r, user, name)
+		return
+	}
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			query := r.URL.Query()
+			draft := &MessageDraft{To: query.Get("to"), Subject: query.Get("subject")}
+			h.renderInbox(w, r, user, draft, "", http.StatusOK)
+		case http.MethodPost:
+			h.newConversation(w, r, user)
+		default:
+			h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	conversationID, err := strconv.ParseInt(path, 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+	//not even the moderators can read a conversation they are not in
+	member, err := h.isMember(conversationID, user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error checking conversation", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if !member {
+		h.ErrorHandler(w, r, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.renderConversation(w, r, user, conversationID, "", http.StatusOK)
+	case http.MethodPost:
+		h.replyConversation(w, r, user, conversationID)
+	default:
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) renderInbox(w http.ResponseWriter, r *http.Request, user *User, draft *MessageDraft, message string, code int) {
+	conversations, err := h.getConversations(user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting conversations", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	blocked, err := h.getBlockedUsers(user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting blocked users", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	data := TemplateData{
+		Title:         "Messages",
+		User:          user,
+		Conversations: conversations,
+		Blocked:       blocked,
+		Draft:         draft,
+		Error:         message,
+	}
+	w.WriteHeader(code)
+	if err := h.render(w, r, "messages.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+	}
+}
+
+func (h *Handler) renderConversation(w http.ResponseWriter, r *http.Request, user *User, conversationID int64, message string, code int) {
+	conversation, err := h.getConversation(conversationID, user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting conversation", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	//opening the conversation reads it
+	_, err = h.db.Exec(`
+		UPDATE conversation_members SET last_read_id = (SELECT COALESCE(MAX(id), 0) FROM messages WHERE conversation_id = ?)
+		WHERE conversation_id = ? AND user_id = ?
+	`, conversationID, conversationID, user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error marking conversation read", "err", err)
+	}
+
+	data := TemplateData{
+		Title:        "Conversation",
+		User:         user,
+		Conversation: conversation,
+		Error:        message,
+	}
+	w.WriteHeader(code)
+	if err := h.render(w, r, "conversation.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+	}
+}
+
+func (h *Handler) newConversation(w http.ResponseWriter, r *http.Request, user *User) {
+	if err := h.parseMessageForm(w, r); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	draft := &MessageDraft{
+		To:      r.FormValue("to"),
+		Subject: strings.TrimSpace(r.FormValue("subject")),
+		Content: strings.TrimSpace(r.FormValue("content")),
+	}
+
+	attachments, err := h.readAttachments(r)
+	var conversationID int64
+	if err == nil {
+		conversationID, err = h.startConversation(user, draft.To, draft.Subject, draft.Content, attachments)
+		if err != nil {
+			h.removeUploads(attachments)
+		}
+	}
+	if err != nil {
+		var formErr *FormError
+		if errors.As(err, &formErr) {
+			h.renderInbox(w, r, user, draft, formErr.Message, formErr.Code)
+			return
+		}
+		LogFrom(r.Context()).Error("Error starting conversation", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	LogFrom(r.Context()).Info("Conversation started", "conversation_id", conversationID, "user_id", user.ID)
+	http.Redirect(w, r, "/messages/"+strconv.FormatInt(conversationID, 10), http.StatusSeeOther)
+}
+
+func (h *Handler) replyConversation(w http.ResponseWriter, r *http.Request, user *User, conversationID int64) {
+	if err := h.parseMessageForm(w, r); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+
+	attachments, err := h.readAttachments(r)
+	var messageID int64
+	if err == nil {
+		messageID, err = h.sendMessage(user, conversationID, strings.TrimSpace(r.FormValue("content")), attachments)
+		if err != nil {
+			h.removeUploads(attachments)
+		}
+	}
+	if err != nil {
+		var formErr *FormError
+		if errors.As(err, &formErr) {
+			h.renderConversation(w, r, user, conversationID, formErr.Message, formErr.Code)
+			return
+		}
+		LogFrom(r.Context()).Error("Error sending message", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/messages/%d#message-%d", conversationID, messageID), http.StatusSeeOther)
+}
+
+// messageAttachment serves an image of a message to the members of the
+// conversation, and to the moderators when the message has been reported
+func (h *Handler) messageAttachment(w http.ResponseWriter, r *http.Request, user *User, name string) {
+	if !validUploadName(name) {
+		h.ErrorHandler(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+	var allowed bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM message_attachments a JOIN messages m ON m.id = a.message_id
+			WHERE a.filename = ? AND m.removed_at IS NULL AND (
+				EXISTS(SELECT 1 FROM conversation_members cm
+					WHERE cm.conversation_id = m.conversation_id AND cm.user_id = ? AND cm.left_at IS NULL)
+				OR (? AND EXISTS(SELECT 1 FROM message_reports WHERE message_id = m.id))
+			)
+		)
+	`, name, user.ID, user.IsAdmin).Scan(&allowed)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error checking attachment", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		h.ErrorHandler(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, filepath.Join(h.uploadDir, name))
+}
+
+// isAttachment tells if the upload belongs to a private message, those are
+// not served from /uploads/
+func (h *Handler) isAttachment(name string) (bool, error) {
+	var attachment bool
+	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM message_attachments WHERE filename = ?)", name).Scan(&attachment)
+	return attachment, err
+}
+
+// MessageAPI blocks and unblocks users, leaves conversations and reports
+// messages to the moderators, from the forms of the messages pages
+func (h *Handler) MessageAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	redirect := "/messages"
+	var err error
+	switch action := r.FormValue("action"); action {
+	case "block":
+		var blockedID int64
+		err = h.db.QueryRow("SELECT id FROM users WHERE username = ? COLLATE NOCASE", strings.TrimSpace(r.FormValue("username"))).
+			Scan(&blockedID)
+		if err == sql.ErrNoRows || blockedID == user.ID {
+			h.ErrorHandler(w, r, "User not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			_, err = h.db.Exec("INSERT OR IGNORE INTO user_blocks (user_id, blocked_id) VALUES (?, ?)", user.ID, blockedID)
+		}
+
+	case "unblock":
+		_, err = h.db.Exec("DELETE FROM user_blocks WHERE user_id = ? AND blocked_id = ?", user.ID, r.FormValue("user_id"))
+
+	case "leave":
+		_, err = h.db.Exec(`
+			UPDATE conversation_members SET left_at = CURRENT_TIMESTAMP
+			WHERE conversation_id = ? AND user_id = ? AND left_at IS NULL
+		`, r.FormValue("conversation_id"), user.ID)
+
+	case "report":
+		messageID, _ := strconv.ParseInt(r.FormValue("message_id"), 10, 64)
+		var conversationID int64
+		err = h.db.QueryRow(`
+			SELECT m.conversation_id FROM messages m JOIN conversation_members cm ON cm.conversation_id = m.conversation_id
+			WHERE m.id = ? AND m.user_id != ? AND cm.user_id = ? AND cm.left_at IS NULL
+		`, messageID, user.ID, user.ID).Scan(&conversationID)
+		if err == sql.ErrNoRows {
+			h.ErrorHandler(w, r, "Message not found", http.StatusNotFound)
+			return
+		}
+		reason := strings.TrimSpace(r.FormValue("reason"))
+		if utf8.RuneCountInString(reason) > 500 {
+			h.ErrorHandler(w, r, "The reason can be at most 500 characters", http.StatusBadRequest)
+			return
+		}
+		if err == nil {
+			_, err = h.db.Exec(`
+				INSERT OR IGNORE INTO message_reports (message_id, reporter_id, reason) VALUES (?, ?, ?)
+			`, messageID, user.ID, reason)
+		}
+		if err == nil {
+			LogFrom(r.Context()).Info("Message reported", "message_id", messageID, "user_id", user.ID)
+		}
+		redirect = fmt.Sprintf("/messages/%d#message-%d", conversationID, messageID)
+
+	default:
+		h.ErrorHandler(w, r, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error changing messages", "action", r.FormValue("action"), "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// getMessageReports returns the reported messages that are waiting for a
+// moderator, the oldest first
+func (h *Handler) getMessageReports() ([]MessageReport, error) {
+	rows, err := h.db.Query(`
+		SELECT r.id, r.reason, r.created_at, reporter.username,
+		m.id, m.conversation_id, m.user_id, author.username, m.content, m.created_at, m.removed_at IS NOT NULL
+		FROM message_reports r
+		JOIN messages m ON m.id = r.message_id
+		JOIN users reporter ON reporter.id = r.reporter_id
+		JOIN users author ON author.id = m.user_id
+		WHERE r.resolved_at IS NULL
+		ORDER BY r.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []MessageReport
+	for rows.Next() {
+		var rep MessageReport
+		m := &rep.Message
+		err := rows.Scan(&rep.ID, &rep.Reason, &rep.CreatedAt, &rep.Reporter,
+			&m.ID, &m.ConversationID, &m.UserID, &m.Username, &m.Content, &m.CreatedAt, &m.Removed)
+		if err != nil {
+			return nil, err
+		}
+		rep.CreatedAt = rep.CreatedAt.In(h.location)
+		m.CreatedAt = m.CreatedAt.In(h.location)
+		reports = append(reports, rep)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, len(reports))
+	for i := range reports {
+		messages[i] = reports[i].Message
+	}
+	if err := h.addAttachments(messages); err != nil {
+		return nil, err
+	}
+	for i := range reports {
+		reports[i].Message.Attachments = messages[i].Attachments
+	}
+	return reports, nil
+}
+
+// AdminReports shows the reported private messages. The moderators see the
+// reported message only, never the rest of the conversation.
+func (h *Handler) AdminReports(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(w, r)
+	if user == nil {
+		return
+	}
+	if r.Method != http.MethodGet {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reports, err := h.getMessageReports()
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting reports", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	data := TemplateData{
+		Title:   "Reported messages",
+		User:    user,
+		Reports: reports,
+	}
+	if err := h.render(w, r, "admin_reports.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// ReportAPI resolves a report: action=dismiss keeps the message and
+// action=remove removes it with its images and tells the author. Either way
+// every report of the message is resolved.
+func (h *Handler) ReportAPI(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(w, r)
+	if user == nil {
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	action := r.FormValue("action")
+	if action != "dismiss" && action != "remove" {
+		h.ErrorHandler(w, r, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	var messageID, authorID int64
+	err := h.db.QueryRow(`
+		SELECT m.id, m.user_id FROM message_reports r JOIN messages m ON m.id = r.message_id WHERE r.id = ?
+	`, r.FormValue("id")).Scan(&messageID, &authorID)
+	if err == sql.ErrNoRows {
+		h.ErrorHandler(w, r, "Report not found", http.StatusNotFound)
+		return
+	}
+	var attachments []string
+	if err == nil && action == "remove" {
+		attachments, err = h.removeMessage(messageID)
+	}
+	if err == nil {
+		_, err = h.db.Exec(`
+			UPDATE message_reports SET resolved_at = CURRENT_TIMESTAMP, resolved_by = ?
+			WHERE message_id = ? AND resolved_at IS NULL
+		`, user.ID, messageID)
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error resolving report", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	LogFrom(r.Context()).Info("Message report resolved", "action", action, "message_id", messageID, "admin_id", user.ID)
+
+	if action == "remove" {
+		h.removeUploads(attachments)
+		h.notify(r.Context(), Notification{
+			UserID:  authorID,
+			ActorID: user.ID,
+			Type:    NotifyModeration,
+			Message: "A moderator removed a private message of yours that was reported",
+		})
+	}
+	http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+}
+
+// removeMessage blanks the message and deletes its attachments, it returns
+// the files to remove from the upload directory
+func (h *Handler) removeMessage(messageID int64) ([]string, error) {
+	rows, err := h.db.Query("SELECT filename FROM message_attachments WHERE message_id = ?", messageID)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE messages SET content = '', removed_at = CURRENT_TIMESTAMP WHERE id = ?", messageID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM message_attachments WHERE message_id = ?", messageID); err != nil {
+		return nil, err
+	}
+	return names, tx.Commit()
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestConversationAccess(t *testing.T) {
+	h := newTestHandler(t)
+	h.uploadDir = t.TempDir()
+	anna := &User{ID: addUser(t, h, "anna"), Username: "anna"}
+	bob := addUser(t, h, "bob")
+	carol := addUser(t, h, "carol")
+	admin := addUser(t, h, "admin")
+	exec(t, h.db, "UPDATE users SET is_admin = 1 WHERE id = ?", admin)
+	cookies := map[int64]*http.Cookie{}
+	for _, id := range []int64{anna.ID, bob, carol, admin} {
+		cookies[id] = addSession(t, h, id)
+	}
+
+	attachment := strings.Repeat("ab", 16) + ".png"
+	if err := os.WriteFile(filepath.Join(h.uploadDir, attachment), []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	conversationID, err := h.startConversation(anna, "bob", "Hello", "Hi Bob", []string{attachment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversation := "/messages/" + strconv.FormatInt(conversationID, 10)
+	var messageID int64
+	h.db.QueryRow("SELECT id FROM messages WHERE conversation_id = ?", conversationID).Scan(&messageID)
+	reply := url.Values{"content": {"Hi"}}
+	report := url.Values{"action": {"report"}, "message_id": {strconv.FormatInt(messageID, 10)}}
+
+	tests := []struct {
+		name    string
+		userID  int64
+		handler http.HandlerFunc
+		method  string
+		target  string
+		form    url.Values
+		want    int
+	}{
+		{"the sender reads", anna.ID, h.Messages, "GET", conversation, nil, http.StatusOK},
+		{"the recipient reads", bob, h.Messages, "GET", conversation, nil, http.StatusOK},
+		{"the recipient loads the image", bob, h.Messages, "GET", "/messages/attachments/" + attachment, nil, http.StatusOK},
+		{"another user reads", carol, h.Messages, "GET", conversation, nil, http.StatusNotFound},
+		{"another user replies", carol, h.Messages, "POST", conversation, reply, http.StatusNotFound},
+		{"another user loads the image", carol, h.Messages, "GET", "/messages/attachments/" + attachment, nil, http.StatusNotFound},
+		{"another user reports", carol, h.MessageAPI, "POST", "/messages/api", report, http.StatusNotFound},
+		{"an admin reads", admin, h.Messages, "GET", conversation, nil, http.StatusNotFound},
+		{"an admin loads the image", admin, h.Messages, "GET", "/messages/attachments/" + attachment, nil, http.StatusNotFound},
+		{"the sender reports their own message", anna.ID, h.MessageAPI, "POST", "/messages/api", report, http.StatusNotFound},
+		//a reported image can be seen by the moderators
+		{"the recipient reports", bob, h.MessageAPI, "POST", "/messages/api", report, http.StatusSeeOther},
+		{"an admin loads the reported image", admin, h.Messages, "GET", "/messages/attachments/" + attachment, nil, http.StatusOK},
+		{"an admin still can't read", admin, h.Messages, "GET", conversation, nil, http.StatusNotFound},
+		//a member who left is no longer in the conversation
+		{"the recipient leaves", bob, h.MessageAPI, "POST", "/messages/api",
+			url.Values{"action": {"leave"}, "conversation_id": {strconv.FormatInt(conversationID, 10)}}, http.StatusSeeOther},
+		{"the recipient reads after leaving", bob, h.Messages, "GET", conversation, nil, http.StatusNotFound},
+		{"the recipient loads the image after leaving", bob, h.Messages, "GET", "/messages/attachments/" + attachment, nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := formRequest(tt.handler, cookies[tt.userID], tt.method, tt.target, tt.form); code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
+
+func TestMessageBlocks(t *testing.T) {
+	h := newTestHandler(t)
+	anna := &User{ID: addUser(t, h, "anna"), Username: "anna"}
+	bob := &User{ID: addUser(t, h, "bob"), Username: "bob"}
+	addUser(t, h, "carol")
+
+	private, err := h.startConversation(anna, "bob", "", "Hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := h.startConversation(anna, "bob, carol", "", "Hi all", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, h.db, "INSERT INTO user_blocks (user_id, blocked_id) VALUES (?, ?)", bob.ID, anna.ID)
+
+	//the block works both ways in a conversation of two
+	for _, sender := range []*User{anna, bob} {
+		var formErr *FormError
+		if _, err := h.sendMessage(sender, private, "hello?", nil); !errors.As(err, &formErr) || formErr.Code != http.StatusForbidden {
+			t.Errorf("%s sent a message in a blocked conversation: %v", sender.Username, err)
+		}
+	}
+	var formErr *FormError
+	if _, err := h.startConversation(anna, "bob", "", "Hi again", nil); !errors.As(err, &formErr) || formErr.Code != http.StatusForbidden {
+		t.Errorf("started a conversation with a user who blocked the sender: %v", err)
+	}
+
+	//in a group the message is sent but the blocker doesn't see it
+	if _, err := h.sendMessage(anna, group, "anyone?", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		user *User
+		want int
+	}{{anna, 2}, {bob, 0}} {
+		c, err := h.getConversation(group, tt.user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Messages) != tt.want {
+			t.Errorf("%s sees %d messages of the group, want %d", tt.user.Username, len(c.Messages), tt.want)
+		}
+	}
+
+	checks := []struct {
+		to   string
+		want int
+	}{
+		{"nobody", http.StatusBadRequest},
+		{"anna", http.StatusBadRequest}, //only the sender
+		{"", http.StatusBadRequest},
+	}
+	for _, tt := range checks {
+		var formErr *FormError
+		if _, err := h.startConversation(anna, tt.to, "", "Hi", nil); !errors.As(err, &formErr) || formErr.Code != tt.want {
+			t.Errorf("startConversation to %q: %v, want the status %d", tt.to, err, tt.want)
+		}
+	}
+}
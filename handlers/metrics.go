@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"forum/metrics"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// the metrics of the forum, exposed on /metrics
+var (
+	Metrics = metrics.NewRegistry()
+
+	httpRequests = Metrics.NewCounterVec("forum_http_requests_total",
+		"Number of HTTP requests by route, method and status code.", "route", "method", "status")
+	httpDuration = Metrics.NewHistogramVec("forum_http_request_duration_seconds",
+		"Time spent handling HTTP requests by route.", metrics.DefBuckets, "route")
+	templateDuration = Metrics.NewHistogramVec("forum_template_render_duration_seconds",
+		"Time spent rendering templates.", metrics.DefBuckets, "template")
+	queryDuration = Metrics.NewHistogramVec("forum_db_query_duration_seconds",
+		"Time spent on SQL queries by query name.", metrics.DefBuckets, "query")
+
+	activeSessions = Metrics.NewGauge("forum_active_sessions",
+		"Number of sessions that have not expired.")
+	goroutines = Metrics.NewGauge("forum_goroutines",
+		"Number of goroutines of the process.")
+	liveClients = Metrics.NewGauge("forum_live_clients",
+		"Number of open Server-Sent Events streams.")
+	chatClients = Metrics.NewGauge("forum_chat_clients",
+		"Number of open chat WebSocket connections.")
+
+	postsCreated    = Metrics.NewCounter("forum_posts_created_total", "Number of posts created.")
+	commentsCreated = Metrics.NewCounter("forum_comments_created_total", "Number of comments created.")
+	reactionsTotal  = Metrics.NewCounterVec("forum_reactions_total",
+		"Number of reactions by target (post or comment) and type.", "target", "type")
+	registrations = Metrics.NewCounter("forum_registrations_total", "Number of users registered.")
+	failedLogins  = Metrics.NewCounter("forum_failed_logins_total", "Number of failed login attempts.")
+	chatMessages  = Metrics.NewCounter("forum_chat_messages_total", "Number of chat messages sent.")
+)
+
+// Instrument counts the requests of a route and measures how long they take.
+// The route is the pattern the handler is registered with, not the URL, so the
+// number of series stays small.
+func Instrument(route string, next http.Handler) http.Handler {
+	duration := httpDuration.WithLabelValues(route)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		duration.Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, methodLabel(r.Method), strconv.Itoa(status)).Inc()
+	})
+}
+
+// methodLabel is the method of the request as a label. The client picks the
+// method, so the made up ones are counted together as OTHER or every new one
+// would be a new series.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// observeQuery starts timing a named query, call the returned function when it is done
+func observeQuery(name string) func() {
+	start := time.Now()
+	return func() {
+		queryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsHandler writes the metrics in the Prometheus text format. When a token
+// is set the scraper has to send it as a bearer token.
+func (h *Handler) MetricsHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			expected := []byte("Bearer " + token)
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		//the gauges are read from the database when they are scraped
+		var sessions int
+		done := observeQuery("count_active_sessions")
+		err := h.db.QueryRowContext(r.Context(),
+			"SELECT COUNT(*) FROM sessions WHERE expires_at > CURRENT_TIMESTAMP").Scan(&sessions)
+		done()
+		if err != nil {
+			LogFrom(r.Context()).Error("Error counting sessions", "err", err)
+		} else {
+			activeSessions.Set(float64(sessions))
+		}
+		goroutines.Set(float64(runtime.NumGoroutine()))
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Metrics.WriteText(w); err != nil {
+			LogFrom(r.Context()).Error("Error writing metrics", "err", err)
+		}
+	}
+}
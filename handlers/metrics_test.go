@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMethodLabel(t *testing.T) {
+	tests := []struct {
+		method, want string
+	}{
+		{"GET", "GET"},
+		{"POST", "POST"},
+		{"OPTIONS", "OPTIONS"},
+		{"FOO1", "OTHER"},
+		{"get", "OTHER"},
+		{"", "OTHER"},
+	}
+	for _, tt := range tests {
+		if got := methodLabel(tt.method); got != tt.want {
+			t.Errorf("methodLabel(%q) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	h := Instrument("/test-instrument", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	for _, method := range []string{"GET", "POST", "FOO1", "FOO2"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/test-instrument", nil))
+	}
+
+	var b strings.Builder
+	if err := Metrics.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`forum_http_requests_total{route="/test-instrument",method="GET",status="200"} 1`,
+		`forum_http_requests_total{route="/test-instrument",method="POST",status="201"} 1`,
+		`forum_http_requests_total{route="/test-instrument",method="OTHER",status="200"} 2`,
+		`forum_http_request_duration_seconds_count{route="/test-instrument"} 4`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("no %q in the metrics", want)
+		}
+	}
+	if strings.Contains(b.String(), "FOO") {
+		t.Error("a made up method got its own series")
+	}
+}
+
+func TestMetricsHandlerToken(t *testing.T) {
+	h := newTestHandler(t)
+	tests := []struct {
+		token, authorization string
+		want                 int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		h.MetricsHandler(tt.token)(w, r)
+		if w.Code != tt.want {
+			t.Errorf("token %q, Authorization %q: status %d, want %d", tt.token, tt.authorization, w.Code, tt.want)
+		}
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "# TYPE forum_active_sessions gauge") {
+			t.Error("the metrics weren't written")
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHSTS(t *testing.T) {
+	h := HSTS(365*24*time.Hour, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=31536000; includeSubDomains" {
+		t.Errorf("Strict-Transport-Security is %q", got)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		httpsAddr string
+		host      string
+		url       string
+		want      string
+	}{
+		{":443", "forum.example", "/post/1?c=2", "https://forum.example/post/1?c=2"},
+		{":443", "forum.example:80", "/", "https://forum.example/"},
+		{":8443", "forum.example:8080", "/login", "https://forum.example:8443/login"},
+		{":8443", "[::1]:8080", "/", "https://[::1]:8443/"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		RedirectToHTTPS(tt.httpsAddr).ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s%s redirects with %d to %q, want %q", tt.host, tt.url, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migration is one file from the migrations directory, named like 001_add_bans.sql
+type migration struct {
+	Version int
+	Name    string
+	Path    string
+}
+
+// loadMigrations lists the migrations in the directory ordered by version.
+// A missing directory means there are no migrations yet.
+func loadMigrations(dir string) ([]migration, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	seen := map[int]string{}
+	for _, path := range files {
+		base := filepath.Base(path)
+		prefix, _, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: name must look like 001_description.sql", base)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version %q", base, prefix)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, base)
+		}
+		seen[version] = base
+		migrations = append(migrations, migration{Version: version, Name: base, Path: path})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// LatestMigration returns the version the database has after all the migrations in the directory
+func LatestMigration(dir string) (int, error) {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// SchemaVersion returns the version of the last migration applied to the database
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// Migrate applies the migrations that are newer than the schema version of the
+// database. Every migration runs in its own transaction together with the
+// version update, so a failing migration leaves the database as it was.
+func Migrate(db *sql.DB, dir string) error {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		script, err := os.ReadFile(m.Path)
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(script)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+		//PRAGMA doesn't accept parameters, the version is a number we parsed ourselves
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.Version)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+		current = m.Version
+	}
+	return nil
+}
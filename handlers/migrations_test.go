@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeMigrations writes the files into a new directory
+func writeMigrations(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		want    []int
+		wantErr string
+	}{
+		{"empty", nil, nil, ""},
+		{"ordered by version", []string{"010_c.sql", "002_b.sql", "001_a.sql"}, []int{1, 2, 10}, ""},
+		{"other files are ignored", []string{"001_a.sql", "README.md"}, []int{1}, ""},
+		{"no description", []string{"001.sql"}, nil, "name must look like"},
+		{"not a number", []string{"abc_a.sql"}, nil, "invalid version"},
+		{"version 0", []string{"000_a.sql"}, nil, "invalid version"},
+		{"same version", []string{"001_a.sql", "1_b.sql"}, nil, "same version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make(map[string]string)
+			for _, name := range tt.files {
+				files[name] = ""
+			}
+			migrations, err := loadMigrations(writeMigrations(t, files))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var versions []int
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+			}
+			if len(versions) != len(tt.want) {
+				t.Fatalf("got versions %v, want %v", versions, tt.want)
+			}
+			for i := range versions {
+				if versions[i] != tt.want[i] {
+					t.Fatalf("got versions %v, want %v", versions, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMigrationsMissingDir(t *testing.T) {
+	migrations, err := loadMigrations(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || len(migrations) != 0 {
+		t.Fatalf("got %v, %v, want no migrations", migrations, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	//the scripts fail when they run twice, so a migration applied again shows up
+	dir := writeMigrations(t, map[string]string{
+		"001_a.sql": "CREATE TABLE a (id INTEGER);",
+		"002_b.sql": "CREATE TABLE b (id INTEGER);",
+	})
+	if err := Migrate(db, dir); err != nil {
+		t.Fatalf("first Migrate: %v", err)
+	}
+	if version, _ := SchemaVersion(db); version != 2 {
+		t.Fatalf("version after the first run is %d, want 2", version)
+	}
+	if err := Migrate(db, dir); err != nil {
+		t.Fatalf("Migrate without new migrations: %v", err)
+	}
+
+	//a failing migration is rolled back with its version, the ones before it stay
+	more := map[string]string{
+		"003_c.sql": "CREATE TABLE c (id INTEGER);",
+		"004_d.sql": "CREATE TABLE d (id INTEGER); INSERT INTO missing VALUES (1);",
+	}
+	for name, script := range more {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Migrate(db, dir); err == nil || !strings.Contains(err.Error(), "004_d.sql") {
+		t.Fatalf("got %v, want the error of 004_d.sql", err)
+	}
+	if version, _ := SchemaVersion(db); version != 3 {
+		t.Errorf("version after the failed migration is %d, want 3", version)
+	}
+	var tables int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'd'").Scan(&tables)
+	if tables != 0 {
+		t.Error("the table of the failed migration was left behind")
+	}
+}
+
+// the migrations of the repository apply to the schema, and InitDB can run
+// again on the migrated database
+func TestRepositoryMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forum.db")
+	db, err := InitDB(path, testSchema, testMigrations)
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := LatestMigration(testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latest {
+		t.Errorf("schema version is %d, want the latest migration %d", version, latest)
+	}
+	db.Close()
+
+	db, err = InitDB(path, testSchema, testMigrations)
+	if err != nil {
+		t.Fatalf("InitDB on the migrated database: %v", err)
+	}
+	db.Close()
+}
+
+// the seed database of the repository is migrated on the first start, so it
+// has to stay at a version the migrations can bring up to date
+func TestSeedDatabaseMigrates(t *testing.T) {
+	seed, err := os.ReadFile("../database/forum.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "forum.db")
+	if err := os.WriteFile(path, seed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := InitDB(path, testSchema, testMigrations)
+	if err != nil {
+		t.Fatalf("InitDB on the seed database: %v", err)
+	}
+	defer db.Close()
+
+	//the subcategories of the migrations end up under their parents
+	var orphans int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM categories
+		WHERE parent_id IS NOT NULL AND parent_id NOT IN (SELECT id FROM categories)
+	`).Scan(&orphans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 0 {
+		t.Errorf("%d categories have a missing parent", orphans)
+	}
+}
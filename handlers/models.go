@@ -27,13 +27,46 @@ type Post struct {
 	Comments     []Comment 
 	CommentCount int       
 	Category    Category  
+	ReadOnly     bool //all the categories of the post are archived
+	Tags         []string
+	Type         string   //one of the PostTypes
+	Listing      *Listing //the marketplace fields when Type is PostTypeListing
+	Event        *Event   //the calendar fields when Type is PostTypeEvent
+	Job          *Job     //the job board fields when Type is PostTypeJob
+	Housing      *Housing //the housing fields when Type is PostTypeHousing
+
+	Question          bool  //the post is in a Q&A category
+	AcceptedCommentID int64 //0 when no answer is accepted
+	AuthorReputation  int
+	Photos       []string //file names of the uploaded photos
+	Bookmarked   bool     //the viewer has bookmarked the post
+	New            bool  //the viewer hasn't opened the post
+	UnreadComments int   //the comments the viewer hasn't read
+	FirstUnread    int64 //the oldest unread comment, where the jump link goes
 }
 
 type Category struct {
 	ID          int64  
 	Name        string 
 	Description string 
-	PostCount   int 
+	PostCount   int //posts of the category and its subcategories
+	Position    int
+	Archived    bool //archived categories are read-only
+	ParentID    int64
+	Depth       int //0 for the top level categories
+	Children    []Category
+	Rules       *CategoryRules //nil when the category has no posting rules
+	Selected    bool           //checked in the new post form
+	PostType    string         //the type of the new posts of the category
+	QAMode      bool           //the posts are questions that can get an accepted answer
+}
+
+type Tag struct {
+	ID        int64    `json:"-"`
+	Name      string   `json:"name"`
+	PostCount int      `json:"post_count"`
+	Weight    int      `json:"-"` //1-5, the size in the tag cloud
+	Synonyms  []string `json:"synonyms,omitempty"`
 }
 
 type Comment struct {
@@ -47,6 +80,10 @@ type Comment struct {
 	Dislikes     int       `json:"dislikes"`
 	UserLiked    bool      `json:"user_liked"`
 	UserDisliked bool      `json:"user_disliked"`
+	Accepted     bool      `json:"accepted"`
+	Reputation   int       `json:"-"` //of the author
+	Bookmarked   bool      `json:"-"` //by the viewer
+	Unread       bool      `json:"-"` //new since the viewer last read the post
 }
 
 type TemplateData struct {
@@ -62,6 +99,54 @@ type TemplateData struct {
 	ShowLikedPosts   bool
 	Title            string
 	Error            string
+	Nonce            string //CSP nonce for the script tags of the page
+	Status           *SystemStatus
+	Breadcrumbs      []Category //the parent categories, top level first
+	TagCloud         []Tag
+	FilterTags       []string //the posts are filtered by these tags
+	TagList          []Tag
+	ListingFilter    *ListingFilter
+	PostTypes        []string
+	Currencies       []string
+	Conditions       []string
+	Calendar         *Calendar
+	JobFilter        *JobFilter
+	EmploymentTypes  []string
+	JobLanguages     []string
+	SalaryPeriods    []string
+	HousingFilter    *HousingFilter
+	HousingKinds     []string
+	Municipalities   []string
+	SavedSearches    []SavedSearch
+	HousingAlerts    int //the unseen alerts of the saved searches
+	AcceptedAnswer   *CommentData //pinned under a question
+	Unanswered       string       //"yes" or "no" filters the questions by an accepted answer
+	UpcomingEvents   []Post //the events sidebar
+	Notifications    []Notification
+	NotifySettings   []NotificationSetting
+	UnreadCount      int //the unread notifications, on the bell of the header
+	MailEnabled      bool   //the forum sends email
+	Digest           string //"daily", "weekly" or "" for no digest
+	Following        bool   //the user follows the category
+	Followed         []Category
+	Unsubscribed     string //what the unsubscribe link stopped
+	Conversations    []Conversation
+	Conversation     *Conversation
+	UnreadMessages   int //on the envelope of the header
+	Blocked          []User
+	Draft            *MessageDraft //the new conversation form
+	Reports          []MessageReport
+	Feed             []FeedItem
+	FeedMode         string //"following" or "all"
+	FeedBefore       string //where the next page of the feed starts, empty on the last page
+	FollowedUsers    []User
+	FollowedPosts    []Post
+	FollowingPost    bool
+	FollowingAuthor  bool
+	Bookmarks        []Bookmark
+	Folders          []BookmarkFolder
+	Folder           string //the folder the bookmarks page shows, "none" or an ID
+	UnreadOnly       bool   //the category shows only the posts with something unread
 }
 
 type CommentData struct {
@@ -73,4 +158,5 @@ type CommentData struct {
 type ErrorData struct {
     ErrorMessage string
     ErrorCode    string
+    Nonce        string
 }
@@ -0,0 +1,510 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the types of notifications
+const (
+	NotifyComment    = "comment"    //a comment on the user's post
+	NotifyReply      = "reply"      //a comment on a post the user has commented on
+	NotifyReaction   = "reaction"   //a like or a dislike of the user's post or comment
+	NotifyMention    = "mention"    //@username in a post or a comment
+	NotifyAnswer     = "answer"     //the user's answer was accepted
+	NotifyModeration = "moderation" //an admin changed the user's post
+)
+
+// how many notifications the notifications page shows
+const notificationsLimit = 100
+
+// how many users a post or a comment can mention
+const maxMentions = 10
+
+// NotificationType is a type of notifications the user can turn off. The
+// replies and the mentions can also be sent by email.
+type NotificationType struct {
+	Name  string
+	Label string
+	Mail  bool
+}
+
+var NotificationTypes = []NotificationType{
+	{NotifyComment, "Comments on my posts", true},
+	{NotifyReply, "Comments on posts I have commented on", true},
+	{NotifyReaction, "Likes and dislikes of my posts and comments", false},
+	{NotifyMention, "Mentions of me", true},
+	{NotifyAnswer, "My answers accepted", false},
+	{NotifyModeration, "Moderators' changes to my posts", false},
+}
+
+// mailedType tells if the notifications of the type can be sent by email
+func mailedType(name string) bool {
+	for _, t := range NotificationTypes {
+		if t.Name == name {
+			return t.Mail
+		}
+	}
+	return false
+}
+
+// Notification tells the user of something that concerns them
+type Notification struct {
+	ID        int64
+	UserID    int64
+	ActorID   int64
+	Type      string
+	PostID    int64
+	CommentID int64
+	Message   string
+	CreatedAt time.Time
+	Read      bool
+}
+
+// Target is the page the notification is about
+func (n *Notification) Target() string {
+	if n.PostID == 0 {
+		return "/notifications"
+	}
+	target := "/post/" + strconv.FormatInt(n.PostID, 10)
+	if n.CommentID != 0 {
+		target += "#comment-" + strconv.FormatInt(n.CommentID, 10)
+	}
+	return target
+}
+
+// NotificationSetting is a type of notifications and if the user gets them
+// on the site and by email
+type NotificationSetting struct {
+	NotificationType
+	InApp bool
+	Email bool
+}
+
+// nullID stores a missing ID as NULL
+func nullID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// notify stores the notifications, one for each user at most, the first one
+// wins, and queues the emails of the replies and the mentions when the email
+// is on. Nobody is notified of what they did themselves, nor of the types
+// they have turned off. The errors are only logged, the action that caused
+// the notifications has already succeeded.
+func (h *Handler) notify(ctx context.Context, notifications ...Notification) {
+	notified := make(map[int64]bool)
+	for _, n := range notifications {
+		if n.UserID == 0 || n.UserID == n.ActorID || notified[n.UserID] {
+			continue
+		}
+		notified[n.UserID] = true
+		if err := h.deliver(ctx, &n); err != nil {
+			LogFrom(ctx).Error("Error creating notification", "user_id", n.UserID, "type", n.Type, "err", err)
+		}
+	}
+}
+
+// deliver stores the notification and queues its email as the user has chosen
+func (h *Handler) deliver(ctx context.Context, n *Notification) error {
+	var address string
+	var inApp, byEmail bool
+	err := h.db.QueryRowContext(ctx, `
+		SELECT u.email, COALESCE(s.in_app, 1), COALESCE(s.email, 1)
+		FROM users u
+		LEFT JOIN notification_settings s ON s.user_id = u.id AND s.type = ?
+		WHERE u.id = ?
+	`, n.Type, n.UserID).Scan(&address, &inApp, &byEmail)
+	if err != nil {
+		return err
+	}
+
+	if inApp {
+		done := observeQuery("create_notification")
+		_, err = h.db.ExecContext(ctx, `
+			INSERT INTO notifications (user_id, actor_id, type, post_id, comment_id, message)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, n.UserID, nullID(n.ActorID), n.Type, nullID(n.PostID), nullID(n.CommentID), n.Message)
+		done()
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.mailer != nil && byEmail && mailedType(n.Type) {
+		if to, ok := emailAddress(address); ok {
+			return h.mailNotification(ctx, to, n)
+		}
+	}
+	return nil
+}
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])@([\p{L}\p{N}_.-]+)`)
+
+// mentionedUsers returns the IDs of the users mentioned as @username in the
+// text. The usernames are compared without case.
+func (h *Handler) mentionedUsers(text string) ([]int64, error) {
+	var ids []int64
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		//a mention can end a sentence
+		name := strings.ToLower(strings.TrimRight(match[1], ".-"))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if len(seen) > maxMentions {
+			break
+		}
+		var id int64
+		err := h.db.QueryRow("SELECT id FROM users WHERE username = ? COLLATE NOCASE", name).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// mentionNotifications are the notifications of the users mentioned in the
+// post or the comment
+func (h *Handler) mentionNotifications(actor *User, text, title string, postID, commentID int64) ([]Notification, error) {
+	ids, err := h.mentionedUsers(text)
+	if err != nil {
+		return nil, err
+	}
+	where := "a comment on"
+	if commentID == 0 {
+		where = "the post"
+	}
+	var notifications []Notification
+	for _, id := range ids {
+		notifications = append(notifications, Notification{
+			UserID:    id,
+			ActorID:   actor.ID,
+			Type:      NotifyMention,
+			PostID:    postID,
+			CommentID: commentID,
+			Message:   fmt.Sprintf("%s mentioned you in %s “%s”", actor.Username, where, title),
+		})
+	}
+	return notifications, nil
+}
+
+// notifyComment notifies of a new comment the mentioned users, the author of
+// the post and the others who have commented on it
+func (h *Handler) notifyComment(ctx context.Context, actor *User, postID, commentID int64, content string) error {
+	var authorID int64
+	var title string
+	err := h.db.QueryRow("SELECT user_id, title FROM posts WHERE id = ?", postID).Scan(&authorID, &title)
+	if err != nil {
+		return err
+	}
+	notifications, err := h.mentionNotifications(actor, content, title, postID, commentID)
+	if err != nil {
+		return err
+	}
+	notifications = append(notifications, Notification{
+		UserID:    authorID,
+		ActorID:   actor.ID,
+		Type:      NotifyComment,
+		PostID:    postID,
+		CommentID: commentID,
+		Message:   fmt.Sprintf("%s commented on your post “%s”", actor.Username, title),
+	})
+
+	rows, err := h.db.Query(`
+		SELECT DISTINCT user_id FROM comments WHERE post_id = ? AND id != ? LIMIT 100
+	`, postID, commentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return err
+		}
+		notifications = append(notifications, Notification{
+			UserID:    userID,
+			ActorID:   actor.ID,
+			Type:      NotifyReply,
+			PostID:    postID,
+			CommentID: commentID,
+			Message:   fmt.Sprintf("%s also commented on “%s”", actor.Username, title),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	h.notify(ctx, notifications...)
+	return nil
+}
+
+// notifyReaction notifies the author of the post, or of the comment when
+// commentID is set, of a new like or dislike
+func (h *Handler) notifyReaction(ctx context.Context, actor *User, postID, commentID int64, reaction string) error {
+	var authorID int64
+	var title string
+	what := "post"
+	var err error
+	if commentID != 0 {
+		what = "comment on"
+		err = h.db.QueryRow(`
+			SELECT c.user_id, c.post_id, p.title FROM comments c JOIN posts p ON p.id = c.post_id WHERE c.id = ?
+		`, commentID).Scan(&authorID, &postID, &title)
+	} else {
+		err = h.db.QueryRow("SELECT user_id, title FROM posts WHERE id = ?", postID).Scan(&authorID, &title)
+	}
+	if err != nil {
+		return err
+	}
+	h.notify(ctx, Notification{
+		UserID:    authorID,
+		ActorID:   actor.ID,
+		Type:      NotifyReaction,
+		PostID:    postID,
+		CommentID: commentID,
+		Message:   fmt.Sprintf("%s %sd your %s “%s”", actor.Username, reaction, what, title),
+	})
+	return nil
+}
+
+// unreadNotifications counts the unread notifications of the user for the bell
+func (h *Handler) unreadNotifications(userID int64) (int, error) {
+	var count int
+	done := observeQuery("unread_notifications")
+	err := h.db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count)
+	done()
+	return count, err
+}
+
+// getNotifications returns the latest notifications of the user, newest first
+func (h *Handler) getNotifications(userID int64) ([]Notification, error) {
+	done := observeQuery("get_notifications")
+	rows, err := h.db.Query(`
+		SELECT id, user_id, COALESCE(actor_id, 0), type, COALESCE(post_id, 0), COALESCE(comment_id, 0),
+		message, created_at, read_at IS NOT NULL
+		FROM notifications
+		WHERE user_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, userID, notificationsLimit)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.ActorID, &n.Type, &n.PostID, &n.CommentID,
+			&n.Message, &n.CreatedAt, &n.Read); err != nil {
+			return nil, err
+		}
+		n.CreatedAt = n.CreatedAt.In(h.location)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// getNotificationSettings returns every type of notifications and if the
+// user gets them
+func (h *Handler) getNotificationSettings(userID int64) ([]NotificationSetting, error) {
+	saved := make(map[string]NotificationSetting)
+	rows, err := h.db.Query("SELECT type, in_app, email FROM notification_settings WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t string
+		var setting NotificationSetting
+		if err := rows.Scan(&t, &setting.InApp, &setting.Email); err != nil {
+			return nil, err
+		}
+		saved[t] = setting
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	settings := make([]NotificationSetting, len(NotificationTypes))
+	for i, t := range NotificationTypes {
+		setting, ok := saved[t.Name]
+		if !ok {
+			setting = NotificationSetting{InApp: true, Email: true}
+		}
+		setting.NotificationType = t
+		settings[i] = setting
+	}
+	return settings, nil
+}
+
+// Notifications shows the notifications of the user and the settings of
+// which ones they get. /notifications/{id} marks one read and opens the
+// page it is about.
+func (h *Handler) Notifications(w http.ResponseWriter, r *http.Request) {
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if id := strings.TrimPrefix(r.URL.Path, "/notifications/"); id != r.URL.Path && id != "" {
+		h.openNotification(w, r, user, id)
+		return
+	}
+
+	notifications, err := h.getNotifications(user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting notifications", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	settings, err := h.getNotificationSettings(user.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting notification settings", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	digest, err := h.getDigestFrequency(user.ID)
+	var followed []Category
+	if err == nil {
+		followed, err = h.getFollowedCategories(user.ID)
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting digest settings", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	data := TemplateData{
+		Title:          "Notifications",
+		User:           user,
+		Notifications:  notifications,
+		NotifySettings: settings,
+		MailEnabled:    h.mailer != nil,
+		Digest:         digest,
+		Followed:       followed,
+	}
+	if err := h.render(w, r, "notifications.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// openNotification marks the notification read and redirects to its page
+func (h *Handler) openNotification(w http.ResponseWriter, r *http.Request, user *User, id string) {
+	notificationID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Notification not found", http.StatusNotFound)
+		return
+	}
+	var n Notification
+	err = h.db.QueryRow(`
+		SELECT COALESCE(post_id, 0), COALESCE(comment_id, 0) FROM notifications WHERE id = ? AND user_id = ?
+	`, notificationID, user.ID).Scan(&n.PostID, &n.CommentID)
+	if err == sql.ErrNoRows {
+		h.ErrorHandler(w, r, "Notification not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		_, err = h.db.Exec(`
+			UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE id = ? AND read_at IS NULL
+		`, notificationID)
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, n.Target(), http.StatusSeeOther)
+}
+
+// NotificationAPI marks a notification read (action=read with id), all of
+// them read (action=read_all) or saves the types of notifications the user
+// gets and the digest (action=settings with the in_app and email types
+// checked and digest)
+func (h *Handler) NotificationAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch r.FormValue("action") {
+	case "read":
+		id, parseErr := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if parseErr != nil {
+			h.ErrorHandler(w, r, "Invalid notification ID", http.StatusBadRequest)
+			return
+		}
+		_, err = h.db.Exec(`
+			UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ? AND read_at IS NULL
+		`, id, user.ID)
+
+	case "read_all":
+		_, err = h.db.Exec(`
+			UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND read_at IS NULL
+		`, user.ID)
+
+	case "settings":
+		err = h.saveNotificationSettings(user.ID, r.Form["in_app"], r.Form["email"])
+		if err == nil {
+			err = h.saveDigestFrequency(user.ID, r.FormValue("digest"))
+		}
+
+	default:
+		h.ErrorHandler(w, r, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error updating notifications", "action", r.FormValue("action"), "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// saveNotificationSettings turns on the types given and off the others, on
+// the site and by email
+func (h *Handler) saveNotificationSettings(userID int64, inApp, email []string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, t := range NotificationTypes {
+		_, err := tx.Exec(`
+			INSERT INTO notification_settings (user_id, type, in_app, email) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, type) DO UPDATE SET in_app = excluded.in_app, email = excluded.email
+		`, userID, t.Name, contains(inApp, t.Name), contains(email, t.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
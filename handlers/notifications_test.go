@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// notificationsOf returns the types of the notifications of the user, oldest first
+func notificationsOf(t *testing.T, h *Handler, userID int64) []string {
+	t.Helper()
+	rows, err := h.db.Query("SELECT type FROM notifications WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var types []string
+	for rows.Next() {
+		var notificationType string
+		if err := rows.Scan(&notificationType); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, notificationType)
+	}
+	return types
+}
+
+func TestMentionedUsers(t *testing.T) {
+	h := newTestHandler(t)
+	anna := addUser(t, h, "Anna")
+	dotted := addUser(t, h, "j.doe")
+
+	tests := []struct {
+		text string
+		want []int64
+	}{
+		{"hi @anna", []int64{anna}},
+		{"@ANNA and @anna again", []int64{anna}},
+		{"thanks @j.doe.", []int64{dotted}},
+		{"(@Anna) @j.doe", []int64{anna, dotted}},
+		{"anna@example.com is not a mention", nil},
+		{"@nobody", nil},
+	}
+	for _, tt := range tests {
+		got, err := h.mentionedUsers(tt.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameIDs(got, tt.want) {
+			t.Errorf("mentionedUsers(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestNotifyComment(t *testing.T) {
+	h := newTestHandler(t)
+	author := addUser(t, h, "author")
+	commenter := addUser(t, h, "commenter")
+	earlier := addUser(t, h, "earlier")
+	mentioned := addUser(t, h, "mentioned")
+	muted := addUser(t, h, "muted")
+	exec(t, h.db, "INSERT INTO notification_settings (user_id, type, in_app) VALUES (?, ?, 0)", muted, NotifyReply)
+
+	postID := addPost(t, h, author, PostTypePost, time.Now())
+	addComment(t, h, earlier, postID, time.Now())
+	addComment(t, h, muted, postID, time.Now())
+	addComment(t, h, commenter, postID, time.Now())
+	commentID := addComment(t, h, commenter, postID, time.Now())
+
+	actor := &User{ID: commenter, Username: "commenter"}
+	err := h.notifyComment(context.Background(), actor, postID, commentID, "@mentioned @author @commenter what do you think?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		userID int64
+		want   []string
+	}{
+		//the mention comes first, so the author isn't notified twice
+		{"author", author, []string{NotifyMention}},
+		{"earlier commenter", earlier, []string{NotifyReply}},
+		{"mentioned", mentioned, []string{NotifyMention}},
+		{"replies turned off", muted, nil},
+		{"the commenter themselves", commenter, nil},
+	}
+	for _, tt := range tests {
+		got := notificationsOf(t, h, tt.userID)
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("%s got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNotifyWithoutActor(t *testing.T) {
+	h := newTestHandler(t)
+	userID := addUser(t, h, "member")
+	postID := addPost(t, h, userID, PostTypePost, time.Now())
+
+	//a notice of the forum itself has no actor and is still delivered, the
+	//user's own actions are not
+	h.notify(context.Background(), Notification{
+		UserID:  userID,
+		Type:    NotifyModeration,
+		PostID:  postID,
+		Message: "Your listing has expired",
+	})
+	h.notify(context.Background(), Notification{
+		UserID:  userID,
+		ActorID: userID,
+		Type:    NotifyReaction,
+		PostID:  postID,
+		Message: "member liked your post",
+	})
+	if got := notificationsOf(t, h, userID); len(got) != 1 || got[0] != NotifyModeration {
+		t.Errorf("the user got %v, want only the moderation notice", got)
+	}
+}
@@ -2,8 +2,8 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,43 +14,34 @@ import (
 func (h *Handler) CreatePost(w http.ResponseWriter, r *http.Request) {
 	//checking if the user is logged in
 	user := h.GetSessionUser(w, r)
-	if user == nil {
+	if user == nil || user.ID == 0 {
 		http.Redirect(w, r, "/login", http.StatusSeeOther) //if they are not logged in, redirect them to the login page
 		return
 	}
 
 	//if the request method is GET, the user wants to create a post and it will display the create post page
 	if r.Method == http.MethodGet {
-		//loading the categories to choose from
-		categories, err := h.getCategories()
-		if err != nil {
-			log.Printf("Error loading catgories: %v", err)
-			h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
-			return
-		}
-
-		//creating the data to be displayed on the page
-		data := &TemplateData{
-			Title:      "Create Post",
-			User:       user,
-			Categories: categories,
-		}
-		//executing the template and displaying the page
-		h.templates.ExecuteTemplate(w, "new_post.html", data)
+		//the category can be chosen beforehand, /post/new?category=3
+		selected, _ := strconv.ParseInt(r.URL.Query().Get("category"), 10, 64)
+		h.renderNewPost(w, r, user, &Post{}, []int64{selected}, "", http.StatusOK)
 		return
 	}
 
 	//if the request method is not POST, display an error message
 	if r.Method != http.MethodPost {
-		h.ErrorHandler(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	//parsing the form
-	if err := r.ParseForm(); err != nil {
-		h.ErrorHandler(w, "Failed to parse form", http.StatusBadRequest)
+	//parsing the form, it is multipart when it has photos
+	r.Body = http.MaxBytesReader(w, r.Body, int64(h.maxUpload)*maxPhotos+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
 
 	//getting the title and content of the post
 	title := strings.TrimSpace(r.FormValue("title"))
@@ -59,48 +50,212 @@ func (h *Handler) CreatePost(w http.ResponseWriter, r *http.Request) {
 
 	// check if title or content are empty after trimming spaces
 	if title == "" || content == "" {
-		h.ErrorHandler(w, "Title and content cannot be empty", http.StatusBadRequest)
+		h.ErrorHandler(w, r, "Title and content cannot be empty", http.StatusBadRequest)
 		return
 	}
 
-	createdAt := time.Now().In(h.location)
-	result, err := h.db.Exec(`
-    INSERT INTO posts (user_id, title, content, username, created_at)
-    SELECT ?, ?, ?, username, ? FROM users WHERE id = ?
-`, user.ID, title, content, createdAt, user.ID)
+	//the tags are optional, written comma separated
+	tags, err := ParseTags(r.FormValue("tags"))
 	if err != nil {
-		log.Printf("Error creating post: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		h.ErrorHandler(w, r, "A post can have at most 5 tags", http.StatusBadRequest)
 		return
 	}
 
-	//getting the ID of the post
-	postID, err := result.LastInsertId()
+	//checking that the chosen categories exist and are not archived
+	categoryIDs, err := h.postableCategories(categories)
 	if err != nil {
-		log.Printf("Error getting post id: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		if errors.Is(err, ErrInvalidCategory) {
+			h.ErrorHandler(w, r, "Invalid category", http.StatusBadRequest)
+			return
+		}
+		LogFrom(r.Context()).Error("Error checking categories", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
-	// If no categories were selected, use category ID = 1
-	if len(categories) == 0 {
-		categories = append(categories, "1") // Use category ID 1 if no category is selected
+	//the rules of the categories, like the title prefix, and the fields of
+	//the post type, like the price of a listing. The daily limit is checked
+	//when the post is saved.
+	form := &Post{Title: title, Content: content, Tags: tags}
+	err = h.checkPostingRules(user, categoryIDs, title)
+	if err == nil {
+		form.Type, err = h.postTypeOf(categoryIDs)
+	}
+	if err == nil {
+		err = h.readPostDetails(r, form)
+	}
+	if err != nil {
+		var formErr *FormError
+		if errors.As(err, &formErr) {
+			h.renderNewPost(w, r, user, form, categoryIDs, formErr.Message, formErr.Code)
+			return
+		}
+		LogFrom(r.Context()).Error("Error checking the post", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
 	}
 
-	for _, categoryID := range categories {
-		_, err = h.db.Exec(`
-			INSERT INTO post_categories (post_id, category_id)
-			VALUES (?, ?)
-		`, postID, categoryID)
-		if err != nil {
-			continue
+	//the post, its categories, the fields of its type, its photos and its
+	//tags are saved together, so a failure leaves nothing half made and the
+	//uploaded photos are removed
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.removeUploads(form.Photos)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	postID, err := createPost(tx, user.ID, form, categoryIDs, time.Now().In(h.location))
+	if err == nil {
+		err = h.checkDailyLimits(tx, user, categoryIDs)
+	}
+	if err == nil {
+		err = h.savePostDetails(tx, postID, form)
+	}
+	if err != nil {
+		h.removeUploads(form.Photos)
+		var formErr *FormError
+		if errors.As(err, &formErr) {
+			//the post is dropped before the form is shown, so the write lock
+			//isn't held while the page renders
+			tx.Rollback()
+			h.renderNewPost(w, r, user, form, categoryIDs, formErr.Message, formErr.Code)
+			return
+		}
+		LogFrom(r.Context()).Error("Error creating post", "user_id", user.ID, "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		h.removeUploads(form.Photos)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	postsCreated.Inc()
+
+	//the users whose saved searches the new home matches get an alert
+	if form.Type == PostTypeHousing {
+		if _, err := h.alertSavedSearches(r.Context(), postID, user.ID); err != nil {
+			LogFrom(r.Context()).Error("Error sending housing alerts", "post_id", postID, "err", err)
 		}
 	}
 
+	mentions, err := h.mentionNotifications(user, content, title, postID, 0)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error sending notifications", "post_id", postID, "err", err)
+	}
+	h.notify(r.Context(), mentions...)
+	if err := h.publishPost(postID, title, user.Username); err != nil {
+		LogFrom(r.Context()).Error("Error publishing post", "post_id", postID, "err", err)
+	}
+
 	//redirecting the user to the newly created post page
 	http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
 }
 
+// createPost inserts the post with its categories and tags in the
+// transaction and returns its ID
+func createPost(tx *sql.Tx, userID int64, form *Post, categoryIDs []int64, createdAt time.Time) (int64, error) {
+	done := observeQuery("create_post")
+	result, err := tx.Exec(`
+		INSERT INTO posts (user_id, title, content, username, created_at, type)
+		SELECT ?, ?, ?, username, ?, ? FROM users WHERE id = ?
+	`, userID, form.Title, form.Content, createdAt, form.Type, userID)
+	done()
+	if err != nil {
+		return 0, err
+	}
+	//the insert copies the username, so it adds nothing when the user is gone
+	if n, err := result.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, fmt.Errorf("user %d not found", userID)
+	}
+	postID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, categoryID := range categoryIDs {
+		_, err := tx.Exec("INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)", postID, categoryID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := setPostTags(tx, postID, form.Tags); err != nil {
+		return 0, err
+	}
+	return postID, nil
+}
+
+// renderNewPost shows the new post form. The form keeps what the user wrote
+// when it is shown again with an error.
+func (h *Handler) renderNewPost(w http.ResponseWriter, r *http.Request, user *User, form *Post, selected []int64, message string, code int) {
+	//loading the categories to choose from
+	categories, err := h.getCategories()
+	if err != nil {
+		LogFrom(r.Context()).Error("Error loading catgories", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	rules, err := h.getAllCategoryRules()
+	if err != nil {
+		LogFrom(r.Context()).Error("Error loading posting rules", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	active := activeCategories(flattenCategories(categories))
+	if form.Listing == nil {
+		form.Listing = &Listing{Currency: "EUR"}
+	}
+	if form.Event == nil {
+		form.Event = &Event{}
+	}
+	if form.Job == nil {
+		form.Job = &Job{}
+	}
+	if form.Housing == nil {
+		form.Housing = &Housing{}
+	}
+	for i := range active {
+		active[i].Rules = rules[active[i].ID]
+		for _, id := range selected {
+			if active[i].ID != id {
+				continue
+			}
+			active[i].Selected = true
+			//a new post starts from the template of the chosen category
+			if message == "" && active[i].Rules != nil {
+				form.Title = active[i].Rules.TitlePrefix
+				form.Content = active[i].Rules.ContentTemplate
+			}
+		}
+	}
+
+	//creating the data to be displayed on the page
+	data := &TemplateData{
+		Title:           "Create Post",
+		User:            user,
+		Post:            form,
+		Categories:      active,
+		Error:           message,
+		Currencies:      Currencies,
+		Conditions:      ListingConditions,
+		EmploymentTypes: EmploymentTypes,
+		JobLanguages:    JobLanguages,
+		SalaryPeriods:   SalaryPeriods,
+		HousingKinds:    HousingKinds,
+		Municipalities:  Municipalities,
+	}
+	//executing the template and displaying the page
+	w.WriteHeader(code)
+	h.render(w, r, "new_post.html", data)
+}
+
 // a function to prepare the data for the post.html template
 func (h *Handler) GetPost(w http.ResponseWriter, r *http.Request) {
 	//get the post ID from the URL by cutting the /post/ from the URL
@@ -117,7 +272,15 @@ func (h *Handler) GetPost(w http.ResponseWriter, r *http.Request) {
 	//calling out the getPostByID function to get the post with the given ID
 	post, err := h.getPostByID(postID)
 	if err != nil {
-		h.ErrorHandler(w, "Post not found", http.StatusNotFound)
+		h.ErrorHandler(w, r, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	//the breadcrumbs lead through the category the user came from
+	breadcrumbs, err := h.postBreadcrumbs(post.ID, Category.ID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting category path", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
@@ -127,11 +290,21 @@ func (h *Handler) GetPost(w http.ResponseWriter, r *http.Request) {
 		post.UserDisliked = h.hasUserReaction(user.ID, post.ID, "dislike")
 	}
 
+	//the answer of the user to an event
+	if user != nil && post.Event != nil {
+		post.Event.UserRSVP, err = h.getUserRSVP(post.ID, user.ID)
+		if err != nil {
+			LogFrom(r.Context()).Error("Error getting RSVP", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	//calling out the getComments function to get the comments of the post
 	comments, err := h.getComments(post.ID)
 	if err != nil {
-		log.Printf("Error loading comments: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Error loading comments", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
@@ -143,15 +316,78 @@ func (h *Handler) GetPost(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	//the comments since the user last read the post, then the post is read
+	//up to the latest comment
+	if user != nil && user.ID != 0 {
+		//the page works without the unread markers, so the errors are only logged
+		states, err := h.readStates(user.ID, []int64{post.ID})
+		if err != nil {
+			LogFrom(r.Context()).Error("Error getting read state", "post_id", post.ID, "err", err)
+		} else {
+			state := states[post.ID]
+			post.UnreadComments = state.Unread
+			post.FirstUnread = state.FirstUnread
+			var lastCommentID int64
+			for _, comment := range comments {
+				comment.Unread = comment.ID > state.ReadTo && comment.UserID != user.ID
+				if comment.ID > lastCommentID {
+					lastCommentID = comment.ID
+				}
+			}
+			if err := h.markPostRead(user.ID, post.ID, lastCommentID, state); err != nil {
+				LogFrom(r.Context()).Error("Error marking post read", "post_id", post.ID, "err", err)
+			}
+		}
+	}
+
+	//what the user has bookmarked, and the folders for the bookmark form
+	var folders []BookmarkFolder
+	if user != nil && user.ID != 0 {
+		var bookmarked map[int64]bool
+		post.Bookmarked, bookmarked, err = h.bookmarkedOnPost(user.ID, post.ID)
+		if err == nil {
+			folders, err = h.getBookmarkFolders(user.ID)
+		}
+		if err != nil {
+			LogFrom(r.Context()).Error("Error getting bookmarks", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		for _, comment := range comments {
+			comment.Bookmarked = bookmarked[comment.ID]
+		}
+	}
+
+	//the reputation of the author and the commenters
+	authors := []int64{post.UserID}
+	for _, comment := range comments {
+		authors = append(authors, comment.UserID)
+	}
+	reputation, err := h.getReputation(authors)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting reputation", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	post.AuthorReputation = reputation[post.UserID]
+
 	// prepare data for the template
 	var commentDataList []CommentData
+	var accepted *CommentData
 	for _, comment := range comments {
+		comment.Reputation = reputation[comment.UserID]
 		//each comment will have a user and a post
 		commentData := CommentData{
 			Comment: comment,
 			User:    user,
 			Post:    post,
 		}
+		//the accepted answer is pinned under the question instead of the list
+		if comment.ID == post.AcceptedCommentID {
+			comment.Accepted = true
+			accepted = &commentData
+			continue
+		}
 		commentDataList = append(commentDataList, commentData)
 	}
 
@@ -163,20 +399,36 @@ func (h *Handler) GetPost(w http.ResponseWriter, r *http.Request) {
 		Comments:        comments,
 		CommentDataList: commentDataList,
 		Category:        &Category,
+		Breadcrumbs:     breadcrumbs,
+		AcceptedAnswer:  accepted,
+		Folders:         folders,
+	}
+	if user != nil && user.ID != 0 {
+		data.FollowingPost, err = h.isFollowingPost(user.ID, post.ID)
+		if err == nil {
+			data.FollowingAuthor, err = h.isFollowingUser(user.ID, post.UserID)
+		}
+		if err != nil {
+			LogFrom(r.Context()).Error("Error checking follows", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	//render the post.html template with the data
-	if err := h.templates.ExecuteTemplate(w, "post.html", data); err != nil {
-		log.Printf("Error rendering page: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	if err := h.render(w, r, "post.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 	}
 }
 
 // a function to get a specific post from the database
 func (h *Handler) getPostByID(postID string) (*Post, error) {
 	var post Post
+	done := observeQuery("get_post")
 	err := h.db.QueryRow(`
-		SELECT p.id, p.user_id, p.title, p.content, p.created_at, u.username,
+		SELECT p.id, p.user_id, p.title, p.content, p.created_at, u.username, p.type,
+		COALESCE(p.accepted_comment_id, 0),
 		COUNT(DISTINCT CASE WHEN r.type = 'like' THEN r.id END) as likes,
 		COUNT(DISTINCT CASE WHEN r.type = 'dislike' THEN r.id END) as dislikes
 		FROM posts p
@@ -186,8 +438,9 @@ func (h *Handler) getPostByID(postID string) (*Post, error) {
 		GROUP BY p.id, p.user_id, p.title, p.content, p.created_at, u.username
 	`, postID).Scan(
 		&post.ID, &post.UserID, &post.Title, &post.Content, &post.CreatedAt,
-		&post.Username, &post.Likes, &post.Dislikes,
+		&post.Username, &post.Type, &post.AcceptedCommentID, &post.Likes, &post.Dislikes,
 	)
+	done()
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -202,29 +455,59 @@ func (h *Handler) getPostByID(postID string) (*Post, error) {
 		return nil, err
 	}
 
+	//recieve the tags of the post
+	tags, err := h.getTagsForPosts([]int64{post.ID})
+	if err != nil {
+		return nil, err
+	}
+	post.Tags = tags[post.ID]
+
+	//the fields of the post type, like the price of a listing
+	details := []Post{post}
+	if err := h.loadPostDetails(details); err != nil {
+		return nil, err
+	}
+	post = details[0]
+
 	//recieve the comment count of the post
 	var commentCount int
+	done = observeQuery("count_post_comments")
 	err = h.db.QueryRow(`
 		SELECT COUNT(*) 
 		FROM comments 
 		WHERE post_id = ?
 	`, post.ID).Scan(&commentCount)
+	done()
 	if err != nil {
 		return nil, err
 	}
 	post.CommentCount = commentCount
 
+	//posts in archived categories can't be commented or reacted to
+	post.ReadOnly, err = h.isPostReadOnly(post.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	//the posts of the Q&A categories can get an accepted answer
+	post.Question, err = h.isQuestion(post.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	return &post, nil
 }
 
 // getting the posts from the database with the post ID
 func (h *Handler) getPostCategories(postID int64) ([]string, error) {
+	done := observeQuery("get_post_categories")
 	rows, err := h.db.Query(`
 		SELECT c.name
 		FROM categories c
 		JOIN post_categories pc ON c.id = pc.category_id
 		WHERE pc.post_id = ?
 	`, postID)
+	done()
 
 	if err != nil {
 		return nil, err
@@ -241,3 +524,83 @@ func (h *Handler) getPostCategories(postID int64) ([]string, error) {
 	}
 	return categories, nil
 }
+
+// postableCategories checks the category IDs from the form. If no category was
+// chosen the first category that is not archived is used.
+func (h *Handler) postableCategories(ids []string) ([]int64, error) {
+	if len(ids) == 0 {
+		var id int64
+		err := h.db.QueryRow(`
+			SELECT id FROM categories
+			WHERE archived_at IS NULL
+			ORDER BY position, id
+			LIMIT 1
+		`).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidCategory
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []int64{id}, nil
+	}
+
+	var categoryIDs []int64
+	seen := make(map[int64]bool)
+	for _, value := range ids {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidCategory
+		}
+		//a category picked twice is linked once
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		var active bool
+		err = h.db.QueryRow("SELECT archived_at IS NULL FROM categories WHERE id = ?", id).Scan(&active)
+		if err == sql.ErrNoRows || (err == nil && !active) {
+			return nil, ErrInvalidCategory
+		}
+		if err != nil {
+			return nil, err
+		}
+		categoryIDs = append(categoryIDs, id)
+	}
+	return categoryIDs, nil
+}
+
+// postBreadcrumbs returns the category path of the post. The category the user
+// came from is used when it is given, otherwise the first category of the post.
+func (h *Handler) postBreadcrumbs(postID, fromCategoryID int64) ([]Category, error) {
+	var categoryID sql.NullInt64
+	err := h.db.QueryRow(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT CASE WHEN EXISTS(SELECT 1 FROM post_categories
+			WHERE post_id = ? AND category_id IN (SELECT id FROM subtree))
+			THEN ? ELSE (SELECT MIN(category_id) FROM post_categories WHERE post_id = ?) END
+	`, fromCategoryID, postID, fromCategoryID, postID).Scan(&categoryID)
+	if err != nil {
+		return nil, err
+	}
+	if !categoryID.Valid {
+		return nil, nil //the post has no categories
+	}
+	return h.categoryPath(categoryID.Int64)
+}
+
+// isPostReadOnly tells if all the categories of the post are archived
+func (h *Handler) isPostReadOnly(postID int64) (bool, error) {
+	var readOnly bool
+	err := h.db.QueryRow(`
+		SELECT COUNT(*) > 0 AND COUNT(*) = COUNT(c.archived_at)
+		FROM post_categories pc
+		JOIN categories c ON c.id = pc.category_id
+		WHERE pc.post_id = ?
+	`, postID).Scan(&readOnly)
+	return readOnly, err
+}
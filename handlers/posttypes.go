@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The post types. A category takes one type of posts and the posts get the
+// type of their category. The types other than PostTypePost have extra
+// fields saved in their own table.
+const (
+	PostTypePost    = "post"
+	PostTypeListing = "listing"
+	PostTypeEvent   = "event"
+	PostTypeJob     = "job"
+	PostTypeHousing = "housing"
+)
+
+// PostTypes lists the types an admin can choose for a category
+var PostTypes = []string{PostTypePost, PostTypeListing, PostTypeEvent, PostTypeJob, PostTypeHousing}
+
+var ErrInvalidPostType = errors.New("invalid post type")
+
+// SetCategoryPostType changes the type of the new posts of the category, the
+// old posts keep their type
+func SetCategoryPostType(db *sql.DB, categoryID int64, postType string) error {
+	valid := false
+	for _, t := range PostTypes {
+		if t == postType {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrInvalidPostType
+	}
+	return execOne(db, "UPDATE categories SET post_type = ? WHERE id = ?", postType, categoryID)
+}
+
+// postTypeOf returns the type of a post in the categories. The categories of
+// one post can't have different special types.
+func (h *Handler) postTypeOf(categoryIDs []int64) (string, error) {
+	postType := PostTypePost
+	for _, id := range categoryIDs {
+		var t string
+		if err := h.db.QueryRow("SELECT post_type FROM categories WHERE id = ?", id).Scan(&t); err != nil {
+			return "", err
+		}
+		if t == PostTypePost || t == postType {
+			continue
+		}
+		if postType != PostTypePost {
+			return "", &FormError{
+				Message: fmt.Sprintf("A post can't be of two kinds (%s and %s), choose the categories of one kind", postType, t),
+				Code:    http.StatusBadRequest,
+			}
+		}
+		postType = t
+	}
+	return postType, nil
+}
+
+// readPostDetails reads and checks the fields of the post type from the form.
+// The photos are saved right away and need to be removed if the post is not
+// saved after all.
+func (h *Handler) readPostDetails(r *http.Request, post *Post) error {
+	switch post.Type {
+	case PostTypeListing:
+		listing, err := parseListingForm(r)
+		post.Listing = listing
+		if err != nil {
+			return err
+		}
+		photos, err := h.readPhotos(r)
+		if err != nil {
+			return err
+		}
+		post.Photos = photos
+	case PostTypeEvent:
+		event, err := h.parseEventForm(r)
+		post.Event = event
+		if err != nil {
+			return err
+		}
+	case PostTypeJob:
+		job, err := h.parseJobForm(r)
+		post.Job = job
+		if err != nil {
+			return err
+		}
+	case PostTypeHousing:
+		housing, err := h.parseHousingForm(r)
+		post.Housing = housing
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savePostDetails saves the fields of the post type and the photos of a new
+// post in the transaction of the post
+func (h *Handler) savePostDetails(tx dbtx, postID int64, post *Post) error {
+	var err error
+	switch post.Type {
+	case PostTypeListing:
+		err = h.saveListing(tx, postID, post.Listing)
+	case PostTypeEvent:
+		err = h.saveEvent(tx, postID, post.Event)
+	case PostTypeJob:
+		err = h.saveJob(tx, postID, post.Job)
+	case PostTypeHousing:
+		err = h.saveHousing(tx, postID, post.Housing)
+	}
+	if err != nil {
+		return err
+	}
+	return savePhotos(tx, postID, post.Photos)
+}
+
+// loadPostDetails fills in the fields of the post type of the posts
+func (h *Handler) loadPostDetails(posts []Post) error {
+	var listingIDs, eventIDs, jobIDs, housingIDs []int64
+	var ids []int64
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+		switch p.Type {
+		case PostTypeListing:
+			listingIDs = append(listingIDs, p.ID)
+		case PostTypeEvent:
+			eventIDs = append(eventIDs, p.ID)
+		case PostTypeJob:
+			jobIDs = append(jobIDs, p.ID)
+		case PostTypeHousing:
+			housingIDs = append(housingIDs, p.ID)
+		}
+	}
+
+	listings, err := h.getListings(listingIDs)
+	if err != nil {
+		return err
+	}
+	events, err := h.getEvents(eventIDs)
+	if err != nil {
+		return err
+	}
+	jobs, err := h.getJobs(jobIDs)
+	if err != nil {
+		return err
+	}
+	homes, err := h.getHousing(housingIDs)
+	if err != nil {
+		return err
+	}
+	photos, err := h.getPhotos(ids)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Listing = listings[posts[i].ID]
+		posts[i].Event = events[posts[i].ID]
+		posts[i].Job = jobs[posts[i].ID]
+		posts[i].Housing = homes[posts[i].ID]
+		posts[i].Photos = photos[posts[i].ID]
+	}
+	return nil
+}
+
+// the most photos a post can have
+const maxPhotos = 5
+
+// readPhotos saves the photos of the form to the upload directory
+func (h *Handler) readPhotos(r *http.Request) ([]string, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+	files := r.MultipartForm.File["photos"]
+	if len(files) > maxPhotos {
+		return nil, &FormError{Message: fmt.Sprintf("A post can have at most %d photos", maxPhotos), Code: http.StatusBadRequest}
+	}
+
+	var names []string
+	for _, fh := range files {
+		if fh.Size == 0 && fh.Filename == "" {
+			continue //the file field was left empty
+		}
+		name, err := h.saveUpload(fh)
+		if err != nil {
+			h.removeUploads(names)
+			if errors.Is(err, ErrUploadTooLarge) {
+				return nil, &FormError{
+					Message: fmt.Sprintf("The photo %s is too large, the limit is %d MB", fh.Filename, h.maxUpload>>20),
+					Code:    http.StatusRequestEntityTooLarge,
+				}
+			}
+			if errors.Is(err, ErrUploadType) {
+				return nil, &FormError{Message: "Only JPEG, PNG, GIF and WebP photos can be added", Code: http.StatusBadRequest}
+			}
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func savePhotos(tx dbtx, postID int64, names []string) error {
+	for i, name := range names {
+		_, err := tx.Exec("INSERT INTO post_photos (post_id, filename, position) VALUES (?, ?, ?)", postID, name, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getting the photos of the posts by post ID
+func (h *Handler) getPhotos(postIDs []int64) (map[int64][]string, error) {
+	photos := make(map[int64][]string)
+	if len(postIDs) == 0 {
+		return photos, nil
+	}
+	done := observeQuery("get_post_photos")
+	rows, err := h.db.Query(`
+		SELECT post_id, filename FROM post_photos
+		WHERE post_id IN (?`+strings.Repeat(", ?", len(postIDs)-1)+`)
+		ORDER BY post_id, position
+	`, int64Args(postIDs)...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		var name string
+		if err := rows.Scan(&postID, &name); err != nil {
+			return nil, err
+		}
+		photos[postID] = append(photos[postID], name)
+	}
+	return photos, rows.Err()
+}
+
+// int64Args turns the IDs into query arguments
+func int64Args(ids []int64) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
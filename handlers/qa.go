@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the reputation points of an accepted answer, a like is worth one point
+const acceptedAnswerPoints = 10
+
+// SetCategoryQAMode turns the Q&A mode of the category on or off. The posts
+// of a Q&A category are questions and their author can accept an answer.
+func SetCategoryQAMode(db *sql.DB, categoryID int64, on bool) error {
+	return execOne(db, "UPDATE categories SET qa_mode = ? WHERE id = ?", on, categoryID)
+}
+
+// isQuestion tells if the post is in a category with the Q&A mode on
+func (h *Handler) isQuestion(postID int64) (bool, error) {
+	var question bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM post_categories pc
+			JOIN categories c ON c.id = pc.category_id
+			WHERE pc.post_id = ? AND c.qa_mode = 1
+		)
+	`, postID).Scan(&question)
+	return question, err
+}
+
+// getReputation returns the reputation of the users: points for their
+// answers accepted by someone else and for the likes on their posts and
+// comments
+func (h *Handler) getReputation(userIDs []int64) (map[int64]int, error) {
+	reputation := make(map[int64]int)
+	if len(userIDs) == 0 {
+		return reputation, nil
+	}
+	in := "(?" + strings.Repeat(", ?", len(userIDs)-1) + ")"
+	args := int64Args(userIDs)
+	done := observeQuery("get_reputation")
+	rows, err := h.db.Query(`
+		SELECT user_id, SUM(points) FROM (
+			SELECT c.user_id, ? AS points
+			FROM posts p JOIN comments c ON c.id = p.accepted_comment_id
+			WHERE c.user_id IN `+in+` AND p.user_id != c.user_id
+			UNION ALL
+			SELECT p.user_id, 1
+			FROM reactions r JOIN posts p ON p.id = r.post_id
+			WHERE r.type = 'like' AND p.user_id IN `+in+`
+			UNION ALL
+			SELECT c.user_id, 1
+			FROM reactions r JOIN comments c ON c.id = r.comment_id
+			WHERE r.type = 'like' AND c.user_id IN `+in+`
+		)
+		GROUP BY user_id
+	`, append(append(append([]interface{}{acceptedAnswerPoints}, args...), args...), args...)...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int64
+		var points int
+		if err := rows.Scan(&userID, &points); err != nil {
+			return nil, err
+		}
+		reputation[userID] = points
+	}
+	return reputation, rows.Err()
+}
+
+// AcceptAnswer marks a comment as the accepted answer of its post, or with
+// action=unaccept removes the mark. Only the author of the question and the
+// admins can do it, and only in the Q&A categories.
+func (h *Handler) AcceptAnswer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	commentID, err := strconv.ParseInt(r.FormValue("comment_id"), 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Invalid comment ID", http.StatusBadRequest)
+		return
+	}
+
+	var postID, authorID, answererID int64
+	var title string
+	err = h.db.QueryRow(`
+		SELECT p.id, p.user_id, p.title, c.user_id FROM comments c JOIN posts p ON p.id = c.post_id WHERE c.id = ?
+	`, commentID).Scan(&postID, &authorID, &title, &answererID)
+	if err == sql.ErrNoRows {
+		h.ErrorHandler(w, r, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if authorID != user.ID && !user.IsAdmin {
+		h.ErrorHandler(w, r, "Only the author of the question can accept an answer", http.StatusForbidden)
+		return
+	}
+
+	question, err := h.isQuestion(postID)
+	if err == nil && !question {
+		h.ErrorHandler(w, r, "Answers can only be accepted in the Q&A categories", http.StatusBadRequest)
+		return
+	}
+	var readOnly bool
+	if err == nil {
+		readOnly, err = h.isPostReadOnly(postID)
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if readOnly {
+		h.ErrorHandler(w, r, "This post is archived", http.StatusForbidden)
+		return
+	}
+
+	if r.FormValue("action") == "unaccept" {
+		_, err = h.db.Exec("UPDATE posts SET accepted_comment_id = NULL WHERE id = ? AND accepted_comment_id = ?", postID, commentID)
+	} else {
+		_, err = h.db.Exec("UPDATE posts SET accepted_comment_id = ? WHERE id = ?", commentID, postID)
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error accepting answer", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("action") != "unaccept" {
+		h.notify(r.Context(), Notification{
+			UserID:    answererID,
+			ActorID:   user.ID,
+			Type:      NotifyAnswer,
+			PostID:    postID,
+			CommentID: commentID,
+			Message:   fmt.Sprintf("%s accepted your answer to “%s”", user.Username, title),
+		}, Notification{
+			//an admin accepting the answer of someone else's question
+			UserID:    authorID,
+			ActorID:   user.ID,
+			Type:      NotifyModeration,
+			PostID:    postID,
+			CommentID: commentID,
+			Message:   fmt.Sprintf("A moderator accepted an answer to your question “%s”", title),
+		})
+	}
+	LogFrom(r.Context()).Info("Answer accepted", "post_id", postID, "comment_id", commentID,
+		"action", r.FormValue("action"), "user_id", user.ID)
+	http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10)+"#comment-"+strconv.FormatInt(commentID, 10), http.StatusSeeOther)
+}
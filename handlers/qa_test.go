@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptedAnswer returns the accepted comment of the post, 0 when there is none
+func acceptedAnswer(t *testing.T, h *Handler, postID int64) int64 {
+	t.Helper()
+	var commentID int64
+	if err := h.db.QueryRow("SELECT COALESCE(accepted_comment_id, 0) FROM posts WHERE id = ?", postID).Scan(&commentID); err != nil {
+		t.Fatal(err)
+	}
+	return commentID
+}
+
+func TestAcceptAnswer(t *testing.T) {
+	h := newTestHandler(t)
+	asker := addUser(t, h, "asker")
+	answerer := addUser(t, h, "answerer")
+	admin := addUser(t, h, "admin")
+	exec(t, h.db, "UPDATE users SET is_admin = 1 WHERE id = ?", admin)
+	qa := addCategory(t, h, "Questions", 0)
+	if err := SetCategoryQAMode(h.db, qa, true); err != nil {
+		t.Fatal(err)
+	}
+	plain := addCategory(t, h, "Chatter", 0)
+	archived := addCategory(t, h, "Old questions", 0)
+	SetCategoryQAMode(h.db, archived, true)
+	SetCategoryArchived(h.db, archived, true)
+
+	question := addPost(t, h, asker, PostTypePost, time.Now(), qa)
+	first := addComment(t, h, answerer, question, time.Now())
+	second := addComment(t, h, answerer, question, time.Now())
+	discussion := addPost(t, h, asker, PostTypePost, time.Now(), plain)
+	notAnswer := addComment(t, h, answerer, discussion, time.Now())
+	oldQuestion := addPost(t, h, asker, PostTypePost, time.Now(), archived)
+	oldAnswer := addComment(t, h, answerer, oldQuestion, time.Now())
+
+	cookies := map[int64]*http.Cookie{}
+	for _, id := range []int64{asker, answerer, admin} {
+		cookies[id] = addSession(t, h, id)
+	}
+	tests := []struct {
+		name      string
+		userID    int64 //0 for no session
+		commentID int64
+		action    string
+		want      int
+		accepted  int64 //the accepted answer of the question afterwards
+	}{
+		{"no session", 0, first, "", http.StatusUnauthorized, 0},
+		{"the answerer", answerer, first, "", http.StatusForbidden, 0},
+		{"the asker", asker, first, "", http.StatusSeeOther, first},
+		{"unaccepting another answer", asker, second, "unaccept", http.StatusSeeOther, first},
+		{"an admin", admin, second, "", http.StatusSeeOther, second},
+		{"unaccepting", asker, second, "unaccept", http.StatusSeeOther, 0},
+		{"missing comment", asker, 999, "", http.StatusNotFound, 0},
+		{"not a Q&A category", asker, notAnswer, "", http.StatusBadRequest, 0},
+		{"archived", asker, oldAnswer, "", http.StatusForbidden, 0},
+	}
+	for _, tt := range tests {
+		form := url.Values{"comment_id": {strconv.FormatInt(tt.commentID, 10)}, "action": {tt.action}}
+		r := httptest.NewRequest("POST", "/post/accept", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.userID != 0 {
+			r.AddCookie(cookies[tt.userID])
+		}
+		w := httptest.NewRecorder()
+		h.AcceptAnswer(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if got := acceptedAnswer(t, h, question); got != tt.accepted {
+			t.Errorf("%s: accepted answer %d, want %d", tt.name, got, tt.accepted)
+		}
+	}
+	if got := acceptedAnswer(t, h, discussion) + acceptedAnswer(t, h, oldQuestion); got != 0 {
+		t.Errorf("an answer was accepted outside the open Q&A categories")
+	}
+}
+
+func TestGetReputation(t *testing.T) {
+	h := newTestHandler(t)
+	asker := addUser(t, h, "asker")
+	answerer := addUser(t, h, "answerer")
+	quiet := addUser(t, h, "quiet")
+
+	question := addPost(t, h, asker, PostTypePost, time.Now())
+	answer := addComment(t, h, answerer, question, time.Now())
+	exec(t, h.db, "UPDATE posts SET accepted_comment_id = ? WHERE id = ?", answer, question)
+	//an accepted answer to one's own question brings no points
+	ownQuestion := addPost(t, h, answerer, PostTypePost, time.Now())
+	ownAnswer := addComment(t, h, answerer, ownQuestion, time.Now())
+	exec(t, h.db, "UPDATE posts SET accepted_comment_id = ? WHERE id = ?", ownAnswer, ownQuestion)
+
+	//a like is a point, a dislike takes none away
+	exec(t, h.db, "INSERT INTO reactions (user_id, post_id, type) VALUES (?, ?, 'like')", answerer, question)
+	exec(t, h.db, "INSERT INTO reactions (user_id, post_id, type) VALUES (?, ?, 'dislike')", quiet, question)
+	exec(t, h.db, "INSERT INTO reactions (user_id, comment_id, type) VALUES (?, ?, 'like')", asker, answer)
+	exec(t, h.db, "INSERT INTO reactions (user_id, comment_id, type) VALUES (?, ?, 'like')", quiet, answer)
+
+	reputation, err := h.getReputation([]int64{asker, answerer, quiet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]int{asker: 1, answerer: acceptedAnswerPoints + 2, quiet: 0}
+	for id, points := range want {
+		if reputation[id] != points {
+			t.Errorf("user %d has %d points, want %d", id, reputation[id], points)
+		}
+	}
+	if reputation, err := h.getReputation(nil); err != nil || len(reputation) != 0 {
+		t.Errorf("getReputation(nil) = %v, %v", reputation, err)
+	}
+}
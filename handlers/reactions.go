@@ -3,7 +3,6 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
 	"net/http"
 )
 
@@ -39,26 +38,39 @@ func (h *Handler) hasUserReaction(userID int64, postID int64, reactionType strin
 // this handles the reactions for the posts (likes and dislikes)
 func (h *Handler) PostReaction(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		h.ErrorHandler(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	user := h.GetSessionUser(w, r)
-	if user == nil {
-		h.ErrorHandler(w, "Unauthorized", http.StatusUnauthorized)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// reading the request(body) and decoding into the ReactionRequest struct
 	var req ReactionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.ErrorHandler(w, "Invalid request", http.StatusBadRequest)
+		h.ErrorHandler(w, r, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// posts in archived categories are read-only
+	readOnly, err := h.isPostReadOnly(req.PostID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if readOnly {
+		h.ErrorHandler(w, r, "This post is archived", http.StatusForbidden)
 		return
 	}
 
 	// checking if the user has already reacted to the post
 	var existingType string
-	err := h.db.QueryRow(`
+	done := observeQuery("post_reaction")
+	err = h.db.QueryRow(`
 		SELECT type FROM reactions 
 		WHERE user_id = ? AND post_id = ?`,
 		user.ID, req.PostID,
@@ -89,15 +101,25 @@ func (h *Handler) PostReaction(w http.ResponseWriter, r *http.Request) {
 			)
 		}
 	}
+	done()
 
 	if err != nil {
-		log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
+	// only the reactions that were added or changed are counted, not the removed ones
+	if existingType != req.Type {
+		reactionsTotal.WithLabelValues("post", req.Type).Inc()
+		if err := h.notifyReaction(r.Context(), user, req.PostID, 0, req.Type); err != nil {
+			LogFrom(r.Context()).Error("Error sending notifications", "err", err)
+		}
+	}
+
 	// getting the updated reaction counts
 	var likes, dislikes int
+	done = observeQuery("post_reaction_counts")
 	err = h.db.QueryRow(`
 		SELECT 
 			COUNT(CASE WHEN type = 'like' THEN 1 END) as likes,
@@ -106,13 +128,16 @@ func (h *Handler) PostReaction(w http.ResponseWriter, r *http.Request) {
 		WHERE post_id = ?`,
 		req.PostID,
 	).Scan(&likes, &dislikes)
+	done()
 
 	if err != nil {
-		log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
+	h.publishReactions(req.PostID, 0, likes, dislikes)
+
 	// creating a json response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ReactionResponse{
@@ -143,27 +168,40 @@ func (h *Handler) hasCommentReaction(userID int64, commentID int64, reactionType
 // this handles the reactions for the comments (likes and dislikes)
 func (h *Handler) HandleCommentReaction(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		h.ErrorHandler(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Get the user from the session
 	user := h.GetSessionUser(w, r)
-	if user == nil {
-		h.ErrorHandler(w, "Unauthorized", http.StatusUnauthorized)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Read and decode the request body into ReactionRequest struct
 	var req ReactionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.ErrorHandler(w, "Invalid request", http.StatusBadRequest)
+		h.ErrorHandler(w, r, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// posts in archived categories are read-only
+	readOnly, err := h.isCommentReadOnly(req.CommentID)
+	if err != nil {
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if readOnly {
+		h.ErrorHandler(w, r, "This post is archived", http.StatusForbidden)
 		return
 	}
 
 	// Check if the user has already reacted to the comment
 	var existingType string
-	err := h.db.QueryRow(`
+	done := observeQuery("comment_reaction")
+	err = h.db.QueryRow(`
 		SELECT type FROM reactions 
 		WHERE user_id = ? AND comment_id = ?`,
 		user.ID, req.CommentID,
@@ -194,15 +232,25 @@ func (h *Handler) HandleCommentReaction(w http.ResponseWriter, r *http.Request)
 			)
 		}
 	}
+	done()
 
 	if err != nil {
-		log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
+	// only the reactions that were added or changed are counted, not the removed ones
+	if existingType != req.Type {
+		reactionsTotal.WithLabelValues("comment", req.Type).Inc()
+		if err := h.notifyReaction(r.Context(), user, 0, req.CommentID, req.Type); err != nil {
+			LogFrom(r.Context()).Error("Error sending notifications", "err", err)
+		}
+	}
+
 	// Count updated reaction counts
 	var likes, dislikes int
+	done = observeQuery("comment_reaction_counts")
 	err = h.db.QueryRow(`
 		SELECT 
 			COUNT(CASE WHEN type = 'like' THEN 1 END) as likes,
@@ -211,13 +259,16 @@ func (h *Handler) HandleCommentReaction(w http.ResponseWriter, r *http.Request)
 		WHERE comment_id = ?`,
 		req.CommentID,
 	).Scan(&likes, &dislikes)
+	done()
 
 	if err != nil {
-		log.Printf("Database error: %v", err)
-		h.ErrorHandler(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		LogFrom(r.Context()).Error("Database error", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 		return
 	}
 
+	h.publishReactions(0, req.CommentID, likes, dislikes)
+
 	// Send the response with updated reaction counts
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ReactionResponse{
@@ -226,3 +277,16 @@ func (h *Handler) HandleCommentReaction(w http.ResponseWriter, r *http.Request)
 		Dislikes: dislikes,
 	})
 }
+
+// isCommentReadOnly tells if the post of the comment is read-only
+func (h *Handler) isCommentReadOnly(commentID int64) (bool, error) {
+	var postID int64
+	err := h.db.QueryRow("SELECT post_id FROM comments WHERE id = ?", commentID).Scan(&postID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return h.isPostReadOnly(postID)
+}
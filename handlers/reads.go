@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ReadState is what the user hasn't read of a post
+type ReadState struct {
+	Seen        bool  //the user has opened the post or marked its category as read
+	ReadTo      int64 //the comments up to this ID are read
+	Unread      int   //the comments after ReadTo by the other users
+	FirstUnread int64 //the oldest unread comment, 0 when there is none
+}
+
+// readStates returns the read state of the posts for the user. A post is
+// read up to the last comment the user saw on it or up to the watermark of
+// any of its categories, whichever is later. The user's own posts and
+// comments are never unread.
+func (h *Handler) readStates(userID int64, postIDs []int64) (map[int64]ReadState, error) {
+	states := make(map[int64]ReadState)
+	if len(postIDs) == 0 {
+		return states, nil
+	}
+
+	done := observeQuery("read_states")
+	rows, err := h.db.Query(`
+		WITH state AS (
+			SELECT p.id AS post_id,
+			p.user_id = ?1 OR r.post_id IS NOT NULL OR p.id <= COALESCE(MAX(cr.last_post_id), 0) AS seen,
+			MAX(COALESCE(r.last_comment_id, 0), COALESCE(MAX(cr.last_comment_id), 0)) AS read_to
+			FROM posts p
+			LEFT JOIN post_reads r ON r.user_id = ?1 AND r.post_id = p.id
+			LEFT JOIN post_categories pc ON pc.post_id = p.id
+			LEFT JOIN category_reads cr ON cr.user_id = ?1 AND cr.category_id = pc.category_id
+			WHERE p.id IN (?`+strings.Repeat(", ?", len(postIDs)-1)+`)
+			GROUP BY p.id
+		)
+		SELECT s.post_id, s.seen, s.read_to, COUNT(c.id), COALESCE(MIN(c.id), 0)
+		FROM state s
+		LEFT JOIN comments c ON c.post_id = s.post_id AND c.id > s.read_to AND c.user_id != ?1
+		GROUP BY s.post_id
+	`, append([]interface{}{userID}, int64Args(postIDs)...)...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		var state ReadState
+		if err := rows.Scan(&postID, &state.Seen, &state.ReadTo, &state.Unread, &state.FirstUnread); err != nil {
+			return nil, err
+		}
+		states[postID] = state
+	}
+	return states, rows.Err()
+}
+
+// addReadStates marks the posts the user hasn't opened and counts their
+// unread comments
+func (h *Handler) addReadStates(userID int64, posts []Post) error {
+	ids := make([]int64, len(posts))
+	for i, p := range posts {
+		ids[i] = p.ID
+	}
+	states, err := h.readStates(userID, ids)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		state := states[posts[i].ID]
+		posts[i].New = !state.Seen
+		posts[i].UnreadComments = state.Unread
+		posts[i].FirstUnread = state.FirstUnread
+	}
+	return nil
+}
+
+// markPostRead records that the user has read the post up to the comment.
+// Nothing is written when the category watermark already covers it, so the
+// table only grows with the posts read after the category was marked.
+func (h *Handler) markPostRead(userID, postID, lastCommentID int64, state ReadState) error {
+	if state.Seen && lastCommentID <= state.ReadTo {
+		return nil
+	}
+	_, err := h.db.Exec(`
+		INSERT INTO post_reads (user_id, post_id, last_comment_id) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, post_id) DO UPDATE
+		SET last_comment_id = MAX(last_comment_id, excluded.last_comment_id)
+	`, userID, postID, lastCommentID)
+	return err
+}
+
+// markCategoryRead moves the watermark of the category and its
+// subcategories to the latest post and comment, and drops the reads of
+// single posts the watermark now covers
+func (h *Handler) markCategoryRead(userID, categoryID int64) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var lastPostID, lastCommentID int64
+	err = tx.QueryRow(`
+		SELECT COALESCE((SELECT MAX(id) FROM posts), 0), COALESCE((SELECT MAX(id) FROM comments), 0)
+	`).Scan(&lastPostID, &lastCommentID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		INSERT INTO category_reads (user_id, category_id, last_post_id, last_comment_id)
+		SELECT ?, id, ?, ? FROM subtree WHERE true
+		ON CONFLICT (user_id, category_id) DO UPDATE
+		SET last_post_id = excluded.last_post_id, last_comment_id = excluded.last_comment_id
+	`, categoryID, userID, lastPostID, lastCommentID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM post_reads
+		WHERE user_id = ? AND last_comment_id <= ?
+		AND post_id IN (
+			SELECT pc.post_id FROM post_categories pc
+			JOIN category_reads cr ON cr.category_id = pc.category_id AND cr.user_id = ?
+			WHERE cr.last_post_id = ? AND cr.last_comment_id = ?
+		)
+	`, userID, lastCommentID, userID, lastPostID, lastCommentID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MarkCategoryRead marks the category and its subcategories as read
+func (h *Handler) MarkCategoryRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := h.GetSessionUser(w, r)
+	if user == nil || user.ID == 0 {
+		h.ErrorHandler(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	categoryID, err := strconv.ParseInt(r.FormValue("category_id"), 10, 64)
+	if err != nil {
+		h.ErrorHandler(w, r, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", categoryID).Scan(&exists)
+	if err == nil && !exists {
+		h.ErrorHandler(w, r, "Category not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = h.markCategoryRead(user.ID, categoryID)
+	}
+	if err != nil {
+		LogFrom(r.Context()).Error("Error marking category read", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	redirect := "/category/" + strconv.FormatInt(categoryID, 10)
+	if r.FormValue("unread") == "1" {
+		redirect += "?unread=1"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReadStates(t *testing.T) {
+	h := newTestHandler(t)
+	reader := addUser(t, h, "reader")
+	other := addUser(t, h, "other")
+	news := addCategory(t, h, "News", 0)
+	local := addCategory(t, h, "Local", news)
+	misc := addCategory(t, h, "Misc", 0)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	at := func(minute int) time.Time { return start.Add(time.Duration(minute) * time.Minute) }
+	inLocal := addPost(t, h, other, PostTypePost, at(0), local)
+	own := addPost(t, h, reader, PostTypePost, at(1), misc)
+	inMisc := addPost(t, h, other, PostTypePost, at(2), misc)
+	first := addComment(t, h, other, inLocal, at(3))
+	addComment(t, h, reader, inLocal, at(4))
+	third := addComment(t, h, other, inLocal, at(5))
+	onOwn := addComment(t, h, other, own, at(6))
+
+	var later, newPost int64
+	postReads := func() (n int) {
+		if err := h.db.QueryRow("SELECT COUNT(*) FROM post_reads WHERE user_id = ?", reader).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	markPostRead := func(postID, lastCommentID int64) {
+		states, err := h.readStates(reader, []int64{postID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.markPostRead(reader, postID, lastCommentID, states[postID]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the steps run in order, each on the state the earlier ones left
+	steps := []struct {
+		name      string
+		do        func()
+		want      func() map[int64]ReadState //called after do, for the IDs it adds
+		postReads int
+	}{
+		{
+			//the own post is seen and the own comment is never unread
+			name: "nothing read",
+			do:   func() {},
+			want: func() map[int64]ReadState {
+				return map[int64]ReadState{
+					inLocal: {Unread: 2, FirstUnread: first},
+					own:     {Seen: true, Unread: 1, FirstUnread: onOwn},
+					inMisc:  {},
+				}
+			},
+		},
+		{
+			name: "post read to the first comment",
+			do:   func() { markPostRead(inLocal, first) },
+			want: func() map[int64]ReadState {
+				return map[int64]ReadState{
+					inLocal: {Seen: true, ReadTo: first, Unread: 1, FirstUnread: third},
+				}
+			},
+			postReads: 1,
+		},
+		{
+			name: "reading an older comment doesn't go back",
+			do: func() {
+				if err := h.markPostRead(reader, inLocal, 0, ReadState{}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: func() map[int64]ReadState {
+				return map[int64]ReadState{
+					inLocal: {Seen: true, ReadTo: first, Unread: 1, FirstUnread: third},
+				}
+			},
+			postReads: 1,
+		},
+		{
+			//the watermark of the parent covers the subcategory, and the
+			//post read it replaces is dropped
+			name: "parent category read",
+			do: func() {
+				if err := h.markCategoryRead(reader, news); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: func() map[int64]ReadState {
+				return map[int64]ReadState{
+					inLocal: {Seen: true, ReadTo: onOwn},
+					own:     {Seen: true, Unread: 1, FirstUnread: onOwn},
+					inMisc:  {},
+				}
+			},
+		},
+		{
+			name: "no write under the watermark",
+			do:   func() { markPostRead(inLocal, onOwn) },
+			want: func() map[int64]ReadState {
+				return map[int64]ReadState{
+					inLocal: {Seen: true, ReadTo: onOwn},
+				}
+			},
+		},
+		{
+			name: "new comment and post after the watermark",
+			do: func() {
+				later = addComment(t, h, other, inLocal, at(7))
+				newPost = addPost(t, h, other, PostTypePost, at(8), local)
+			},
+			want: func() map[int64]ReadState {
+				return map[int64]ReadState{
+					inLocal: {Seen: true, ReadTo: onOwn, Unread: 1, FirstUnread: later},
+					newPost: {ReadTo: onOwn},
+				}
+			},
+		},
+		{
+			name: "post read past the watermark",
+			do:   func() { markPostRead(inLocal, later) },
+			want: func() map[int64]ReadState {
+				return map[int64]ReadState{
+					inLocal: {Seen: true, ReadTo: later},
+				}
+			},
+			postReads: 1,
+		},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			step.do()
+			want := step.want()
+			var ids []int64
+			for id := range want {
+				ids = append(ids, id)
+			}
+			states, err := h.readStates(reader, ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for id, want := range want {
+				if got := states[id]; got != want {
+					t.Errorf("post %d is %+v, want %+v", id, got, want)
+				}
+			}
+			if n := postReads(); n != step.postReads {
+				t.Errorf("%d rows in post_reads, want %d", n, step.postReads)
+			}
+		})
+	}
+}
+
+func TestGetPostWithoutReadState(t *testing.T) {
+	h := newTestHandler(t)
+	author := addUser(t, h, "author")
+	reader := addUser(t, h, "reader")
+	categoryID := addCategory(t, h, "Boats", 0)
+	postID := addPost(t, h, author, PostTypePost, time.Now(), categoryID)
+	addComment(t, h, author, postID, time.Now())
+	cookie := addSession(t, h, reader)
+	target := "/post/" + strconv.FormatInt(postID, 10)
+
+	if code := formRequest(h.GetPost, cookie, "GET", target, nil); code != http.StatusOK {
+		t.Fatalf("status %d, want %d", code, http.StatusOK)
+	}
+	//the unread markers are left out when the read state can't be loaded
+	exec(t, h.db, "DROP TABLE post_reads")
+	if code := formRequest(h.GetPost, cookie, "GET", target, nil); code != http.StatusOK {
+		t.Errorf("status %d without the read state, want %d", code, http.StatusOK)
+	}
+}
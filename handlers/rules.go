@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// who can post in a category
+const (
+	PostEveryone = "everyone"
+	PostAdmins   = "admins"
+)
+
+var ErrInvalidRules = errors.New("invalid posting rules")
+
+// CategoryRules limit the posting in a category. The admins only need to
+// follow the title prefix.
+type CategoryRules struct {
+	CategoryID        int64  `json:"category_id"`
+	WhoCanPost        string `json:"who_can_post"`
+	MinAccountAgeDays int    `json:"min_account_age_days"`
+	TitlePrefix       string `json:"title_prefix"`
+	ContentTemplate   string `json:"content_template"`
+	MaxPostsPerDay    int    `json:"max_posts_per_day"`
+}
+
+// FormError tells the user what is wrong with the post they sent, like the
+// posting rule it breaks. The form is shown again with the message.
+type FormError struct {
+	Message string
+	Code    int
+}
+
+func (e *FormError) Error() string {
+	return e.Message
+}
+
+// GetCategoryRules returns the rules of the category, the defaults allow everything
+func GetCategoryRules(db *sql.DB, categoryID int64) (*CategoryRules, error) {
+	rules := CategoryRules{CategoryID: categoryID, WhoCanPost: PostEveryone}
+	err := db.QueryRow(`
+		SELECT who_can_post, min_account_age_days, title_prefix, content_template, max_posts_per_day
+		FROM category_rules WHERE category_id = ?
+	`, categoryID).Scan(&rules.WhoCanPost, &rules.MinAccountAgeDays, &rules.TitlePrefix,
+		&rules.ContentTemplate, &rules.MaxPostsPerDay)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// SetCategoryRules saves the rules of the category
+func SetCategoryRules(db *sql.DB, rules *CategoryRules) error {
+	if rules.WhoCanPost == "" {
+		rules.WhoCanPost = PostEveryone
+	}
+	if rules.WhoCanPost != PostEveryone && rules.WhoCanPost != PostAdmins {
+		return ErrInvalidRules
+	}
+	if rules.MinAccountAgeDays < 0 || rules.MaxPostsPerDay < 0 {
+		return ErrInvalidRules
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", rules.CategoryID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	//the templates are written in the browser, so the line endings are \r\n
+	template := strings.ReplaceAll(rules.ContentTemplate, "\r\n", "\n")
+
+	_, err := db.Exec(`
+		INSERT INTO category_rules (category_id, who_can_post, min_account_age_days,
+			title_prefix, content_template, max_posts_per_day, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(category_id) DO UPDATE SET
+			who_can_post = excluded.who_can_post,
+			min_account_age_days = excluded.min_account_age_days,
+			title_prefix = excluded.title_prefix,
+			content_template = excluded.content_template,
+			max_posts_per_day = excluded.max_posts_per_day,
+			updated_at = excluded.updated_at
+	`, rules.CategoryID, rules.WhoCanPost, rules.MinAccountAgeDays,
+		strings.TrimSpace(rules.TitlePrefix), template, rules.MaxPostsPerDay)
+	return err
+}
+
+// getAllCategoryRules returns the rules by category ID, for the new post form
+func (h *Handler) getAllCategoryRules() (map[int64]*CategoryRules, error) {
+	done := observeQuery("get_category_rules")
+	rows, err := h.db.Query(`
+		SELECT category_id, who_can_post, min_account_age_days, title_prefix, content_template, max_posts_per_day
+		FROM category_rules
+	`)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := make(map[int64]*CategoryRules)
+	for rows.Next() {
+		var rules CategoryRules
+		if err := rows.Scan(&rules.CategoryID, &rules.WhoCanPost, &rules.MinAccountAgeDays,
+			&rules.TitlePrefix, &rules.ContentTemplate, &rules.MaxPostsPerDay); err != nil {
+			return nil, err
+		}
+		all[rules.CategoryID] = &rules
+	}
+	return all, rows.Err()
+}
+
+// checkPostingRules checks the rules of every chosen category. A broken rule
+// is returned as a *FormError, other errors are database errors.
+func (h *Handler) checkPostingRules(user *User, categoryIDs []int64, title string) error {
+	for _, categoryID := range categoryIDs {
+		rules, err := GetCategoryRules(h.db, categoryID)
+		if err != nil {
+			return err
+		}
+
+		var name string
+		if err := h.db.QueryRow("SELECT name FROM categories WHERE id = ?", categoryID).Scan(&name); err != nil {
+			return err
+		}
+
+		if rules.WhoCanPost == PostAdmins && !user.IsAdmin {
+			return &FormError{
+				Message: fmt.Sprintf("Only the admins can post in %s", name),
+				Code:    http.StatusForbidden,
+			}
+		}
+
+		if rules.MinAccountAgeDays > 0 && !user.IsAdmin {
+			var oldEnough bool
+			err := h.db.QueryRow(`
+				SELECT julianday('now') - julianday(created_at) >= ?
+				FROM users WHERE id = ?
+			`, rules.MinAccountAgeDays, user.ID).Scan(&oldEnough)
+			if err != nil {
+				return err
+			}
+			if !oldEnough {
+				return &FormError{
+					Message: fmt.Sprintf("Your account must be at least %d days old to post in %s", rules.MinAccountAgeDays, name),
+					Code:    http.StatusForbidden,
+				}
+			}
+		}
+
+		//the prefix keeps the titles of the category uniform, also for the admins
+		if rules.TitlePrefix != "" && !strings.HasPrefix(title, rules.TitlePrefix) {
+			return &FormError{
+				Message: fmt.Sprintf("The title of a post in %s must start with %q", name, rules.TitlePrefix),
+				Code:    http.StatusBadRequest,
+			}
+		}
+	}
+	return nil
+}
+
+// checkDailyLimits checks the daily post limits of the categories in the
+// transaction that has just inserted the post, so the count includes it. The
+// insert locks the database for writing, so two posts sent at the same time
+// can't both see the count under the limit.
+func (h *Handler) checkDailyLimits(tx dbtx, user *User, categoryIDs []int64) error {
+	if user.IsAdmin {
+		return nil
+	}
+	//the day changes at midnight of the forum's time zone
+	now := time.Now().In(h.location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, h.location)
+	for _, categoryID := range categoryIDs {
+		var name string
+		var max, count int
+		err := tx.QueryRow(`
+			SELECT c.name, COALESCE(cr.max_posts_per_day, 0),
+			(SELECT COUNT(*) FROM posts p
+				JOIN post_categories pc ON pc.post_id = p.id
+				WHERE p.user_id = ? AND pc.category_id = c.id AND p.created_at >= ?)
+			FROM categories c
+			LEFT JOIN category_rules cr ON cr.category_id = c.id
+			WHERE c.id = ?
+		`, user.ID, today, categoryID).Scan(&name, &max, &count)
+		if err != nil {
+			return err
+		}
+		if max > 0 && count > max {
+			return &FormError{
+				Message: fmt.Sprintf("You can post at most %d times a day in %s", max, name),
+				Code:    http.StatusTooManyRequests,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDailyPostLimit(t *testing.T) {
+	h := newTestHandler(t)
+	member := addUser(t, h, "member")
+	admin := addUser(t, h, "admin")
+	exec(t, h.db, "UPDATE users SET is_admin = 1 WHERE id = ?", admin)
+	limited := addCategory(t, h, "Boats", 0)
+	free := addCategory(t, h, "Ships", 0)
+	if err := SetCategoryRules(h.db, &CategoryRules{CategoryID: limited, MaxPostsPerDay: 2}); err != nil {
+		t.Fatal(err)
+	}
+	//a post of yesterday doesn't count
+	addPost(t, h, member, PostTypePost, time.Now().Add(-48*time.Hour), limited)
+
+	cookies := map[int64]*http.Cookie{member: addSession(t, h, member), admin: addSession(t, h, admin)}
+	createPost := func(userID int64, categoryIDs ...int64) int {
+		form := url.Values{"title": {"For sale"}, "content": {"A boat"}}
+		for _, id := range categoryIDs {
+			form.Add("categories", strconv.FormatInt(id, 10))
+		}
+		r := httptest.NewRequest("POST", "/post/new", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookies[userID])
+		w := httptest.NewRecorder()
+		h.CreatePost(w, r)
+		return w.Code
+	}
+	tests := []struct {
+		name        string
+		userID      int64
+		categoryIDs []int64
+		want        int
+	}{
+		{"first", member, []int64{limited}, http.StatusSeeOther},
+		{"in another category too", member, []int64{limited, free}, http.StatusSeeOther},
+		{"over the limit", member, []int64{free, limited}, http.StatusTooManyRequests},
+		{"no limit in the other category", member, []int64{free}, http.StatusSeeOther},
+		{"admin", admin, []int64{limited}, http.StatusSeeOther},
+		{"admin again", admin, []int64{limited}, http.StatusSeeOther},
+		{"admin over the limit", admin, []int64{limited}, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		if code := createPost(tt.userID, tt.categoryIDs...); code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+
+	//the post over the limit was not saved
+	var posts int
+	h.db.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = ?", member).Scan(&posts)
+	if posts != 4 {
+		t.Errorf("the member has %d posts, want 4", posts)
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const nonceKey contextKey = "csp-nonce"
+
+// the font-awesome icons are loaded from cdnjs, everything else is served by us
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'nonce-%s'; " +
+	"style-src 'self' https://cdnjs.cloudflare.com; " +
+	"font-src 'self' https://cdnjs.cloudflare.com; " +
+	"img-src 'self' data:; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'; " +
+	"report-uri /csp-report"
+
+// SecurityHeaders adds the security headers to every response. Each request gets
+// its own nonce which the templates put on the script tags. With reportOnly the
+// browser only reports the violations to /csp-report instead of blocking them.
+func SecurityHeaders(reportOnly bool, next http.Handler) http.Handler {
+	cspHeader := "Content-Security-Policy"
+	if reportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := newNonce()
+		if err != nil {
+			LogFrom(r.Context()).Error("Error generating CSP nonce", "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		header := w.Header()
+		header.Set(cspHeader, strings.Replace(contentSecurityPolicy, "%s", nonce, 1))
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		header.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=(), payment=(), usb=()")
+
+		ctx := context.WithValue(r.Context(), nonceKey, nonce)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Nonce returns the CSP nonce of the request, or an empty string outside of SecurityHeaders
+func Nonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceKey).(string)
+	return nonce
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CSPReport is the body the browsers send to the report-uri
+type CSPReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		Referrer           string `json:"referrer"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		BlockedURI         string `json:"blocked-uri"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+		Disposition        string `json:"disposition"`
+	} `json:"csp-report"`
+}
+
+// HandleCSPReport logs the CSP violations reported by the browsers
+func (h *Handler) HandleCSPReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	//the reports are small, so there is no reason to read more than this
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var report CSPReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	v := report.Report
+	LogFrom(r.Context()).Warn("CSP violation",
+		"disposition", v.Disposition,
+		"directive", v.ViolatedDirective,
+		"blocked_uri", v.BlockedURI,
+		"document_uri", v.DocumentURI,
+		"source_file", v.SourceFile,
+		"line", v.LineNumber,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		reportOnly bool
+		header     string
+	}{
+		{false, "Content-Security-Policy"},
+		{true, "Content-Security-Policy-Report-Only"},
+	}
+	for _, tt := range tests {
+		var nonces []string
+		h := SecurityHeaders(tt.reportOnly, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nonces = append(nonces, Nonce(r.Context()))
+		}))
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			nonce := nonces[len(nonces)-1]
+			if nonce == "" {
+				t.Fatal("no nonce in the request context")
+			}
+			if csp := w.Header().Get(tt.header); !strings.Contains(csp, "script-src 'self' 'nonce-"+nonce+"'") {
+				t.Errorf("%s is %q, want the nonce %q", tt.header, csp, nonce)
+			}
+			for _, name := range []string{"X-Content-Type-Options", "X-Frame-Options", "Referrer-Policy", "Permissions-Policy"} {
+				if w.Header().Get(name) == "" {
+					t.Errorf("no %s header", name)
+				}
+			}
+		}
+		if nonces[0] == nonces[1] {
+			t.Errorf("two requests got the same nonce %q", nonces[0])
+		}
+	}
+	if nonce := Nonce(httptest.NewRequest("GET", "/", nil).Context()); nonce != "" {
+		t.Errorf("nonce %q outside of SecurityHeaders", nonce)
+	}
+}
+
+func TestHandleCSPReport(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		want   int
+	}{
+		{"POST", `{"csp-report": {"document-uri": "http://forum.example/", "violated-directive": "script-src", "blocked-uri": "inline"}}`, http.StatusNoContent},
+		{"POST", `not json`, http.StatusBadRequest},
+		{"POST", `{"csp-report": ` + strings.Repeat(" ", 64<<10) + `{}}`, http.StatusBadRequest},
+		{"GET", "", http.StatusMethodNotAllowed},
+	}
+	h := &Handler{}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.HandleCSPReport(w, httptest.NewRequest(tt.method, "/csp-report", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%s %.40q: status %d, want %d", tt.method, tt.body, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// CleanupSessions removes the expired sessions from the database every interval,
+// until the context is cancelled
+func (h *Handler) CleanupSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := PurgeSessions(ctx, h.db, false)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("Error cleaning up sessions", "err", err)
+				}
+				continue
+			}
+			if n > 0 {
+				slog.Info("Removed expired sessions", "count", n)
+			}
+		}
+	}
+}
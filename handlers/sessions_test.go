@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCleanupSessions(t *testing.T) {
+	h := newTestHandler(t)
+	userID := addUser(t, h, "sleeper")
+	exec(t, h.db, "INSERT INTO sessions (token, user_id, expires_at) VALUES ('old', ?, datetime('now', '-1 hour'))", userID)
+	exec(t, h.db, "INSERT INTO sessions (token, user_id, expires_at) VALUES ('new', ?, datetime('now', '+1 hour'))", userID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		h.CleanupSessions(ctx, 10*time.Millisecond)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var tokens []string
+		rows, err := h.db.Query("SELECT token FROM sessions ORDER BY token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var token string
+			rows.Scan(&token)
+			tokens = append(tokens, token)
+		}
+		rows.Close()
+		if len(tokens) == 1 && tokens[0] == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions left: %v, want only the one that hasn't expired", tokens)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("CleanupSessions didn't stop when the context was cancelled")
+	}
+}
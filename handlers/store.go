@@ -0,0 +1,539 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The functions in this file change the data outside of a single request, so
+// the web handlers and the forum command line use the same rules.
+
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrInvalidEmail     = errors.New("wrong e-mail format")
+	ErrUsernameRequired = errors.New("username cannot be empty")
+	ErrPasswordTooShort = errors.New("password must be at least 6 characters long")
+	ErrEmailTaken       = errors.New("this email address is already registered")
+	ErrUsernameTaken    = errors.New("this username is already taken")
+	ErrCategoryExists   = errors.New("a category with this name already exists")
+	ErrCategoryNotEmpty = errors.New("the category still has posts")
+	ErrInvalidCategory  = errors.New("invalid category")
+	ErrCategoryName     = errors.New("category name cannot be empty")
+	ErrMergeIntoItself  = errors.New("a category cannot be merged into itself")
+	ErrCategoryCycle    = errors.New("a category cannot be moved under itself or its subcategories")
+)
+
+const MinPasswordLength = 6
+
+// CreateUser validates the data, hashes the password and saves the new user
+func CreateUser(db *sql.DB, email, username, password string, isAdmin bool) (int64, error) {
+	username = strings.TrimSpace(username)
+	if !isValidEmail(email) {
+		return 0, ErrInvalidEmail
+	}
+	if username == "" {
+		return 0, ErrUsernameRequired
+	}
+	if len(password) < MinPasswordLength {
+		return 0, ErrPasswordTooShort
+	}
+
+	// Check if user exists with this email
+	var exists bool
+	done := observeQuery("user_email_exists")
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", email).Scan(&exists)
+	done()
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, ErrEmailTaken
+	}
+
+	// Check if username is taken
+	done = observeQuery("username_exists")
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists)
+	done()
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, ErrUsernameTaken
+	}
+
+	// Hash the password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	// Create new user
+	done = observeQuery("create_user")
+	result, err := db.Exec(`
+		INSERT INTO users (email, username, password_hash, is_admin)
+		VALUES (?, ?, ?, ?)
+	`, email, username, string(hashedPassword), isAdmin)
+	done()
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// FindUser looks up a user by email or username
+func FindUser(db *sql.DB, emailOrUsername string) (*User, error) {
+	var user User
+	err := db.QueryRow(`
+		SELECT id, email, username, is_admin
+		FROM users
+		WHERE email = ? OR username = ?
+	`, emailOrUsername, emailOrUsername).Scan(&user.ID, &user.Email, &user.Username, &user.IsAdmin)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SetAdmin gives or takes away the admin rights of the user
+func SetAdmin(db *sql.DB, userID int64, isAdmin bool) error {
+	return execOne(db, "UPDATE users SET is_admin = ? WHERE id = ?", isAdmin, userID)
+}
+
+// SetBanned bans or unbans the user. A banned user is logged out everywhere.
+func SetBanned(db *sql.DB, userID int64, banned bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE users SET banned_at = NULL WHERE id = ?"
+	if banned {
+		query = "UPDATE users SET banned_at = CURRENT_TIMESTAMP WHERE id = ? AND banned_at IS NULL"
+	}
+	if _, err := tx.Exec(query, userID); err != nil {
+		return err
+	}
+	if banned {
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ResetPassword sets a new password and logs the user out everywhere
+func ResetPassword(db *sql.DB, userID int64, password string) error {
+	if len(password) < MinPasswordLength {
+		return ErrPasswordTooShort
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hashedPassword), userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateCategory adds a new category, under the parent when parentID is not 0
+func CreateCategory(db *sql.DB, name, description string, parentID int64) (int64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, ErrCategoryName
+	}
+	if parentID != 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", parentID).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, ErrInvalidCategory
+		}
+	}
+	//new categories go to the end of the list
+	result, err := db.Exec(`
+		INSERT INTO categories (name, description, parent_id, position)
+		VALUES (?, ?, NULLIF(?, 0), (SELECT COALESCE(MAX(position), 0) + 1 FROM categories))
+	`, name, description, parentID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, ErrCategoryExists
+		}
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// SetCategoryParent moves the category under another one, or to the top level
+// when parentID is 0. The subcategories move along with it.
+func SetCategoryParent(db *sql.DB, categoryID, parentID int64) error {
+	if parentID != 0 {
+		//the new parent can't be the category itself or one of its subcategories
+		var inSubtree, exists bool
+		err := db.QueryRow(`
+			WITH RECURSIVE subtree(id) AS (
+				SELECT ?
+				UNION
+				SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+			)
+			SELECT EXISTS(SELECT 1 FROM subtree WHERE id = ?),
+			EXISTS(SELECT 1 FROM categories WHERE id = ?)
+		`, categoryID, parentID, parentID).Scan(&inSubtree, &exists)
+		if err != nil {
+			return err
+		}
+		if inSubtree {
+			return ErrCategoryCycle
+		}
+		if !exists {
+			return ErrInvalidCategory
+		}
+	}
+	return execOne(db, "UPDATE categories SET parent_id = NULLIF(?, 0) WHERE id = ?", parentID, categoryID)
+}
+
+// RenameCategory changes the name of the category
+func RenameCategory(db *sql.DB, categoryID int64, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ErrCategoryName
+	}
+	err := execOne(db, "UPDATE categories SET name = ? WHERE id = ?", name, categoryID)
+	if isUniqueViolation(err) {
+		return ErrCategoryExists
+	}
+	return err
+}
+
+// UpdateCategory changes the name and the description of the category
+func UpdateCategory(db *sql.DB, categoryID int64, name, description string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ErrCategoryName
+	}
+	err := execOne(db, "UPDATE categories SET name = ?, description = ? WHERE id = ?",
+		name, strings.TrimSpace(description), categoryID)
+	if isUniqueViolation(err) {
+		return ErrCategoryExists
+	}
+	return err
+}
+
+// MoveCategory swaps the category with its neighbour under the same parent,
+// up when up is true
+func MoveCategory(db *sql.DB, categoryID int64, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var position int
+	var parentID sql.NullInt64
+	err = tx.QueryRow("SELECT position, parent_id FROM categories WHERE id = ?", categoryID).Scan(&position, &parentID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	query := `SELECT id, position FROM categories WHERE position > ? AND parent_id IS ? ORDER BY position, id LIMIT 1`
+	if up {
+		query = `SELECT id, position FROM categories WHERE position < ? AND parent_id IS ? ORDER BY position DESC, id DESC LIMIT 1`
+	}
+	var otherID int64
+	var otherPosition int
+	err = tx.QueryRow(query, position, parentID).Scan(&otherID, &otherPosition)
+	if err == sql.ErrNoRows {
+		return nil //already the first or the last one
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE categories SET position = ? WHERE id = ?", otherPosition, categoryID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE categories SET position = ? WHERE id = ?", position, otherID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetCategoryArchived archives or restores the category. Nothing new can be
+// posted to an archived category.
+func SetCategoryArchived(db *sql.DB, categoryID int64, archived bool) error {
+	if archived {
+		return execOne(db, "UPDATE categories SET archived_at = COALESCE(archived_at, CURRENT_TIMESTAMP) WHERE id = ?", categoryID)
+	}
+	return execOne(db, "UPDATE categories SET archived_at = NULL WHERE id = ?", categoryID)
+}
+
+// MergeCategories moves all the posts of the source category to the target,
+// deletes the source and leaves a redirect from its URL to the target
+func MergeCategories(db *sql.DB, sourceID, targetID int64) error {
+	if sourceID == targetID {
+		return ErrMergeIntoItself
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range []int64{sourceID, targetID} {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+	}
+
+	//when the target is under the source it first takes the place of the
+	//source, then the other subcategories of the source move under the target
+	var targetInSource bool
+	err = tx.QueryRow(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT EXISTS(SELECT 1 FROM subtree WHERE id = ?)
+	`, sourceID, targetID).Scan(&targetInSource)
+	if err != nil {
+		return err
+	}
+	if targetInSource {
+		_, err = tx.Exec("UPDATE categories SET parent_id = (SELECT parent_id FROM categories WHERE id = ?) WHERE id = ?", sourceID, targetID)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE categories SET parent_id = ? WHERE parent_id = ?", targetID, sourceID); err != nil {
+		return err
+	}
+
+	if err := moveCategoryRows(tx, sourceID, targetID); err != nil {
+		return err
+	}
+
+	//posts that are in both categories already have the link to the target
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO post_categories (post_id, category_id)
+		SELECT post_id, ? FROM post_categories WHERE category_id = ?
+	`, targetID, sourceID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM post_categories WHERE category_id = ?", sourceID); err != nil {
+		return err
+	}
+
+	//the categories merged into the source earlier now lead to the target too
+	if _, err := tx.Exec("UPDATE category_redirects SET new_id = ? WHERE new_id = ?", targetID, sourceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO category_redirects (old_id, new_id) VALUES (?, ?)", sourceID, targetID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM categories WHERE id = ?", sourceID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// movedCategoryTables are the tables whose rows of a merged category move to
+// the target. A row the target already has wins over the one of the source.
+var movedCategoryTables = []string{"category_follows", "housing_searches", "chat_messages", "chat_mutes"}
+
+// moveCategoryRows moves the rows of the source category in the other tables
+// to the target, it has to run before the posts are moved
+func moveCategoryRows(tx *sql.Tx, sourceID, targetID int64) error {
+	//the read watermark of the source doesn't carry over to the target, so
+	//the posts it covered are recorded as read one by one
+	_, err := tx.Exec(`
+		INSERT INTO post_reads (user_id, post_id, last_comment_id)
+		SELECT cr.user_id, pc.post_id, cr.last_comment_id
+		FROM category_reads cr
+		JOIN post_categories pc ON pc.category_id = cr.category_id AND pc.post_id <= cr.last_post_id
+		WHERE cr.category_id = ?
+		ON CONFLICT (user_id, post_id) DO UPDATE
+		SET last_comment_id = MAX(last_comment_id, excluded.last_comment_id)
+	`, sourceID)
+	if err != nil {
+		return err
+	}
+	for _, table := range movedCategoryTables {
+		if _, err := tx.Exec("UPDATE OR IGNORE "+table+" SET category_id = ? WHERE category_id = ?", targetID, sourceID); err != nil {
+			return err
+		}
+	}
+	//what is left are the rules of the source, the target keeps its own, and
+	//the rows the target already had
+	return deleteCategoryRows(tx, sourceID)
+}
+
+// deleteCategoryRows deletes the rows of the category in the other tables.
+// The foreign keys are not enforced, so their ON DELETE CASCADE doesn't do it.
+func deleteCategoryRows(tx *sql.Tx, categoryID int64) error {
+	_, err := tx.Exec("DELETE FROM housing_alerts WHERE search_id IN (SELECT id FROM housing_searches WHERE category_id = ?)", categoryID)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"category_rules", "category_reads", "category_follows", "housing_searches", "chat_messages", "chat_mutes"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE category_id = ?", categoryID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CategoryRedirect returns the category an old category ID was merged into
+func CategoryRedirect(db *sql.DB, oldID int64) (int64, error) {
+	var newID int64
+	err := db.QueryRow("SELECT new_id FROM category_redirects WHERE old_id = ?", oldID).Scan(&newID)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return newID, err
+}
+
+// DeleteCategory removes the category. With force the posts are unlinked from
+// it first, otherwise a category with posts is not deleted.
+func DeleteCategory(db *sql.DB, categoryID int64, force bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var posts int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM post_categories WHERE category_id = ?", categoryID).Scan(&posts); err != nil {
+		return err
+	}
+	if posts > 0 && !force {
+		return ErrCategoryNotEmpty
+	}
+	if _, err := tx.Exec("DELETE FROM post_categories WHERE category_id = ?", categoryID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM category_redirects WHERE new_id = ?", categoryID); err != nil {
+		return err
+	}
+	if err := deleteCategoryRows(tx, categoryID); err != nil {
+		return err
+	}
+	//the subcategories move up a level
+	_, err = tx.Exec("UPDATE categories SET parent_id = (SELECT parent_id FROM categories WHERE id = ?) WHERE parent_id = ?", categoryID, categoryID)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM categories WHERE id = ?", categoryID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// PurgeSessions deletes the expired sessions, or all of them when all is true
+func PurgeSessions(ctx context.Context, db *sql.DB, all bool) (int64, error) {
+	query := "DELETE FROM sessions WHERE expires_at <= CURRENT_TIMESTAMP"
+	if all {
+		query = "DELETE FROM sessions"
+	}
+	result, err := db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Stats are the totals shown by "forum stats"
+type Stats struct {
+	Users          int64
+	Admins         int64
+	BannedUsers    int64
+	Posts          int64
+	Comments       int64
+	Reactions      int64
+	Categories     int64
+	ActiveSessions int64
+}
+
+func GetStats(db *sql.DB) (*Stats, error) {
+	var s Stats
+	err := db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM users),
+			(SELECT COUNT(*) FROM users WHERE is_admin),
+			(SELECT COUNT(*) FROM users WHERE banned_at IS NOT NULL),
+			(SELECT COUNT(*) FROM posts),
+			(SELECT COUNT(*) FROM comments),
+			(SELECT COUNT(*) FROM reactions),
+			(SELECT COUNT(*) FROM categories),
+			(SELECT COUNT(*) FROM sessions WHERE expires_at > CURRENT_TIMESTAMP)
+	`).Scan(&s.Users, &s.Admins, &s.BannedUsers, &s.Posts, &s.Comments,
+		&s.Reactions, &s.Categories, &s.ActiveSessions)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Reindex rebuilds the indexes and refreshes the statistics of the query planner
+func Reindex(db *sql.DB) error {
+	_, err := db.Exec("REINDEX; ANALYZE;")
+	return err
+}
+
+// execOne runs an update that has to change exactly one row
+func execOne(db *sql.DB, query string, args ...interface{}) error {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCreateUser(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := CreateUser(db, "taken@example.com", "taken", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		email, username, password string
+		want                      error
+	}{
+		{"new@example.com", " new ", "secret", nil},
+		{"not an email", "other", "secret", ErrInvalidEmail},
+		{"other@example.com", "  ", "secret", ErrUsernameRequired},
+		{"other@example.com", "other", "short", ErrPasswordTooShort},
+		{"taken@example.com", "other", "secret", ErrEmailTaken},
+		{"other@example.com", "taken", "secret", ErrUsernameTaken},
+	}
+	for _, tt := range tests {
+		_, err := CreateUser(db, tt.email, tt.username, tt.password, false)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("CreateUser(%q, %q) error = %v, want %v", tt.email, tt.username, err, tt.want)
+		}
+	}
+
+	//the username is saved trimmed, and both the email and the username find the user
+	for _, name := range []string{"new", "new@example.com"} {
+		user, err := FindUser(db, name)
+		if err != nil || user.Username != "new" {
+			t.Errorf("FindUser(%q) = %+v, %v", name, user, err)
+		}
+	}
+	if _, err := FindUser(db, "nobody"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FindUser of a missing user: %v", err)
+	}
+}
+
+func TestUserAdministration(t *testing.T) {
+	h := newTestHandler(t)
+	userID := addUser(t, h, "member")
+	sessions := func() (n int) {
+		if err := h.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = ?", userID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	login := func() {
+		exec(t, h.db, "INSERT INTO sessions (token, user_id, expires_at) VALUES (hex(randomblob(16)), ?, datetime('now', '+1 hour'))", userID)
+	}
+
+	if err := SetAdmin(h.db, userID, true); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := FindUser(h.db, "member"); !user.IsAdmin {
+		t.Error("the user wasn't made an admin")
+	}
+	if err := SetAdmin(h.db, 999, true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetAdmin of a missing user: %v", err)
+	}
+
+	//a ban and a new password both log the user out
+	login()
+	if err := SetBanned(h.db, userID, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := sessions(); n != 0 {
+		t.Errorf("%d sessions left after the ban", n)
+	}
+	if err := SetBanned(h.db, userID, false); err != nil {
+		t.Fatal(err)
+	}
+	login()
+	if err := ResetPassword(h.db, userID, "short"); !errors.Is(err, ErrPasswordTooShort) {
+		t.Errorf("ResetPassword with a short password: %v", err)
+	}
+	if err := ResetPassword(h.db, 999, "secret"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ResetPassword of a missing user: %v", err)
+	}
+	if err := ResetPassword(h.db, userID, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if n := sessions(); n != 0 {
+		t.Errorf("%d sessions left after the new password", n)
+	}
+}
+
+func TestPurgeSessions(t *testing.T) {
+	h := newTestHandler(t)
+	userID := addUser(t, h, "member")
+	exec(t, h.db, "INSERT INTO sessions (token, user_id, expires_at) VALUES ('old', ?, datetime('now', '-1 hour'))", userID)
+	exec(t, h.db, "INSERT INTO sessions (token, user_id, expires_at) VALUES ('new', ?, datetime('now', '+1 hour'))", userID)
+
+	if n, err := PurgeSessions(context.Background(), h.db, false); err != nil || n != 1 {
+		t.Errorf("purging the expired sessions removed %d, %v, want 1", n, err)
+	}
+	stats, err := GetStats(h.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Users != 1 || stats.ActiveSessions != 1 {
+		t.Errorf("stats %+v, want 1 user with 1 session", stats)
+	}
+	if n, err := PurgeSessions(context.Background(), h.db, true); err != nil || n != 1 {
+		t.Errorf("purging all the sessions removed %d, %v, want 1", n, err)
+	}
+}
+
+func TestCategoryCommands(t *testing.T) {
+	h := newTestHandler(t)
+	userID := addUser(t, h, "member")
+	id, err := CreateCategory(h.db, " Boats ", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCategory(h.db, "Boats", "", 0); !errors.Is(err, ErrCategoryExists) {
+		t.Errorf("a second category with the same name: %v", err)
+	}
+	if _, err := CreateCategory(h.db, " ", "", 0); !errors.Is(err, ErrCategoryName) {
+		t.Errorf("a category without a name: %v", err)
+	}
+	if err := RenameCategory(h.db, id, "Ships"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RenameCategory(h.db, 999, "Ships"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("renaming a missing category: %v", err)
+	}
+
+	//a category with posts is only deleted with force, the posts stay
+	postID := addPost(t, h, userID, PostTypePost, time.Now(), id)
+	if err := DeleteCategory(h.db, id, false); !errors.Is(err, ErrCategoryNotEmpty) {
+		t.Errorf("deleting a category with posts: %v", err)
+	}
+	if err := DeleteCategory(h.db, id, true); err != nil {
+		t.Fatal(err)
+	}
+	var links, posts int
+	h.db.QueryRow("SELECT COUNT(*) FROM post_categories WHERE category_id = ?", id).Scan(&links)
+	h.db.QueryRow("SELECT COUNT(*) FROM posts WHERE id = ?", postID).Scan(&posts)
+	if links != 0 || posts != 1 {
+		t.Errorf("%d links to the deleted category and %d posts, want 0 and 1", links, posts)
+	}
+	if err := DeleteCategory(h.db, id, true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting a missing category: %v", err)
+	}
+}
+
+// categoryTables are the tables with rows of a category
+var categoryTables = []string{"post_categories", "category_rules", "category_reads", "category_follows",
+	"housing_searches", "chat_messages", "chat_mutes"}
+
+// addCategoryRows gives the category a row in every table of categoryTables
+// but post_categories, the user follows it and has marked it read
+func addCategoryRows(t *testing.T, h *Handler, categoryID, userID, postID int64) {
+	t.Helper()
+	exec(t, h.db, "INSERT INTO category_rules (category_id, max_posts_per_day) VALUES (?, 1)", categoryID)
+	exec(t, h.db, "INSERT INTO category_reads (user_id, category_id, last_post_id, last_comment_id) VALUES (?, ?, ?, 0)", userID, categoryID, postID)
+	exec(t, h.db, "INSERT INTO category_follows (user_id, category_id) VALUES (?, ?)", userID, categoryID)
+	searchID := exec(t, h.db, "INSERT INTO housing_searches (user_id, category_id, query) VALUES (?, ?, '')", userID, categoryID)
+	exec(t, h.db, "INSERT INTO housing_alerts (search_id, post_id) VALUES (?, ?)", searchID, postID)
+	exec(t, h.db, `INSERT INTO chat_messages (category_id, user_id, username, content, created_at)
+		VALUES (?, ?, 'member', 'hi', CURRENT_TIMESTAMP)`, categoryID, userID)
+	exec(t, h.db, `INSERT INTO chat_mutes (category_id, user_id, muted_until, muted_by)
+		VALUES (?, ?, CURRENT_TIMESTAMP, ?)`, categoryID, userID, userID)
+}
+
+// categoryRowCounts counts the rows of the category in categoryTables
+func categoryRowCounts(t *testing.T, h *Handler, categoryID int64) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for _, table := range categoryTables {
+		var n int
+		if err := h.db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE category_id = ?", categoryID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		counts[table] = n
+	}
+	return counts
+}
+
+// orphanAlerts counts the housing alerts of searches that don't exist
+func orphanAlerts(t *testing.T, h *Handler) int {
+	t.Helper()
+	var n int
+	err := h.db.QueryRow("SELECT COUNT(*) FROM housing_alerts WHERE search_id NOT IN (SELECT id FROM housing_searches)").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMergeCategories(t *testing.T) {
+	h := newTestHandler(t)
+	member := addUser(t, h, "member")
+	other := addUser(t, h, "other")
+	source := addCategory(t, h, "Boats", 0)
+	target := addCategory(t, h, "Ships", 0)
+	child := addCategory(t, h, "Sailboats", source)
+	old := addCategory(t, h, "Vessels", 0)
+	if err := MergeCategories(h.db, old, source); err != nil {
+		t.Fatal(err)
+	}
+	onlySource := addPost(t, h, other, PostTypePost, time.Now(), source)
+	inBoth := addPost(t, h, other, PostTypePost, time.Now(), source, target)
+	addCategoryRows(t, h, source, member, inBoth)
+	//the other user has the rows in both categories, the ones of the target stay
+	exec(t, h.db, "INSERT INTO category_rules (category_id, max_posts_per_day) VALUES (?, 5)", target)
+	exec(t, h.db, "INSERT INTO category_follows (user_id, category_id) VALUES (?, ?), (?, ?)", other, source, other, target)
+
+	if err := MergeCategories(h.db, source, source); !errors.Is(err, ErrMergeIntoItself) {
+		t.Errorf("merging into itself: %v", err)
+	}
+	if err := MergeCategories(h.db, source, 999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("merging into a missing category: %v", err)
+	}
+	if err := MergeCategories(h.db, source, target); err != nil {
+		t.Fatal(err)
+	}
+
+	for table, n := range categoryRowCounts(t, h, source) {
+		if n != 0 {
+			t.Errorf("%d rows of the merged category left in %s", n, table)
+		}
+	}
+	want := map[string]int{"post_categories": 2, "category_rules": 1, "category_reads": 0, "category_follows": 2,
+		"housing_searches": 1, "chat_messages": 1, "chat_mutes": 1}
+	for table, n := range categoryRowCounts(t, h, target) {
+		if n != want[table] {
+			t.Errorf("%d rows of the target in %s, want %d", n, table, want[table])
+		}
+	}
+	var maxPosts int
+	h.db.QueryRow("SELECT max_posts_per_day FROM category_rules WHERE category_id = ?", target).Scan(&maxPosts)
+	if maxPosts != 5 {
+		t.Errorf("the target has a limit of %d posts a day, want its own 5", maxPosts)
+	}
+	if n := orphanAlerts(t, h); n != 0 {
+		t.Errorf("%d housing alerts without a search", n)
+	}
+
+	//the posts under the watermark of the source are still read
+	states, err := h.readStates(member, []int64{onlySource, inBoth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !states[onlySource].Seen || !states[inBoth].Seen {
+		t.Errorf("read states %+v after the merge, want both posts seen", states)
+	}
+
+	var parentID int64
+	h.db.QueryRow("SELECT parent_id FROM categories WHERE id = ?", child).Scan(&parentID)
+	if parentID != target {
+		t.Errorf("the subcategory is under %d, want the target %d", parentID, target)
+	}
+	for _, id := range []int64{source, old} {
+		if newID, err := CategoryRedirect(h.db, id); err != nil || newID != target {
+			t.Errorf("category %d redirects to %d, %v, want %d", id, newID, err, target)
+		}
+	}
+}
+
+func TestDeleteCategoryRows(t *testing.T) {
+	h := newTestHandler(t)
+	member := addUser(t, h, "member")
+	id := addCategory(t, h, "Boats", 0)
+	postID := addPost(t, h, member, PostTypePost, time.Now(), id)
+	addCategoryRows(t, h, id, member, postID)
+
+	if err := DeleteCategory(h.db, id, true); err != nil {
+		t.Fatal(err)
+	}
+	for table, n := range categoryRowCounts(t, h, id) {
+		if n != 0 {
+			t.Errorf("%d rows of the deleted category left in %s", n, table)
+		}
+	}
+	if n := orphanAlerts(t, h); n != 0 {
+		t.Errorf("%d housing alerts without a search", n)
+	}
+}
@@ -0,0 +1,631 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	MaxTagsPerPost = 5
+	MaxTagLength   = 30
+)
+
+var (
+	ErrTooManyTags  = errors.New("a post can have at most 5 tags")
+	ErrInvalidTag   = errors.New("invalid tag")
+	ErrSynonymIsTag = errors.New("the synonym cannot be the tag itself")
+)
+
+// NormalizeTag makes the tags written in different ways the same: lower case,
+// words joined with dashes and only letters, numbers and dashes kept.
+// "Summer Jobs" and "summer_jobs" both become "summer-jobs".
+func NormalizeTag(tag string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(tag)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if dash && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			dash = false
+			b.WriteRune(r)
+		case r == '-' || r == '_' || unicode.IsSpace(r):
+			dash = true
+		}
+	}
+	name := []rune(b.String())
+	if len(name) > MaxTagLength {
+		name = name[:MaxTagLength]
+	}
+	return strings.Trim(string(name), "-")
+}
+
+// ParseTags splits the comma separated tags of the post form and normalizes
+// them, leaving out the empty ones and the duplicates
+func ParseTags(value string) ([]string, error) {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		tag := NormalizeTag(part)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > MaxTagsPerPost {
+		return nil, ErrTooManyTags
+	}
+	return tags, nil
+}
+
+// dbtx is what the queries need from either the database or a transaction
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// canonicalTag returns the name the tag is saved as, following the synonyms
+func canonicalTag(db dbtx, name string) (string, error) {
+	var canonical string
+	err := db.QueryRow(`
+		SELECT t.name FROM tag_synonyms s
+		JOIN tags t ON t.id = s.tag_id
+		WHERE s.alias = ?
+	`, name).Scan(&canonical)
+	if err == sql.ErrNoRows {
+		return name, nil
+	}
+	return canonical, err
+}
+
+// setPostTags saves the tags of the post, creating the new ones
+func setPostTags(db dbtx, postID int64, tags []string) error {
+	for _, tag := range tags {
+		name, err := canonicalTag(db, tag)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", name); err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+			INSERT OR IGNORE INTO post_tags (post_id, tag_id)
+			SELECT ?, id FROM tags WHERE name = ?
+		`, postID, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getting the tags of the posts with one query, by post ID
+func (h *Handler) getTagsForPosts(postIDs []int64) (map[int64][]string, error) {
+	tags := make(map[int64][]string)
+	if len(postIDs) == 0 {
+		return tags, nil
+	}
+
+	done := observeQuery("get_post_tags")
+	rows, err := h.db.Query(`
+		SELECT pt.post_id, t.name
+		FROM post_tags pt
+		JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.post_id IN (?`+strings.Repeat(", ?", len(postIDs)-1)+`)
+		ORDER BY t.name
+	`, int64Args(postIDs)...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		var name string
+		if err := rows.Scan(&postID, &name); err != nil {
+			return nil, err
+		}
+		tags[postID] = append(tags[postID], name)
+	}
+	return tags, rows.Err()
+}
+
+// addPostTags fills in the Tags of the posts
+func (h *Handler) addPostTags(posts []Post) error {
+	ids := make([]int64, len(posts))
+	for i, p := range posts {
+		ids[i] = p.ID
+	}
+	tags, err := h.getTagsForPosts(ids)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Tags = tags[posts[i].ID]
+	}
+	return nil
+}
+
+// tagCloud returns the most used tags of the category and its subcategories,
+// or of the whole forum when categoryID is 0
+func (h *Handler) tagCloud(categoryID int64, limit int) ([]Tag, error) {
+	done := observeQuery("tag_cloud")
+	rows, err := h.db.Query(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT t.name, COUNT(DISTINCT pt.post_id) as post_count
+		FROM tags t
+		JOIN post_tags pt ON pt.tag_id = t.id
+		WHERE ? = 0 OR pt.post_id IN (
+			SELECT post_id FROM post_categories WHERE category_id IN (SELECT id FROM subtree)
+		)
+		GROUP BY t.id
+		ORDER BY post_count DESC, t.name
+		LIMIT ?
+	`, categoryID, categoryID, limit)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	max := 0
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.Name, &tag.PostCount); err != nil {
+			return nil, err
+		}
+		if tag.PostCount > max {
+			max = tag.PostCount
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	//the weight from 1 to 5 sets the font size in the cloud
+	for i := range tags {
+		tags[i].Weight = 1 + 4*tags[i].PostCount/max
+	}
+	//the cloud is shown in alphabetical order
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+// tagFilter returns the SQL condition that keeps the posts having all the tags
+func tagFilter(tags []string) (string, []interface{}) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+	args := make([]interface{}, 0, len(tags)+1)
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+	args = append(args, len(tags))
+	return `
+		AND p.id IN (
+			SELECT pt.post_id FROM post_tags pt
+			JOIN tags t ON t.id = pt.tag_id
+			WHERE t.name IN (?` + strings.Repeat(", ?", len(tags)-1) + `)
+			GROUP BY pt.post_id
+			HAVING COUNT(DISTINCT t.id) = ?
+		)`, args
+}
+
+// filterTags reads the tag filters from the query string
+func filterTags(query url.Values) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, value := range query["tag"] {
+		tag := NormalizeTag(value)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// resolveTags replaces the synonyms with their tags and drops the duplicates
+func (h *Handler) resolveTags(tags []string) ([]string, error) {
+	var resolved []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		name, err := canonicalTag(h.db, tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[name] {
+			seen[name] = true
+			resolved = append(resolved, name)
+		}
+	}
+	return resolved, nil
+}
+
+// TagHandler lists the posts with the tag, /tag/{name}. More tags and a
+// category can be added as filters: /tag/ferry?tag=summer&category=3
+func (h *Handler) TagHandler(w http.ResponseWriter, r *http.Request) {
+	raw, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/tag/"))
+	if err != nil {
+		h.ErrorHandler(w, r, "Tag not found", http.StatusNotFound)
+		return
+	}
+	name := NormalizeTag(raw)
+	if name == "" {
+		h.ErrorHandler(w, r, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	//synonyms and the tags written differently lead to the right address
+	canonical, err := canonicalTag(h.db, name)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting tag", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if canonical != raw {
+		target := "/tag/" + url.PathEscape(canonical)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	user := h.GetSessionUser(w, r)
+	var userID int64
+	if user != nil {
+		userID = user.ID
+	}
+
+	tags, err := h.resolveTags(append([]string{canonical}, filterTags(r.URL.Query())...))
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting tag", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	categoryID, _ := strconv.ParseInt(r.URL.Query().Get("category"), 10, 64)
+
+	posts, err := h.getPostsByTags(userID, categoryID, tags)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting posts", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	var category *Category
+	if categoryID != 0 {
+		path, err := h.categoryPath(categoryID)
+		if err != nil {
+			LogFrom(r.Context()).Error("Error getting category path", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		if len(path) > 0 {
+			category = &path[len(path)-1]
+		}
+	}
+
+	data := TemplateData{
+		Title:      "#" + canonical,
+		User:       user,
+		Posts:      posts,
+		Category:   category,
+		FilterTags: tags,
+	}
+	if err := h.render(w, r, "tag.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// getPostsByTags returns the posts having all the tags, only from the category
+// and its subcategories when categoryID is not 0
+func (h *Handler) getPostsByTags(userID, categoryID int64, tags []string) ([]Post, error) {
+	filter, filterArgs := tagFilter(tags)
+	args := append([]interface{}{categoryID, userID, categoryID}, filterArgs...)
+
+	done := observeQuery("tag_posts")
+	rows, err := h.db.Query(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION
+			SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT p.id, p.title, p.content, p.username, p.created_at, p.user_id,
+		(SELECT COUNT(*) FROM comments cm WHERE cm.post_id = p.id) as comment_count,
+		EXISTS(SELECT 1 FROM reactions r WHERE r.post_id = p.id AND r.user_id = ? AND r.type = 'like') as user_liked
+		FROM posts p
+		WHERE (? = 0 OR p.id IN (
+			SELECT post_id FROM post_categories WHERE category_id IN (SELECT id FROM subtree)
+		))`+filter+`
+		ORDER BY p.created_at DESC
+	`, args...)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Username, &p.CreatedAt, &p.UserID,
+			&p.CommentCount, &p.UserLiked); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return posts, h.addPostTags(posts)
+}
+
+// TagSuggestions answers the autocomplete of the tag field with the most used
+// tags starting with the typed text, /api/tags?q=fer
+func (h *Handler) TagSuggestions(w http.ResponseWriter, r *http.Request) {
+	prefix := NormalizeTag(r.URL.Query().Get("q"))
+
+	var suggestions []Tag
+	if prefix != "" {
+		//LIKE treats % and _ as wildcards, NormalizeTag has removed them
+		done := observeQuery("tag_suggestions")
+		rows, err := h.db.Query(`
+			SELECT t.name, COUNT(pt.post_id) as post_count
+			FROM tags t
+			LEFT JOIN post_tags pt ON pt.tag_id = t.id
+			WHERE t.name LIKE ? || '%'
+			GROUP BY t.id
+			ORDER BY post_count DESC, t.name
+			LIMIT 10
+		`, prefix)
+		done()
+		if err != nil {
+			LogFrom(r.Context()).Error("Error getting tags", "err", err)
+			h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var tag Tag
+			if err := rows.Scan(&tag.Name, &tag.PostCount); err != nil {
+				LogFrom(r.Context()).Error("Error getting tags", "err", err)
+				h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+				return
+			}
+			suggestions = append(suggestions, tag)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
+
+// AddTagSynonym makes the alias lead to the tag. When the alias is in use as a
+// tag itself, its posts are moved to the tag and the old tag is removed.
+func AddTagSynonym(db *sql.DB, alias, tagName string) error {
+	alias = NormalizeTag(alias)
+	tagName = NormalizeTag(tagName)
+	if alias == "" || tagName == "" {
+		return ErrInvalidTag
+	}
+	if alias == tagName {
+		return ErrSynonymIsTag
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//the target might be a synonym itself
+	var target string
+	err = tx.QueryRow("SELECT t.name FROM tag_synonyms s JOIN tags t ON t.id = s.tag_id WHERE s.alias = ?", tagName).Scan(&target)
+	if err == sql.ErrNoRows {
+		target = tagName
+	} else if err != nil {
+		return err
+	}
+	if target == alias {
+		return ErrSynonymIsTag
+	}
+
+	var tagID int64
+	if _, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", target); err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT id FROM tags WHERE name = ?", target).Scan(&tagID); err != nil {
+		return err
+	}
+
+	var aliasID int64
+	err = tx.QueryRow("SELECT id FROM tags WHERE name = ?", alias).Scan(&aliasID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if aliasID != 0 {
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO post_tags (post_id, tag_id)
+			SELECT post_id, ? FROM post_tags WHERE tag_id = ?
+		`, tagID, aliasID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM post_tags WHERE tag_id = ?", aliasID); err != nil {
+			return err
+		}
+		//synonyms of the old tag now lead to the new one
+		if _, err := tx.Exec("UPDATE tag_synonyms SET tag_id = ? WHERE tag_id = ?", tagID, aliasID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM tags WHERE id = ?", aliasID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("INSERT OR REPLACE INTO tag_synonyms (alias, tag_id) VALUES (?, ?)", alias, tagID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveTagSynonym stops the alias leading to its tag
+func RemoveTagSynonym(db *sql.DB, alias string) error {
+	return execOne(db, "DELETE FROM tag_synonyms WHERE alias = ?", NormalizeTag(alias))
+}
+
+// getting all the tags with their synonyms for the moderators
+func (h *Handler) getAllTags() ([]Tag, error) {
+	done := observeQuery("get_all_tags")
+	rows, err := h.db.Query(`
+		SELECT t.id, t.name,
+		(SELECT COUNT(*) FROM post_tags pt WHERE pt.tag_id = t.id),
+		COALESCE((SELECT GROUP_CONCAT(s.alias, ',') FROM tag_synonyms s WHERE s.tag_id = t.id), '')
+		FROM tags t
+		ORDER BY t.name
+	`)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		var synonyms string
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.PostCount, &synonyms); err != nil {
+			return nil, err
+		}
+		if synonyms != "" {
+			tag.Synonyms = strings.Split(synonyms, ",")
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// AdminTags shows the tags and their synonyms to the moderators
+func (h *Handler) AdminTags(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(w, r)
+	if user == nil {
+		return
+	}
+	if r.Method != http.MethodGet {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.renderAdminTags(w, r, user, "", http.StatusOK)
+}
+
+func (h *Handler) renderAdminTags(w http.ResponseWriter, r *http.Request, user *User, message string, code int) {
+	tags, err := h.getAllTags()
+	if err != nil {
+		LogFrom(r.Context()).Error("Error getting tags", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	data := TemplateData{
+		Title:   "Tags",
+		User:    user,
+		TagList: tags,
+		Error:   message,
+	}
+	w.WriteHeader(code)
+	if err := h.render(w, r, "admin_tags.html", &data); err != nil {
+		LogFrom(r.Context()).Error("Error rendering page", "err", err)
+	}
+}
+
+// TagAPI adds and removes tag synonyms, from the form of the tags page or as
+// JSON: {"action": "add|remove", "alias": "ferries", "tag": "ferry"}
+func (h *Handler) TagAPI(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(w, r)
+	if user == nil {
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.ErrorHandler(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Action string `json:"action"`
+		Alias  string `json:"alias"`
+		Tag    string `json:"tag"`
+	}
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.ErrorHandler(w, r, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			h.ErrorHandler(w, r, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		req.Action = r.FormValue("action")
+		req.Alias = r.FormValue("alias")
+		req.Tag = r.FormValue("tag")
+	}
+
+	var err error
+	switch req.Action {
+	case "add":
+		err = AddTagSynonym(h.db, req.Alias, req.Tag)
+	case "remove":
+		err = RemoveTagSynonym(h.db, req.Alias)
+	default:
+		err = errUnknownAction
+	}
+
+	code := http.StatusOK
+	switch {
+	case err == nil:
+		LogFrom(r.Context()).Info("Tag synonym changed", "action", req.Action, "alias", req.Alias, "tag", req.Tag, "admin_id", user.ID)
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrInvalidTag), errors.Is(err, ErrSynonymIsTag), errors.Is(err, errUnknownAction):
+		code = http.StatusBadRequest
+	default:
+		LogFrom(r.Context()).Error("Error changing tag synonym", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	if isJSON {
+		resp := ActionResponse{Success: err == nil}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if err != nil {
+		h.renderAdminTags(w, r, user, err.Error(), code)
+		return
+	}
+	http.Redirect(w, r, "/admin/tags", http.StatusSeeOther)
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"Summer Jobs", "summer-jobs"},
+		{"summer_jobs", "summer-jobs"},
+		{"  --Summer   jobs-- ", "summer-jobs"},
+		{"C++ & Go!", "c-go"},
+		{"Ålands Hav", "ålands-hav"},
+		{"2024", "2024"},
+		{"!!!", ""},
+		{strings.Repeat("å", MaxTagLength+5), strings.Repeat("å", MaxTagLength)},
+		//the cut doesn't leave a dash at the end
+		{strings.Repeat("a", MaxTagLength-1) + " b", strings.Repeat("a", MaxTagLength-1)},
+	}
+	for _, tt := range tests {
+		if got := NormalizeTag(tt.tag); got != tt.want {
+			t.Errorf("NormalizeTag(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr error
+	}{
+		{"", nil, nil},
+		{"boats, Boats ,, sailing", []string{"boats", "sailing"}, nil},
+		{"a, b, c, d, e, a", []string{"a", "b", "c", "d", "e"}, nil},
+		{"a, b, c, d, e, f", nil, ErrTooManyTags},
+	}
+	for _, tt := range tests {
+		got, err := ParseTags(tt.value)
+		if !errors.Is(err, tt.wantErr) || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("ParseTags(%q) = %q, %v, want %q, %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// postTags returns the tags of the post
+func postTags(t *testing.T, h *Handler, postID int64) string {
+	t.Helper()
+	tags, err := h.getTagsForPosts([]int64{postID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(tags[postID], ",")
+}
+
+func TestTagSynonyms(t *testing.T) {
+	h := newTestHandler(t)
+	userID := addUser(t, h, "member")
+	first := addPost(t, h, userID, PostTypePost, time.Now())
+	second := addPost(t, h, userID, PostTypePost, time.Now())
+	if err := setPostTags(h.db, first, []string{"boat", "sailing"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPostTags(h.db, second, []string{"boats"}); err != nil {
+		t.Fatal(err)
+	}
+
+	//the posts of a tag that becomes a synonym move to its tag
+	if err := AddTagSynonym(h.db, "Boat", "boats"); err != nil {
+		t.Fatal(err)
+	}
+	if got := postTags(t, h, first); got != "boats,sailing" {
+		t.Errorf("the tags of the first post are %q, want boats,sailing", got)
+	}
+	//a synonym of a synonym leads to the tag
+	if err := AddTagSynonym(h.db, "ships", "boat"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPostTags(h.db, second, []string{"ships", "boat"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := postTags(t, h, second); got != "boats" {
+		t.Errorf("the tags of the second post are %q, want boats", got)
+	}
+	resolved, err := h.resolveTags([]string{"ships", "boat", "boats", "sailing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(resolved, ","); got != "boats,sailing" {
+		t.Errorf("resolveTags = %q, want boats,sailing", got)
+	}
+
+	errorTests := []struct {
+		alias, tag string
+		want       error
+	}{
+		{"boats", "Boats", ErrSynonymIsTag},
+		{"boats", "ships", ErrSynonymIsTag},
+		{"!!", "boats", ErrInvalidTag},
+		{"vessels", "", ErrInvalidTag},
+	}
+	for _, tt := range errorTests {
+		if err := AddTagSynonym(h.db, tt.alias, tt.tag); !errors.Is(err, tt.want) {
+			t.Errorf("AddTagSynonym(%q, %q) = %v, want %v", tt.alias, tt.tag, err, tt.want)
+		}
+	}
+	if err := RemoveTagSynonym(h.db, "ships"); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := canonicalTag(h.db, "ships"); err != nil || name != "ships" {
+		t.Errorf("the removed synonym leads to %q, %v", name, err)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	h := newTestHandler(t)
+	userID := addUser(t, h, "member")
+	both := addPost(t, h, userID, PostTypePost, time.Now())
+	boats := addPost(t, h, userID, PostTypePost, time.Now())
+	addPost(t, h, userID, PostTypePost, time.Now())
+	setPostTags(h.db, both, []string{"boats", "sailing"})
+	setPostTags(h.db, boats, []string{"boats"})
+
+	tests := []struct {
+		tags []string
+		want []int64
+	}{
+		{[]string{"boats"}, []int64{both, boats}},
+		{[]string{"boats", "sailing"}, []int64{both}},
+		{[]string{"sailing", "fishing"}, nil},
+	}
+	for _, tt := range tests {
+		where, args := tagFilter(tt.tags)
+		if got := filteredPosts(t, h, where, "p.id", args); !sameIDs(got, tt.want) {
+			t.Errorf("posts tagged %q: %v, want %v", tt.tags, got, tt.want)
+		}
+	}
+	if where, args := tagFilter(nil); where != "" || args != nil {
+		t.Errorf("tagFilter(nil) = %q, %v, want no condition", where, args)
+	}
+}
+
+func TestPostableCategories(t *testing.T) {
+	h := newTestHandler(t)
+	active := addCategory(t, h, "Boats", 0)
+	archived := addCategory(t, h, "Old boats", 0)
+	if err := SetCategoryArchived(h.db, archived, true); err != nil {
+		t.Fatal(err)
+	}
+	id := strconv.FormatInt(active, 10)
+
+	tests := []struct {
+		ids     []string
+		want    []int64
+		wantErr error
+	}{
+		{[]string{id, id}, []int64{active}, nil},
+		{[]string{strconv.FormatInt(archived, 10)}, nil, ErrInvalidCategory},
+		{[]string{"999"}, nil, ErrInvalidCategory},
+		{[]string{"boats"}, nil, ErrInvalidCategory},
+	}
+	for _, tt := range tests {
+		got, err := h.postableCategories(tt.ids)
+		if !errors.Is(err, tt.wantErr) || !sameIDs(got, tt.want) {
+			t.Errorf("postableCategories(%q) = %v, %v, want %v, %v", tt.ids, got, err, tt.want, tt.wantErr)
+		}
+	}
+	//without a category the post goes to the first one that is not archived
+	if got, err := h.postableCategories(nil); err != nil || len(got) != 1 {
+		t.Errorf("postableCategories(nil) = %v, %v, want one category", got, err)
+	}
+}
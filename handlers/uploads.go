@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrUploadTooLarge = errors.New("the file is too large")
+	ErrUploadType     = errors.New("only JPEG, PNG, GIF and WebP images can be uploaded")
+)
+
+// the accepted image types and the extension they are saved with
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// saveUpload checks that the uploaded file is an image and saves it under a
+// random name in the upload directory. The type is detected from the content,
+// the name and the type sent by the browser are not trusted.
+func (h *Handler) saveUpload(fh *multipart.FileHeader) (string, error) {
+	if fh.Size > int64(h.maxUpload) {
+		return "", ErrUploadTooLarge
+	}
+	file, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	ext, ok := imageTypes[http.DetectContentType(head[:n])]
+	if !ok {
+		return "", ErrUploadType
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(random) + ext
+
+	if err := os.MkdirAll(h.uploadDir, 0o755); err != nil {
+		return "", err
+	}
+	out, err := os.OpenFile(filepath.Join(h.uploadDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+	//the size from the header can't be trusted either
+	if _, err := io.Copy(out, io.LimitReader(file, int64(h.maxUpload)+1)); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	if info, err := os.Stat(out.Name()); err == nil && info.Size() > int64(h.maxUpload) {
+		os.Remove(out.Name())
+		return "", ErrUploadTooLarge
+	}
+	return name, nil
+}
+
+// removeUploads deletes the saved files, used when saving the post fails
+func (h *Handler) removeUploads(names []string) {
+	for _, name := range names {
+		os.Remove(filepath.Join(h.uploadDir, name))
+	}
+}
+
+// Uploads serves the uploaded files. Only the names saveUpload gives are
+// served, so nothing outside the upload directory can be reached. The
+// attachments of the private messages have their own access checked route.
+func (h *Handler) Uploads(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if !validUploadName(name) {
+		h.ErrorHandler(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+	//the images of the private messages are served to the members only
+	attachment, err := h.isAttachment(name)
+	if err != nil {
+		LogFrom(r.Context()).Error("Error checking upload", "err", err)
+		h.ErrorHandler(w, r, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if attachment {
+		h.ErrorHandler(w, r, "Page not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, filepath.Join(h.uploadDir, name))
+}
+
+func validUploadName(name string) bool {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if len(base) != 32 {
+		return false
+	}
+	if _, err := hex.DecodeString(base); err != nil {
+		return false
+	}
+	for _, ext := range imageTypes {
+		if filepath.Ext(name) == ext {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// the server side of the WebSocket protocol (RFC 6455), only what the chat
+// needs: text messages, fragmentation, ping, pong and close
+
+// the GUID of the Sec-WebSocket-Accept header
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// the opcodes of the frames
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// the status codes of the close frames
+const (
+	wsNormalClosure   = 1000
+	wsGoingAway       = 1001
+	wsProtocolError   = 1002
+	wsUnsupportedData = 1003
+	wsInvalidPayload  = 1007
+	wsPolicyViolation = 1008
+	wsMessageTooBig   = 1009
+)
+
+const (
+	wsWriteTimeout     = 10 * time.Second //how long a write can take before the client is given up
+	wsMaxControlLength = 125              //the longest payload of a ping, pong or close frame
+)
+
+// wsCloseError is the close frame the peer sent, or the one we send because
+// of a protocol error
+type wsCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return "websocket closed: " + e.Reason
+}
+
+// wsConn is an upgraded connection. One goroutine reads and any goroutine can
+// write, the writes are serialized.
+type wsConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	maxMessage int
+	writeMu    sync.Mutex
+	closed     bool
+}
+
+// websocketAccept is the Sec-WebSocket-Accept value of the key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// sameOrigin tells if the page that opens the socket is on this site. The
+// browsers send the cookies with a cross-site WebSocket too, so without the
+// check any site could chat as the logged in user.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		//not a browser, so no cookies of someone else either
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// upgradeWebSocket checks the handshake and takes over the connection. On an
+// error the response has already been written.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, maxMessage int) (*wsConn, error) {
+	headerHas := func(name, token string) bool {
+		for _, value := range strings.Split(r.Header.Get(name), ",") {
+			if strings.EqualFold(strings.TrimSpace(value), token) {
+				return true
+			}
+		}
+		return false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: method is not GET")
+	case !headerHas("Connection", "upgrade") || !headerHas("Upgrade", "websocket"):
+		http.Error(w, "Expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("websocket: not an upgrade request")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	case len(key) != 24:
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: invalid key")
+	case !sameOrigin(r):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, errors.New("websocket: cross-origin request")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
+		return nil, err
+	}
+	//the timeouts of the HTTP server don't apply anymore, the chat sets its own
+	conn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader, maxMessage: maxMessage}, nil
+}
+
+// readFrame reads one frame and unmasks its payload
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.reader, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	if head[0]&0x70 != 0 {
+		return fin, opcode, nil, &wsCloseError{wsProtocolError, "reserved bits set"}
+	}
+	//the frames of a client are always masked
+	if head[1]&0x80 == 0 {
+		return fin, opcode, nil, &wsCloseError{wsProtocolError, "frame not masked"}
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (length > wsMaxControlLength || !fin) {
+		return fin, opcode, nil, &wsCloseError{wsProtocolError, "invalid control frame"}
+	}
+	if length > uint64(c.maxMessage) {
+		return fin, opcode, nil, &wsCloseError{wsMessageTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// ReadMessage returns the next text message. The pings are answered and the
+// fragments put together on the way. onPong is called for every pong, to
+// move the read deadline. A close frame from the client is answered and
+// returned as a *wsCloseError.
+func (c *wsConn) ReadMessage(onPong func()) ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			if onPong != nil {
+				onPong()
+			}
+			continue
+		case wsClose:
+			code := wsNormalClosure
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.Close(code, "")
+			return nil, &wsCloseError{code, string(payload[min(2, len(payload)):])}
+		case wsText:
+			if fragmented {
+				return nil, &wsCloseError{wsProtocolError, "new message before the last fragment"}
+			}
+			message = payload
+			fragmented = !fin
+		case wsContinuation:
+			if !fragmented {
+				return nil, &wsCloseError{wsProtocolError, "continuation without a message"}
+			}
+			if len(message)+len(payload) > c.maxMessage {
+				return nil, &wsCloseError{wsMessageTooBig, "message too big"}
+			}
+			message = append(message, payload...)
+			fragmented = !fin
+		case wsBinary:
+			return nil, &wsCloseError{wsUnsupportedData, "binary messages are not supported"}
+		default:
+			return nil, &wsCloseError{wsProtocolError, "unknown opcode"}
+		}
+		if !fragmented {
+			if !utf8.Valid(message) {
+				return nil, &wsCloseError{wsInvalidPayload, "text is not UTF-8"}
+			}
+			return message, nil
+		}
+	}
+}
+
+// writeFrame writes one unmasked, unfragmented frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteText sends a text message
+func (c *wsConn) WriteText(message []byte) error {
+	return c.writeFrame(wsText, message)
+}
+
+// Ping sends a ping, the client answers with a pong
+func (c *wsConn) Ping() error {
+	return c.writeFrame(wsPing, nil)
+}
+
+// Close sends a close frame with the code and closes the connection. It is
+// safe to call more than once.
+func (c *wsConn) Close(code int, reason string) {
+	if len(reason) > wsMaxControlLength-2 {
+		reason = reason[:wsMaxControlLength-2]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	c.writeFrame(wsClose, append(payload, reason...))
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.conn.Close()
+	}
+}
+
+// SetReadDeadline limits how long the next read can wait
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestConn is the connection under a wsConn in the tests, the frames the
+// server writes are kept in written
+type wsTestConn struct {
+	net.Conn
+	written bytes.Buffer
+	closed  bool
+}
+
+func (c *wsTestConn) Write(b []byte) (int, error)      { return c.written.Write(b) }
+func (c *wsTestConn) Close() error                     { c.closed = true; return nil }
+func (c *wsTestConn) SetWriteDeadline(time.Time) error { return nil }
+
+// clientFrame is a frame as a browser sends it, masked unless unmasked is set
+func clientFrame(fin bool, opcode byte, payload []byte, unmasked bool) []byte {
+	frame := []byte{opcode, 0}
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame[1] = byte(n)
+	case n <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if unmasked {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// newTestWSConn returns a server side connection that reads the frames
+func newTestWSConn(maxMessage int, frames ...[]byte) (*wsConn, *wsTestConn) {
+	conn := &wsTestConn{}
+	return &wsConn{
+		conn:       conn,
+		reader:     bufio.NewReader(bytes.NewReader(bytes.Join(frames, nil))),
+		maxMessage: maxMessage,
+	}, conn
+}
+
+func TestWebsocketAccept(t *testing.T) {
+	//the example of RFC 6455, section 1.3
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("websocketAccept = %q", got)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://forum.example", true},
+		{"https://FORUM.example", true},
+		{"http://evil.example", false},
+		{"http://forum.example:8080", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/chat", nil)
+		r.Host = "forum.example"
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := sameOrigin(r); got != tt.want {
+			t.Errorf("sameOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		name     string
+		frames   [][]byte
+		want     string
+		wantCode int //the close code of the error, 0 for a message
+	}{
+		{
+			name:   "masked text",
+			frames: [][]byte{clientFrame(true, wsText, []byte("hei"), false)},
+			want:   "hei",
+		},
+		{
+			name:   "16-bit length",
+			frames: [][]byte{clientFrame(true, wsText, []byte(long), false)},
+			want:   long,
+		},
+		{
+			name: "fragments with a ping in between",
+			frames: [][]byte{
+				clientFrame(false, wsText, []byte("hej "), false),
+				clientFrame(true, wsPing, []byte("p"), false),
+				clientFrame(false, wsContinuation, []byte("på "), false),
+				clientFrame(true, wsContinuation, []byte("dig"), false),
+			},
+			want: "hej på dig",
+		},
+		{
+			name: "a character split between fragments",
+			frames: [][]byte{
+				clientFrame(false, wsText, []byte("å")[:1], false),
+				clientFrame(true, wsContinuation, []byte("å")[1:], false),
+			},
+			want: "å",
+		},
+		{
+			name:     "unmasked",
+			frames:   [][]byte{clientFrame(true, wsText, []byte("hei"), true)},
+			wantCode: wsProtocolError,
+		},
+		{
+			name:     "reserved bits",
+			frames:   [][]byte{append([]byte{0xC1}, clientFrame(true, wsText, nil, false)[1:]...)},
+			wantCode: wsProtocolError,
+		},
+		{
+			name:     "control frame too long",
+			frames:   [][]byte{clientFrame(true, wsPing, make([]byte, wsMaxControlLength+1), false)},
+			wantCode: wsProtocolError,
+		},
+		{
+			name:     "fragmented control frame",
+			frames:   [][]byte{clientFrame(false, wsPing, []byte("p"), false)},
+			wantCode: wsProtocolError,
+		},
+		{
+			name:     "frame over the size cap",
+			frames:   [][]byte{clientFrame(true, wsText, make([]byte, 1025), false)},
+			wantCode: wsMessageTooBig,
+		},
+		{
+			name: "fragments over the size cap",
+			frames: [][]byte{
+				clientFrame(false, wsText, make([]byte, 600), false),
+				clientFrame(true, wsContinuation, make([]byte, 600), false),
+			},
+			wantCode: wsMessageTooBig,
+		},
+		{
+			name:     "continuation without a message",
+			frames:   [][]byte{clientFrame(true, wsContinuation, []byte("x"), false)},
+			wantCode: wsProtocolError,
+		},
+		{
+			name: "new message before the last fragment",
+			frames: [][]byte{
+				clientFrame(false, wsText, []byte("x"), false),
+				clientFrame(true, wsText, []byte("y"), false),
+			},
+			wantCode: wsProtocolError,
+		},
+		{
+			name:     "binary",
+			frames:   [][]byte{clientFrame(true, wsBinary, []byte{1, 2}, false)},
+			wantCode: wsUnsupportedData,
+		},
+		{
+			name:     "unknown opcode",
+			frames:   [][]byte{clientFrame(true, 0x3, nil, false)},
+			wantCode: wsProtocolError,
+		},
+		{
+			name:     "invalid UTF-8",
+			frames:   [][]byte{clientFrame(true, wsText, []byte{0xff, 0xfe}, false)},
+			wantCode: wsInvalidPayload,
+		},
+		{
+			name:     "close from the client",
+			frames:   [][]byte{clientFrame(true, wsClose, binary.BigEndian.AppendUint16(nil, wsGoingAway), false)},
+			wantCode: wsGoingAway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestWSConn(1024, tt.frames...)
+			message, err := c.ReadMessage(nil)
+			var closeErr *wsCloseError
+			switch {
+			case tt.wantCode == 0 && err != nil:
+				t.Fatalf("ReadMessage: %v", err)
+			case tt.wantCode == 0 && string(message) != tt.want:
+				t.Errorf("message %q, want %q", message, tt.want)
+			case tt.wantCode != 0 && !errors.As(err, &closeErr):
+				t.Fatalf("got %q, %v, want a close error", message, err)
+			case tt.wantCode != 0 && closeErr.Code != tt.wantCode:
+				t.Errorf("close code %d, want %d", closeErr.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReadMessageControlFrames(t *testing.T) {
+	c, conn := newTestWSConn(1024,
+		clientFrame(true, wsPing, []byte("are you there"), false),
+		clientFrame(true, wsPong, nil, false),
+		clientFrame(true, wsText, []byte("yes"), false),
+	)
+	pongs := 0
+	message, err := c.ReadMessage(func() { pongs++ })
+	if err != nil || string(message) != "yes" {
+		t.Fatalf("ReadMessage = %q, %v", message, err)
+	}
+	if pongs != 1 {
+		t.Errorf("onPong called %d times, want 1", pongs)
+	}
+	//the ping is answered with an unmasked pong of the same payload
+	want := append([]byte{0x80 | wsPong, 13}, "are you there"...)
+	if !bytes.Equal(conn.written.Bytes(), want) {
+		t.Errorf("wrote % x, want % x", conn.written.Bytes(), want)
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{0, []byte{0x81, 0}},
+		{125, []byte{0x81, 125}},
+		{126, []byte{0x81, 126, 0, 126}},
+		{0x10000, []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+	for _, tt := range tests {
+		c, conn := newTestWSConn(0)
+		payload := bytes.Repeat([]byte("a"), tt.length)
+		if err := c.WriteText(payload); err != nil {
+			t.Fatal(err)
+		}
+		if want := append(tt.header, payload...); !bytes.Equal(conn.written.Bytes(), want) {
+			t.Errorf("frame of %d bytes starts with % x, want % x", tt.length, conn.written.Bytes()[:len(tt.header)], tt.header)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	c, conn := newTestWSConn(0)
+	c.Close(wsPolicyViolation, strings.Repeat("x", 200))
+	c.Close(wsNormalClosure, "")
+
+	frame := conn.written.Bytes()
+	if len(frame) != 2+wsMaxControlLength || frame[0] != 0x80|wsClose || frame[1] != wsMaxControlLength {
+		t.Fatalf("close frame % x", frame[:min(4, len(frame))])
+	}
+	if code := binary.BigEndian.Uint16(frame[2:]); code != wsPolicyViolation {
+		t.Errorf("close code %d, want %d", code, wsPolicyViolation)
+	}
+	if !conn.closed {
+		t.Error("the connection wasn't closed")
+	}
+	if err := c.WriteText([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close: %v", err)
+	}
+}
+
+func TestChatClientAllow(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name    string
+		tokens  float64
+		after   time.Duration
+		allowed int //how many messages in a row get through
+	}{
+		{"full burst", chatBurst, 0, chatBurst},
+		{"empty", 0, 0, 0},
+		{"empty, one refill later", 0, chatRefill, 1},
+		{"half a refill is not enough", 0, chatRefill / 2, 0},
+		{"refill doesn't go over the burst", 0, time.Hour, chatBurst},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &chatClient{tokens: tt.tokens, refilledAt: start}
+			now := start.Add(tt.after)
+			allowed := 0
+			for c.allow(now) {
+				allowed++
+			}
+			if allowed != tt.allowed {
+				t.Errorf("%d messages allowed, want %d", allowed, tt.allowed)
+			}
+		})
+	}
+}
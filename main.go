@@ -1,48 +1,37 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"forum/config"
 	"forum/handlers"
-	"html/template"
 	"log"
-	"net/http"
+	"log/slog"
+	"os"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
-	// Initialize database
-	db, err := handlers.InitDB()
+	// Load the configuration from the environment
+	cfg, err := config.Load()
 	if err != nil {
-		log.Fatal("Failed to initialize the database:", err)
+		log.Fatal("Failed to load the configuration:", err)
 	}
-	defer db.Close()
 
-	templates, err := template.ParseGlob("templates/*.html")
+	logger, err := handlers.NewLogger(os.Stderr, cfg.LogFormat, cfg.LogLevel)
 	if err != nil {
-		log.Fatal("Failed to parse templates:", err)
+		log.Fatal("Failed to create the logger:", err)
+	}
+	//the default logger is also used by the log package, so every line has the same format
+	slog.SetDefault(logger)
+
+	if err := runCommand(cfg, logger, os.Args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(os.Stderr, "%v\n\n%s", err, usage)
+			os.Exit(2)
+		}
+		slog.Error("Command failed", "err", err)
+		os.Exit(1)
 	}
-
-	// Create connection to the database
-	h := handlers.NewHandler(db, templates)
-
-	// Setup routes
-	http.HandleFunc("/", h.HomeHandler)
-	http.HandleFunc("/rules", h.Rules)
-	http.HandleFunc("/register", h.HandleRegister)
-	http.HandleFunc("/login", h.HandleLogin)
-	http.HandleFunc("/logout", h.LogoutHandler)
-	http.HandleFunc("/post/new", h.CreatePost)
-	http.HandleFunc("/post/", h.GetPost)
-	http.HandleFunc("/category/", h.CategoryHandler)
-	http.HandleFunc("/api/react", h.PostReaction)
-	http.HandleFunc("/api/comment", h.AddComment)
-	http.HandleFunc("/api/comment/react", h.HandleCommentReaction)
-
-	// Serve static files
-	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
-
-	fmt.Println("Server running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil)) // Logs the error and exits.
 }
@@ -0,0 +1,347 @@
+// Package metrics is a small implementation of counters, gauges and histograms
+// that are written in the Prometheus text format, so the forum can be scraped
+// without depending on the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets in seconds, from 1ms to 10s
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric family which can write itself in the text format
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics that are exposed together
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes all the metrics in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// family has the parts that are the same for every type of metric
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// key joins the label values into a map key, the separator can't appear in valid UTF-8
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats the labels like {route="/",method="GET"}, extra is added at the end
+func (f *family) labelString(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, escapeLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extra[i], escapeLabel(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// labelEscaper escapes a label value the way the text format wants: only the
+// backslash, the double quote and the line feed. Go's %q would also escape
+// tabs and other characters with sequences Prometheus doesn't read.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes the label value, the invalid UTF-8 is replaced
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(strings.ToValidUTF8(s, "�"))
+}
+
+func escapeHelp(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// atomicFloat is a float64 that can be changed from many goroutines
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (a *atomicFloat) add(v float64) {
+	for {
+		old := a.bits.Load()
+		if a.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (a *atomicFloat) set(v float64) {
+	a.bits.Store(math.Float64bits(v))
+}
+
+func (a *atomicFloat) load() float64 {
+	return math.Float64frombits(a.bits.Load())
+}
+
+// series is one combination of label values of a metric family
+type series[T any] struct {
+	values []string
+	metric *T
+}
+
+// vec keeps the series of a family, creating them the first time they are used
+type vec[T any] struct {
+	family
+	mu     sync.RWMutex
+	series map[string]*series[T]
+	create func() *T
+}
+
+func (v *vec[T]) with(values []string) *T {
+	key := v.key(values)
+
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.metric
+	}
+	s = &series[T]{values: append([]string(nil), values...), metric: v.create()}
+	v.series[key] = s
+	return s.metric
+}
+
+// sorted returns the series ordered by their label values, so the output is stable
+func (v *vec[T]) sorted() []*series[T] {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*series[T], len(keys))
+	for i, k := range keys {
+		out[i] = v.series[k]
+	}
+	return out
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	value atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.value.add(1)
+}
+
+// Add increases the counter, negative values are ignored
+func (c *Counter) Add(v float64) {
+	if v > 0 {
+		c.value.add(v)
+	}
+}
+
+// CounterVec is a counter with labels
+type CounterVec struct {
+	vec[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec[Counter]{
+		family: family{name: name, help: help, kind: "counter", labels: labels},
+		series: map[string]*series[Counter]{},
+		create: func() *Counter { return &Counter{} },
+	}}
+	r.register(c)
+	return c
+}
+
+// NewCounter creates a counter without labels
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).WithLabelValues()
+}
+
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	return c.with(values)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	for _, s := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(s.values), formatFloat(s.metric.value.load()))
+	}
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.value.set(v)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.value.add(v)
+}
+
+// GaugeVec is a gauge with labels
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec[Gauge]{
+		family: family{name: name, help: help, kind: "gauge", labels: labels},
+		series: map[string]*series[Gauge]{},
+		create: func() *Gauge { return &Gauge{} },
+	}}
+	r.register(g)
+	return g
+}
+
+// NewGauge creates a gauge without labels
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).WithLabelValues()
+}
+
+func (g *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return g.with(values)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	for _, s := range g.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(s.values), formatFloat(s.metric.value.load()))
+	}
+}
+
+// Histogram counts the observed values in buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64 //upper bounds, sorted
+	counts  []uint64  //counts[i] is the number of values <= buckets[i] and > buckets[i-1]
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// HistogramVec is a histogram with labels
+type HistogramVec struct {
+	vec[Histogram]
+	buckets []float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{buckets: buckets}
+	h.vec = vec[Histogram]{
+		family: family{name: name, help: help, kind: "histogram", labels: labels},
+		series: map[string]*series[Histogram]{},
+		create: func() *Histogram {
+			return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		},
+	}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return h.with(values)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	for _, s := range h.sorted() {
+		hist := s.metric
+		hist.mu.Lock()
+		var cumulative uint64
+		for i, upper := range hist.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.values, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(s.values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(s.values), hist.count)
+		hist.mu.Unlock()
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelEscaping(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"/post/", `/post/`},
+		{`say "hi"`, `say \"hi\"`},
+		{`C:\path`, `C:\\path`},
+		{"two\nlines", `two\nlines`},
+		{"tab\there", "tab\there"},
+		{"Åland", "Åland"},
+		{"bad \xff byte", "bad � byte"},
+	}
+	for _, tt := range tests {
+		r := NewRegistry()
+		r.NewCounterVec("test_total", "Test.", "value").WithLabelValues(tt.value).Inc()
+		var b strings.Builder
+		if err := r.WriteText(&b); err != nil {
+			t.Fatal(err)
+		}
+		if want := `test_total{value="` + tt.want + `"} 1` + "\n"; !strings.HasSuffix(b.String(), want) {
+			t.Errorf("label %q written as\n%s\nwant\n%s", tt.value, b.String(), want)
+		}
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("requests_total", "Number of requests.\nBy route.", "route", "method")
+	requests.WithLabelValues("/b", "GET").Add(2)
+	requests.WithLabelValues("/a", "POST").Inc()
+	requests.WithLabelValues("/a", "POST").Add(-5) //ignored
+	r.NewGauge("clients", `Open clients, in \ units.`).Set(3.5)
+	duration := r.NewHistogramVec("duration_seconds", "Time spent.", []float64{1, 0.1}, "route")
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		duration.WithLabelValues("/").Observe(v)
+	}
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP requests_total Number of requests.\nBy route.
+# TYPE requests_total counter
+requests_total{route="/a",method="POST"} 1
+requests_total{route="/b",method="GET"} 2
+# HELP clients Open clients, in \\ units.
+# TYPE clients gauge
+clients 3.5
+# HELP duration_seconds Time spent.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="/",le="0.1"} 2
+duration_seconds_bucket{route="/",le="1"} 3
+duration_seconds_bucket{route="/",le="+Inf"} 4
+duration_seconds_sum{route="/"} 2.65
+duration_seconds_count{route="/"} 4
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	r := NewRegistry()
+	r.NewHistogramVec("wait_seconds", "Wait.", []float64{1}).WithLabelValues().Observe(0.5)
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`wait_seconds_bucket{le="1"} 1`,
+		`wait_seconds_bucket{le="+Inf"} 1`,
+		"wait_seconds_sum 0.5",
+		"wait_seconds_count 1",
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("no %q in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestWrongNumberOfLabels(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic with a missing label value")
+		}
+	}()
+	NewRegistry().NewCounterVec("test_total", "Test.", "a", "b").WithLabelValues("only a")
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"forum/config"
+	"forum/handlers"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// run starts the forum and blocks until it receives SIGINT or SIGTERM.
+// After the signal the server stops accepting new connections, waits for the
+// requests in flight, stops the background workers and closes the database.
+func run(cfg *config.Config, logger *slog.Logger) error {
+	// Initialize database
+	db, err := handlers.InitDB(cfg.DBPath, cfg.SchemaPath, cfg.MigrationsDir)
+	if err != nil {
+		return fmt.Errorf("failed to initialize the database: %w", err)
+	}
+	defer func() {
+		if err := handlers.CloseDB(db); err != nil {
+			slog.Error("Error closing the database", "err", err)
+		}
+	}()
+
+	templates, err := template.ParseGlob(cfg.TemplatesGlob)
+	if err != nil {
+		return fmt.Errorf("failed to parse templates: %w", err)
+	}
+
+	// Create connection to the database
+	h := handlers.NewHandler(db, templates, cfg)
+
+	//the context is cancelled when the process gets SIGINT (ctrl+c) or SIGTERM (docker stop)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	//starting the background workers, they stop when the context is cancelled
+	var workers sync.WaitGroup
+	startWorker := func(work func(ctx context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			work(ctx)
+		}()
+	}
+	startWorker(func(ctx context.Context) {
+		h.CleanupSessions(ctx, cfg.SessionCleanupInterval)
+	})
+	if cfg.BackupInterval > 0 {
+		startWorker(func(ctx context.Context) {
+			h.RunBackups(ctx, cfg.BackupInterval)
+		})
+	}
+	if cfg.ExpiryInterval > 0 {
+		startWorker(func(ctx context.Context) {
+			h.RunExpiry(ctx, cfg.ExpiryInterval)
+		})
+	}
+	if cfg.MailTransport != "" {
+		startWorker(func(ctx context.Context) {
+			h.RunMail(ctx, cfg.MailInterval)
+		})
+	}
+
+	var handler http.Handler = handlers.SecurityHeaders(cfg.CSPReportOnly, routes(h, cfg))
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	servers := []*http.Server{srv}
+
+	if cfg.TLSEnabled() {
+		certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			stop()
+			workers.Wait()
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		startWorker(func(ctx context.Context) {
+			certs.watch(ctx, cfg.CertReloadInterval)
+		})
+
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+		handler = handlers.HSTS(cfg.HSTSMaxAge, handler)
+
+		if cfg.HTTPRedirectAddr != "" {
+			servers = append(servers, &http.Server{
+				Addr:              cfg.HTTPRedirectAddr,
+				Handler:           handlers.RedirectToHTTPS(cfg.Addr),
+				ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+				IdleTimeout:       cfg.IdleTimeout,
+			})
+		}
+	}
+	//the event streams don't end by themselves, Shutdown would wait for them
+	srv.RegisterOnShutdown(h.CloseLive)
+	srv.RegisterOnShutdown(h.CloseChat)
+
+	//the request ID has to be the outermost, so all the other layers can log with it
+	srv.Handler = handlers.RequestID(logger, handlers.AccessLog(handler))
+
+	serverErr := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			if s.TLSConfig != nil {
+				slog.Info("Server running", "url", "https://localhost"+s.Addr)
+				serverErr <- s.ListenAndServeTLS("", "")
+				return
+			}
+			if s == srv {
+				slog.Info("Server running", "url", "http://localhost"+s.Addr)
+			} else {
+				slog.Info("Redirecting to HTTPS", "url", "http://localhost"+s.Addr)
+			}
+			serverErr <- s.ListenAndServe()
+		}(s)
+	}
+
+	var runErr error
+	select {
+	case err := <-serverErr:
+		//a server could not start (for example the port is taken)
+		if !errors.Is(err, http.ErrServerClosed) {
+			runErr = fmt.Errorf("server error: %w", err)
+		}
+	case <-ctx.Done():
+		slog.Info("Shutting down, waiting for requests to finish")
+	}
+
+	//second signal kills the process right away
+	stop()
+
+	shutdown(servers, cfg.ShutdownTimeout)
+	workers.Wait()
+
+	slog.Info("Server stopped")
+	return runErr
+}
+
+// shutdown stops all the servers at the same time and waits for the requests in flight
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				slog.Error("Error during shutdown", "addr", s.Addr, "err", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// routes connects the URLs to the handlers
+func routes(h *handlers.Handler, cfg *config.Config) http.Handler {
+	mux := http.NewServeMux()
+
+	//every route is measured with its pattern as the label
+	handle := func(pattern string, handler http.Handler) {
+		mux.Handle(pattern, handlers.Instrument(pattern, handler))
+	}
+	handleFunc := func(pattern string, handler http.HandlerFunc) {
+		handle(pattern, handler)
+	}
+
+	handleFunc("/", h.HomeHandler)
+	handleFunc("/rules", h.Rules)
+	handleFunc("/register", h.HandleRegister)
+	handleFunc("/login", h.HandleLogin)
+	handleFunc("/logout", h.LogoutHandler)
+	handleFunc("/post/new", h.CreatePost)
+	handleFunc("/post/", h.GetPost)
+	handleFunc("/category/", h.CategoryHandler)
+	handleFunc("/tag/", h.TagHandler)
+	handleFunc("/api/tags", h.TagSuggestions)
+	handleFunc("/api/react", h.PostReaction)
+	handleFunc("/api/comment", h.AddComment)
+	handleFunc("/api/comment/react", h.HandleCommentReaction)
+	handleFunc("/api/comment/accept", h.AcceptAnswer)
+	handleFunc("/api/listing/status", h.ListingStatus)
+	handleFunc("/uploads/", h.Uploads)
+	handleFunc("/events", h.EventsCalendar)
+	handleFunc("/events.ics", h.EventFeed)
+	handleFunc("/event/", h.EventICS)
+	handleFunc("/api/event/rsvp", h.EventRSVP)
+	handleFunc("/housing/searches", h.SavedSearches)
+	handleFunc("/api/housing/searches", h.SavedSearchAPI)
+	handleFunc("/notifications", h.Notifications)
+	handleFunc("/notifications/", h.Notifications)
+	handleFunc("/api/notifications", h.NotificationAPI)
+	handleFunc("/api/category/follow", h.FollowCategory)
+	handleFunc("/api/category/read", h.MarkCategoryRead)
+	handleFunc("/api/follow", h.Follow)
+	handleFunc("/bookmarks", h.Bookmarks)
+	handleFunc("/bookmarks.json", h.BookmarksExport)
+	handleFunc("/api/bookmarks", h.BookmarkAPI)
+	handleFunc("/unsubscribe", h.Unsubscribe)
+	handleFunc("/live", h.Live)
+	handleFunc("/chat/", h.Chat)
+	handleFunc("/messages", h.Messages)
+	handleFunc("/messages/", h.Messages)
+	handleFunc("/api/messages", h.MessageAPI)
+	handleFunc("/csp-report", h.HandleCSPReport)
+	handleFunc("/metrics", h.MetricsHandler(cfg.MetricsToken))
+	handleFunc("/healthz", h.Healthz)
+	handleFunc("/readyz", h.Readyz)
+	handleFunc("/debug/status", h.DebugStatus)
+	handleFunc("/admin/backup", h.DownloadBackup)
+	handleFunc("/admin/categories", h.AdminCategories)
+	handleFunc("/admin/categories/", h.AdminCategoryRules)
+	handleFunc("/api/admin/categories", h.CategoryAPI)
+	handleFunc("/admin/tags", h.AdminTags)
+	handleFunc("/api/admin/tags", h.TagAPI)
+	handleFunc("/admin/reports", h.AdminReports)
+	handleFunc("/api/admin/reports", h.ReportAPI)
+
+	// Serve static files
+	fs := http.FileServer(http.Dir("static"))
+	handle("/static/", http.StripPrefix("/static/", fs))
+
+	return mux
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startServer serves the handler on a free port of localhost
+func startServer(t *testing.T, handler http.Handler) (*http.Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	return srv, "http://" + ln.Addr().String()
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	started := make(chan struct{})
+	srv, url := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+
+	type result struct {
+		body string
+		err  error
+	}
+	response := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			response <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		response <- result{string(body), err}
+	}()
+
+	<-started
+	shutdown([]*http.Server{srv}, 5*time.Second)
+	//the request in flight was answered before shutdown returned
+	select {
+	case res := <-response:
+		if res.err != nil || res.body != "done" {
+			t.Errorf("request in flight got %q, %v", res.body, res.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request in flight didn't finish")
+	}
+
+	if _, err := http.Get(url); err == nil {
+		t.Error("the server still accepts requests after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv, url := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	go http.Get(url)
+
+	<-started
+	start := time.Now()
+	shutdown([]*http.Server{srv}, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v with a timeout of 100ms", elapsed)
+	}
+}
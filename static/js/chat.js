@@ -0,0 +1,154 @@
+// the chat room of a category over a WebSocket. The socket reconnects with a
+// growing wait when it drops, and the history is loaded again on connect.
+document.addEventListener('DOMContentLoaded', function() {
+    const chat = document.getElementById('chat');
+    if (!chat || !window.WebSocket) {
+        return;
+    }
+    const list = chat.querySelector('.chat-messages');
+    const status = chat.querySelector('.chat-status');
+    const typing = chat.querySelector('.chat-typing');
+    const older = chat.querySelector('.chat-older');
+    const form = chat.querySelector('.chat-form');
+    const isAdmin = chat.dataset.isAdmin === 'true';
+    const userId = Number(chat.dataset.userId);
+
+    const scheme = window.location.protocol === 'https:' ? 'wss://' : 'ws://';
+    const url = scheme + window.location.host + '/chat/' + chat.dataset.categoryId + '/ws';
+    let socket;
+    let wait = 1000;
+    let typingTimer;
+    let typedAt = 0;
+
+    function send(event) {
+        if (socket && socket.readyState === WebSocket.OPEN) {
+            socket.send(JSON.stringify(event));
+        }
+    }
+
+    function connect() {
+        socket = new WebSocket(url);
+        socket.addEventListener('open', () => {
+            wait = 1000;
+            status.textContent = '';
+        });
+        socket.addEventListener('message', e => receive(JSON.parse(e.data)));
+        socket.addEventListener('close', () => {
+            status.textContent = 'Disconnected, reconnecting…';
+            setTimeout(connect, wait);
+            wait = Math.min(wait * 2, 30000);
+        });
+    }
+
+    function receive(event) {
+        switch (event.type) {
+        case 'history':
+            showHistory(event);
+            break;
+        case 'message':
+            typing.textContent = '';
+            list.append(messageItem(event.message));
+            list.lastElementChild.scrollIntoView({block: 'nearest'});
+            break;
+        case 'typing':
+            typing.textContent = event.username + ' is typing…';
+            clearTimeout(typingTimer);
+            typingTimer = setTimeout(() => typing.textContent = '', 4000);
+            break;
+        case 'deleted': {
+            const item = document.getElementById('chat-message-' + event.id);
+            if (item) {
+                item.remove();
+            }
+            break;
+        }
+        case 'muted':
+            status.textContent = event.until
+                ? event.username + ' is muted until ' + event.until
+                : event.username + ' is no longer muted';
+            break;
+        case 'error':
+            status.textContent = event.error;
+            break;
+        }
+    }
+
+    function showHistory(event) {
+        const messages = event.messages || [];
+        const items = messages.map(messageItem);
+        if (event.before) {
+            list.prepend(...items);
+        } else {
+            // a reconnect starts over from the latest messages
+            list.replaceChildren(...items);
+            if (list.lastElementChild) {
+                list.lastElementChild.scrollIntoView({block: 'nearest'});
+            }
+        }
+        older.hidden = messages.length < 50;
+        if (messages.length > 0) {
+            older.dataset.before = messages[0].id;
+        }
+    }
+
+    function messageItem(message) {
+        const item = document.createElement('li');
+        item.id = 'chat-message-' + message.id;
+        item.className = 'chat-message';
+
+        const author = document.createElement('strong');
+        author.textContent = message.username;
+        const time = document.createElement('time');
+        time.textContent = message.created_at;
+        const content = document.createElement('span');
+        content.className = 'chat-content';
+        content.textContent = message.content;
+        item.append(time, ' ', author, ' ', content);
+
+        if (isAdmin) {
+            const remove = document.createElement('button');
+            remove.type = 'button';
+            remove.className = 'chat-action';
+            remove.textContent = 'Delete';
+            remove.addEventListener('click', () => send({type: 'delete', id: message.id}));
+            item.append(' ', remove);
+            if (message.user_id !== userId) {
+                const mute = document.createElement('button');
+                mute.type = 'button';
+                mute.className = 'chat-action';
+                mute.textContent = 'Mute';
+                mute.addEventListener('click', () => {
+                    const minutes = window.prompt('Mute ' + message.username + ' for how many minutes? 0 lifts the mute.', '60');
+                    if (minutes !== null) {
+                        send({type: 'mute', user_id: message.user_id, minutes: Number(minutes)});
+                    }
+                });
+                item.append(' ', mute);
+            }
+        }
+        return item;
+    }
+
+    older.addEventListener('click', () => send({type: 'history', before: Number(older.dataset.before)}));
+
+    if (form) {
+        const input = form.elements.content;
+        form.addEventListener('submit', e => {
+            e.preventDefault();
+            const content = input.value.trim();
+            if (content) {
+                send({type: 'message', content: content});
+                input.value = '';
+            }
+        });
+        input.addEventListener('input', () => {
+            const now = Date.now();
+            if (now - typedAt > 2000) {
+                typedAt = now;
+                send({type: 'typing'});
+            }
+        });
+    }
+
+    connect();
+});
@@ -1,4 +1,4 @@
-function filterPosts(filter) {
+function filterPosts(filter, button) {
     const posts = document.querySelectorAll('.post-preview');
     
     posts.forEach(post => {
@@ -24,8 +24,16 @@ function filterPosts(filter) {
     });
 
     // update active button
-    document.querySelectorAll('.filter-btn').forEach(btn => {
+    button.parentElement.querySelectorAll('.filter-btn').forEach(btn => {
         btn.classList.remove('active');
     });
-    event.target.classList.add('active');
-}
\ No newline at end of file
+    button.classList.add('active');
+}
+
+document.addEventListener('DOMContentLoaded', function() {
+    document.querySelectorAll('.filter-btn').forEach(button => {
+        button.addEventListener('click', function() {
+            filterPosts(this.dataset.filter, this);
+        });
+    });
+});
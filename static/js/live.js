@@ -0,0 +1,91 @@
+// live updates of the post and the category pages over Server-Sent Events.
+// The browser reconnects by itself and sends the ID of the last event, so
+// the events missed in between are delivered too.
+document.addEventListener('DOMContentLoaded', function() {
+    if (!window.EventSource) {
+        return;
+    }
+    const comments = document.getElementById('comments');
+    const posts = document.getElementById('postsContainer');
+
+    let source;
+    if (comments && comments.dataset.postId) {
+        source = new EventSource('/live?post=' + comments.dataset.postId);
+        source.addEventListener('comment', e => addComment(comments, JSON.parse(e.data)));
+        source.addEventListener('reaction', e => updateReactions(JSON.parse(e.data)));
+    } else if (posts && posts.dataset.categoryId) {
+        source = new EventSource('/live?category=' + posts.dataset.categoryId);
+        source.addEventListener('post', e => addPost(posts, JSON.parse(e.data)));
+    } else {
+        return;
+    }
+    // the server no longer has the events the page missed
+    source.addEventListener('reset', () => window.location.reload());
+});
+
+function updateReactions(data) {
+    const target = data.comment_id
+        ? document.getElementById('comment-' + data.comment_id)
+        : document.querySelector('.post');
+    if (!target) {
+        return;
+    }
+    target.querySelectorAll(':scope > .reactions .likes-count').forEach(el => el.textContent = data.likes);
+    target.querySelectorAll(':scope > .reactions .dislikes-count').forEach(el => el.textContent = data.dislikes);
+}
+
+function element(tag, className, text) {
+    const el = document.createElement(tag);
+    if (className) {
+        el.className = className;
+    }
+    if (text !== undefined) {
+        el.textContent = text;
+    }
+    return el;
+}
+
+function reactionButton(commentId, type, emoji, countClass) {
+    const button = element('button', type + '-btn');
+    button.dataset.commentId = commentId;
+    button.dataset.type = type;
+    button.append(emoji + ' ', element('span', countClass, '0'));
+    return button;
+}
+
+function addComment(section, data) {
+    // the author's own comment is already on the page after the redirect
+    if (document.getElementById('comment-' + data.comment_id)) {
+        return;
+    }
+    const comment = element('div', 'comment live-new');
+    comment.id = 'comment-' + data.comment_id;
+
+    const meta = element('div', 'comment-meta');
+    meta.append(element('span', 'author', data.username), ' ', element('time', '', data.created_at));
+
+    const reactions = element('div', 'reactions');
+    if (section.dataset.loggedIn) {
+        reactions.append(
+            reactionButton(data.comment_id, 'like', '👍', 'likes-count'), ' ',
+            reactionButton(data.comment_id, 'dislike', '👎', 'dislikes-count'));
+    } else {
+        const likes = element('span', 'reaction-count', '👍 ');
+        likes.append(element('span', 'likes-count', '0'));
+        const dislikes = element('span', 'reaction-count', '👎 ');
+        dislikes.append(element('span', 'dislikes-count', '0'));
+        reactions.append(likes, ' ', dislikes);
+    }
+
+    comment.append(meta, element('div', 'comment-content', data.content), reactions);
+    section.querySelector('.comments-list').prepend(comment);
+}
+
+function addPost(container, data) {
+    const notice = element('p', 'live-notice', 'New post: ');
+    const link = element('a', '', data.title);
+    link.href = '/post/' + data.post_id;
+    notice.append(link, ' by ' + data.username);
+    container.querySelectorAll('.no-posts').forEach(el => el.remove());
+    container.prepend(notice);
+}
@@ -17,3 +17,11 @@ function handleBack() {
         window.location.href = '/';
     }
 }
+
+// the back buttons get their click handler here, because inline handlers are blocked by the CSP.
+// navigation.js can be included twice on a page, so the handler is assigned instead of added
+document.addEventListener('DOMContentLoaded', function() {
+    document.querySelectorAll('button.back-button').forEach(button => {
+        button.onclick = handleBack;
+    });
+});
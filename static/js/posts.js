@@ -6,3 +6,63 @@ function validateComment(form) {
     }
     return true;
 }
+
+document.addEventListener('DOMContentLoaded', function() {
+    document.querySelectorAll('.comment-form').forEach(form => {
+        form.addEventListener('submit', function(e) {
+            if (!validateComment(this)) {
+                e.preventDefault();
+            }
+        });
+    });
+});
+
+// choosing a category with posting rules fills in its title prefix and
+// content template, as long as the user hasn't written anything yet
+document.addEventListener('DOMContentLoaded', function() {
+    const title = document.getElementById('title');
+    const content = document.getElementById('content');
+    if (!title || !content) {
+        return;
+    }
+
+    document.querySelectorAll('input[name="categories"]').forEach(box => {
+        box.addEventListener('change', function() {
+            if (!this.checked) {
+                return;
+            }
+            const prefix = this.dataset.titlePrefix || '';
+            const template = this.dataset.template || '';
+            if (prefix !== '' && !title.value.startsWith(prefix)) {
+                title.value = prefix + ' ' + title.value.trim();
+            }
+            if (template !== '' && content.value.trim() === '') {
+                content.value = template;
+            }
+        });
+    });
+});
+
+// the extra fields of a post type are shown when a category of that type is chosen
+document.addEventListener('DOMContentLoaded', function() {
+    const boxes = document.querySelectorAll('input[name="categories"]');
+    const fieldsets = document.querySelectorAll('.post-type-fields');
+    if (fieldsets.length === 0) {
+        return;
+    }
+
+    function update() {
+        const types = new Set();
+        boxes.forEach(box => {
+            if (box.checked) {
+                types.add(box.dataset.postType);
+            }
+        });
+        fieldsets.forEach(fieldset => {
+            fieldset.classList.toggle('hidden', !types.has(fieldset.dataset.postType));
+        });
+    }
+
+    boxes.forEach(box => box.addEventListener('change', update));
+    update();
+});
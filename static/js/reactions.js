@@ -1,75 +1,48 @@
 document.addEventListener('DOMContentLoaded', function() {
-    // Handler for post reactions
-    document.querySelectorAll('.post .reactions button').forEach(button => {
-        button.addEventListener('click', async function(e) {
-            e.preventDefault();
-
-            const postId = this.dataset.postId;
-            const type = this.dataset.type;
-
-            try {
-                const response = await fetch('/api/react', {
-                    method: 'POST',
-                    headers: {
-                        'Content-Type': 'application/json',
-                    },
-                    body: JSON.stringify({ post_id: parseInt(postId), type })
-                });
-
-                if (!response.ok) throw new Error('Network response was not ok');
-
-                const data = await response.json();
-                if (data.success) {
-                    // Update the counters
-                    const post = this.closest('.post');
-                    post.querySelector('.like-btn .likes-count').textContent = data.likes;
-                    post.querySelector('.dislike-btn .dislikes-count').textContent = data.dislikes;
-
-                    // Update the active state of the buttons
-                    post.querySelectorAll('.reactions button').forEach(btn => btn.classList.remove('active'));
-                    this.classList.add('active');
-                }
-            } catch (error) {
-                console.error('Error:', error);
-                alert('Error updating reaction');
-            }
-        });
-    });
-
-    // Handler for comment reactions
-    document.querySelectorAll('.comment .reactions button').forEach(button => {
-        button.addEventListener('click', async function(e) {
-            e.preventDefault();
-
-            const commentId = this.dataset.commentId;
-            const type = this.dataset.type;
-
-            try {
-                const response = await fetch('/api/comment/react', {
-                    method: 'POST',
-                    headers: {
-                        'Content-Type': 'application/json',
-                    },
-                    body: JSON.stringify({ comment_id: parseInt(commentId), type })
-                });
-
-                if (!response.ok) throw new Error('Network response was not ok');
-
-                const data = await response.json();
-                if (data.success) {
-                    // Update the counters
-                    const comment = this.closest('.comment');
-                    comment.querySelector('.like-btn .likes-count').textContent = data.likes;
-                    comment.querySelector('.dislike-btn .dislikes-count').textContent = data.dislikes;
-
-                    // Update the active state of the buttons
-                    comment.querySelectorAll('.reactions button').forEach(btn => btn.classList.remove('active'));
-                    this.classList.add('active');
+    // the clicks are handled on the document, so the comments that arrive
+    // live get working buttons too
+    document.addEventListener('click', async function(e) {
+        const button = e.target.closest('.reactions button[data-type]');
+        if (!button) {
+            return;
+        }
+        e.preventDefault();
+
+        const type = button.dataset.type;
+        const isComment = button.dataset.commentId !== undefined;
+        const url = isComment ? '/api/comment/react' : '/api/react';
+        const body = isComment
+            ? { comment_id: parseInt(button.dataset.commentId), type }
+            : { post_id: parseInt(button.dataset.postId), type };
+
+        try {
+            const response = await fetch(url, {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                },
+                body: JSON.stringify(body)
+            });
+
+            if (!response.ok) throw new Error('Network response was not ok');
+
+            const data = await response.json();
+            if (data.success) {
+                // Update the counters
+                const target = button.closest(isComment ? '.comment' : '.post');
+                target.querySelector('.like-btn .likes-count').textContent = data.likes;
+                target.querySelector('.dislike-btn .dislikes-count').textContent = data.dislikes;
+
+                // clicking the active button again removes the reaction
+                const wasActive = button.classList.contains('active');
+                target.querySelectorAll('.reactions button').forEach(btn => btn.classList.remove('active'));
+                if (!wasActive) {
+                    button.classList.add('active');
                 }
-            } catch (error) {
-                console.error('Error:', error);
-                alert('Error updating reaction');
             }
-        });
+        } catch (error) {
+            console.error('Error:', error);
+            alert('Error updating reaction');
+        }
     });
 });
\ No newline at end of file
@@ -0,0 +1,64 @@
+// autocomplete for the comma separated tags field of the new post form
+document.addEventListener('DOMContentLoaded', function() {
+    const input = document.getElementById('tags');
+    const list = document.getElementById('tag-suggestions');
+    if (!input || !list) {
+        return;
+    }
+
+    let timer = null;
+
+    // the tag being written is the text after the last comma
+    function currentTag() {
+        const parts = input.value.split(',');
+        return parts[parts.length - 1].trim();
+    }
+
+    function hideSuggestions() {
+        list.innerHTML = '';
+        list.classList.add('hidden');
+    }
+
+    function choose(name) {
+        const parts = input.value.split(',');
+        parts[parts.length - 1] = ' ' + name;
+        input.value = parts.join(',').replace(/^\s+/, '') + ', ';
+        hideSuggestions();
+        input.focus();
+    }
+
+    function showSuggestions(tags) {
+        list.innerHTML = '';
+        if (!tags || tags.length === 0) {
+            list.classList.add('hidden');
+            return;
+        }
+        tags.forEach(tag => {
+            const item = document.createElement('li');
+            item.textContent = '#' + tag.name + ' (' + tag.post_count + ')';
+            item.addEventListener('mousedown', function(e) {
+                e.preventDefault();
+                choose(tag.name);
+            });
+            list.appendChild(item);
+        });
+        list.classList.remove('hidden');
+    }
+
+    input.addEventListener('input', function() {
+        clearTimeout(timer);
+        const prefix = currentTag();
+        if (prefix === '') {
+            hideSuggestions();
+            return;
+        }
+        timer = setTimeout(function() {
+            fetch('/api/tags?q=' + encodeURIComponent(prefix))
+                .then(response => response.json())
+                .then(showSuggestions)
+                .catch(hideSuggestions);
+        }, 200);
+    });
+
+    input.addEventListener('blur', hideSuggestions);
+});